@@ -0,0 +1,174 @@
+// Command mergephones is a one-off migration that rewrites users.phone to
+// E.164 and merges accounts that turn out to share a number, e.g. one
+// registered as "87070000001" and another as "+7 707 000 00 01".
+//
+// It prints what it would do unless -apply is given. Each merge runs in its
+// own transaction: orders, payments, addresses, subscriptions, promocode
+// usages, device tokens, waitlist entries and the courier record of the
+// duplicates move to the surviving account, their sessions are revoked,
+// their pending password resets and e-mail changes dropped, and they are
+// marked deleted with their phone replaced by "merged:<survivor id>:<own id>".
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/core/phone"
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/repo/postgres"
+)
+
+// tables whose user_id moves to the surviving account
+var ownedTables = []string{"addresses", "subscriptions", "orders", "payments", "user_promocodes", "device_tokens", "waitlist_entries"}
+
+type account struct {
+	domain.User
+	IsCourier bool
+}
+
+// group is the set of accounts sharing one normalized phone.
+type group struct {
+	Phone string
+	Primary account
+	Duplicates []account
+}
+
+func main() {
+	_ = godotenv.Load()
+	apply := flag.Bool("apply", false, "write changes (default is a dry run)")
+	dsn := flag.String("dsn", os.Getenv("DB_DSN"), "Postgres DSN")
+	flag.Parse()
+
+	db, err := postgres.Open(*dsn)
+	if err != nil { fail(err) }
+	var users []account
+	err = db.Table("users").Select("users.*, EXISTS (SELECT 1 FROM couriers c WHERE c.user_id = users.id) AS is_courier").Scan(&users).Error
+	if err != nil { fail(err) }
+
+	groups, invalid := plan(users)
+	for _, u := range invalid { fmt.Printf("skip %s: phone %q is not a Kazakhstan mobile number\n", u.ID, u.Phone) }
+	for _, g := range groups {
+		if n := couriers(g); n > 1 {
+			fmt.Printf("skip %s: %d accounts are couriers, merge them by hand\n", g.Phone, n)
+			continue
+		}
+		describe(g)
+		if !*apply { continue }
+		if err := db.Transaction(func(tx *gorm.DB) error { return merge(tx, g) }); err != nil {
+			fmt.Printf("  failed: %v\n", err)
+		}
+	}
+	if !*apply { fmt.Println("dry run, rerun with -apply to write changes") }
+}
+
+// plan groups users by normalized phone and returns the groups that need a
+// change: a merge or just a rewrite of the phone. Users whose phone cannot be
+// normalized are returned separately and left alone.
+func plan(users []account) (groups []group, invalid []account) {
+	byPhone := map[string][]account{}
+	for _, u := range users {
+		if u.Phone == "" || (u.IsDeleted && !phone.IsValid(u.Phone)) { continue }
+		p, err := phone.Normalize(u.Phone)
+		if err != nil { invalid = append(invalid, u); continue }
+		byPhone[p] = append(byPhone[p], u)
+	}
+	for p, accs := range byPhone {
+		sort.SliceStable(accs, func(i, j int) bool { return better(accs[i], accs[j], p) })
+		g := group{Phone: p, Primary: accs[0], Duplicates: accs[1:]}
+		if len(g.Duplicates) == 0 && g.Primary.Phone == p { continue }
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Phone < groups[j].Phone })
+	return groups, invalid
+}
+
+// better orders the accounts of a group: live before deleted, staff before
+// customers, an already normalized phone first, then the oldest account.
+func better(a, b account, normalized string) bool {
+	if a.IsDeleted != b.IsDeleted { return !a.IsDeleted }
+	if roleRank(a.Role) != roleRank(b.Role) { return roleRank(a.Role) > roleRank(b.Role) }
+	if (a.Phone == normalized) != (b.Phone == normalized) { return a.Phone == normalized }
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+func roleRank(r domain.Role) int {
+	switch r {
+	case domain.RoleAdmin:
+		return 2
+	case domain.RoleCourier:
+		return 1
+	}
+	return 0
+}
+
+func couriers(g group) int {
+	n := 0
+	if g.Primary.IsCourier { n++ }
+	for _, d := range g.Duplicates { if d.IsCourier { n++ } }
+	return n
+}
+
+func describe(g group) {
+	if len(g.Duplicates) == 0 {
+		fmt.Printf("%s: rewrite phone %q of %s\n", g.Phone, g.Primary.Phone, g.Primary.ID)
+		return
+	}
+	fmt.Printf("%s: keep %s (%q), merge", g.Phone, g.Primary.ID, g.Primary.Phone)
+	for _, d := range g.Duplicates { fmt.Printf(" %s (%q)", d.ID, d.Phone) }
+	fmt.Println()
+}
+
+func merge(tx *gorm.DB, g group) error {
+	p := g.Primary
+	ids := make([]uuid.UUID, len(g.Duplicates))
+	for i, d := range g.Duplicates { ids[i] = d.ID }
+	updates := map[string]interface{}{"phone": g.Phone, "updated_at": time.Now()}
+
+	for _, d := range g.Duplicates {
+		// take over whatever the survivor lacks
+		if p.Email == nil && d.Email != nil { updates["email"], p.Email = *d.Email, d.Email }
+		if p.PasswordHash == nil && d.PasswordHash != nil { updates["password_hash"], p.PasswordHash = *d.PasswordHash, d.PasswordHash }
+		if p.Name == "" && d.Name != "" { updates["name"], p.Name = d.Name, d.Name }
+		if d.IsCourier && p.Role == domain.RoleUser { updates["role"] = domain.RoleCourier }
+	}
+	if len(ids) > 0 {
+		// a user has one live default address: the survivor's, or else the
+		// newest of the duplicates'
+		err := tx.Exec(`UPDATE addresses SET is_default = false
+			WHERE user_id IN ? AND is_default AND deleted_at IS NULL AND id <> (
+				SELECT id FROM addresses WHERE (user_id = ? OR user_id IN ?) AND is_default AND deleted_at IS NULL
+				ORDER BY user_id = ? DESC, created_at DESC LIMIT 1
+			)`, ids, p.ID, ids, p.ID).Error
+		if err != nil { return fmt.Errorf("addresses: %w", err) }
+		for _, t := range ownedTables {
+			if err := tx.Table(t).Where("user_id IN ?", ids).Update("user_id", p.ID).Error; err != nil { return fmt.Errorf("%s: %w", t, err) }
+		}
+		if err := tx.Table("couriers").Where("user_id IN ?", ids).Update("user_id", p.ID).Error; err != nil { return err }
+		if err := tx.Table("sessions").Where("user_id IN ? AND revoked_at IS NULL", ids).Update("revoked_at", time.Now()).Error; err != nil { return err }
+		// pending reset links and e-mail changes belong to the account that
+		// asked for them
+		if err := tx.Table("password_resets").Where("user_id IN ?", ids).Delete(nil).Error; err != nil { return err }
+		if err := tx.Table("email_verifications").Where("user_id IN ?", ids).Delete(nil).Error; err != nil { return err }
+		// free the unique phone and e-mail before the survivor takes them
+		for _, id := range ids {
+			err := tx.Table("users").Where("id = ?", id).Updates(map[string]interface{}{
+				"phone": "merged:" + p.ID.String() + ":" + id.String(), "email": nil, "is_deleted": true, "updated_at": time.Now(),
+			}).Error
+			if err != nil { return err }
+		}
+	}
+	return tx.Table("users").Where("id = ?", p.ID).Updates(updates).Error
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
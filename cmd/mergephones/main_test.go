@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/repo/postgres"
+)
+
+func acc(ph string, role domain.Role, age int) account {
+	return account{User: domain.User{ID: uuid.New(), Phone: ph, Role: role, CreatedAt: time.Now().Add(-time.Duration(age) * time.Hour)}}
+}
+
+func TestPlan(t *testing.T) {
+	oldest := acc("87070000001", domain.RoleUser, 30)
+	normalized := acc("+77070000001", domain.RoleUser, 10)
+	spaced := acc("+7 707 000 00 01", domain.RoleUser, 20)
+	courier := acc("8 747 123 45 67", domain.RoleCourier, 1)
+	customer := acc("+77471234567", domain.RoleUser, 50)
+	clean := acc("+77010000000", domain.RoleUser, 5)
+	rewrite := acc("8 701 000 00 09", domain.RoleUser, 5)
+	foreign := acc("+79161234567", domain.RoleUser, 5)
+
+	groups, invalid := plan([]account{oldest, normalized, spaced, courier, customer, clean, rewrite, foreign})
+	if len(invalid) != 1 || invalid[0].ID != foreign.ID { t.Fatalf("invalid = %+v", invalid) }
+	if len(groups) != 3 { t.Fatalf("want 3 groups, got %d", len(groups)) }
+
+	byPhone := map[string]group{}
+	for _, g := range groups { byPhone[g.Phone] = g }
+	g := byPhone["+77070000001"]
+	if g.Primary.ID != normalized.ID || len(g.Duplicates) != 2 || g.Duplicates[0].ID != oldest.ID {
+		t.Fatalf("group 707: primary %s, duplicates %+v", g.Primary.Phone, g.Duplicates)
+	}
+	if g := byPhone["+77471234567"]; g.Primary.ID != courier.ID {
+		t.Fatalf("courier account should survive, got %s", g.Primary.Phone)
+	}
+	if g := byPhone["+77010000009"]; g.Primary.ID != rewrite.ID || len(g.Duplicates) != 0 {
+		t.Fatalf("single account with unnormalized phone should be rewritten: %+v", g)
+	}
+}
+
+// TestMergeDefaultAddresses merges two accounts that both have a default
+// address on the database named by TEST_DB_DSN, inside a transaction that is
+// rolled back. The survivor keeps its default and the duplicate's address
+// moves over as a plain one, as does its waitlist entry; its pending e-mail
+// change is dropped.
+func TestMergeDefaultAddresses(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" { t.Skip("TEST_DB_DSN not set") }
+	db, err := postgres.Open(dsn)
+	if err != nil { t.Fatal(err) }
+	tx := db.Begin()
+	if tx.Error != nil { t.Fatal(tx.Error) }
+	defer tx.Rollback()
+
+	primary, dup := acc("+77079990110", domain.RoleUser, 10), acc("87079990110", domain.RoleUser, 5)
+	for _, a := range []*account{&primary, &dup} {
+		if err := tx.Create(&a.User).Error; err != nil { t.Fatal(err) }
+		addr := domain.Address{UserID: a.ID, City: "Алматы", Street: a.Phone, IsDefault: true}
+		if err := tx.Create(&addr).Error; err != nil { t.Fatal(err) }
+	}
+	if err := tx.Create(&domain.WaitlistEntry{UserID: dup.ID, Lat: 43.3, Lng: 76.9, City: "Алматы"}).Error; err != nil { t.Fatal(err) }
+	ev := domain.EmailVerification{UserID: dup.ID, Email: "dup@example.com", TokenHash: uuid.NewString(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := tx.Create(&ev).Error; err != nil { t.Fatal(err) }
+	if err := merge(tx, group{Phone: "+77079990110", Primary: primary, Duplicates: []account{dup}}); err != nil { t.Fatal(err) }
+
+	var waitlist, verifications int64
+	if err := tx.Model(&domain.WaitlistEntry{}).Where("user_id = ?", primary.ID).Count(&waitlist).Error; err != nil { t.Fatal(err) }
+	if err := tx.Model(&domain.EmailVerification{}).Where("user_id = ?", dup.ID).Count(&verifications).Error; err != nil { t.Fatal(err) }
+	if waitlist != 1 || verifications != 0 { t.Fatalf("after merge: %d waitlist entries moved, %d e-mail verifications left", waitlist, verifications) }
+
+	var addrs []domain.Address
+	if err := tx.Where("user_id = ?", primary.ID).Order("created_at").Find(&addrs).Error; err != nil { t.Fatal(err) }
+	if len(addrs) != 2 { t.Fatalf("%d addresses after merge", len(addrs)) }
+	if !addrs[0].IsDefault || addrs[0].Street != primary.Phone || addrs[1].IsDefault { t.Fatalf("addresses after merge: %+v", addrs) }
+}
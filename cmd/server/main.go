@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	// APP_TIMEZONE is loaded even where the image has no zoneinfo
+	_ "time/tzdata"
 
 	"github.com/rs/zerolog/log"
 	"github.com/joho/godotenv"
@@ -16,7 +20,12 @@ import (
 	httpapi "github.com/musorok/server/internal/http"
 	"github.com/musorok/server/internal/repo/postgres"
 	redisrepo "github.com/musorok/server/internal/repo/redis"
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/core/mail"
+	"github.com/musorok/server/internal/core/otp"
 	"github.com/musorok/server/internal/core/payments/paynetworks"
+	"github.com/musorok/server/internal/services"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -27,29 +36,26 @@ func main() {
 
 	db, err := postgres.Open(cfg.DBDSN)
 	if err != nil { log.Fatal().Err(err).Msg("open db") }
+	if cfg.SpatialBackend == "postgis" {
+		if err := postgres.CheckPostGIS(db); err != nil { log.Fatal().Err(err).Msg("spatial backend") }
+	}
 
-	// ── Redis: делаем опциональным ───────────────────────────────────────────────
-	if cfg.RedisAddr == "" {
-		log.Warn().Msg("redis disabled: REDIS_ADDR is empty")
+	// OTP codes, send limits and login throttling live in Redis so every
+	// replica sees the same ones. The in-memory fallback is per process: it
+	// must be asked for with ALLOW_MEMORY_STORES and never runs in production.
+	rdb, err := openRedis(cfg)
+	if err != nil {
+		if isProduction(cfg) || !cfg.AllowMemoryStores { log.Fatal().Err(err).Msg("redis is required; set ALLOW_MEMORY_STORES=true for a single dev instance") }
+		log.Error().Err(err).Msg("REDIS UNAVAILABLE: OTP codes, send limits and login throttling are kept in this process only (ALLOW_MEMORY_STORES)")
 	} else {
-		r := redisrepo.Open(cfg.RedisAddr)
-		if err := redisrepo.Ping(context.Background(), r); err != nil {
-			log.Warn().Err(err).Str("addr", cfg.RedisAddr).Msg("redis not available, continuing without redis")
-		} else {
-			log.Info().Str("addr", cfg.RedisAddr).Msg("redis connected")
-		}
+		log.Info().Str("addr", cfg.RedisAddr).Msg("redis connected")
 	}
-	// ─────────────────────────────────────────────────────────────────────────────
-
-	pay := paynetworks.New(cfg.PayAPIKey, cfg.PayReturnURL)
-	router := httpapi.NewRouter(
-		db,
-		cfg.JWTSecret,
-		cfg.JWTRefreshSecret,
-		int64(cfg.JWTAccessTTL.Seconds()),
-		int64(cfg.JWTRefreshTTL.Seconds()),
-		pay,
-	)
+
+	keys, err := loadKeys(cfg)
+	if err != nil { log.Fatal().Err(err).Msg("load jwt keys") }
+
+	pay := paynetworks.New(cfg.PayAPIKey, cfg.PayAPIURL, cfg.PayReturnURL)
+	router := httpapi.NewRouter(db, rdb, cfg, keys, pay, newOTPSender(cfg), newMailer(cfg))
 	srv := &http.Server{ Addr: ":"+cfg.AppPort, Handler: router }
 
 	application := &app.App{ Server: srv }
@@ -67,3 +73,62 @@ func main() {
 	defer cancel()
 	_ = application.Shutdown(ctx)
 }
+
+// openRedis connects to REDIS_ADDR and checks that it answers.
+func openRedis(cfg *config.Config) (*redis.Client, error) {
+	if cfg.RedisAddr == "" { return nil, errors.New("REDIS_ADDR is empty") }
+	r := redisrepo.Open(cfg.RedisAddr)
+	if err := redisrepo.Ping(context.Background(), r); err != nil { return nil, fmt.Errorf("redis %s: %w", cfg.RedisAddr, err) }
+	return r, nil
+}
+
+func isProduction(cfg *config.Config) bool { return cfg.AppEnv == "prod" || cfg.AppEnv == "production" }
+
+// loadKeys builds the access-token key set: asymmetric keys from
+// JWT_KEYS_DIR when configured, otherwise HS256 with JWT_SECRET. Kid-less
+// legacy tokens are accepted only until JWT_LEGACY_HS256_UNTIL.
+func loadKeys(cfg *config.Config) (*auth.KeySet, error) {
+	var keys *auth.KeySet
+	if cfg.JWTKeysDir == "" {
+		log.Warn().Msg("JWT_KEYS_DIR is empty: access tokens are signed with HS256 and no JWKS is published")
+		keys = auth.NewHMACKeySet(cfg.JWTSecret, cfg.JWTIssuer, cfg.JWTAudience)
+	} else {
+		var err error
+		keys, err = auth.LoadKeySet(cfg.JWTKeysDir, cfg.JWTActiveKID, cfg.JWTIssuer, cfg.JWTAudience)
+		if err != nil { return nil, err }
+	}
+	if !cfg.JWTLegacyUntil.IsZero() {
+		if cfg.JWTSecret == "" { return nil, errors.New("JWT_LEGACY_HS256_UNTIL needs JWT_SECRET") }
+		log.Warn().Time("until", cfg.JWTLegacyUntil).Msg("legacy HS256 access tokens without kid are accepted")
+		keys.AcceptLegacyHS256(cfg.JWTSecret, cfg.JWTLegacyUntil)
+	}
+	return keys, nil
+}
+
+// newMailer sends through SMTP when SMTP_ADDR is set and logs otherwise.
+func newMailer(cfg *config.Config) services.Mailer {
+	if cfg.SMTPAddr == "" {
+		log.Warn().Msg("SMTP_ADDR is empty: e-mails are written to the log and never sent")
+		return mail.LogMailer{}
+	}
+	return &mail.SMTPMailer{Addr: cfg.SMTPAddr, User: cfg.SMTPUser, Password: cfg.SMTPPassword, From: cfg.MailFrom}
+}
+
+// newOTPSender picks the OTP delivery channel configured by OTP_SENDER. The
+// log sender writes codes in plain text and delivers nothing, so production
+// refuses to start with it, as with an unknown OTP_SENDER.
+func newOTPSender(cfg *config.Config) services.OTPSender {
+	switch cfg.OTPSender {
+	case "whatsapp":
+		return &otp.WhatsAppSender{APIKey: cfg.WhatsAppAPIKey, BaseURL: cfg.WhatsAppURL, Template: cfg.WhatsAppOTPTemplate, NotifyTemplate: cfg.WhatsAppNotifyTemplate, Language: cfg.WhatsAppOTPLanguage}
+	case "sms":
+		return &otp.SMSSender{APIKey: cfg.SMSAPIKey, BaseURL: cfg.SMSURL, From: cfg.SMSFrom}
+	case "log":
+		if isProduction(cfg) { log.Fatal().Msg("OTP_SENDER is log in production: set it to sms or whatsapp") }
+		log.Warn().Msg("OTP_SENDER is log: codes are written to the log and never delivered")
+		return otp.LogSender{}
+	default:
+		log.Fatal().Str("otp_sender", cfg.OTPSender).Msg("OTP_SENDER must be sms, whatsapp or log")
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+// Command zones imports service zones from a GeoJSON FeatureCollection or a
+// KML file (QGIS, Google My Maps) and exports them in either format.
+//
+//	zones import [-apply] [-deactivate-missing] [-city Алматы] zones.geojson
+//	zones export [-format kml] [-active] [-o zones.kml]
+//
+// import prints the diff against the zones in the database and how many
+// saved addresses would enter or leave coverage; it writes nothing unless
+// -apply is given. Features need a name property; city, priority and
+// is_active are optional. A file written by export can be edited and
+// imported back, its zones match by id. Waitlisted users whose place an
+// applied import covers are notified as the server would: by e-mail through
+// SMTP_ADDR, or without a verified address through OTP_SENDER.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+
+	"github.com/musorok/server/config"
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/core/mail"
+	"github.com/musorok/server/internal/core/otp"
+	"github.com/musorok/server/internal/repo/postgres"
+	"github.com/musorok/server/internal/services"
+)
+
+func main() {
+	_ = godotenv.Load()
+	if len(os.Args) < 2 { usage() }
+	switch os.Args[1] {
+	case "import":
+		importCmd(os.Args[2:])
+	case "export":
+		exportCmd(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: zones import [-apply] [-deactivate-missing] [-city CITY] FILE\n       zones export [-format geojson|kml] [-active] [-o FILE]")
+	os.Exit(2)
+}
+
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "write changes (default is a dry run)")
+	deactivate := fs.Bool("deactivate-missing", false, "deactivate active zones that are not in the file")
+	city := fs.String("city", "", "city of features without a city property")
+	dsn := fs.String("dsn", os.Getenv("DB_DSN"), "Postgres DSN")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 { usage() }
+
+	features, err := readFeatures(fs.Arg(0))
+	if err != nil { fail(err) }
+	zones, err := services.ZonesFromFeatures(features, *city)
+	if err != nil { fail(err) }
+	db, err := postgres.Open(*dsn)
+	if err != nil { fail(err) }
+	// no ZoneIndex here: running servers pick the change up on their next
+	// refresh
+	svc := services.NewPolygonService(db, nil, nil)
+	res, err := svc.Import(context.Background(), uuid.Nil, zones, services.ZoneImportOptions{DryRun: !*apply, DeactivateMissing: *deactivate})
+	if err != nil { fail(err) }
+	for _, z := range res.Zones {
+		fmt.Printf("%-10s %s / %s", z.Action, z.City, z.Name)
+		if len(z.Changes) > 0 { fmt.Printf(" (%s)", strings.Join(z.Changes, ", ")) }
+		fmt.Println()
+	}
+	fmt.Printf("created %d, updated %d, unchanged %d, deactivated %d\n", res.Created, res.Updated, res.Unchanged, res.Deactivated)
+	fmt.Printf("addresses: %d enter coverage, %d leave it, %d move to another zone\n", res.Coverage.Entered, res.Coverage.Left, res.Coverage.Reassigned)
+	fmt.Printf("waitlist: %d entries covered\n", res.Coverage.Waitlisted)
+	if res.DryRun { fmt.Println("dry run, rerun with -apply to write changes"); return }
+	if res.Coverage.Waitlisted > 0 {
+		// sent here rather than in the background: the process exits next
+		n, err := services.NewWaitlistService(db, nil, notifier()).NotifyCovered(context.Background())
+		if err != nil { fail(err) }
+		fmt.Printf("waitlist: %d users notified\n", n)
+	}
+}
+
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "geojson", "geojson or kml")
+	activeOnly := fs.Bool("active", false, "only active zones")
+	out := fs.String("o", "", "output file (default stdout)")
+	dsn := fs.String("dsn", os.Getenv("DB_DSN"), "Postgres DSN")
+	_ = fs.Parse(args)
+
+	var active *bool
+	if *activeOnly { active = activeOnly }
+	db, err := postgres.Open(*dsn)
+	if err != nil { fail(err) }
+	features, err := services.NewPolygonService(db, nil, nil).Export(context.Background(), active)
+	if err != nil { fail(err) }
+	var buf bytes.Buffer
+	switch *format {
+	case "kml":
+		err = geospatial.EncodeKML(&buf, "Musorok zones", features)
+	case "geojson":
+		var b []byte
+		b, err = geospatial.EncodeFeatureCollection(features)
+		buf.Write(b)
+	default:
+		usage()
+	}
+	if err != nil { fail(err) }
+	if *out == "" { _, err = os.Stdout.Write(buf.Bytes()) } else { err = os.WriteFile(*out, buf.Bytes(), 0o644) }
+	if err != nil { fail(err) }
+}
+
+// readFeatures reads a .kml file as KML and anything else as GeoJSON.
+func readFeatures(path string) ([]geospatial.Feature, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".kml") { return geospatial.ParseKML(f) }
+	b, err := io.ReadAll(f)
+	if err != nil { return nil, err }
+	return geospatial.ParseFeatures(string(b))
+}
+
+// mailer is configured like the server's.
+// notifier reaches users by e-mail, or by the OTP channel when they have no
+// verified address.
+func notifier() services.Notifier {
+	cfg, err := config.Load()
+	if err != nil { fail(err) }
+	var m services.Mailer = mail.LogMailer{}
+	if cfg.SMTPAddr != "" { m = &mail.SMTPMailer{Addr: cfg.SMTPAddr, User: cfg.SMTPUser, Password: cfg.SMTPPassword, From: cfg.MailFrom} }
+	var texts services.TextSender = otp.LogSender{}
+	switch cfg.OTPSender {
+	case "whatsapp":
+		texts = &otp.WhatsAppSender{APIKey: cfg.WhatsAppAPIKey, BaseURL: cfg.WhatsAppURL, NotifyTemplate: cfg.WhatsAppNotifyTemplate, Language: cfg.WhatsAppOTPLanguage}
+	case "sms":
+		texts = &otp.SMSSender{APIKey: cfg.SMSAPIKey, BaseURL: cfg.SMSURL, From: cfg.SMSFrom}
+	}
+	return services.FallbackNotifier{services.MailNotifier{Mailer: m}, services.PhoneNotifier{Sender: texts}}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
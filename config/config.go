@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
 	"time"
 	"github.com/spf13/viper"
 )
@@ -10,13 +12,95 @@ type Config struct {
 	AppPort string `mapstructure:"APP_PORT"`
 	DBDSN string `mapstructure:"DB_DSN"`
 	RedisAddr string `mapstructure:"REDIS_ADDR"`
+	// lets a non-production server start without Redis, keeping OTP codes and
+	// login throttling in its own memory
+	AllowMemoryStores bool `mapstructure:"ALLOW_MEMORY_STORES"`
 	JWTSecret string `mapstructure:"JWT_SECRET"`
 	JWTRefreshSecret string `mapstructure:"JWT_REFRESH_SECRET"`
 	JWTAccessTTL time.Duration `mapstructure:"JWT_ACCESS_TTL"`
 	JWTRefreshTTL time.Duration `mapstructure:"JWT_REFRESH_TTL"`
+	// Access tokens are signed with RS256/EdDSA keys from JWTKeysDir (one
+	// PEM per kid) when set; JWTSecret then only verifies HS256 tokens issued
+	// before the switch. Without JWTKeysDir access tokens use HS256.
+	JWTKeysDir string `mapstructure:"JWT_KEYS_DIR"`
+	JWTActiveKID string `mapstructure:"JWT_ACTIVE_KID"`
+	JWTIssuer string `mapstructure:"JWT_ISSUER"`
+	JWTAudience string `mapstructure:"JWT_AUDIENCE"`
+	// kid-less HS256 tokens from before key sets, signed with JWT_SECRET or
+	// JWT_REFRESH_SECRET, are accepted only when JWT_LEGACY_HS256_UNTIL
+	// (RFC 3339) is set, and only until then; Load parses it into JWTLegacyUntil
+	JWTLegacyHS256Until string `mapstructure:"JWT_LEGACY_HS256_UNTIL"`
+	JWTLegacyUntil time.Time
 	PayAPIKey string `mapstructure:"PAYNETWORKS_API_KEY"`
+	PayAPIURL string `mapstructure:"PAYNETWORKS_API_URL"`
 	PayWebhookSecret string `mapstructure:"PAYNETWORKS_WEBHOOK_SECRET"`
 	PayReturnURL string `mapstructure:"PAYNETWORKS_RETURN_URL"`
+
+	// OTP delivery: log (dev only), whatsapp (360Dialog) or sms
+	OTPSender string `mapstructure:"OTP_SENDER"`
+	OTPLength int `mapstructure:"OTP_LENGTH"`
+	OTPTTL time.Duration `mapstructure:"OTP_TTL"`
+	OTPMaxAttempts int `mapstructure:"OTP_MAX_ATTEMPTS"`
+	OTPResendCooldown time.Duration `mapstructure:"OTP_RESEND_COOLDOWN"`
+	OTPPhoneLimit int `mapstructure:"OTP_PHONE_LIMIT"`
+	OTPIPLimit int `mapstructure:"OTP_IP_LIMIT"`
+	OTPLimitWindow time.Duration `mapstructure:"OTP_LIMIT_WINDOW"`
+	WhatsAppAPIKey string `mapstructure:"WHATSAPP_360_API_KEY"`
+	WhatsAppURL string `mapstructure:"WHATSAPP_360_URL"`
+	WhatsAppOTPTemplate string `mapstructure:"WHATSAPP_OTP_TEMPLATE"`
+	WhatsAppNotifyTemplate string `mapstructure:"WHATSAPP_NOTIFY_TEMPLATE"`
+	WhatsAppOTPLanguage string `mapstructure:"WHATSAPP_OTP_LANGUAGE"`
+	SMSAPIKey string `mapstructure:"SMS_API_KEY"`
+	SMSURL string `mapstructure:"SMS_API_URL"`
+	SMSFrom string `mapstructure:"SMS_FROM"`
+
+	// mail goes through SMTP when SMTPAddr is set, otherwise to the log
+	SMTPAddr string `mapstructure:"SMTP_ADDR"`
+	SMTPUser string `mapstructure:"SMTP_USER"`
+	SMTPPassword string `mapstructure:"SMTP_PASSWORD"`
+	MailFrom string `mapstructure:"MAIL_FROM"`
+	// link mailed for password recovery, %s is replaced by the token
+	PasswordResetURL string `mapstructure:"PASSWORD_RESET_URL"`
+	PasswordResetTTL time.Duration `mapstructure:"PASSWORD_RESET_TTL"`
+	// link mailed to confirm a new e-mail address, %s is replaced by the token
+	EmailVerifyURL string `mapstructure:"EMAIL_VERIFY_URL"`
+	EmailVerifyTTL time.Duration `mapstructure:"EMAIL_VERIFY_TTL"`
+	// how stale the in-memory zone index may get before it is rebuilt; admin
+	// changes on this replica rebuild it at once
+	ZoneRefreshInterval time.Duration `mapstructure:"ZONE_REFRESH_INTERVAL"`
+	WaitlistRetryInterval time.Duration `mapstructure:"WAITLIST_RETRY_INTERVAL"`
+	// how often the queue of refunds the payment provider failed is looked
+	// at; a failed refund waits RefundBaseDelay, doubling per failure up to
+	// RefundMaxDelay, and is given up after RefundMaxAttempts failures
+	RefundRetryInterval time.Duration `mapstructure:"REFUND_RETRY_INTERVAL"`
+	RefundBaseDelay time.Duration `mapstructure:"REFUND_RETRY_BASE_DELAY"`
+	RefundMaxDelay time.Duration `mapstructure:"REFUND_RETRY_MAX_DELAY"`
+	RefundMaxAttempts int `mapstructure:"REFUND_MAX_ATTEMPTS"`
+	// memory (default) answers spatial queries from the in-memory zone
+	// index, postgis from the PostGIS columns of migration 0012
+	SpatialBackend string `mapstructure:"SPATIAL_BACKEND"`
+
+	// login throttling: failures per identifier and per IP are counted in a
+	// sliding window; past the free attempts each retry waits an exponentially
+	// growing delay, and past the thresholds the key is locked out
+	LoginWindow time.Duration `mapstructure:"LOGIN_WINDOW"`
+	LoginFreeAttempts int `mapstructure:"LOGIN_FREE_ATTEMPTS"`
+	LoginBaseDelay time.Duration `mapstructure:"LOGIN_BASE_DELAY"`
+	LoginMaxDelay time.Duration `mapstructure:"LOGIN_MAX_DELAY"`
+	LoginLockoutThreshold int `mapstructure:"LOGIN_LOCKOUT_THRESHOLD"`
+	LoginIPThreshold int `mapstructure:"LOGIN_IP_THRESHOLD"`
+	LoginLockoutDuration time.Duration `mapstructure:"LOGIN_LOCKOUT_DURATION"`
+
+	// slot discounts of tariffs are local times of this zone, whatever TZ the
+	// process runs in; Load resolves it into Location
+	Timezone string `mapstructure:"APP_TIMEZONE"`
+	Location *time.Location
+
+	// customer cancellation: free until a courier accepts the order, then
+	// the fee is kept from the refund of a one-time order, or in bags from
+	// those a subscription order returns
+	CancelFeeKZT int `mapstructure:"CANCEL_FEE_KZT"`
+	CancelFeeBags int `mapstructure:"CANCEL_FEE_BAGS"`
 }
 
 func Load() (*Config, error) {
@@ -24,7 +108,67 @@ func Load() (*Config, error) {
 	viper.AutomaticEnv()
 	_ = viper.ReadInConfig()
 	cfg := &Config{}
+	bindEnv(cfg)
+	// a zero fee is a valid setting, so these default through viper
+	viper.SetDefault("CANCEL_FEE_KZT", 300)
+	viper.SetDefault("CANCEL_FEE_BAGS", 1)
 	if err := viper.Unmarshal(cfg); err != nil { return nil, err }
+	if cfg.JWTLegacyHS256Until != "" {
+		until, err := time.Parse(time.RFC3339, cfg.JWTLegacyHS256Until)
+		if err != nil { return nil, fmt.Errorf("JWT_LEGACY_HS256_UNTIL: %w", err) }
+		cfg.JWTLegacyUntil = until
+	}
+	if cfg.Timezone == "" { cfg.Timezone = "Asia/Almaty" }
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil { return nil, fmt.Errorf("APP_TIMEZONE: %w", err) }
+	cfg.Location = loc
 	if cfg.AppPort == "" { cfg.AppPort = "8080" }
+	if cfg.JWTIssuer == "" { cfg.JWTIssuer = "musorok" }
+	if cfg.OTPSender == "" { cfg.OTPSender = "log" }
+	if cfg.OTPLength == 0 { cfg.OTPLength = 4 }
+	if cfg.OTPTTL == 0 { cfg.OTPTTL = 5 * time.Minute }
+	if cfg.OTPMaxAttempts == 0 { cfg.OTPMaxAttempts = 5 }
+	if cfg.OTPResendCooldown == 0 { cfg.OTPResendCooldown = time.Minute }
+	if cfg.OTPPhoneLimit == 0 { cfg.OTPPhoneLimit = 5 }
+	if cfg.OTPIPLimit == 0 { cfg.OTPIPLimit = 20 }
+	if cfg.OTPLimitWindow == 0 { cfg.OTPLimitWindow = time.Hour }
+	if cfg.WhatsAppURL == "" { cfg.WhatsAppURL = "https://waba-v2.360dialog.io" }
+	if cfg.WhatsAppOTPTemplate == "" { cfg.WhatsAppOTPTemplate = "otp_code" }
+	if cfg.WhatsAppNotifyTemplate == "" { cfg.WhatsAppNotifyTemplate = "service_notice" }
+	if cfg.WhatsAppOTPLanguage == "" { cfg.WhatsAppOTPLanguage = "ru" }
+	if cfg.PayAPIURL == "" { cfg.PayAPIURL = "https://api.paynetworks.kz" }
+	if cfg.SMSURL == "" { cfg.SMSURL = "https://api.mobizon.kz" }
+	if cfg.MailFrom == "" { cfg.MailFrom = "MusorOK <no-reply@musorok.kz>" }
+	if cfg.PasswordResetURL == "" { cfg.PasswordResetURL = "https://musorok.kz/reset-password?token=%s" }
+	if cfg.PasswordResetTTL == 0 { cfg.PasswordResetTTL = 30 * time.Minute }
+	if cfg.EmailVerifyURL == "" { cfg.EmailVerifyURL = "https://musorok.kz/verify-email?token=%s" }
+	if cfg.EmailVerifyTTL == 0 { cfg.EmailVerifyTTL = 24 * time.Hour }
+	if cfg.ZoneRefreshInterval == 0 { cfg.ZoneRefreshInterval = time.Minute }
+	if cfg.WaitlistRetryInterval == 0 { cfg.WaitlistRetryInterval = 10 * time.Minute }
+	if cfg.RefundRetryInterval == 0 { cfg.RefundRetryInterval = 5 * time.Minute }
+	if cfg.RefundBaseDelay == 0 { cfg.RefundBaseDelay = 5 * time.Minute }
+	if cfg.RefundMaxDelay == 0 { cfg.RefundMaxDelay = 6 * time.Hour }
+	if cfg.RefundMaxAttempts == 0 { cfg.RefundMaxAttempts = 10 }
+	if cfg.SpatialBackend == "" { cfg.SpatialBackend = "memory" }
+	if cfg.SpatialBackend != "memory" && cfg.SpatialBackend != "postgis" {
+		return nil, fmt.Errorf("SPATIAL_BACKEND: %q is neither memory nor postgis", cfg.SpatialBackend)
+	}
+	if cfg.LoginWindow == 0 { cfg.LoginWindow = 15 * time.Minute }
+	if cfg.LoginFreeAttempts == 0 { cfg.LoginFreeAttempts = 3 }
+	if cfg.LoginBaseDelay == 0 { cfg.LoginBaseDelay = 2 * time.Second }
+	if cfg.LoginMaxDelay == 0 { cfg.LoginMaxDelay = time.Minute }
+	if cfg.LoginLockoutThreshold == 0 { cfg.LoginLockoutThreshold = 10 }
+	if cfg.LoginIPThreshold == 0 { cfg.LoginIPThreshold = 50 }
+	if cfg.LoginLockoutDuration == 0 { cfg.LoginLockoutDuration = 15 * time.Minute }
 	return cfg, nil
 }
+
+// bindEnv registers every mapstructure key with viper. AutomaticEnv alone
+// only covers keys that also appear in .env, so optional settings would
+// otherwise be invisible to Unmarshal when set in the environment only.
+func bindEnv(cfg *Config) {
+	t := reflect.TypeOf(cfg).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if k := t.Field(i).Tag.Get("mapstructure"); k != "" { _ = viper.BindEnv(k) }
+	}
+}
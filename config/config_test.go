@@ -0,0 +1,21 @@
+package config
+
+import "testing"
+
+func TestLoadSpatialBackend(t *testing.T) {
+	for backend, ok := range map[string]bool{"": true, "memory": true, "postgis": true, "PostGIS": false, "postgres": false} {
+		t.Setenv("SPATIAL_BACKEND", backend)
+		_, err := Load()
+		if (err == nil) != ok { t.Errorf("SPATIAL_BACKEND=%q: %v", backend, err) }
+	}
+}
+
+func TestLoadTimezone(t *testing.T) {
+	t.Setenv("TZ", "UTC")
+	t.Setenv("APP_TIMEZONE", "")
+	cfg, err := Load()
+	if err != nil { t.Fatal(err) }
+	if cfg.Location.String() != "Asia/Almaty" { t.Fatalf("default location %s", cfg.Location) }
+	t.Setenv("APP_TIMEZONE", "Mars/Olympus")
+	if _, err := Load(); err == nil { t.Fatal("unknown APP_TIMEZONE accepted") }
+}
@@ -1,7 +1,6 @@
 package auth
 
 import (
-	"time"
 	"crypto/sha256"
 	"encoding/hex"
 	"github.com/golang-jwt/jwt/v5"
@@ -10,6 +9,13 @@ import (
 type Claims struct {
 	UserID string `json:"uid"`
 	Role string `json:"role"`
+	// SessionID identifies the login session (the refresh-token family) the
+	// token was issued for.
+	SessionID string `json:"sid,omitempty"`
+	// CourierID and PolygonID are set for COURIER tokens only and spare
+	// courier endpoints a lookup of the couriers row on every call.
+	CourierID string `json:"cid,omitempty"`
+	PolygonID string `json:"pid,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -17,21 +23,3 @@ func HashToken(s string) string {
 	h := sha256.Sum256([]byte(s))
 	return hex.EncodeToString(h[:])
 }
-
-func NewAccessToken(secret string, userID, role string, ttl time.Duration) (string, error) {
-	claims := &Claims{
-		UserID: userID, Role: role,
-		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl))},
-	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString([]byte(secret))
-}
-
-func ParseClaims(secret, token string) (*Claims, error) {
-	tok, err := jwt.ParseWithClaims(token, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-	if err != nil { return nil, err }
-	if c, ok := tok.Claims.(*Claims); ok && tok.Valid { return c, nil }
-	return nil, jwt.ErrTokenInvalidClaims
-}
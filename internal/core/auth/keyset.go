@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Key is one signing or verification key of a KeySet. Private is nil for
+// retired keys that are kept only to verify tokens issued before a rotation.
+type Key struct {
+	KID string
+	Method jwt.SigningMethod
+	Private crypto.Signer
+	Public crypto.PublicKey
+	secret []byte
+}
+
+// KeySet signs tokens with its active key and verifies tokens signed by any
+// of its keys, selected by the kid header. Rotating means adding a new key,
+// making it active and keeping the old one until the tokens it signed have
+// expired. Asymmetric public keys are published as JWKS so other services
+// can verify tokens without holding a secret.
+type KeySet struct {
+	active string
+	keys map[string]*Key
+	issuer string
+	audience string
+	// legacy accepts HS256 tokens without a kid, as issued before key sets,
+	// until legacyUntil
+	legacy []byte
+	legacyUntil time.Time
+}
+
+// NewHMACKeySet returns a key set with a single HS256 key. It backs refresh
+// tokens, which only this service ever verifies, and local development.
+func NewHMACKeySet(secret, issuer, audience string) *KeySet {
+	k := &Key{KID: "hs256", Method: jwt.SigningMethodHS256, secret: []byte(secret)}
+	return &KeySet{active: k.KID, keys: map[string]*Key{k.KID: k}, issuer: issuer, audience: audience}
+}
+
+// LoadKeySet reads every *.pem file in dir. The file name without extension
+// is the kid. PKCS#8 private keys (RSA or Ed25519) can sign; PKIX public
+// keys only verify. activeKID selects the signing key.
+func LoadKeySet(dir, activeKID, issuer, audience string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil { return nil, err }
+	ks := &KeySet{active: activeKID, keys: map[string]*Key{}, issuer: issuer, audience: audience}
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil { return nil, err }
+		kid := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		k, err := parseKey(kid, raw)
+		if err != nil { return nil, fmt.Errorf("%s: %w", f, err) }
+		ks.keys[kid] = k
+	}
+	active, ok := ks.keys[activeKID]
+	if !ok { return nil, fmt.Errorf("active key %q not found in %s", activeKID, dir) }
+	if active.Private == nil { return nil, fmt.Errorf("active key %q has no private key", activeKID) }
+	return ks, nil
+}
+
+func parseKey(kid string, raw []byte) (*Key, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil { return nil, errors.New("no PEM block") }
+	k := &Key{KID: kid}
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil { return nil, err }
+		signer, ok := priv.(crypto.Signer)
+		if !ok { return nil, errors.New("unsupported private key") }
+		k.Private, k.Public = signer, signer.Public()
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil { return nil, err }
+		k.Public = pub
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	switch k.Public.(type) {
+	case *rsa.PublicKey:
+		k.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		k.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+	return k, nil
+}
+
+// ErrLegacyNoSession rejects a legacy token that names no session, which
+// could never be revoked.
+var ErrLegacyNoSession = errors.New("legacy token without a session")
+
+// AcceptLegacyHS256 makes the set also accept HS256 tokens that carry no
+// kid, as minted with a shared secret before asymmetric keys were rolled
+// out, until the cutoff. They must carry a sid, so logging out revokes them.
+// Sets never accept them unless this is called; it is meant for the
+// rollout window only.
+func (ks *KeySet) AcceptLegacyHS256(secret string, until time.Time) { ks.legacy, ks.legacyUntil = []byte(secret), until }
+
+func (ks *KeySet) legacyOpen() bool { return ks.legacy != nil && time.Now().Before(ks.legacyUntil) }
+
+// Sign signs a copy of claims with the active key; it expires after ttl.
+// Every token gets a random jti so that two tokens minted in the same second
+// never collide, which matters for refresh tokens stored by hash.
+func (ks *KeySet) Sign(claims Claims, ttl time.Duration) (string, error) {
+	k := ks.keys[ks.active]
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID: uuid.NewString(),
+		Issuer: ks.issuer,
+		IssuedAt: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	if ks.audience != "" { claims.Audience = jwt.ClaimStrings{ks.audience} }
+	t := jwt.NewWithClaims(k.Method, &claims)
+	t.Header["kid"] = k.KID
+	if k.secret != nil { return t.SignedString(k.secret) }
+	return t.SignedString(k.Private)
+}
+
+// Parse verifies token against the key named by its kid and validates
+// expiry, issuer and audience.
+func (ks *KeySet) Parse(token string) (*Claims, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods(ks.methods())}
+	// legacy tokens predate issuer and audience, so only their signature,
+	// expiry and session can be checked
+	legacy := ks.isLegacy(token)
+	if !legacy {
+		if ks.issuer != "" { opts = append(opts, jwt.WithIssuer(ks.issuer)) }
+		if ks.audience != "" { opts = append(opts, jwt.WithAudience(ks.audience)) }
+	}
+	tok, err := jwt.ParseWithClaims(token, &Claims{}, ks.keyFunc, opts...)
+	if err != nil { return nil, err }
+	if c, ok := tok.Claims.(*Claims); ok && tok.Valid {
+		if legacy && c.SessionID == "" { return nil, ErrLegacyNoSession }
+		return c, nil
+	}
+	return nil, jwt.ErrTokenInvalidClaims
+}
+
+func (ks *KeySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" && ks.legacyOpen() && t.Method == jwt.SigningMethodHS256 { return ks.legacy, nil }
+	k, ok := ks.keys[kid]
+	if !ok { return nil, fmt.Errorf("unknown kid %q", kid) }
+	if t.Method.Alg() != k.Method.Alg() { return nil, fmt.Errorf("kid %q does not sign %s", kid, t.Method.Alg()) }
+	if k.secret != nil { return k.secret, nil }
+	return k.Public, nil
+}
+
+func (ks *KeySet) isLegacy(token string) bool {
+	if !ks.legacyOpen() { return false }
+	t, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil { return false }
+	kid, _ := t.Header["kid"].(string)
+	return kid == ""
+}
+
+func (ks *KeySet) methods() []string {
+	seen := map[string]bool{}
+	if ks.legacyOpen() { seen[jwt.SigningMethodHS256.Alg()] = true }
+	for _, k := range ks.keys { seen[k.Method.Alg()] = true }
+	out := make([]string, 0, len(seen))
+	for m := range seen { out = append(out, m) }
+	return out
+}
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X string `json:"x,omitempty"`
+}
+
+// JWKS returns the public half of every asymmetric key, active first.
+// HMAC keys are never published.
+func (ks *KeySet) JWKS() map[string][]JWK {
+	keys := make([]JWK, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		b64 := base64.RawURLEncoding.EncodeToString
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{Kty: "RSA", Kid: k.KID, Use: "sig", Alg: k.Method.Alg(), N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{Kty: "OKP", Kid: k.KID, Use: "sig", Alg: k.Method.Alg(), Crv: "Ed25519", X: b64(pub)})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kid == ks.active || keys[j].Kid == ks.active { return keys[i].Kid == ks.active }
+		return keys[i].Kid < keys[j].Kid
+	})
+	return map[string][]JWK{"keys": keys}
+}
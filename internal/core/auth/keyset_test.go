@@ -0,0 +1,95 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/musorok/server/internal/core/auth"
+)
+
+func writeKey(t *testing.T, dir, kid string, key interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil { t.Fatal(err) }
+	b := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), b, 0o600); err != nil { t.Fatal(err) }
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "2024-01", edKey)
+
+	old, err := auth.LoadKeySet(dir, "2024-01", "musorok", "musorok-api")
+	if err != nil { t.Fatal(err) }
+	tok, err := old.Sign(auth.Claims{UserID: "u1", Role: "USER"}, time.Minute)
+	if err != nil { t.Fatal(err) }
+
+	// rotate: add an RSA key and make it active, keep the old one
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil { t.Fatal(err) }
+	writeKey(t, dir, "2024-02", rsaKey)
+	rotated, err := auth.LoadKeySet(dir, "2024-02", "musorok", "musorok-api")
+	if err != nil { t.Fatal(err) }
+
+	c, err := rotated.Parse(tok)
+	if err != nil { t.Fatalf("token signed before rotation: %v", err) }
+	if c.UserID != "u1" { t.Fatalf("uid = %q", c.UserID) }
+
+	fresh, err := rotated.Sign(auth.Claims{UserID: "u2", Role: "USER"}, time.Minute)
+	if err != nil { t.Fatal(err) }
+	parsed, _, _ := jwt.NewParser().ParseUnverified(fresh, &auth.Claims{})
+	if parsed.Header["kid"] != "2024-02" || parsed.Method.Alg() != "RS256" {
+		t.Fatalf("fresh token header = %v", parsed.Header)
+	}
+
+	jwks := rotated.JWKS()["keys"]
+	if len(jwks) != 2 || jwks[0].Kid != "2024-02" || jwks[1].Kty != "OKP" {
+		t.Fatalf("unexpected jwks %+v", jwks)
+	}
+
+	// the old set does not know the new kid
+	if _, err := old.Parse(fresh); err == nil { t.Fatal("unknown kid accepted") }
+}
+
+func TestKeySetRejectsWrongAudience(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeKey(t, dir, "k1", edKey)
+	a, _ := auth.LoadKeySet(dir, "k1", "musorok", "partner-a")
+	b, _ := auth.LoadKeySet(dir, "k1", "musorok", "partner-b")
+	tok, err := a.Sign(auth.Claims{UserID: "u1"}, time.Minute)
+	if err != nil { t.Fatal(err) }
+	if _, err := b.Parse(tok); err == nil { t.Fatal("token for another audience accepted") }
+}
+
+func TestKeySetLegacyHS256(t *testing.T) {
+	legacy := func(sid string) string {
+		tok, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.Claims{
+			UserID: "u1", SessionID: sid,
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+		}).SignedString([]byte("old-secret"))
+		return tok
+	}
+	tok := legacy("s1")
+
+	// a set built with the same secret still refuses kid-less tokens
+	if _, err := auth.NewHMACKeySet("old-secret", "musorok", "").Parse(tok); err == nil { t.Fatal("legacy token accepted by default") }
+	ks := auth.NewHMACKeySet("new-secret", "musorok", "")
+	if _, err := ks.Parse(tok); err == nil { t.Fatal("legacy token accepted without opt-in") }
+	ks.AcceptLegacyHS256("old-secret", time.Now().Add(time.Hour))
+	if c, err := ks.Parse(tok); err != nil || c.SessionID != "s1" { t.Fatalf("legacy token: %v", err) }
+	if _, err := ks.Parse(legacy("")); !errors.Is(err, auth.ErrLegacyNoSession) { t.Fatalf("legacy token without sid: %v", err) }
+	ks.AcceptLegacyHS256("old-secret", time.Now().Add(-time.Second))
+	if _, err := ks.Parse(tok); err == nil { t.Fatal("legacy token accepted after the cutoff") }
+}
@@ -0,0 +1,42 @@
+package auth
+
+import "github.com/musorok/server/internal/domain"
+
+// Permission is a fine-grained capability checked by
+// middleware.RequirePermission. Roles are mapped to permissions below so
+// that routes declare what they need instead of who may call them.
+type Permission string
+
+const (
+	PermAdminAccess Permission = "admin:access"
+	PermPolygonsRead Permission = "polygons:read"
+	PermPolygonsWrite Permission = "polygons:write"
+	PermCouriersRead Permission = "couriers:read"
+	PermCouriersWrite Permission = "couriers:write"
+	PermPromocodesWrite Permission = "promocodes:write"
+	PermMetricsRead Permission = "metrics:read"
+	PermTariffsRead Permission = "tariffs:read"
+	PermTariffsWrite Permission = "tariffs:write"
+	PermRefundsRead Permission = "refunds:read"
+	PermRefundsWrite Permission = "refunds:write"
+)
+
+var rolePermissions = map[domain.Role][]Permission{
+	domain.RoleAdmin: {
+		PermAdminAccess,
+		PermPolygonsRead, PermPolygonsWrite,
+		PermCouriersRead, PermCouriersWrite,
+		PermPromocodesWrite,
+		PermMetricsRead,
+		PermTariffsRead, PermTariffsWrite,
+		PermRefundsRead, PermRefundsWrite,
+	},
+}
+
+// HasPermission reports whether role grants p.
+func HasPermission(role string, p Permission) bool {
+	for _, granted := range rolePermissions[domain.Role(role)] {
+		if granted == p { return true }
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package geospatial
+
+import (
+	"container/heap"
+	"math"
+)
+
+// EarthRadius is the mean Earth radius in metres (IUGG).
+const EarthRadius = 6371008.8
+
+func rad(deg float64) float64 { return deg * math.Pi / 180 }
+
+// Haversine returns the great-circle distance between a and b in metres.
+func Haversine(a, b Position) float64 {
+	dLat := rad(b[1] - a[1])
+	dLng := rad(b[0] - a[0])
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a[1]))*math.Cos(rad(b[1]))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// segmentDistance returns the distance in metres from pt to the segment
+// a-b. The closest point is found in an equirectangular projection centred
+// on pt, which is exact enough for segments up to a few hundred kilometres,
+// and measured with Haversine.
+func segmentDistance(pt, a, b Position) float64 {
+	k := math.Cos(rad(pt[1]))
+	ax, ay := (a[0]-pt[0])*k, a[1]-pt[1]
+	bx, by := (b[0]-pt[0])*k, b[1]-pt[1]
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 { t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l)) }
+	return Haversine(pt, Position{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])})
+}
+
+// DistanceToBoundary returns the distance in metres from pt to the nearest
+// edge of any ring of mp, whether pt is inside or outside.
+func (mp MultiPolygon) DistanceToBoundary(pt Position) float64 {
+	best := math.Inf(1)
+	for _, p := range mp {
+		for _, ring := range p {
+			for i := 0; i+1 < len(ring); i++ {
+				best = math.Min(best, segmentDistance(pt, ring[i], ring[i+1]))
+			}
+		}
+	}
+	return best
+}
+
+// Distance returns how far in metres pt is from mp: 0 inside or on the
+// boundary, else the distance to the nearest edge.
+func (mp MultiPolygon) Distance(pt Position) float64 {
+	if mp.contains(pt) { return 0 }
+	return mp.DistanceToBoundary(pt)
+}
+
+// Area returns the area of mp on the sphere in square metres, exterior
+// rings minus holes.
+func (mp MultiPolygon) Area() float64 {
+	total := 0.0
+	for _, p := range mp {
+		for i, ring := range p {
+			a := math.Abs(sphericalRingArea(ring))
+			if i == 0 { total += a } else { total -= a }
+		}
+	}
+	return total
+}
+
+// sphericalRingArea is the signed area of a closed ring on the sphere
+// (Chamberlain and Duquette, "Some algorithms for polygons on a sphere").
+func sphericalRingArea(ring []Position) float64 {
+	n := len(ring) - 1 // the closing position repeats the first
+	if n < 3 { return 0 }
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		prev, next := ring[(i+n-1)%n], ring[(i+1)%n]
+		sum += rad(next[0]-prev[0]) * math.Sin(rad(ring[i][1]))
+	}
+	return sum * EarthRadius * EarthRadius / 2
+}
+
+// Centroid returns the area-weighted centre of mp, holes subtracted. It is
+// computed in lng/lat, which keeps it exact for city-sized zones, and may
+// lie outside a concave zone. A zone without area gets the centre of its
+// bounding box.
+func (mp MultiPolygon) Centroid() Position {
+	b := mp.Bounds()
+	origin := b.center()
+	var area, cx, cy float64
+	for _, p := range mp {
+		for i, ring := range p {
+			a, x, y := ringMoments(ring, origin)
+			// normalise the winding: exteriors add, holes subtract
+			if (a < 0) == (i == 0) { a, x, y = -a, -x, -y }
+			area, cx, cy = area+a, cx+x, cy+y
+		}
+	}
+	if area == 0 || math.IsInf(origin[0], 0) { return origin }
+	return Position{origin[0] + cx/(3*area), origin[1] + cy/(3*area)}
+}
+
+// ringMoments returns the signed shoelace area of ring and its first
+// moments times 3, relative to origin to keep precision.
+func ringMoments(ring []Position, origin Position) (area, mx, my float64) {
+	for i := 0; i+1 < len(ring); i++ {
+		x0, y0 := ring[i][0]-origin[0], ring[i][1]-origin[1]
+		x1, y1 := ring[i+1][0]-origin[0], ring[i+1][1]-origin[1]
+		c := x0*y1 - x1*y0
+		area += c / 2
+		mx += (x0 + x1) * c / 2
+		my += (y0 + y1) * c / 2
+	}
+	return area, mx, my
+}
+
+// boxDistance is about the shortest distance in metres from pt to any
+// point of b, 0 inside it. Nearest uses it to skip subtrees.
+func (b BBox) boxDistance(pt Position) float64 {
+	if b.contains(pt) { return 0 }
+	return Haversine(pt, Position{math.Max(b.MinLng, math.Min(pt[0], b.MaxLng)), math.Max(b.MinLat, math.Min(pt[1], b.MaxLat))})
+}
+
+// Nearest returns the zone closest to the point and its distance in metres,
+// 0 for a zone containing it. Ties go to the zone Resolve would pick. The
+// search visits subtrees nearest first and stops once no bounding box can
+// hold a closer zone.
+func (idx *Index) Nearest(lng, lat float64) (*Zone, float64, bool) {
+	if idx.root == nil { return nil, 0, false }
+	pt := Position{lng, lat}
+	var best *Zone
+	bestDist := math.Inf(1)
+	q := &nodeQueue{{n: idx.root, dist: idx.root.bbox.boxDistance(pt)}}
+	for q.Len() > 0 {
+		item := heap.Pop(q).(queued)
+		if item.dist > bestDist { break }
+		if z := item.n.zone; z != nil {
+			d := z.Geometry.Distance(pt)
+			if best == nil || d < bestDist || (d == bestDist && better(z, best)) { best, bestDist = z, d }
+			continue
+		}
+		for _, c := range item.n.children {
+			if d := c.bbox.boxDistance(pt); d <= bestDist { heap.Push(q, queued{n: c, dist: d}) }
+		}
+	}
+	return best, bestDist, best != nil
+}
+
+type queued struct {
+	n *node
+	dist float64
+}
+
+// nodeQueue is a min-heap of nodes by distance.
+type nodeQueue []queued
+
+func (q nodeQueue) Len() int { return len(q) }
+func (q nodeQueue) Less(i, j int) bool { return q[i].dist < q[j].dist }
+func (q nodeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x any) { *q = append(*q, x.(queued)) }
+func (q *nodeQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,81 @@
+package geospatial
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func near(got, want, tol float64) bool { return math.Abs(got-want) <= tol }
+
+func TestHaversine(t *testing.T) {
+	almaty, astana := Position{76.9286, 43.2567}, Position{71.4491, 51.1694}
+	if d := Haversine(almaty, astana); !near(d, 971_000, 2_000) { t.Fatalf("Алматы–Астана = %.0f m", d) }
+	if d := Haversine(almaty, almaty); d != 0 { t.Fatalf("same point = %v", d) }
+	// a degree of latitude is about 111.2 km anywhere
+	if d := Haversine(Position{76, 43}, Position{76, 44}); !near(d, 111_195, 10) { t.Fatalf("1° lat = %.0f m", d) }
+}
+
+func TestDistanceToZone(t *testing.T) {
+	block := square(76.91, 43.2185, 0.008)
+	metresPerLng := 111_195 * math.Cos(rad(43.222))
+	cases := []struct {
+		name string
+		pt Position
+		want, tol float64
+	}{
+		{"inside", Position{76.914, 43.222}, 0, 0},
+		{"east of the block", Position{76.928, 43.222}, 0.01 * metresPerLng, 5},
+		{"south of the block", Position{76.914, 43.2085}, 1112, 5},
+		{"off the corner", Position{76.909, 43.2175}, math.Hypot(0.001*111_195*math.Cos(rad(43.2185)), 111.2), 5},
+	}
+	for _, tc := range cases {
+		if d := block.Distance(tc.pt); !near(d, tc.want, tc.tol) { t.Errorf("%s: %.1f m, want %.1f", tc.name, d, tc.want) }
+	}
+	// inside, the distance to the boundary is to the nearest edge
+	if d := block.DistanceToBoundary(Position{76.914, 43.2195}); !near(d, 111.2, 1) { t.Fatalf("to boundary from inside = %.1f", d) }
+	// a hole's edge is a boundary too
+	withHole := MultiPolygon{{block[0][0], {{76.912, 43.2205}, {76.912, 43.2245}, {76.916, 43.2245}, {76.916, 43.2205}, {76.912, 43.2205}}}}
+	if d := withHole.Distance(Position{76.914, 43.2225}); !near(d, 0.002*metresPerLng, 5) { t.Fatalf("from inside the hole = %.1f", d) }
+}
+
+func TestAreaAndCentroid(t *testing.T) {
+	// 0.01° × 0.01° at 43°N is about 1112 m × 812 m
+	sq := square(76.9, 43.2, 0.01)
+	want := 0.01 * 111_195 * 0.01 * 111_195 * math.Cos(rad(43.205))
+	if a := sq.Area(); !near(a, want, want*0.002) { t.Fatalf("area = %.0f, want %.0f", a, want) }
+	if c := sq.Centroid(); !near(c[0], 76.905, 1e-9) || !near(c[1], 43.205, 1e-9) { t.Fatalf("centroid = %v", c) }
+
+	// a hole in the east half moves the centroid west and takes its area
+	holed := MultiPolygon{{sq[0][0], {{76.906, 43.202}, {76.906, 43.208}, {76.908, 43.208}, {76.908, 43.202}, {76.906, 43.202}}}}
+	if a := holed.Area(); !near(a, want*0.88, want*0.003) { t.Fatalf("holed area = %.0f", a) }
+	if c := holed.Centroid(); c[0] >= 76.905 || !near(c[1], 43.205, 1e-9) { t.Fatalf("holed centroid = %v", c) }
+
+	// the winding does not matter and two equal squares balance out
+	two := MultiPolygon{sq[0], {{{76.92, 43.2}, {76.92, 43.21}, {76.93, 43.21}, {76.93, 43.2}, {76.92, 43.2}}}}
+	if c := two.Centroid(); !near(c[0], 76.915, 1e-9) { t.Fatalf("two squares centroid = %v", c) }
+	if a := two.Area(); !near(a, 2*want, want*0.004) { t.Fatalf("two squares area = %.0f", a) }
+}
+
+func TestIndexNearest(t *testing.T) {
+	idx := NewIndex([]Zone{
+		{ID: "block", Name: "ЖК 4YOU", Geometry: square(76.91, 43.2185, 0.008)},
+		{ID: "far", Name: "Астана", Geometry: square(71.3, 51.0, 0.3)},
+	})
+	z, d, ok := idx.Nearest(76.928, 43.222)
+	if !ok || z.ID != "block" || !near(d, 0.01*111_195*math.Cos(rad(43.222)), 5) { t.Fatalf("nearest = %+v %.1f", z, d) }
+	if z, d, _ := idx.Nearest(76.914, 43.222); z.ID != "block" || d != 0 { t.Fatalf("inside = %+v %.1f", z, d) }
+	if _, _, ok := NewIndex(nil).Nearest(0, 0); ok { t.Fatal("empty index found a zone") }
+
+	// the tree search agrees with a linear scan
+	zones, _ := randomZones(2000)
+	idx = NewIndex(zones)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 300; i++ {
+		pt := Position{69 + r.Float64()*12, 39 + r.Float64()*12}
+		want := math.Inf(1)
+		for _, z := range zones { want = math.Min(want, z.Geometry.Distance(pt)) }
+		_, got, _ := idx.Nearest(pt[0], pt[1])
+		if !near(got, want, 1e-6) { t.Fatalf("Nearest(%v) = %.3f, linear scan %.3f", pt, got, want) }
+	}
+}
@@ -0,0 +1,91 @@
+package geospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Feature is one GeoJSON feature with an areal geometry.
+type Feature struct {
+	// ID is the feature's "id" member as a string, or empty.
+	ID string
+	Properties map[string]interface{}
+	Geometry MultiPolygon
+}
+
+type feature struct {
+	Type string `json:"type"`
+	ID json.RawMessage `json:"id"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry json.RawMessage `json:"geometry"`
+	Features []json.RawMessage `json:"features"`
+}
+
+// ParseFeatures decodes a GeoJSON Polygon, MultiPolygon, Feature or
+// FeatureCollection. A bare geometry becomes one feature without
+// properties. Every feature must have a Polygon or MultiPolygon geometry;
+// the geometries are not validated.
+func ParseFeatures(geojson string) ([]Feature, error) {
+	var f feature
+	if err := json.Unmarshal([]byte(geojson), &f); err != nil { return nil, err }
+	switch f.Type {
+	case "Polygon", "MultiPolygon":
+		mp, err := ParseGeometry(geojson)
+		if err != nil { return nil, err }
+		return []Feature{{Geometry: mp}}, nil
+	case "Feature":
+		ft, err := f.decode()
+		if err != nil { return nil, err }
+		return []Feature{ft}, nil
+	case "FeatureCollection":
+		if len(f.Features) == 0 { return nil, fmt.Errorf("feature collection is empty") }
+		out := make([]Feature, 0, len(f.Features))
+		for i, raw := range f.Features {
+			var m feature
+			if err := json.Unmarshal(raw, &m); err != nil { return nil, fmt.Errorf("feature %d: %w", i, err) }
+			if m.Type != "Feature" { return nil, fmt.Errorf("feature %d: type %q, want Feature", i, m.Type) }
+			ft, err := m.decode()
+			if err != nil { return nil, fmt.Errorf("feature %d: %w", i, err) }
+			out = append(out, ft)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported GeoJSON type %q, want Polygon, MultiPolygon, Feature or FeatureCollection", f.Type)
+}
+
+func (f feature) decode() (Feature, error) {
+	if len(f.Geometry) == 0 || string(f.Geometry) == "null" { return Feature{}, fmt.Errorf("feature has no geometry") }
+	mp, err := ParseGeometry(string(f.Geometry))
+	if err != nil { return Feature{}, err }
+	id := strings.Trim(string(f.ID), `"`)
+	if id == "null" { id = "" }
+	return Feature{ID: id, Properties: f.Properties, Geometry: mp}, nil
+}
+
+// GeoJSON encodes mp as a Polygon geometry when it has one member and as a
+// MultiPolygon otherwise.
+func (mp MultiPolygon) GeoJSON() string {
+	var g interface{} = map[string]interface{}{"type": "MultiPolygon", "coordinates": mp}
+	if len(mp) == 1 { g = map[string]interface{}{"type": "Polygon", "coordinates": mp[0]} }
+	b, _ := json.Marshal(g)
+	return string(b)
+}
+
+// EncodeFeatureCollection encodes features as a GeoJSON FeatureCollection.
+func EncodeFeatureCollection(features []Feature) ([]byte, error) {
+	type out struct {
+		Type string `json:"type"`
+		ID string `json:"id,omitempty"`
+		Properties map[string]interface{} `json:"properties"`
+		Geometry json.RawMessage `json:"geometry"`
+	}
+	fc := struct {
+		Type string `json:"type"`
+		Features []out `json:"features"`
+	}{Type: "FeatureCollection", Features: make([]out, len(features))}
+	for i, f := range features {
+		fc.Features[i] = out{Type: "Feature", ID: f.ID, Properties: f.Properties, Geometry: json.RawMessage(f.Geometry.GeoJSON())}
+	}
+	return json.MarshalIndent(fc, "", "  ")
+}
@@ -0,0 +1,51 @@
+package geospatial
+
+import (
+	"strings"
+	"testing"
+)
+
+const ring = `[[[76.9,43.2],[76.91,43.2],[76.91,43.21],[76.9,43.21],[76.9,43.2]]]`
+
+func TestParseFeatures(t *testing.T) {
+	cases := []struct {
+		name, geojson string
+		features, polygons int
+	}{
+		{"polygon", `{"type":"Polygon","coordinates":` + ring + `}`, 1, 1},
+		{"multipolygon", `{"type":"MultiPolygon","coordinates":[` + ring + `,` + ring + `]}`, 1, 2},
+		{"feature", `{"type":"Feature","id":7,"properties":{"name":"ЖК 4YOU"},"geometry":{"type":"Polygon","coordinates":` + ring + `}}`, 1, 1},
+		{"collection", `{"type":"FeatureCollection","features":[
+			{"type":"Feature","properties":{"name":"a"},"geometry":{"type":"Polygon","coordinates":` + ring + `}},
+			{"type":"Feature","properties":null,"geometry":{"type":"MultiPolygon","coordinates":[` + ring + `]}}]}`, 2, 2},
+	}
+	for _, tc := range cases {
+		fs, err := ParseFeatures(tc.geojson)
+		if err != nil { t.Fatalf("%s: %v", tc.name, err) }
+		n := 0
+		for _, f := range fs { n += len(f.Geometry) }
+		if len(fs) != tc.features || n != tc.polygons { t.Errorf("%s: %d features, %d polygons", tc.name, len(fs), n) }
+	}
+	fs, _ := ParseFeatures(cases[2].geojson)
+	if fs[0].ID != "7" || fs[0].Properties["name"] != "ЖК 4YOU" { t.Errorf("feature metadata lost: %+v", fs[0]) }
+
+	for geojson, want := range map[string]string{
+		`{"type":"Point","coordinates":[1,2]}`: "unsupported GeoJSON type",
+		`{"type":"Feature","geometry":null}`: "no geometry",
+		`{"type":"FeatureCollection","features":[]}`: "empty",
+		`{"type":"FeatureCollection","features":[{"type":"Feature","geometry":{"type":"LineString","coordinates":[[1,2],[3,4]]}}]}`: "feature 0",
+	} {
+		if _, err := ParseFeatures(geojson); err == nil || !strings.Contains(err.Error(), want) { t.Errorf("%s: got %v, want %q", geojson, err, want) }
+	}
+}
+
+func TestGeoJSONRoundTrip(t *testing.T) {
+	for _, mp := range []MultiPolygon{square(76.9, 43.2, 0.01), append(square(76.9, 43.2, 0.01), square(77, 43.3, 0.01)...)} {
+		back, err := ParseGeometry(mp.GeoJSON())
+		if err != nil { t.Fatal(err) }
+		if len(back) != len(mp) || back[0][0][2] != mp[0][0][2] { t.Fatalf("round trip changed %v into %v", mp, back) }
+	}
+	if !strings.Contains(square(0, 0, 1).GeoJSON(), `"type":"Polygon"`) {
+		t.Fatal("a single polygon should be stored as a Polygon")
+	}
+}
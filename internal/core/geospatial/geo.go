@@ -1,46 +1,147 @@
 package geospatial
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
 
+// Position is a [lng, lat] pair, in GeoJSON order.
 type Position = [2]float64
+
+// Polygon is a list of linear rings: the first is the exterior, the rest are
+// holes.
 type Polygon = [][]Position
-type MultiPolygon = []Polygon
+type MultiPolygon []Polygon
 
 type geo struct {
 	Type string `json:"type"`
 	Coordinates json.RawMessage `json:"coordinates"`
 }
 
+// boundaryEps is how far from an edge, in degrees, a point still counts as
+// lying on it (about 0.1 mm).
+const boundaryEps = 1e-9
+
+type location int
+
+const (
+	outside location = iota
+	inside
+	onBoundary
+)
+
+// locate tells whether pt is inside, outside or on the edge of a single
+// ring. Closing the ring is implied, so it works on unclosed input too.
+func locate(pt Position, ring []Position) location {
+	x, y := pt[0], pt[1]
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		if onSegment(pt, ring[j], ring[i]) { return onBoundary }
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi { in = !in }
+	}
+	if in { return inside }
+	return outside
+}
+
+// pointInPolygon treats a polygon as a closed set: pt must be inside or on
+// the exterior ring and not strictly inside any hole. Points on a hole's
+// edge belong to the polygon, so a boundary shared by two neighbouring
+// zones is served by both and Index picks between them.
 func pointInPolygon(pt Position, poly Polygon) bool {
-	x := pt[0]; y := pt[1]
-	inside := false
-	for _, ring := range poly {
-		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
-			xi, yi := ring[i][0], ring[i][1]
-			xj, yj := ring[j][0], ring[j][1]
-			intersect := ((yi > y) != (yj > y)) && (x < (xj-xi)*(y-yi)/(yj-yi)+xi)
-			if intersect { inside = !inside }
-		}
+	if len(poly) == 0 { return false }
+	switch locate(pt, poly[0]) {
+	case outside: return false
+	case onBoundary: return true
+	}
+	for _, hole := range poly[1:] {
+		if locate(pt, hole) == inside { return false }
+	}
+	return true
+}
+
+func onSegment(p, a, b Position) bool {
+	if p[0] < math.Min(a[0], b[0])-boundaryEps || p[0] > math.Max(a[0], b[0])+boundaryEps ||
+		p[1] < math.Min(a[1], b[1])-boundaryEps || p[1] > math.Max(a[1], b[1])+boundaryEps {
+		return false
 	}
-	return inside
+	l := math.Hypot(b[0]-a[0], b[1]-a[1])
+	if l == 0 { return math.Hypot(p[0]-a[0], p[1]-a[1]) <= boundaryEps }
+	return math.Abs(cross(a, b, p))/l <= boundaryEps
+}
+
+// cross is the z component of (b-a)×(p-a): positive when p is left of a→b.
+func cross(a, b, p Position) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+// ContainsPoint reports whether the GeoJSON Polygon or MultiPolygon contains
+// the point. Geometry that does not parse or fails Validate is an error
+// rather than "not contained".
+func ContainsPoint(geojson string, lng, lat float64) (bool, error) {
+	mp, err := ParseValidGeometry(geojson)
+	if err != nil { return false, err }
+	return mp.contains(Position{lng, lat}), nil
 }
 
-func ContainsPoint(geojson string, lng, lat float64) bool {
+// ParseGeometry decodes a GeoJSON Polygon or MultiPolygon geometry. A
+// Polygon is returned as a MultiPolygon with one member. Only the structure
+// is checked here; see Validate for the geometry itself.
+func ParseGeometry(geojson string) (MultiPolygon, error) {
 	var g geo
-	if err := json.Unmarshal([]byte(geojson), &g); err != nil { return false }
+	if err := json.Unmarshal([]byte(geojson), &g); err != nil { return nil, err }
+	if len(g.Coordinates) == 0 { return nil, fmt.Errorf("%s geometry has no coordinates", g.Type) }
+	// positions are decoded as slices first: a [2]float64 would quietly pad
+	// a one-number position with zero
 	switch g.Type {
 	case "Polygon":
-		var p Polygon
-		if json.Unmarshal(g.Coordinates, &p) == nil {
-			return pointInPolygon([2]float64{lng, lat}, p)
-		}
+		var raw [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &raw); err != nil { return nil, fmt.Errorf("polygon coordinates: %w", err) }
+		p, err := toPolygon(raw, 0)
+		if err != nil { return nil, err }
+		return MultiPolygon{p}, nil
 	case "MultiPolygon":
-		var mp MultiPolygon
-		if json.Unmarshal(g.Coordinates, &mp) == nil {
-			for _, p := range mp {
-				if pointInPolygon([2]float64{lng, lat}, p) { return true }
+		var raw [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &raw); err != nil { return nil, fmt.Errorf("multipolygon coordinates: %w", err) }
+		mp := make(MultiPolygon, len(raw))
+		for i, r := range raw {
+			p, err := toPolygon(r, i)
+			if err != nil { return nil, err }
+			mp[i] = p
+		}
+		return mp, nil
+	}
+	return nil, fmt.Errorf("unsupported geometry type %q, want Polygon or MultiPolygon", g.Type)
+}
+
+// ParseValidGeometry is ParseGeometry followed by Validate.
+func ParseValidGeometry(geojson string) (MultiPolygon, error) {
+	mp, err := ParseGeometry(geojson)
+	if err != nil { return nil, err }
+	if err := Validate(mp); err != nil { return nil, err }
+	return mp, nil
+}
+
+func toPolygon(raw [][][]float64, polygon int) (Polygon, error) {
+	p := make(Polygon, len(raw))
+	for r, ring := range raw {
+		p[r] = make([]Position, len(ring))
+		for v, pos := range ring {
+			// a third number is altitude, which RFC 7946 allows and we ignore
+			if len(pos) != 2 && len(pos) != 3 {
+				return nil, &GeometryError{Polygon: polygon, Ring: r, Vertex: v, Reason: fmt.Sprintf("position has %d numbers, want [lng, lat]", len(pos))}
 			}
+			p[r][v] = Position{pos[0], pos[1]}
 		}
 	}
+	return p, nil
+}
+
+func (mp MultiPolygon) contains(pt Position) bool {
+	for _, p := range mp {
+		if pointInPolygon(pt, p) { return true }
+	}
 	return false
 }
@@ -0,0 +1,104 @@
+package geospatial
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// lake is a 10×10 square with a 4×4 hole in the middle.
+var lake = Polygon{
+	{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+	{{3, 3}, {3, 7}, {7, 7}, {7, 3}, {3, 3}},
+}
+
+func TestPointInPolygonHoles(t *testing.T) {
+	cases := []struct {
+		name string
+		pt Position
+		want bool
+	}{
+		{"interior", Position{1, 1}, true},
+		{"in the hole", Position{5, 5}, false},
+		{"outside", Position{11, 5}, false},
+		{"exterior edge", Position{0, 5}, true},
+		{"exterior vertex", Position{10, 10}, true},
+		{"hole edge", Position{3, 5}, true},
+		{"hole vertex", Position{7, 7}, true},
+	}
+	for _, tc := range cases {
+		if got := pointInPolygon(tc.pt, lake); got != tc.want { t.Errorf("%s %v: got %v, want %v", tc.name, tc.pt, got, tc.want) }
+	}
+
+	// Two holes that overlap each other: XOR-ing the rings used to count the
+	// overlap as inside again.
+	twoHoles := Polygon{lake[0], {{2, 2}, {2, 6}, {6, 6}, {6, 2}, {2, 2}}, lake[1]}
+	if pointInPolygon(Position{5, 5}, twoHoles) { t.Error("point in two holes must be outside") }
+
+	// An island inside the hole is a separate member of the MultiPolygon.
+	island := MultiPolygon{lake, {{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}}}}
+	if !island.contains(Position{5, 5}) { t.Error("point on the island must be inside") }
+	if island.contains(Position{3.5, 3.5}) { t.Error("point in the water around the island must be outside") }
+}
+
+func TestContainsPointReportsBadInput(t *testing.T) {
+	for _, g := range []string{
+		`not json`,
+		`{"type":"Point","coordinates":[76.9,43.2]}`,
+		`{"type":"Polygon"}`,
+		`{"type":"Polygon","coordinates":[[[76.9],[76.91,43.2],[76.91,43.21],[76.9]]]}`,
+		`{"type":"Polygon","coordinates":[[[43.2,76.9],[43.2,76.91],[43.21,76.91],[43.2,76.9]]]}`,
+	} {
+		if _, err := ContainsPoint(g, 76.905, 43.205); err == nil { t.Errorf("%s: expected an error", g) }
+	}
+	ok, err := ContainsPoint(`{"type":"Polygon","coordinates":[[[76.9,43.2],[76.91,43.2],[76.91,43.21],[76.9,43.21],[76.9,43.2]]]}`, 76.905, 43.205)
+	if err != nil || !ok { t.Fatalf("got %v, %v", ok, err) }
+}
+
+func TestValidate(t *testing.T) {
+	sq := []Position{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}
+	cases := []struct {
+		name string
+		mp MultiPolygon
+		want string // substring of the error; empty means valid
+	}{
+		{"square", MultiPolygon{{sq}}, ""},
+		{"with hole", MultiPolygon{lake}, ""},
+		{"hole touching the exterior at a point", MultiPolygon{{sq, {{0, 5}, {3, 7}, {3, 3}, {0, 5}}}}, ""},
+		{"empty", MultiPolygon{}, "no polygons"},
+		{"no rings", MultiPolygon{{}}, "no rings"},
+		{"too short", MultiPolygon{{{{0, 0}, {1, 0}, {0, 0}}}}, "at least 4"},
+		{"unclosed", MultiPolygon{{{{0, 0}, {10, 0}, {10, 10}, {0, 10}}}}, "not closed"},
+		{"repeated points only", MultiPolygon{{{{0, 0}, {0, 0}, {1, 1}, {0, 0}}}}, "fewer than 3 distinct"},
+		{"lat out of range", MultiPolygon{{{{0, 0}, {10, 0}, {10, 95}, {0, 0}}}}, "position 2: [10, 95] is out of range"},
+		{"lng out of range", MultiPolygon{{{{179, 0}, {181, 0}, {181, 1}, {179, 0}}}}, "out of range"},
+		{"clockwise exterior", MultiPolygon{{{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}}}, "exterior ring is clockwise"},
+		{"counter-clockwise hole", MultiPolygon{{sq, {{3, 3}, {7, 3}, {7, 7}, {3, 7}, {3, 3}}}}, "hole 1: hole is counter-clockwise"},
+		{"zero area", MultiPolygon{{{{0, 0}, {5, 0}, {10, 0}, {0, 0}}}}, "zero area"},
+		{"bow tie", MultiPolygon{{{{0, 0}, {10, 10}, {10, 0}, {0, 10}, {0, 0}}}}, "crosses itself"},
+		{"ring touching itself", MultiPolygon{{{{0, 0}, {10, 0}, {5, 5}, {10, 10}, {0, 10}, {5, 5}, {0, 0}}}}, "crosses itself"},
+		{"hole crossing the exterior", MultiPolygon{{sq, {{5, 5}, {5, 12}, {12, 12}, {12, 5}, {5, 5}}}}, "crosses ring 0"},
+		{"hole outside", MultiPolygon{{sq, {{20, 20}, {20, 22}, {22, 22}, {22, 20}, {20, 20}}}}, "outside the exterior ring"},
+		{"nested holes", MultiPolygon{{sq, {{2, 2}, {2, 8}, {8, 8}, {8, 2}, {2, 2}}, {{4, 4}, {4, 6}, {6, 6}, {6, 4}, {4, 4}}}}, "hole 2: hole lies inside hole 1"},
+	}
+	for _, tc := range cases {
+		err := Validate(tc.mp)
+		if tc.want == "" {
+			if err != nil { t.Errorf("%s: unexpected error %v", tc.name, err) }
+			continue
+		}
+		var verr ValidationError
+		if !errors.As(err, &verr) || len(verr) == 0 { t.Errorf("%s: got %v, want a ValidationError", tc.name, err); continue }
+		if !strings.Contains(err.Error(), tc.want) { t.Errorf("%s: %q does not mention %q", tc.name, err, tc.want) }
+	}
+}
+
+func TestValidateReportsEveryPolygon(t *testing.T) {
+	bad := MultiPolygon{
+		{{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}},
+		{{{20, 20}, {30, 20}, {30, 30}}},
+	}
+	var verr ValidationError
+	if !errors.As(Validate(bad), &verr) || len(verr) != 2 { t.Fatalf("got %v", verr) }
+	if verr[0].Polygon != 0 || verr[1].Polygon != 1 { t.Fatalf("problems not attributed to their polygons: %v", verr) }
+}
@@ -0,0 +1,149 @@
+package geospatial
+
+import (
+	"math"
+	"sort"
+)
+
+// Zone is one service area held by an Index.
+type Zone struct {
+	ID string
+	Name string
+	// Priority decides between overlapping zones; higher wins. Among equal
+	// priorities the smaller zone wins, then the lower ID.
+	Priority int
+	Geometry MultiPolygon
+
+	bbox BBox
+	area float64
+}
+
+// BBox is an axis-aligned lng/lat rectangle.
+type BBox struct{ MinLng, MinLat, MaxLng, MaxLat float64 }
+
+func (b BBox) contains(pt Position) bool {
+	return pt[0] >= b.MinLng && pt[0] <= b.MaxLng && pt[1] >= b.MinLat && pt[1] <= b.MaxLat
+}
+
+func (b BBox) union(o BBox) BBox {
+	return BBox{math.Min(b.MinLng, o.MinLng), math.Min(b.MinLat, o.MinLat), math.Max(b.MaxLng, o.MaxLng), math.Max(b.MaxLat, o.MaxLat)}
+}
+
+func (b BBox) center() Position { return Position{(b.MinLng + b.MaxLng) / 2, (b.MinLat + b.MaxLat) / 2} }
+
+// Bounds returns the bounding box of mp.
+func (mp MultiPolygon) Bounds() BBox {
+	b := BBox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, p := range mp {
+		for _, ring := range p {
+			for _, pt := range ring {
+				b = b.union(BBox{pt[0], pt[1], pt[0], pt[1]})
+			}
+		}
+	}
+	return b
+}
+
+// planarArea is the shoelace area in square degrees, exterior rings minus
+// holes. It is only used to rank overlapping zones by size.
+func (mp MultiPolygon) planarArea() float64 {
+	total := 0.0
+	for _, p := range mp {
+		for i, ring := range p {
+			a := 0.0
+			for j := 0; j+1 < len(ring); j++ {
+				a += ring[j][0]*ring[j+1][1] - ring[j+1][0]*ring[j][1]
+			}
+			a = math.Abs(a) / 2
+			if i == 0 { total += a } else { total -= a }
+		}
+	}
+	return total
+}
+
+// nodeSize is the fan-out of the R-tree.
+const nodeSize = 16
+
+type node struct {
+	bbox BBox
+	children []*node
+	zone *Zone
+}
+
+// Index answers "which zone contains this point" for a fixed set of zones.
+// Geometries are parsed once and packed into a Sort-Tile-Recursive R-tree,
+// so a lookup only runs the exact point-in-polygon test on the few zones
+// whose bounding box contains the point. An Index is immutable and safe for
+// concurrent use; rebuild it when zones change.
+type Index struct {
+	root *node
+	size int
+}
+
+// NewIndex builds an index over zones.
+func NewIndex(zones []Zone) *Index {
+	leaves := make([]*node, 0, len(zones))
+	for i := range zones {
+		z := zones[i]
+		if len(z.Geometry) == 0 { continue }
+		z.bbox = z.Geometry.Bounds()
+		z.area = z.Geometry.planarArea()
+		leaves = append(leaves, &node{bbox: z.bbox, zone: &z})
+	}
+	idx := &Index{size: len(leaves)}
+	if len(leaves) == 0 { return idx }
+	level := leaves
+	for len(level) > 1 { level = packLevel(level) }
+	idx.root = level[0]
+	return idx
+}
+
+// packLevel groups nodes into parents of up to nodeSize children: sorted by
+// longitude into vertical slices, each slice sorted by latitude.
+func packLevel(nodes []*node) []*node {
+	parents := int(math.Ceil(float64(len(nodes)) / nodeSize))
+	slices := int(math.Ceil(math.Sqrt(float64(parents))))
+	perSlice := slices * nodeSize
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].bbox.center()[0] < nodes[j].bbox.center()[0] })
+	out := make([]*node, 0, parents)
+	for s := 0; s < len(nodes); s += perSlice {
+		slice := nodes[s:min(s+perSlice, len(nodes))]
+		sort.Slice(slice, func(i, j int) bool { return slice[i].bbox.center()[1] < slice[j].bbox.center()[1] })
+		for k := 0; k < len(slice); k += nodeSize {
+			children := slice[k:min(k+nodeSize, len(slice))]
+			n := &node{bbox: children[0].bbox, children: append([]*node(nil), children...)}
+			for _, c := range children[1:] { n.bbox = n.bbox.union(c.bbox) }
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// Len returns the number of zones in the index.
+func (idx *Index) Len() int { return idx.size }
+
+// Resolve returns the zone containing the point. When zones overlap the one
+// with the highest Priority wins, then the smallest, then the lowest ID, so
+// the answer never depends on load order.
+func (idx *Index) Resolve(lng, lat float64) (*Zone, bool) {
+	if idx.root == nil { return nil, false }
+	pt := Position{lng, lat}
+	var best *Zone
+	var walk func(n *node)
+	walk = func(n *node) {
+		if !n.bbox.contains(pt) { return }
+		if n.zone != nil {
+			if (best == nil || better(n.zone, best)) && n.zone.Geometry.contains(pt) { best = n.zone }
+			return
+		}
+		for _, c := range n.children { walk(c) }
+	}
+	walk(idx.root)
+	return best, best != nil
+}
+
+func better(a, b *Zone) bool {
+	if a.Priority != b.Priority { return a.Priority > b.Priority }
+	if a.area != b.area { return a.area < b.area }
+	return a.ID < b.ID
+}
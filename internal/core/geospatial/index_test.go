@@ -0,0 +1,113 @@
+package geospatial
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func square(lng, lat, size float64) MultiPolygon {
+	return MultiPolygon{{{{lng, lat}, {lng + size, lat}, {lng + size, lat + size}, {lng, lat + size}, {lng, lat}}}}
+}
+
+func TestIndexResolve(t *testing.T) {
+	idx := NewIndex([]Zone{
+		{ID: "city", Name: "Алматы", Geometry: square(76.8, 43.1, 0.3)},
+		{ID: "block", Name: "ЖК 4YOU", Geometry: square(76.91, 43.2185, 0.008)},
+		{ID: "promo", Name: "Акция", Priority: 1, Geometry: square(76.90, 43.21, 0.05)},
+		{ID: "far", Name: "Астана", Geometry: square(71.3, 51.0, 0.3)},
+	})
+	cases := []struct {
+		lng, lat float64
+		want string
+	}{
+		{76.85, 43.15, "city"},   // only the city
+		{76.914, 43.22, "promo"}, // priority beats the smaller block
+		{71.4, 51.1, "far"},
+		{70.0, 40.0, ""},
+	}
+	for _, tc := range cases {
+		z, ok := idx.Resolve(tc.lng, tc.lat)
+		got := ""
+		if ok { got = z.ID }
+		if got != tc.want { t.Errorf("Resolve(%v, %v) = %q, want %q", tc.lng, tc.lat, got, tc.want) }
+	}
+
+	// without priorities the smaller zone wins, whatever the order
+	for _, zones := range [][]Zone{
+		{{ID: "city", Geometry: square(76.8, 43.1, 0.3)}, {ID: "block", Geometry: square(76.91, 43.2185, 0.008)}},
+		{{ID: "block", Geometry: square(76.91, 43.2185, 0.008)}, {ID: "city", Geometry: square(76.8, 43.1, 0.3)}},
+	} {
+		if z, _ := NewIndex(zones).Resolve(76.914, 43.22); z == nil || z.ID != "block" { t.Fatalf("smallest zone should win, got %+v", z) }
+	}
+}
+
+func TestIndexMatchesLinearScan(t *testing.T) {
+	zones, _ := randomZones(2000)
+	idx := NewIndex(zones)
+	if idx.Len() != len(zones) { t.Fatalf("Len = %d", idx.Len()) }
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		lng, lat := 70+r.Float64()*10, 40+r.Float64()*10
+		want := ""
+		var wantArea float64
+		for _, z := range zones {
+			if z.Geometry.contains(Position{lng, lat}) {
+				a := z.Geometry.planarArea()
+				if want == "" || a < wantArea || (a == wantArea && z.ID < want) { want, wantArea = z.ID, a }
+			}
+		}
+		got := ""
+		if z, ok := idx.Resolve(lng, lat); ok { got = z.ID }
+		if got != want { t.Fatalf("(%v, %v): index %q, scan %q", lng, lat, got, want) }
+	}
+}
+
+// randomZones scatters n overlapping squares over a 10°×10° area.
+func randomZones(n int) ([]Zone, []string) {
+	r := rand.New(rand.NewSource(1))
+	zones := make([]Zone, n)
+	geojson := make([]string, n)
+	for i := range zones {
+		g := square(70+r.Float64()*10, 40+r.Float64()*10, 0.05+r.Float64()*0.2)
+		zones[i] = Zone{ID: fmt.Sprintf("z%05d", i), Geometry: g}
+		b, _ := json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": g})
+		geojson[i] = string(b)
+	}
+	return zones, geojson
+}
+
+// BenchmarkLinearScan is the pre-index lookup: parse and test every zone.
+func BenchmarkLinearScan(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		_, geojson := randomZones(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			r := rand.New(rand.NewSource(3))
+			for i := 0; i < b.N; i++ {
+				lng, lat := 70+r.Float64()*10, 40+r.Float64()*10
+				for _, g := range geojson {
+					if ok, _ := ContainsPoint(g, lng, lat); ok { break }
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIndexResolve(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		zones, _ := randomZones(n)
+		idx := NewIndex(zones)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			r := rand.New(rand.NewSource(3))
+			for i := 0; i < b.N; i++ {
+				idx.Resolve(70+r.Float64()*10, 40+r.Float64()*10)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexBuild(b *testing.B) {
+	zones, _ := randomZones(5000)
+	for i := 0; i < b.N; i++ { NewIndex(zones) }
+}
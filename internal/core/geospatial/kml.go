@@ -0,0 +1,153 @@
+package geospatial
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type kmlPlacemark struct {
+	ID string `xml:"id,attr"`
+	Name string `xml:"name"`
+	Description string `xml:"description"`
+	// Google My Maps writes <Data>, QGIS writes <SchemaData>
+	Data []kmlData `xml:"ExtendedData>Data"`
+	SimpleData []kmlSimpleData `xml:"ExtendedData>SchemaData>SimpleData"`
+	Polygons []kmlPolygon `xml:"Polygon"`
+	MultiPolygons []kmlPolygon `xml:"MultiGeometry>Polygon"`
+}
+
+type kmlData struct {
+	Name string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlSimpleData struct {
+	Name string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type kmlPolygon struct {
+	Outer string `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+// ParseKML reads every Placemark of a KML document, in any folder, as a
+// Feature. The placemark's name, description and extended data become
+// string properties. Every placemark must have a Polygon or a
+// MultiGeometry of Polygons; the geometries are not validated.
+func ParseKML(r io.Reader) ([]Feature, error) {
+	d := xml.NewDecoder(r)
+	var out []Feature
+	for {
+		tok, err := d.Token()
+		if err == io.EOF { break }
+		if err != nil { return nil, fmt.Errorf("kml: %w", err) }
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" { continue }
+		var pm kmlPlacemark
+		if err := d.DecodeElement(&pm, &start); err != nil { return nil, fmt.Errorf("kml placemark %d: %w", len(out), err) }
+		f, err := pm.feature()
+		if err != nil { return nil, fmt.Errorf("kml placemark %d (%q): %w", len(out), pm.Name, err) }
+		out = append(out, f)
+	}
+	if len(out) == 0 { return nil, fmt.Errorf("kml has no placemarks") }
+	return out, nil
+}
+
+func (pm kmlPlacemark) feature() (Feature, error) {
+	props := map[string]interface{}{}
+	for _, d := range pm.Data { props[d.Name] = strings.TrimSpace(d.Value) }
+	for _, d := range pm.SimpleData { props[d.Name] = strings.TrimSpace(d.Value) }
+	if name := strings.TrimSpace(pm.Name); name != "" { props["name"] = name }
+	if desc := strings.TrimSpace(pm.Description); desc != "" { props["description"] = desc }
+	var mp MultiPolygon
+	for _, kp := range append(pm.Polygons, pm.MultiPolygons...) {
+		outer, err := kmlRing(kp.Outer)
+		if err != nil { return Feature{}, fmt.Errorf("outer boundary: %w", err) }
+		p := Polygon{outer}
+		for i, in := range kp.Inner {
+			ring, err := kmlRing(in)
+			if err != nil { return Feature{}, fmt.Errorf("inner boundary %d: %w", i+1, err) }
+			p = append(p, ring)
+		}
+		mp = append(mp, p)
+	}
+	if len(mp) == 0 { return Feature{}, fmt.Errorf("placemark has no polygon; remove points and lines before import") }
+	return Feature{ID: pm.ID, Properties: props, Geometry: mp}, nil
+}
+
+// kmlRing parses "lng,lat[,alt] lng,lat[,alt] ..." tuples.
+func kmlRing(s string) ([]Position, error) {
+	fields := strings.Fields(s)
+	ring := make([]Position, 0, len(fields))
+	for i, tuple := range fields {
+		parts := strings.Split(tuple, ",")
+		if len(parts) != 2 && len(parts) != 3 { return nil, fmt.Errorf("coordinate %d %q, want lng,lat[,alt]", i, tuple) }
+		lng, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil { return nil, fmt.Errorf("coordinate %d %q is not numeric", i, tuple) }
+		ring = append(ring, Position{lng, lat})
+	}
+	return ring, nil
+}
+
+type kmlOut struct {
+	XMLName xml.Name `xml:"kml"`
+	NS string `xml:"xmlns,attr"`
+	Name string `xml:"Document>name"`
+	Placemarks []kmlOutPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlOutPlacemark struct {
+	ID string `xml:"id,attr,omitempty"`
+	Name string `xml:"name"`
+	Data []kmlData `xml:"ExtendedData>Data,omitempty"`
+	Polygon *kmlPolygon `xml:"Polygon,omitempty"`
+	Multi []kmlPolygon `xml:"MultiGeometry>Polygon,omitempty"`
+}
+
+// EncodeKML writes features as a KML document named name. The "name"
+// property becomes the placemark name and the other properties become
+// extended data, so ParseKML reads the file back with the same properties
+// (as strings).
+func EncodeKML(w io.Writer, name string, features []Feature) error {
+	doc := kmlOut{NS: "http://www.opengis.net/kml/2.2", Name: name}
+	for _, f := range features {
+		pm := kmlOutPlacemark{ID: f.ID}
+		keys := make([]string, 0, len(f.Properties))
+		for k := range f.Properties { keys = append(keys, k) }
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := fmt.Sprint(f.Properties[k])
+			if k == "name" { pm.Name = v; continue }
+			pm.Data = append(pm.Data, kmlData{Name: k, Value: v})
+		}
+		polys := make([]kmlPolygon, len(f.Geometry))
+		for i, p := range f.Geometry {
+			for j, ring := range p {
+				if j == 0 { polys[i].Outer = kmlCoordinates(ring); continue }
+				polys[i].Inner = append(polys[i].Inner, kmlCoordinates(ring))
+			}
+		}
+		if len(polys) == 1 { pm.Polygon = &polys[0] } else { pm.Multi = polys }
+		doc.Placemarks = append(doc.Placemarks, pm)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil { return err }
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil { return err }
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func kmlCoordinates(ring []Position) string {
+	parts := make([]string, len(ring))
+	for i, pt := range ring {
+		parts[i] = strconv.FormatFloat(pt[0], 'f', -1, 64) + "," + strconv.FormatFloat(pt[1], 'f', -1, 64)
+	}
+	return strings.Join(parts, " ")
+}
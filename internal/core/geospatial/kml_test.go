@@ -0,0 +1,83 @@
+package geospatial
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// myMapsKML is shaped like a Google My Maps export: a folder per layer,
+// clockwise rings with altitude and <Data> for table columns.
+const myMapsKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2">
+  <Document>
+    <name>Зоны</name>
+    <Folder>
+      <name>Алматы</name>
+      <Placemark>
+        <name>ЖК 4YOU</name>
+        <ExtendedData>
+          <Data name="city"><value>Алматы</value></Data>
+          <Data name="priority"><value>2</value></Data>
+        </ExtendedData>
+        <Polygon>
+          <outerBoundaryIs><LinearRing><coordinates>
+            76.91,43.2185,0 76.91,43.223,0 76.918,43.223,0 76.918,43.2185,0 76.91,43.2185,0
+          </coordinates></LinearRing></outerBoundaryIs>
+        </Polygon>
+      </Placemark>
+      <Placemark>
+        <name>Два двора</name>
+        <ExtendedData><SchemaData schemaUrl="#zones"><SimpleData name="is_active">false</SimpleData></SchemaData></ExtendedData>
+        <MultiGeometry>
+          <Polygon><outerBoundaryIs><LinearRing><coordinates>0,0 1,0 1,1 0,1 0,0</coordinates></LinearRing></outerBoundaryIs>
+            <innerBoundaryIs><LinearRing><coordinates>0.2,0.2 0.4,0.2 0.4,0.4 0.2,0.4 0.2,0.2</coordinates></LinearRing></innerBoundaryIs></Polygon>
+          <Polygon><outerBoundaryIs><LinearRing><coordinates>2,2 3,2 3,3 2,3 2,2</coordinates></LinearRing></outerBoundaryIs></Polygon>
+        </MultiGeometry>
+      </Placemark>
+    </Folder>
+  </Document>
+</kml>`
+
+func TestParseKML(t *testing.T) {
+	fs, err := ParseKML(strings.NewReader(myMapsKML))
+	if err != nil { t.Fatal(err) }
+	if len(fs) != 2 { t.Fatalf("got %d features", len(fs)) }
+	if fs[0].Properties["name"] != "ЖК 4YOU" || fs[0].Properties["city"] != "Алматы" || fs[0].Properties["priority"] != "2" {
+		t.Fatalf("properties: %v", fs[0].Properties)
+	}
+	if got := fs[0].Geometry[0][0][1]; got != (Position{76.91, 43.223}) { t.Fatalf("altitude not dropped: %v", got) }
+	if fs[1].Properties["is_active"] != "false" || len(fs[1].Geometry) != 2 || len(fs[1].Geometry[0]) != 2 {
+		t.Fatalf("multigeometry: %+v", fs[1])
+	}
+	// My Maps draws clockwise; Rewind makes it valid
+	if Validate(fs[0].Geometry) == nil { t.Fatal("clockwise ring should fail validation") }
+	if err := Validate(Rewind(fs[0].Geometry)); err != nil { t.Fatalf("after rewind: %v", err) }
+	if err := Validate(Rewind(fs[1].Geometry)); err != nil { t.Fatalf("holes after rewind: %v", err) }
+
+	for kml, want := range map[string]string{
+		`<kml><Document></Document></kml>`: "no placemarks",
+		`<kml><Placemark><name>Пункт</name><Point><coordinates>1,2</coordinates></Point></Placemark></kml>`: "no polygon",
+		`<kml><Placemark><Polygon><outerBoundaryIs><LinearRing><coordinates>1;2 3,4</coordinates></LinearRing></outerBoundaryIs></Polygon></Placemark></kml>`: "coordinate 0",
+		`<kml><Placemark>`: "kml",
+	} {
+		if _, err := ParseKML(strings.NewReader(kml)); err == nil || !strings.Contains(err.Error(), want) { t.Errorf("%s: got %v, want %q", kml, err, want) }
+	}
+}
+
+func TestKMLRoundTrip(t *testing.T) {
+	in := []Feature{
+		{ID: "a", Properties: map[string]interface{}{"name": "Сквер", "city": "Алматы", "priority": 1, "is_active": true}, Geometry: MultiPolygon{lake}},
+		{Properties: map[string]interface{}{"name": "Острова"}, Geometry: append(square(20, 20, 1), square(30, 30, 1)...)},
+	}
+	var buf bytes.Buffer
+	if err := EncodeKML(&buf, "test", in); err != nil { t.Fatal(err) }
+	out, err := ParseKML(&buf)
+	if err != nil { t.Fatalf("%v\n%s", err, buf.String()) }
+	if len(out) != 2 || out[0].ID != "a" || out[0].Properties["priority"] != "1" || out[0].Properties["is_active"] != "true" || out[1].Properties["name"] != "Острова" {
+		t.Fatalf("properties lost: %+v", out)
+	}
+	for i := range in {
+		if out[i].Geometry.GeoJSON() != in[i].Geometry.GeoJSON() { t.Fatalf("geometry %d changed: %s", i, out[i].Geometry.GeoJSON()) }
+	}
+}
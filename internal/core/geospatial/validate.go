@@ -0,0 +1,246 @@
+package geospatial
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// GeometryError is one problem found by Validate. Ring 0 is the exterior
+// ring; Ring and Vertex are -1 when the problem is not about one of them.
+type GeometryError struct {
+	Polygon int `json:"polygon"`
+	Ring int `json:"ring"`
+	Vertex int `json:"vertex"`
+	Reason string `json:"reason"`
+}
+
+func (e *GeometryError) Error() string {
+	where := fmt.Sprintf("polygon %d", e.Polygon)
+	switch {
+	case e.Ring == 0: where += ", exterior ring"
+	case e.Ring > 0: where += fmt.Sprintf(", hole %d", e.Ring)
+	}
+	if e.Vertex >= 0 { where += fmt.Sprintf(", position %d", e.Vertex) }
+	return where + ": " + e.Reason
+}
+
+// ValidationError lists every problem Validate found.
+type ValidationError []*GeometryError
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v { msgs[i] = e.Error() }
+	return "invalid geometry: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks mp against RFC 7946 and returns a ValidationError listing
+// the problems, or nil. It rejects:
+//   - empty multipolygons, polygons and rings with fewer than 4 positions;
+//   - rings whose first and last positions differ;
+//   - longitudes outside [-180, 180] and latitudes outside [-90, 90]
+//     (swapped lat/lng usually shows up here);
+//   - zero-area rings, clockwise exterior rings and counter-clockwise holes;
+//   - rings that cross themselves, holes that cross the exterior or each
+//     other, and holes that are not inside the exterior ring or that lie
+//     inside another hole.
+//
+// Rings of one polygon may touch at single points. Overlap between members
+// of a MultiPolygon is not checked. The self-intersection test compares
+// every pair of edges, which is fine for hand-drawn zones.
+func Validate(mp MultiPolygon) error {
+	var errs ValidationError
+	add := func(p, r, v int, format string, args ...interface{}) {
+		errs = append(errs, &GeometryError{Polygon: p, Ring: r, Vertex: v, Reason: fmt.Sprintf(format, args...)})
+	}
+	if len(mp) == 0 { add(0, -1, -1, "geometry has no polygons") }
+	for pi, poly := range mp {
+		if len(poly) == 0 { add(pi, -1, -1, "polygon has no rings"); continue }
+		rings := make([][]Position, len(poly))
+		ok := true
+		for ri, ring := range poly {
+			if r, problem := checkRing(ring); problem != "" {
+				add(pi, ri, -1, "%s", problem)
+				ok = false
+			} else if v := outOfRange(ring); v >= 0 {
+				add(pi, ri, v, "[%g, %g] is out of range: positions are [lng, lat] with lng in [-180, 180] and lat in [-90, 90]", ring[v][0], ring[v][1])
+				ok = false
+			} else {
+				rings[ri] = r
+			}
+		}
+		if !ok { continue }
+
+		// winding is meaningless for a ring that crosses itself
+		for ri, r := range rings {
+			if i, j, bad := selfIntersection(r); bad {
+				add(pi, ri, i, "ring crosses itself: edges starting at positions %d and %d intersect", i, j)
+				ok = false
+				continue
+			}
+			a := signedArea(r)
+			switch {
+			case a == 0:
+				add(pi, ri, -1, "ring has zero area")
+				ok = false
+			case ri == 0 && a < 0:
+				add(pi, ri, -1, "exterior ring is clockwise, RFC 7946 requires counter-clockwise")
+			case ri > 0 && a > 0:
+				add(pi, ri, -1, "hole is counter-clockwise, RFC 7946 requires clockwise")
+			}
+		}
+		if !ok { continue }
+
+		for ri := 0; ri < len(rings); ri++ {
+			for rj := ri + 1; rj < len(rings); rj++ {
+				if i, _, bad := ringsCross(rings[ri], rings[rj]); bad {
+					add(pi, rj, -1, "crosses ring %d at its edge starting at position %d", ri, i)
+				}
+			}
+		}
+		for hi := 1; hi < len(rings); hi++ {
+			for v, pt := range rings[hi] {
+				if locate(pt, rings[0]) == outside {
+					add(pi, hi, v, "hole extends outside the exterior ring")
+					break
+				}
+			}
+			for hj := 1; hj < len(rings); hj++ {
+				if hj != hi && ringInside(rings[hi], rings[hj]) {
+					add(pi, hi, -1, "hole lies inside hole %d", hj)
+					break
+				}
+			}
+		}
+	}
+	if len(errs) == 0 { return nil }
+	return errs
+}
+
+// Rewind returns a copy of mp with exterior rings counter-clockwise and
+// holes clockwise, as Validate requires. Editors such as Google My Maps do
+// not keep to either order, so imports rewind before validating.
+func Rewind(mp MultiPolygon) MultiPolygon {
+	out := make(MultiPolygon, len(mp))
+	for i, p := range mp {
+		out[i] = make(Polygon, len(p))
+		for j, ring := range p {
+			r := append([]Position(nil), ring...)
+			// the closing position adds nothing to the area, so the ring can
+			// be measured as it is
+			if a := signedArea(r); (j == 0 && a < 0) || (j > 0 && a > 0) {
+				for l, h := 0, len(r)-1; l < h; l, h = l+1, h-1 { r[l], r[h] = r[h], r[l] }
+			}
+			out[i][j] = r
+		}
+	}
+	return out
+}
+
+// checkRing reports structural problems of a ring, or returns it without
+// the closing position and repeated consecutive positions.
+func checkRing(ring []Position) ([]Position, string) {
+	if len(ring) < 4 { return nil, fmt.Sprintf("ring has %d positions, need at least 4 (a triangle plus the closing position)", len(ring)) }
+	if ring[0] != ring[len(ring)-1] { return nil, "ring is not closed: the last position must repeat the first" }
+	r := make([]Position, 0, len(ring)-1)
+	for _, pt := range ring[:len(ring)-1] {
+		if len(r) == 0 || r[len(r)-1] != pt { r = append(r, pt) }
+	}
+	if len(r) > 1 && r[len(r)-1] == r[0] { r = r[:len(r)-1] }
+	if len(r) < 3 { return nil, "ring has fewer than 3 distinct positions" }
+	return r, ""
+}
+
+func outOfRange(ring []Position) int {
+	for i, pt := range ring {
+		if math.IsNaN(pt[0]) || math.IsNaN(pt[1]) || pt[0] < -180 || pt[0] > 180 || pt[1] < -90 || pt[1] > 90 { return i }
+	}
+	return -1
+}
+
+// signedArea is the shoelace area of an open ring; positive when the ring
+// runs counter-clockwise.
+func signedArea(r []Position) float64 {
+	a := 0.0
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a += r[j][0]*r[i][1] - r[i][0]*r[j][1]
+	}
+	return a / 2
+}
+
+func edge(r []Position, i int) (Position, Position) { return r[i], r[(i+1)%len(r)] }
+
+// selfIntersection finds two non-adjacent edges of an open ring that share
+// any point.
+func selfIntersection(r []Position) (int, int, bool) {
+	n := len(r)
+	for i := 0; i < n; i++ {
+		a1, a2 := edge(r, i)
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 { continue } // adjacent through the closing edge
+			b1, b2 := edge(r, j)
+			if segmentsTouch(a1, a2, b1, b2) { return i, j, true }
+		}
+	}
+	return 0, 0, false
+}
+
+// ringsCross finds an edge of a that properly crosses or overlaps an edge
+// of b. Touching at a single point is allowed.
+func ringsCross(a, b []Position) (int, int, bool) {
+	for i := range a {
+		a1, a2 := edge(a, i)
+		for j := range b {
+			b1, b2 := edge(b, j)
+			if segmentsCross(a1, a2, b1, b2) { return i, j, true }
+		}
+	}
+	return 0, 0, false
+}
+
+// ringInside reports whether some position of a lies strictly inside b.
+func ringInside(a, b []Position) bool {
+	for _, pt := range a {
+		switch locate(pt, b) {
+		case inside: return true
+		case outside: return false
+		}
+	}
+	return false
+}
+
+func orient(a, b, p Position) int {
+	switch v := cross(a, b, p); {
+	case v > 0: return 1
+	case v < 0: return -1
+	}
+	return 0
+}
+
+func within(p, a, b Position) bool {
+	return p[0] >= math.Min(a[0], b[0]) && p[0] <= math.Max(a[0], b[0]) && p[1] >= math.Min(a[1], b[1]) && p[1] <= math.Max(a[1], b[1])
+}
+
+// segmentsTouch reports whether segments p1p2 and q1q2 share any point.
+func segmentsTouch(p1, p2, q1, q2 Position) bool {
+	o1, o2 := orient(p1, p2, q1), orient(p1, p2, q2)
+	o3, o4 := orient(q1, q2, p1), orient(q1, q2, p2)
+	if o1*o2 < 0 && o3*o4 < 0 { return true }
+	return (o1 == 0 && within(q1, p1, p2)) || (o2 == 0 && within(q2, p1, p2)) ||
+		(o3 == 0 && within(p1, q1, q2)) || (o4 == 0 && within(p2, q1, q2))
+}
+
+// segmentsCross reports a proper crossing of p1p2 and q1q2, or a collinear
+// overlap longer than a point.
+func segmentsCross(p1, p2, q1, q2 Position) bool {
+	o1, o2 := orient(p1, p2, q1), orient(p1, p2, q2)
+	o3, o4 := orient(q1, q2, p1), orient(q1, q2, p2)
+	if o1*o2 < 0 && o3*o4 < 0 { return true }
+	if o1 != 0 || o2 != 0 { return false }
+	// collinear: compare the projections on the longer axis
+	axis := 0
+	if math.Abs(p2[1]-p1[1]) > math.Abs(p2[0]-p1[0]) { axis = 1 }
+	lo := math.Max(math.Min(p1[axis], p2[axis]), math.Min(q1[axis], q2[axis]))
+	hi := math.Min(math.Max(p1[axis], p2[axis]), math.Max(q1[axis], q2[axis]))
+	return hi > lo
+}
@@ -0,0 +1,44 @@
+// Package mail sends transactional e-mail. Every mailer satisfies
+// services.Mailer.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LogMailer writes messages to the log instead of sending them. It is meant
+// for local development only.
+type LogMailer struct{}
+
+func (LogMailer) Send(_ context.Context, to, subject, body string) error {
+	log.Warn().Str("to", to).Str("subject", subject).Str("body", body).Msg("mail (log mailer, not sent)")
+	return nil
+}
+
+// SMTPMailer sends plain-text UTF-8 mail through an SMTP relay using PLAIN
+// auth when a user is set.
+type SMTPMailer struct {
+	Addr string // host:port
+	User string
+	Password string
+	From string
+}
+
+func (m *SMTPMailer) Send(_ context.Context, to, subject, body string) error {
+	var a smtp.Auth
+	if m.User != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		a = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", m.From, to, subject)
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(body)
+	return smtp.SendMail(m.Addr, a, m.From, []string{to}, []byte(b.String()))
+}
@@ -0,0 +1,128 @@
+// Package otp contains the delivery channels for one-time codes and other
+// messages to a phone. Every sender satisfies services.OTPSender and
+// services.TextSender.
+package otp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// LogSender writes codes to the log instead of delivering them. It is meant
+// for local development only.
+type LogSender struct{}
+
+func (LogSender) SendOTP(_ context.Context, phone, code string) error {
+	log.Warn().Str("phone", phone).Str("code", code).Msg("otp (log sender, not delivered)")
+	return nil
+}
+
+func (LogSender) SendText(_ context.Context, phone, text string) error {
+	log.Warn().Str("phone", phone).Str("text", text).Msg("message (log sender, not delivered)")
+	return nil
+}
+
+// WhatsAppSender delivers codes as a WhatsApp authentication template through
+// the 360Dialog Cloud API, and other messages as the NotifyTemplate utility
+// template, whose body is a single parameter.
+type WhatsAppSender struct {
+	APIKey string
+	BaseURL string // e.g. https://waba-v2.360dialog.io
+	Template string
+	NotifyTemplate string
+	Language string
+}
+
+func (s *WhatsAppSender) SendOTP(ctx context.Context, phone, code string) error {
+	return s.send(ctx, phone, s.Template, []interface{}{
+		map[string]interface{}{
+			"type": "body",
+			"parameters": []interface{}{map[string]string{"type": "text", "text": code}},
+		},
+		// authentication templates carry the code again for the copy-code
+		// button
+		map[string]interface{}{
+			"type": "button", "sub_type": "url", "index": "0",
+			"parameters": []interface{}{map[string]string{"type": "text", "text": code}},
+		},
+	})
+}
+
+func (s *WhatsAppSender) SendText(ctx context.Context, phone, text string) error {
+	return s.send(ctx, phone, s.NotifyTemplate, []interface{}{
+		map[string]interface{}{
+			"type": "body",
+			"parameters": []interface{}{map[string]string{"type": "text", "text": text}},
+		},
+	})
+}
+
+func (s *WhatsAppSender) send(ctx context.Context, phone, template string, components []interface{}) error {
+	body := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type": "individual",
+		"to": strings.TrimPrefix(phone, "+"),
+		"type": "template",
+		"template": map[string]interface{}{
+			"name": template,
+			"language": map[string]string{"code": s.Language},
+			"components": components,
+		},
+	}
+	b, err := json.Marshal(body)
+	if err != nil { return err }
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(s.BaseURL, "/")+"/messages", bytes.NewReader(b))
+	if err != nil { return err }
+	req.Header.Set("D360-API-KEY", s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, "360dialog")
+}
+
+// SMSSender delivers codes by SMS through a Mobizon-compatible HTTP gateway.
+type SMSSender struct {
+	APIKey string
+	BaseURL string // e.g. https://api.mobizon.kz
+	From string
+	Text string // message format with a single %s for the code
+}
+
+func (s *SMSSender) SendOTP(ctx context.Context, phone, code string) error {
+	text := s.Text
+	if text == "" { text = "MusorOK: ваш код %s" }
+	return s.SendText(ctx, phone, fmt.Sprintf(text, code))
+}
+
+func (s *SMSSender) SendText(ctx context.Context, phone, text string) error {
+	q := url.Values{}
+	q.Set("apiKey", s.APIKey)
+	q.Set("recipient", strings.TrimPrefix(phone, "+"))
+	q.Set("text", text)
+	if s.From != "" { q.Set("from", s.From) }
+	u := strings.TrimRight(s.BaseURL, "/") + "/service/message/sendsmsmessage"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(q.Encode()))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do(req, "sms")
+}
+
+func do(req *http.Request, provider string) error {
+	resp, err := httpClient.Do(req)
+	if err != nil { return fmt.Errorf("%s: %w", provider, err) }
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: status %d: %s", provider, resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -1,14 +1,24 @@
 package paynetworks
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"time"
 )
 
 type Client struct {
 	APIKey string
+	BaseURL string // e.g. https://api.paynetworks.kz
 	ReturnURL string
+	HTTP *http.Client
 }
 
 type Intent struct {
@@ -17,7 +27,9 @@ type Intent struct {
 	PaymentURL string
 }
 
-func New(apiKey, returnURL string) *Client { return &Client{APIKey: apiKey, ReturnURL: returnURL} }
+func New(apiKey, baseURL, returnURL string) *Client {
+	return &Client{APIKey: apiKey, BaseURL: baseURL, ReturnURL: returnURL, HTTP: &http.Client{Timeout: 15 * time.Second}}
+}
 
 func (c *Client) CreatePaymentIntent(ctx context.Context, amount int, metadata map[string]string) (*Intent, error) {
 	return &Intent{
@@ -27,6 +39,48 @@ func (c *Client) CreatePaymentIntent(ctx context.Context, amount int, metadata m
 	}, nil
 }
 
+// Refund returns amount of the payment of intentID to the payer and gives
+// the provider's refund id. key goes out as the Idempotency-Key header: the
+// provider makes one refund per key and answers a repeated request with the
+// refund it already made, so a call retried after a lost answer never pays
+// out twice.
+func (c *Client) Refund(ctx context.Context, intentID string, amount int, key string) (string, error) {
+	b, err := json.Marshal(map[string]interface{}{"payment_intent_id": intentID, "amount": amount})
+	if err != nil { return "", err }
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.BaseURL, "/")+"/v1/refunds", bytes.NewReader(b))
+	if err != nil { return "", err }
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set("Idempotency-Key", key)
+	req.Header.Set("Content-Type", "application/json")
+	hc := c.HTTP
+	if hc == nil { hc = http.DefaultClient }
+	resp, err := hc.Do(req)
+	if err != nil { return "", fmt.Errorf("paynetworks: refund: %w", err) }
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 { return "", fmt.Errorf("paynetworks: refund: status %d: %s", resp.StatusCode, body) }
+	var out struct{ ID string `json:"id"` }
+	if err := json.Unmarshal(body, &out); err != nil || out.ID == "" {
+		return "", fmt.Errorf("paynetworks: refund: unexpected answer: %s", body)
+	}
+	return out.ID, nil
+}
+
+// Sign is the signature of a webhook payload: the hex HMAC-SHA256 of the
+// raw body keyed with the webhook secret.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks signature against payload. Without a secret
+// no signature is valid, so an unconfigured server accepts no events.
 func VerifyWebhookSignature(secret string, payload []byte, signature string) bool {
-	return true // TODO: real signature verify
+	if secret == "" || signature == "" { return false }
+	got, err := hex.DecodeString(signature)
+	if err != nil { return false }
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(got, mac.Sum(nil))
 }
@@ -0,0 +1,44 @@
+package paynetworks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRefund(t *testing.T) {
+	made := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/refunds" || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Intent string `json:"payment_intent_id"`
+			Amount int `json:"amount"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Intent != "intent_1" || body.Amount != 748 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		k := r.Header.Get("Idempotency-Key")
+		if _, ok := made[k]; !ok { made[k] = "re_" + k }
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": made[k], "status": "succeeded"})
+	}))
+	defer srv.Close()
+	c := New("key", srv.URL+"/", "")
+	ctx := context.Background()
+
+	id, err := c.Refund(ctx, "intent_1", 748, "order-1")
+	if err != nil || id != "re_order-1" { t.Fatalf("refund: %q %v", id, err) }
+	// the same key gives the same refund back
+	again, err := c.Refund(ctx, "intent_1", 748, "order-1")
+	if err != nil || again != id || len(made) != 1 { t.Fatalf("repeated refund: %q %v, made %v", again, err, made) }
+
+	if _, err := c.Refund(ctx, "intent_1", 100, "order-2"); err == nil || !strings.Contains(err.Error(), "status 400") { t.Fatalf("refused refund: %v", err) }
+	c.APIKey = "wrong"
+	if _, err := c.Refund(ctx, "intent_1", 748, "order-3"); err == nil { t.Fatal("wrong key accepted") }
+}
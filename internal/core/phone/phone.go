@@ -0,0 +1,61 @@
+// Package phone normalizes Kazakhstan mobile numbers to E.164.
+package phone
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalid = errors.New("invalid phone number")
+	ErrNotMobile = errors.New("not a Kazakhstan mobile number")
+)
+
+// mobileCodes are the operator codes (the three digits after +7) assigned
+// to Kazakhstan mobile networks. Russian numbers share country code 7 and
+// are rejected by this list.
+var mobileCodes = map[string]bool{
+	"700": true, "701": true, "702": true, "703": true, "704": true, "705": true, "706": true, "707": true, "708": true,
+	"747": true,
+	"750": true, "751": true,
+	"760": true, "761": true, "762": true, "763": true, "764": true,
+	"771": true, "775": true, "776": true, "777": true, "778": true,
+}
+
+// Normalize converts a Kazakhstan mobile number written in any common form
+// to E.164 ("+77070000001"). Accepted inputs include "+7 707 000 00 01",
+// "8 (707) 000-00-01", "77070000001" and the bare "7070000001". Spaces,
+// dashes, dots and parentheses are ignored.
+func Normalize(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	plus := strings.HasPrefix(s, "+")
+	if plus { s = s[1:] }
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalid
+		}
+	}
+	d := b.String()
+	switch {
+	case plus && len(d) == 11 && d[0] == '7':
+		d = d[1:]
+	case !plus && len(d) == 11 && (d[0] == '7' || d[0] == '8'):
+		d = d[1:]
+	case !plus && len(d) == 10:
+	default:
+		return "", ErrInvalid
+	}
+	if !mobileCodes[d[:3]] { return "", ErrNotMobile }
+	return "+7" + d, nil
+}
+
+// IsValid reports whether s is a Kazakhstan mobile number in any accepted form.
+func IsValid(s string) bool {
+	_, err := Normalize(s)
+	return err == nil
+}
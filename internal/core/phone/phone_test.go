@@ -0,0 +1,35 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		in, want string
+		err error
+	}{
+		{"+77070000001", "+77070000001", nil},
+		{"+7 707 000 00 01", "+77070000001", nil},
+		{"87070000001", "+77070000001", nil},
+		{"8 (707) 000-00-01", "+77070000001", nil},
+		{"77070000001", "+77070000001", nil},
+		{"7070000001", "+77070000001", nil},
+		{" +7-747-123-45-67 ", "+77471234567", nil},
+		{"+77064286612", "+77064286612", nil},
+		{"+79161234567", "", ErrNotMobile},   // Moscow mobile
+		{"+77172123456", "", ErrNotMobile},   // Astana landline
+		{"+8 707 000 00 01", "", ErrInvalid}, // trunk prefix after +
+		{"+7707000000", "", ErrInvalid},
+		{"707000000100", "", ErrInvalid},
+		{"+7707abc0001", "", ErrInvalid},
+		{"", "", ErrInvalid},
+	}
+	for _, tc := range cases {
+		got, err := Normalize(tc.in)
+		if !errors.Is(err, tc.err) || got != tc.want {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
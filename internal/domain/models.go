@@ -20,10 +20,56 @@ type User struct {
 	PasswordHash *string
 	Role Role `gorm:"type:role_enum;default:'USER'"`
 	IsDeleted bool `gorm:"default:false"`
+	// Language is the UI and notification language: ru, kk or en.
+	Language string `gorm:"default:'ru'"`
+	MarketingConsent bool `gorm:"default:false"`
+	MarketingConsentAt *time.Time
+	EmailVerifiedAt *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// Session is one refresh token issued to a user. Rows sharing a FamilyID
+// form the rotation chain of a single login; only the newest row of a live
+// family has RevokedAt unset. ReplacedBy points at the row that superseded a
+// rotated token and tells token reuse apart from a plain logout.
+type Session struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID uuid.UUID `gorm:"type:uuid;index"`
+	FamilyID uuid.UUID `gorm:"type:uuid;index"`
+	RefreshTokenHash string `gorm:"uniqueIndex"`
+	UserAgent string
+	IP string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	RevokedAt *time.Time
+	ReplacedBy *uuid.UUID `gorm:"type:uuid"`
+}
+
+// PasswordReset is a single-use token that lets a user set a new password
+// after proving access to their phone (OTP) or e-mail.
+type PasswordReset struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID uuid.UUID `gorm:"type:uuid;index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	Channel string
+	ExpiresAt time.Time
+	UsedAt *time.Time
+	CreatedAt time.Time
+}
+
+// EmailVerification holds an e-mail address a user asked to switch to until
+// they open the single-use link mailed to it.
+type EmailVerification struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID uuid.UUID `gorm:"type:uuid;index"`
+	Email string
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt *time.Time
+	CreatedAt time.Time
+}
+
 type Address struct {
 	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	UserID uuid.UUID `gorm:"type:uuid;index"`
@@ -41,15 +87,60 @@ type Address struct {
 	PolygonID *uuid.UUID `gorm:"type:uuid;index"`
 	PolygonName *string
 	CreatedAt time.Time
+	UpdatedAt time.Time
+	// DeletedAt is set instead of removing addresses that past orders use.
+	DeletedAt *time.Time
 }
 
 type Polygon struct {
 	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	Name string
 	City string
-	GeoJSON string `gorm:"type:jsonb"`
+	GeoJSON string `gorm:"column:geojson;type:jsonb"`
 	IsActive bool `gorm:"default:true"`
+	// Priority picks between overlapping zones; higher wins, ties go to the
+	// smaller zone.
+	Priority int `gorm:"default:0"`
+	// Version is the number of the newest PolygonVersion.
+	Version int `gorm:"default:1"`
 	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PolygonVersion is an immutable snapshot of a polygon, written on every
+// change. ChangedBy is the admin who made it, if known.
+type PolygonVersion struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	PolygonID uuid.UUID `gorm:"type:uuid;index"`
+	Version int
+	Name string
+	City string
+	GeoJSON string `gorm:"column:geojson;type:jsonb"`
+	IsActive bool
+	Priority int
+	ChangedBy *uuid.UUID `gorm:"type:uuid"`
+	CreatedAt time.Time
+}
+
+// WaitlistEntry is a place a user asked for service where no zone covers
+// it yet. ContactConsent allows telling the user once a zone does.
+type WaitlistEntry struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID uuid.UUID `gorm:"type:uuid;index"`
+	Lat float64
+	Lng float64
+	City string
+	Street string
+	House string
+	ContactConsent bool
+	ConsentAt *time.Time
+	// PolygonID and PolygonName are the zone that covered the entry.
+	PolygonID *uuid.UUID `gorm:"type:uuid"`
+	PolygonName *string
+	CoveredAt *time.Time
+	NotifiedAt *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type SubscriptionPlan string
@@ -91,6 +182,8 @@ const (
 	SCHEDULED TimeOption = "SCHEDULED"
 )
 
+func (o TimeOption) Valid() bool { return o == ASAP || o == SCHEDULED }
+
 type OrderStatus string
 const (
 	StatusNew OrderStatus = "NEW"
@@ -113,12 +206,83 @@ type Order struct {
 	Comment string
 	TimeOption TimeOption `gorm:"type:time_option_enum"`
 	ScheduledAt *time.Time
-	CourierID *uuid.UUID `gorm:"type:uuid;index"`
+	CourierID *uuid.UUID `gorm:"type:uuid;index"` // couriers.id, not the courier's user id
 	Status OrderStatus `gorm:"type:order_status_enum;default:'NEW'"`
+	// TariffID and TariffVersion are the tariff the order was priced with;
+	// the courier is paid by it too.
+	TariffID *uuid.UUID `gorm:"type:uuid"`
+	TariffVersion *int
+	// SubscriptionID is the subscription a SUBSCRIPTION order took its bags
+	// from; canceling the order returns them there.
+	SubscriptionID *uuid.UUID `gorm:"type:uuid"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// ActorRole is who changed an order: the customer, the courier, an admin or
+// the system itself, e.g. on a payment.
+type ActorRole string
+const (
+	ActorCustomer ActorRole = "CUSTOMER"
+	ActorCourier ActorRole = "COURIER"
+	ActorAdmin ActorRole = "ADMIN"
+	ActorSystem ActorRole = "SYSTEM"
+)
+
+// OrderEvent is one status change of an order. FromStatus is nil when the
+// order was created. ActorID is the user, or couriers.id for a courier, and
+// nil for the system. Meta is a JSON object of details such as a reason.
+type OrderEvent struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	OrderID uuid.UUID `gorm:"type:uuid;index"`
+	FromStatus *OrderStatus `gorm:"type:order_status_enum"`
+	ToStatus OrderStatus `gorm:"type:order_status_enum"`
+	ActorRole ActorRole
+	ActorID *uuid.UUID `gorm:"type:uuid"`
+	Meta string `gorm:"type:jsonb"`
+	At time.Time
+}
+
+// Tariff is an immutable price list of a zone, or the default one for zones
+// without their own when PolygonID is nil. Versions count per zone. A tariff
+// applies from ValidFrom until ValidTo, if set; among the tariffs valid at a
+// time the zone's newest version wins.
+type Tariff struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	PolygonID *uuid.UUID `gorm:"type:uuid;index"`
+	Version int
+	// BaseKZT is charged once per order on top of the bags.
+	BaseKZT int
+	PerBagKZT int
+	// BagTiers lower the price of every bag from MinBags bags on.
+	BagTiers []BagTier `gorm:"type:jsonb;serializer:json"`
+	// ASAPSurchargeKZT is added to ASAP orders.
+	ASAPSurchargeKZT int `gorm:"column:asap_surcharge_kzt"`
+	// SlotDiscounts take a percentage off orders scheduled inside a slot.
+	SlotDiscounts []SlotDiscount `gorm:"type:jsonb;serializer:json"`
+	// CourierPerBagKZT is what the courier earns per bag collected.
+	CourierPerBagKZT int
+	ValidFrom time.Time
+	ValidTo *time.Time
+	CreatedBy *uuid.UUID `gorm:"type:uuid"`
+	CreatedAt time.Time
+}
+
+// BagTier is the per-bag price of orders of at least MinBags bags. The
+// tags are the keys stored in tariffs.bag_tiers.
+type BagTier struct {
+	MinBags int `json:"min_bags"`
+	PerBagKZT int `json:"per_bag_kzt"`
+}
+
+// SlotDiscount takes Percent off orders scheduled from From up to, but not
+// including, To, both local "HH:MM" times.
+type SlotDiscount struct {
+	From string `json:"from"`
+	To string `json:"to"`
+	Percent int `json:"percent"`
+}
+
 type PaymentProvider string
 const (
 	ProviderPaynetworks PaymentProvider = "PAYNETWORKS"
@@ -143,10 +307,81 @@ type Payment struct {
 	Status PaymentStatus `gorm:"type:payment_status_enum;default:'INIT'"`
 	ProviderIntentID string
 	ProviderPayload string `gorm:"type:jsonb"`
+	// RefundedKZT is what was returned through the provider, under
+	// ProviderRefundID, when the order was canceled.
+	RefundedKZT int
+	ProviderRefundID *string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+type RefundStatus string
+const (
+	RefundPending RefundStatus = "PENDING"
+	RefundSucceeded RefundStatus = "SUCCEEDED"
+	RefundFailed RefundStatus = "FAILED"
+)
+
+// Refund is money of a payment owed back for a canceled order. It is
+// PENDING until the provider made it under IdempotencyKey, and FAILED once
+// the provider failed too many attempts; Attempts and LastError tell how
+// the tries so far went, NextAttemptAt when a pending one is tried again.
+type Refund struct {
+	ID uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	PaymentID uuid.UUID `gorm:"type:uuid;index"`
+	OrderID uuid.UUID `gorm:"type:uuid"`
+	AmountKZT int
+	IdempotencyKey string `gorm:"uniqueIndex"`
+	Status RefundStatus `gorm:"default:'PENDING'"`
+	Attempts int
+	LastError *string
+	NextAttemptAt time.Time `gorm:"default:now()"`
+	ProviderRefundID *string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// VehicleType is how a courier gets around.
+type VehicleType string
+
+const (
+    VehicleFoot    VehicleType = "FOOT"
+    VehicleBicycle VehicleType = "BICYCLE"
+    VehicleScooter VehicleType = "SCOOTER"
+    VehicleCar     VehicleType = "CAR"
+)
+
+// Valid reports whether v is one of the vehicle types above.
+func (v VehicleType) Valid() bool {
+    switch v {
+    case VehicleFoot, VehicleBicycle, VehicleScooter, VehicleCar:
+        return true
+    }
+    return false
+}
+
+// Courier links a user with the COURIER role to the polygon they serve.
+// Order.CourierID and all settlement and payout rows reference Courier.ID,
+// never the user id. WorkStart and WorkEnd are local "HH:MM" times and
+// CapacityBags is how many bags the courier can carry at once.
+type Courier struct {
+    ID           uuid.UUID   `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+    UserID       uuid.UUID   `gorm:"type:uuid;uniqueIndex"`
+    PolygonID    uuid.UUID   `gorm:"type:uuid;index"`
+    IsActive     bool        `gorm:"default:true"`
+    Vehicle      VehicleType `gorm:"type:vehicle_enum;default:'FOOT'"`
+    WorkStart    string      `gorm:"default:'09:00'"`
+    WorkEnd      string      `gorm:"default:'21:00'"`
+    CapacityBags int         `gorm:"default:10"`
+    // LastLat and LastLng are the last position the courier reported, at
+    // LocatedAt.
+    LastLat      *float64
+    LastLng      *float64
+    LocatedAt    *time.Time
+    CreatedAt    time.Time
+    UpdatedAt    time.Time
+}
+
 // Settlement and payout structures
 
 // OrderSettlement records the amount due to a courier when an order is completed.
@@ -156,7 +391,7 @@ type Payment struct {
 type OrderSettlement struct {
     ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
     OrderID   uuid.UUID `gorm:"type:uuid;index"`
-    CourierID uuid.UUID `gorm:"type:uuid;index"`
+    CourierID uuid.UUID `gorm:"type:uuid;index"` // couriers.id
     BagsCount int
     AmountKZT int
     CreatedAt time.Time
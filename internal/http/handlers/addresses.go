@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/rs/zerolog/log"
 	"github.com/musorok/server/internal/domain"
 	"github.com/musorok/server/internal/services"
 	"gorm.io/gorm"
@@ -13,6 +15,7 @@ import (
 type AddressHandler struct{
 	DB *gorm.DB
 	Addrs *services.AddressService
+	Waitlist *services.WaitlistService
 }
 
 func (h *AddressHandler) List(c *gin.Context) {
@@ -23,26 +26,97 @@ func (h *AddressHandler) List(c *gin.Context) {
 	c.JSON(http.StatusOK, items)
 }
 
+// Create saves an address of the caller. An address outside every zone is
+// rejected with 422 and put on the waitlist instead; waitlist_consent lets
+// us tell the caller once a zone covers it. The 422 names the nearest zone.
 func (h *AddressHandler) Create(c *gin.Context) {
 	uid := c.GetString("uid")
 	uuidv, _ := uuid.Parse(uid)
-	var req domain.Address
+	var req struct {
+		domain.Address
+		WaitlistConsent bool `json:"waitlist_consent"`
+	}
 	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
-	req.UserID = uuidv
-	var polys []domain.Polygon
-	if err := h.DB.Where("is_active = true").Find(&polys).Error; err == nil {
-		for _, p := range polys {
-			if geospatial.ContainsPoint(p.GeoJSON, req.Lng, req.Lat) {
-				req.PolygonID = &p.ID; req.PolygonName = &p.Name
-				break
-			}
-		}
+	a := req.Address
+	a.UserID = uuidv
+	err := h.Addrs.Create(c, &a, nil)
+	if errors.Is(err, services.ErrNotServed) { h.unserved(c, &a, req.WaitlistConsent); return }
+	if err != nil { addressError(c, err); return }
+	c.JSON(http.StatusCreated, a)
+}
+
+// Update edits an address of the caller. Moving the pin re-resolves the
+// polygon; a point outside the served area, even when only one coordinate
+// moved, is answered like Create answers it.
+func (h *AddressHandler) Update(c *gin.Context) {
+	var req struct {
+		services.AddressUpdate
+		WaitlistConsent bool `json:"waitlist_consent"`
 	}
-	if req.PolygonID == nil {
-		c.JSON(http.StatusUnprocessableEntity, gin.H{"error":"этот район пока не обслуживается"}); return
+	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
+	uid := c.GetString("uid")
+	a, err := h.Addrs.Update(c, uid, c.Param("id"), req.AddressUpdate)
+	if errors.Is(err, services.ErrNotServed) {
+		// the point refused is the stored address with the update applied
+		moved, err := h.Addrs.Get(c, uid, c.Param("id"))
+		if err != nil { addressError(c, err); return }
+		if req.Lat != nil { moved.Lat = *req.Lat }
+		if req.Lng != nil { moved.Lng = *req.Lng }
+		if req.City != nil { moved.City = *req.City }
+		if req.Street != nil { moved.Street = *req.Street }
+		if req.House != nil { moved.House = *req.House }
+		h.unserved(c, moved, req.WaitlistConsent)
+		return
 	}
-	if err := h.Addrs.Create(c, &req, nil); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	if err != nil { addressError(c, err); return }
+	c.JSON(http.StatusOK, a)
+}
+
+// unserved answers for the address a outside every zone: it goes on the
+// waitlist of its owner, with consent to be told once a zone covers it, and
+// the 422 names the nearest zone.
+func (h *AddressHandler) unserved(c *gin.Context, a *domain.Address, consent bool) {
+	if h.Waitlist == nil { h.notServed(c, a.Lat, a.Lng, gin.H{}); return }
+	e, err := h.Waitlist.Join(c, a.UserID, services.WaitlistRequest{
+		Lat: a.Lat, Lng: a.Lng, City: a.City, Street: a.Street, House: a.House, ContactConsent: consent,
+	})
+	if err != nil { waitlistError(c, err); return }
+	h.notServed(c, a.Lat, a.Lng, gin.H{"waitlist": waitlistJSON(e)})
+}
+
+// Delete removes an address of the caller; addresses of past orders are
+// hidden rather than removed.
+func (h *AddressHandler) Delete(c *gin.Context) {
+	if err := h.Addrs.Delete(c, c.GetString("uid"), c.Param("id")); err != nil { addressError(c, err); return }
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+// SetDefault makes an address of the caller the default one.
+func (h *AddressHandler) SetDefault(c *gin.Context) {
+	a, err := h.Addrs.SetDefault(c, c.GetString("uid"), c.Param("id"))
+	if err != nil { addressError(c, err); return }
+	c.JSON(http.StatusOK, a)
+}
+
+// notServed answers 422 for a point outside every zone with resp plus the
+// nearest active zone and its distance, so the app can say "we serve
+// ЖК 4YOU, 1.2 km away".
+func (h *AddressHandler) notServed(c *gin.Context, lat, lng float64, resp gin.H) {
+	resp["error"] = "этот район пока не обслуживается"
+	resp["nearest"] = nil
+	p, dist, err := h.Addrs.NearestPolygon(c, lat, lng)
+	if err != nil { log.Error().Err(err).Msg("nearest zone") }
+	if p != nil { resp["nearest"] = gin.H{"id": p.ID, "name": p.Name, "city": p.City, "distance_m": int(math.Round(dist))} }
+	c.JSON(http.StatusUnprocessableEntity, resp)
+}
+
+func addressError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAddressNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "address not found"})
+	case errors.Is(err, services.ErrNotServed):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error":"этот район пока не обслуживается"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
-	c.JSON(http.StatusCreated, req)
 }
@@ -0,0 +1,68 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/http/handlers"
+	"github.com/musorok/server/internal/repo/postgres"
+	"github.com/musorok/server/internal/services"
+)
+
+// TestAddressUnservedResponses moves only one coordinate of an address out
+// of its zone, on the database named by TEST_DB_DSN inside a transaction
+// that is rolled back. Update answers like Create does for the same point:
+// 422 with the nearest zone and a waitlist entry.
+func TestAddressUnservedResponses(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" { t.Skip("TEST_DB_DSN not set") }
+	db, err := postgres.Open(dsn)
+	if err != nil { t.Fatal(err) }
+	tx := db.Begin()
+	if tx.Error != nil { t.Fatal(tx.Error) }
+	defer tx.Rollback()
+	ctx := context.Background()
+	zone := domain.Polygon{Name: "test", City: "Алматы", IsActive: true,
+		GeoJSON: `{"type":"Polygon","coordinates":[[[76.910,43.2185],[76.918,43.2185],[76.918,43.223],[76.910,43.223],[76.910,43.2185]]]}`}
+	if err := tx.Create(&zone).Error; err != nil { t.Fatal(err) }
+	u, err := services.NewUserService(tx).Create(ctx, "+77079990120", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	zones := services.NewZoneIndex(tx, time.Minute)
+	addrs := services.NewAddressService(tx, zones)
+	a := domain.Address{UserID: u.ID, City: "Алматы", Street: "Абая", House: "1", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &a, nil); err != nil { t.Fatal(err) }
+
+	gin.SetMode(gin.TestMode)
+	h := &handlers.AddressHandler{DB: tx, Addrs: addrs, Waitlist: services.NewWaitlistService(tx, zones, nil)}
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("uid", u.ID.String()) })
+	r.POST("/v1/addresses", h.Create)
+	r.PATCH("/v1/addresses/:id", h.Update)
+	call := func(method, path, body string) map[string]interface{} {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != http.StatusUnprocessableEntity { t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body) }
+		var resp map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil { t.Fatal(err) }
+		return resp
+	}
+
+	updated := call(http.MethodPatch, "/v1/addresses/"+a.ID.String(), `{"lng":76.95}`)
+	created := call(http.MethodPost, "/v1/addresses", `{"city":"Алматы","street":"Абая","house":"1","lat":43.22,"lng":76.95}`)
+	for _, resp := range []map[string]interface{}{updated, created} {
+		if resp["nearest"] == nil || resp["waitlist"] == nil { t.Fatalf("unserved response: %v", resp) }
+	}
+	if updated["nearest"].(map[string]interface{})["id"] != created["nearest"].(map[string]interface{})["id"] { t.Fatalf("nearest zones differ: %v, %v", updated, created) }
+	if updated["waitlist"].(map[string]interface{})["lat"] != 43.22 { t.Fatalf("waitlisted point: %v", updated["waitlist"]) }
+	if got, err := addrs.Get(ctx, u.ID.String(), a.ID.String()); err != nil || got.Lng != 76.914 { t.Fatalf("address moved: %+v %v", got, err) }
+}
@@ -1,53 +1,165 @@
 package handlers
 
 import (
+    "errors"
+    "math"
     "net/http"
+    "strconv"
     "time"
 
     "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
     "gorm.io/gorm"
+
+    "github.com/musorok/server/internal/domain"
+    "github.com/musorok/server/internal/services"
 )
 
-// AdminHandler provides stub implementations for administrative operations.
-// Administrative endpoints allow management of polygons, couriers and
-// retrieval of system metrics. These handlers currently return
-// Not Implemented responses.
 // AdminHandler implements administrative operations such as managing
 // polygons, couriers, promocodes and metrics. It holds a DB reference for
 // performing queries and writes. For unimplemented methods it returns
 // HTTP 501.
 type AdminHandler struct{
     DB *gorm.DB
+    Users *services.UserService
+    Couriers *services.CourierService
+    Polygons *services.PolygonService
+    Waitlist *services.WaitlistService
+    Spatial services.SpatialRepo
+    Tariffs *services.TariffService
+    Refunds *services.RefundService
 }
 
-// ListPolygons returns a list of polygons configured in the system. In a
-// real implementation this would query the database and return geojson and
-// status flags.
-func (h *AdminHandler) ListPolygons(c *gin.Context) {
-    c.JSON(http.StatusOK, []gin.H{})
-}
-
-// CreatePolygon creates a new polygon with the supplied name, city and
-// geojson. Currently returns 501.
-func (h *AdminHandler) CreatePolygon(c *gin.Context) {
-    c.JSON(http.StatusNotImplemented, gin.H{"error": "create polygon not implemented"})
+// CreateCourier assigns an existing user (user_id) or a new one (name and
+// phone) as a courier for a polygon. The user's role is switched to COURIER.
+func (h *AdminHandler) CreateCourier(c *gin.Context) {
+    var req struct{
+        UserID uuid.UUID `json:"user_id"`
+        Name string `json:"name"`
+        Phone string `json:"phone"`
+        PolygonID uuid.UUID `json:"polygon_id"`
+        Vehicle domain.VehicleType `json:"vehicle"`
+        WorkStart string `json:"work_start"`
+        WorkEnd string `json:"work_end"`
+        CapacityBags *int `json:"capacity_bags"`
+    }
+    if err := c.BindJSON(&req); err != nil || req.PolygonID == uuid.Nil || (req.UserID == uuid.Nil && req.Phone == "") {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "polygon_id and either user_id or phone required"})
+        return
+    }
+    // checked before a new user is created for the courier
+    if req.Vehicle != "" && !req.Vehicle.Valid() { courierError(c, services.ErrInvalidVehicle); return }
+    // an omitted capacity takes the default, an explicit zero is refused
+    capacity := 0
+    if req.CapacityBags != nil {
+        if *req.CapacityBags <= 0 { courierError(c, services.ErrInvalidCapacity); return }
+        capacity = *req.CapacityBags
+    }
+    if req.UserID == uuid.Nil {
+        u, err := h.Users.Create(c, req.Phone, "", req.Name, "", domain.RoleCourier)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        req.UserID = u.ID
+    }
+    courier := domain.Courier{
+        UserID: req.UserID, PolygonID: req.PolygonID, IsActive: true,
+        Vehicle: req.Vehicle, WorkStart: req.WorkStart, WorkEnd: req.WorkEnd, CapacityBags: capacity,
+    }
+    if err := h.Couriers.Create(c, &courier); err != nil {
+        courierError(c, err)
+        return
+    }
+    c.JSON(http.StatusCreated, courier)
 }
 
-// UpdatePolygon updates an existing polygon identified by id. Currently
-// returns 501.
-func (h *AdminHandler) UpdatePolygon(c *gin.Context) {
-    c.JSON(http.StatusNotImplemented, gin.H{"error": "update polygon not implemented"})
+// courierError maps CourierService errors to responses.
+func courierError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, services.ErrInvalidWorkHours), errors.Is(err, services.ErrInvalidVehicle), errors.Is(err, services.ErrInvalidCapacity):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrPolygonNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+    case errors.Is(err, services.ErrCourierExists):
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    }
 }
 
-// CreateCourier creates a new courier user or assigns an existing user as a
-// courier. Currently returns 501.
-func (h *AdminHandler) CreateCourier(c *gin.Context) {
-    c.JSON(http.StatusNotImplemented, gin.H{"error": "create courier not implemented"})
+// UpdateCourier updates a courier's status, polygon assignment, vehicle,
+// work hours or capacity. Only the fields present in the body change.
+func (h *AdminHandler) UpdateCourier(c *gin.Context) {
+    courier, err := h.Couriers.Get(c, c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "courier not found"})
+        return
+    }
+    var req struct{
+        PolygonID *uuid.UUID `json:"polygon_id"`
+        IsActive *bool `json:"is_active"`
+        Vehicle *domain.VehicleType `json:"vehicle"`
+        WorkStart *string `json:"work_start"`
+        WorkEnd *string `json:"work_end"`
+        CapacityBags *int `json:"capacity_bags"`
+    }
+    if err := c.BindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+        return
+    }
+    if req.PolygonID != nil { courier.PolygonID = *req.PolygonID }
+    if req.IsActive != nil { courier.IsActive = *req.IsActive }
+    if req.Vehicle != nil { courier.Vehicle = *req.Vehicle }
+    if req.WorkStart != nil { courier.WorkStart = *req.WorkStart }
+    if req.WorkEnd != nil { courier.WorkEnd = *req.WorkEnd }
+    if req.CapacityBags != nil { courier.CapacityBags = *req.CapacityBags }
+    if err := h.Couriers.Update(c, courier); err != nil {
+        courierError(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, courier)
 }
 
-// UpdateCourier updates a courier's status, polygon assignment or work hours.
-func (h *AdminHandler) UpdateCourier(c *gin.Context) {
-    c.JSON(http.StatusNotImplemented, gin.H{"error": "update courier not implemented"})
+// NearestCouriers lists active couriers by distance from ?lat=&lng= for
+// dispatch. Optional: polygon_id, radius (metres), max_age (e.g. 10m, how
+// old a position may be) and limit.
+func (h *AdminHandler) NearestCouriers(c *gin.Context) {
+    lat, err1 := strconv.ParseFloat(c.Query("lat"), 64)
+    lng, err2 := strconv.ParseFloat(c.Query("lng"), 64)
+    if err1 != nil || err2 != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "lat and lng required"}); return }
+    var q services.CourierQuery
+    if v := c.Query("polygon_id"); v != "" {
+        id, err := uuid.Parse(v)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad polygon_id"}); return }
+        q.PolygonID = &id
+    }
+    var err error
+    if v := c.Query("radius"); v != "" {
+        if q.RadiusM, err = strconv.ParseFloat(v, 64); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "radius must be metres"}); return }
+    }
+    if v := c.Query("max_age"); v != "" {
+        if q.MaxAge, err = time.ParseDuration(v); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "max_age must be a duration like 10m"}); return }
+    }
+    if v := c.Query("limit"); v != "" {
+        if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit > 100 { c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer up to 100"}); return }
+    }
+    found, err := h.Spatial.NearestCouriers(c, lat, lng, q)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    items := make([]gin.H, 0, len(found))
+    for _, f := range found {
+        items = append(items, gin.H{
+            "courier_id": f.Courier.ID,
+            "user_id": f.Courier.UserID,
+            "polygon_id": f.Courier.PolygonID,
+            "vehicle": f.Courier.Vehicle,
+            "lat": f.Courier.LastLat,
+            "lng": f.Courier.LastLng,
+            "located_at": f.Courier.LocatedAt,
+            "distance_m": int(math.Round(f.DistanceM)),
+        })
+    }
+    c.JSON(http.StatusOK, items)
 }
 
 // Metrics returns summary statistics such as orders per polygon and SLA.
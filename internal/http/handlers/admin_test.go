@@ -0,0 +1,32 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/http/handlers"
+)
+
+// TestCreateCourierValidation checks that bad input is refused with 400
+// before a user is created for the courier.
+func TestCreateCourierValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.AdminHandler{}
+	r := gin.New()
+	r.POST("/v1/admin/couriers", h.CreateCourier)
+	for name, body := range map[string]string{
+		"unknown vehicle": `{"phone":"+77070000001","polygon_id":"6f1c0c7e-5b7e-4c8e-9a41-2f0d4b7c9e11","vehicle":"TRUCK"}`,
+		"zero capacity": `{"phone":"+77070000001","polygon_id":"6f1c0c7e-5b7e-4c8e-9a41-2f0d4b7c9e11","capacity_bags":0}`,
+		"negative capacity": `{"phone":"+77070000001","polygon_id":"6f1c0c7e-5b7e-4c8e-9a41-2f0d4b7c9e11","capacity_bags":-3}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/admin/couriers", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest { t.Fatalf("got %d: %s", w.Code, w.Body) }
+		})
+	}
+}
@@ -1,30 +1,26 @@
 package handlers
 
 import (
+    "errors"
     "net/http"
-    "time"
     
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
     "gorm.io/gorm"
     
-    "github.com/musorok/server/internal/core/auth"
     "github.com/musorok/server/internal/domain"
     "github.com/musorok/server/internal/services"
 )
 
 type AuthHandler struct{
 	Users *services.UserService
-	JWTSecret string
-	JWTRefreshSecret string
-	AccessTTL time.Duration
-	RefreshTTL time.Duration
+	Sessions *services.SessionService
+	OTP *services.OTPService
+	Passwords *services.PasswordService
+	Guard *services.LoginGuard
+	Accounts *services.AccountService
+	Profiles *services.ProfileService
     DB *gorm.DB
-    // in-memory storage for OTP codes by phone. In production this would
-    // integrate with WhatsApp API and a persistent cache (Redis). For the
-    // purpose of this demo the codes are stored in memory and reset on
-    // process restart.
-    otpStore map[string]string
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -38,35 +34,104 @@ func (h *AuthHandler) Register(c *gin.Context) {
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req struct{ Login, Password string }
 	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
+	req.Login = services.NormalizeLogin(req.Login)
+	attempt, ok := checkLogin(c, h.Guard, req.Login)
+	if !ok { return }
 	u, err := h.Users.Authenticate(c, req.Login, req.Password)
 	if err != nil { c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"}); return }
-	acc, _ := auth.NewAccessToken(h.JWTSecret, u.ID.String(), string(u.Role), h.AccessTTL)
-	ref, _ := auth.NewAccessToken(h.JWTRefreshSecret, u.ID.String(), string(u.Role), h.RefreshTTL)
-	c.JSON(http.StatusOK, gin.H{"access": acc, "refresh": ref})
+	loginSucceeded(c, attempt)
+	pair, err := h.Sessions.Start(c, u, c.Request.UserAgent(), c.ClientIP())
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	c.JSON(http.StatusOK, pair)
 }
 
-func (h *AuthHandler) Me(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"user": gin.H{"id": c.GetString("uid")},
-		"hasActiveSubscription": false,
-		"remainingBags": 0,
-		"hasSavedAddresses": false,
-	})
+// Refresh rotates a refresh token: the presented token is revoked and a new
+// access/refresh pair is returned. Reusing an already rotated token revokes
+// every token of that login.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req struct{ Refresh string `json:"refresh"` }
+	if err := c.BindJSON(&req); err != nil || req.Refresh == "" { c.JSON(http.StatusBadRequest, gin.H{"error":"refresh required"}); return }
+	pair, err := h.Sessions.Refresh(c, req.Refresh, c.Request.UserAgent(), c.ClientIP())
+	switch {
+	case errors.Is(err, services.ErrRefreshTokenReused):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token reuse detected, please log in again"}); return
+	case errors.Is(err, services.ErrInvalidRefreshToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, pair)
 }
 
-// SendOTP sends a one-time password to the user's phone via WhatsApp. In
-// this demo implementation it simply records a static code in memory.
+// Logout ends the session the access token was issued for. The refresh
+// token of that session stops working and so does the access token.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	sid := c.GetString("sid")
+	if sid == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "token has no session"}); return }
+	if err := h.Sessions.Revoke(c, c.GetString("uid"), sid); err != nil && !errors.Is(err, services.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"logged_out": true})
+}
+
+// LogoutAll ends every session of the user, including the current one.
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	if err := h.Sessions.RevokeAll(c, c.GetString("uid")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"logged_out": true})
+}
+
+// ListSessions lists the devices the user is currently logged in on. The id of
+// each entry can be passed to RevokeSession.
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	rows, err := h.Sessions.List(c, c.GetString("uid"))
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	current := c.GetString("sid")
+	items := make([]gin.H, 0, len(rows))
+	for _, s := range rows {
+		items = append(items, gin.H{
+			"id": s.FamilyID,
+			"user_agent": s.UserAgent,
+			"ip": s.IP,
+			"last_used_at": s.CreatedAt,
+			"expires_at": s.ExpiresAt,
+			"current": s.FamilyID.String() == current,
+		})
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// RevokeSession ends one of the user's sessions, e.g. on a lost phone.
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"}); return }
+	if err := h.Sessions.Revoke(c, c.GetString("uid"), id.String()); err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "session not found"}); return }
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// SendOTP sends a one-time password to the user's phone through the
+// configured OTPSender (WhatsApp, SMS or the dev log). Codes expire, and
+// sends are limited per phone and per client IP.
 func (h *AuthHandler) SendOTP(c *gin.Context) {
     var req struct { Phone string `json:"phone"` }
     if err := c.BindJSON(&req); err != nil || req.Phone == "" {
         c.JSON(http.StatusBadRequest, gin.H{"error": "phone required"})
         return
     }
-    if h.otpStore == nil { h.otpStore = make(map[string]string) }
-    // generate or assign a static OTP. For testing we use 0000
-    code := "0000"
-    h.otpStore[req.Phone] = code
-    // Here you would integrate with 360Dialog/Twilio to send the code via WhatsApp
+    if !normalizePhone(c, &req.Phone) { return }
+    if err := h.OTP.Send(c, req.Phone, c.ClientIP()); err != nil {
+        var throttled *services.ThrottledError
+        if errors.As(err, &throttled) {
+            tooManyRequests(c, throttled.RetryAfter, throttled.Reason)
+            return
+        }
+        c.JSON(http.StatusBadGateway, gin.H{"error": "failed to send code"})
+        return
+    }
     c.JSON(http.StatusOK, gin.H{"sent": true})
 }
 
@@ -78,18 +143,27 @@ func (h *AuthHandler) VerifyOTP(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"error": "phone and code required"})
         return
     }
-    if h.otpStore == nil {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "otp not sent"})
-        return
-    }
-    exp, ok := h.otpStore[req.Phone]
-    if !ok || exp != req.Code {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+    if !normalizePhone(c, &req.Phone) { return }
+    attempt, ok := checkLogin(c, h.Guard, req.Phone)
+    if !ok { return }
+    if err := h.OTP.Verify(c, req.Phone, req.Code); err != nil {
+        if errors.Is(err, services.ErrOTPNotFound) { loginReleased(c, attempt) }
+        switch {
+        case errors.Is(err, services.ErrOTPNotFound):
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "otp not sent or expired"})
+        case errors.Is(err, services.ErrOTPInvalid):
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+        case errors.Is(err, services.ErrOTPTooManyAttempts):
+            c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts, request a new code"})
+        default:
+            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        }
         return
     }
+    loginSucceeded(c, attempt)
     // OTP is valid; find or create user
     var u domain.User
-    if err := h.DB.Where("phone = ?", req.Phone).First(&u).Error; err != nil {
+    if err := h.DB.Where("phone = ? AND is_deleted = false", req.Phone).First(&u).Error; err != nil {
         // create new user with empty name and default role
         newUser, err := h.Users.Create(c, req.Phone, "", "", "", domain.RoleUser)
         if err != nil {
@@ -98,34 +172,47 @@ func (h *AuthHandler) VerifyOTP(c *gin.Context) {
         }
         u = *newUser
     }
-    // generate tokens
-    acc, _ := auth.NewAccessToken(h.JWTSecret, u.ID.String(), string(u.Role), h.AccessTTL)
-    ref, _ := auth.NewAccessToken(h.JWTRefreshSecret, u.ID.String(), string(u.Role), h.RefreshTTL)
-    // delete OTP from store
-    delete(h.otpStore, req.Phone)
-    c.JSON(http.StatusOK, gin.H{"access": acc, "refresh": ref})
+    // start a session and generate tokens
+    pair, err := h.Sessions.Start(c, &u, c.Request.UserAgent(), c.ClientIP())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, pair)
 }
 
-// DeleteAccount removes the authenticated user's account and associated data
-// (addresses, sessions, device tokens and subscriptions) from the database.
+// DeleteAccount closes the authenticated user's account. Personal data is
+// anonymized while orders and payments are kept for accounting; see
+// services.AccountService.Delete.
 func (h *AuthHandler) DeleteAccount(c *gin.Context) {
-    uidStr := c.GetString("uid")
-    id, err := uuid.Parse(uidStr)
+    id, err := uuid.Parse(c.GetString("uid"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+        return
+    }
+    switch err := h.Accounts.Delete(c, id); {
+    case errors.Is(err, services.ErrUserNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+    case errors.Is(err, services.ErrActiveOrders):
+        c.JSON(http.StatusConflict, gin.H{"error": "account has orders in progress; wait until they are done or cancel them"})
+    case err != nil:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusOK, gin.H{"deleted": true})
+    }
+}
+
+// ExportAccount returns everything stored about the authenticated user as a
+// downloadable JSON document, for data access requests.
+func (h *AuthHandler) ExportAccount(c *gin.Context) {
+    id, err := uuid.Parse(c.GetString("uid"))
     if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
         return
     }
-    // delete associated rows using raw table names for entities without Go structs
-    // addresses
-    h.DB.Where("user_id = ?", id).Delete(&domain.Address{})
-    // sessions (table: sessions)
-    h.DB.Exec("DELETE FROM sessions WHERE user_id = ?", id)
-    // device tokens (table: device_tokens)
-    h.DB.Exec("DELETE FROM device_tokens WHERE user_id = ?", id)
-    // subscriptions
-    h.DB.Where("user_id = ?", id).Delete(&domain.Subscription{})
-    // orders could remain for history; optionally mark is_deleted
-    // finally delete user
-    h.DB.Where("id = ?", id).Delete(&domain.User{})
-    c.JSON(http.StatusOK, gin.H{"deleted": true})
+    export, err := h.Accounts.Export(c, id)
+    if errors.Is(err, services.ErrUserNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Header("Content-Disposition", `attachment; filename="musorok-export-`+export.ExportedAt.Format("2006-01-02")+`.json"`)
+    c.IndentedJSON(http.StatusOK, export)
 }
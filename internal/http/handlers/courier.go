@@ -1,14 +1,16 @@
 package handlers
 
 import (
+    "errors"
     "net/http"
-    "time"
 
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
     "gorm.io/gorm"
+    "gorm.io/gorm/clause"
 
     "github.com/musorok/server/internal/domain"
+    "github.com/musorok/server/internal/services"
 )
 
 // CourierHandler defines stub endpoints for courier operations. In a full
@@ -21,12 +23,83 @@ import (
 // perform database operations.
 type CourierHandler struct{
     DB *gorm.DB
+    Users *services.UserService
+    Couriers *services.CourierService
+    Orders *services.OrderStateMachine
+    Sessions *services.SessionService
+    OTP *services.OTPService
+    Guard *services.LoginGuard
 }
 
-// Login authenticates a courier using phone/email and password. A JWT is
-// returned on success. Currently not implemented.
+// Login authenticates a courier either with phone/email and password or
+// with a phone and a code obtained from /v1/auth/send_otp. Only users with
+// the COURIER role and an active couriers row may log in; the issued token
+// carries the courier and polygon ids.
 func (h *CourierHandler) Login(c *gin.Context) {
-    c.JSON(http.StatusNotImplemented, gin.H{"error": "courier login not implemented"})
+    var req struct{ Login, Password, Phone, Code string }
+    if err := c.BindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"})
+        return
+    }
+    var u *domain.User
+    switch {
+    case req.Code != "" && req.Phone != "":
+        if !normalizePhone(c, &req.Phone) { return }
+        attempt, ok := checkLogin(c, h.Guard, req.Phone)
+        if !ok { return }
+        if err := h.OTP.Verify(c, req.Phone, req.Code); err != nil {
+            if errors.Is(err, services.ErrOTPNotFound) { loginReleased(c, attempt) }
+            if errors.Is(err, services.ErrOTPTooManyAttempts) {
+                c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts, request a new code"})
+                return
+            }
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+            return
+        }
+        loginSucceeded(c, attempt)
+        var found domain.User
+        if err := h.DB.Where("phone = ? AND is_deleted = false", req.Phone).First(&found).Error; err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+            return
+        }
+        u = &found
+    case req.Login != "" && req.Password != "":
+        req.Login = services.NormalizeLogin(req.Login)
+        attempt, ok := checkLogin(c, h.Guard, req.Login)
+        if !ok { return }
+        found, err := h.Users.Authenticate(c, req.Login, req.Password)
+        if err != nil {
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+            return
+        }
+        loginSucceeded(c, attempt)
+        u = found
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "login and password, or phone and code required"})
+        return
+    }
+    if u.Role != domain.RoleCourier {
+        c.JSON(http.StatusForbidden, gin.H{"error": "not a courier"})
+        return
+    }
+    courier, err := h.Couriers.ActiveByUserID(c, u.ID)
+    switch {
+    case errors.Is(err, services.ErrNotCourier):
+        c.JSON(http.StatusForbidden, gin.H{"error": "not a courier"})
+        return
+    case errors.Is(err, services.ErrCourierInactive):
+        c.JSON(http.StatusForbidden, gin.H{"error": "courier inactive"})
+        return
+    case err != nil:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    pair, err := h.Sessions.Start(c, u, c.Request.UserAgent(), c.ClientIP())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"access": pair.Access, "refresh": pair.Refresh, "courier_id": courier.ID, "polygon_id": courier.PolygonID})
 }
 
 // Me returns information about the logged in courier, such as assigned polygon
@@ -41,167 +114,83 @@ func (h *CourierHandler) ListOrders(c *gin.Context) {
     c.JSON(http.StatusOK, []gin.H{})
 }
 
-// AcceptOrder allows the courier to accept an order by id. In a real
-// implementation the order would be reserved for the courier.
-func (h *CourierHandler) AcceptOrder(c *gin.Context) {
-    // identify courier
-    courierID := c.GetString("uid")
-    id := c.Param("id")
-    if id == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "order id required"})
-        return
-    }
-    // fetch order
-    var order domain.Order
-    if err := h.DB.First(&order, "id = ?", id).Error; err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
-        return
-    }
-    // ensure order is in a state that can be accepted
-    if order.Status != domain.StatusNew && order.Status != domain.StatusPaid {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "order cannot be accepted in its current status"})
-        return
-    }
-    // check that order has no courier yet
-    if order.CourierID != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "order already assigned"})
-        return
-    }
-    // ensure courier belongs to same polygon as the order
-    // fetch courier from couriers table
-    var courier struct{
-        ID uuid.UUID
-        PolygonID uuid.UUID
-        IsActive bool
-    }
-    if err := h.DB.Raw("SELECT id, polygon_id, is_active FROM couriers WHERE user_id = ?", courierID).Scan(&courier).Error; err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "courier not found"})
-        return
-    }
-    if !courier.IsActive {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "courier inactive"})
-        return
+// UpdateLocation records the courier's position, which the app reports
+// while on shift so dispatch can find the nearest courier.
+func (h *CourierHandler) UpdateLocation(c *gin.Context) {
+    var req struct{
+        Lat *float64 `json:"lat"`
+        Lng *float64 `json:"lng"`
     }
-    if courier.PolygonID != order.PolygonID {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "order outside of courier polygon"})
+    if err := c.BindJSON(&req); err != nil || req.Lat == nil || req.Lng == nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "lat and lng required"})
         return
     }
-    // assign order
-    cid := uuid.MustParse(courierID)
-    order.CourierID = &cid
-    order.Status = domain.StatusAssigned
-    if err := h.DB.Save(&order).Error; err != nil {
+    cid, _ := uuid.Parse(c.GetString("cid"))
+    if err := h.Couriers.UpdateLocation(c, cid, *req.Lat, *req.Lng); err != nil {
+        if errors.Is(err, services.ErrBadCoordinates) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
     }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// AcceptOrder assigns a paid order of the courier's polygon to the courier.
+// Of two couriers accepting the same order only the first succeeds; the
+// other gets 409.
+func (h *CourierHandler) AcceptOrder(c *gin.Context) {
+    // couriers.id and zone from the token, not the user id
+    order, err := h.Orders.Transition(c, c.Param("id"), domain.StatusAssigned, courierActor(c), nil)
+    if err != nil { orderError(c, err); return }
     c.JSON(http.StatusOK, order)
 }
 
-// UpdateOrderStatus allows the courier to update the status of an order. The
-// request would specify the next status (e.g. PICKING_UP, DONE) and optional
-// metadata. Currently not implemented.
+// UpdateOrderStatus moves an order assigned to the courier on, to
+// PICKING_UP, DONE or CANCELED. meta, e.g. a cancellation reason, is kept
+// in the order's timeline. Completing an order settles the courier's pay;
+// canceling it returns the customer's bags or money in full.
 func (h *CourierHandler) UpdateOrderStatus(c *gin.Context) {
-    courierID := c.GetString("uid")
-    id := c.Param("id")
-    if id == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "order id required"})
-        return
-    }
     var req struct{
-        ToStatus string `json:"to_status"`
+        ToStatus domain.OrderStatus `json:"to_status"`
         Meta map[string]interface{} `json:"meta"`
     }
     if err := c.BindJSON(&req); err != nil || req.ToStatus == "" {
         c.JSON(http.StatusBadRequest, gin.H{"error": "to_status required"})
         return
     }
-    // fetch order
-    var order domain.Order
-    if err := h.DB.First(&order, "id = ?", id).Error; err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
-        return
-    }
-    // verify courier is assigned to this order
-    if order.CourierID == nil || order.CourierID.String() != courierID {
-        c.JSON(http.StatusForbidden, gin.H{"error": "not assigned to courier"})
-        return
-    }
-    // allowed transitions
-    var newStatus domain.OrderStatus
-    switch req.ToStatus {
-    case string(domain.StatusPickingUp):
-        // only from ASSIGNED
-        if order.Status != domain.StatusAssigned {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "cannot pick up order in current status"})
-            return
-        }
-        newStatus = domain.StatusPickingUp
-    case string(domain.StatusDone):
-        // only from PICKING_UP
-        if order.Status != domain.StatusPickingUp {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "cannot complete order in current status"})
-            return
-        }
-        newStatus = domain.StatusDone
-    case string(domain.StatusCanceled):
-        // allow cancel from ASSIGNED or PICKING_UP
-        if order.Status != domain.StatusAssigned && order.Status != domain.StatusPickingUp {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "cannot cancel order in current status"})
-            return
-        }
-        newStatus = domain.StatusCanceled
-    default:
-        c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status transition"})
-        return
-    }
-    // update status
-    order.Status = newStatus
-    if err := h.DB.Save(&order).Error; err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-    // if completed, create settlement and update courier balance
-    if newStatus == domain.StatusDone {
-        // compute settlement amount: per bag fixed rate (example 200 KZT per bag)
-        amount := order.BagsCount * 200
-        // create settlement record if not exists
-        settlement := domain.OrderSettlement{
-            OrderID: order.ID,
-            CourierID: *order.CourierID,
-            BagsCount: order.BagsCount,
-            AmountKZT: amount,
-        }
-        if err := h.DB.Create(&settlement).Error; err == nil {
-            // update courier balance
-            var bal domain.CourierBalance
-            if err := h.DB.First(&bal, "courier_id = ?", order.CourierID).Error; err == nil {
-                bal.TotalEarnedKZT += int64(amount)
-                bal.UpdatedAt = time.Now()
-                h.DB.Save(&bal)
-            }
-        }
-    }
+    order, err := h.Orders.Transition(c, c.Param("id"), req.ToStatus, courierActor(c), req.Meta)
+    if err != nil { orderError(c, err); return }
     c.JSON(http.StatusOK, order)
 }
 
+// courierActor is the courier of the request by the cid and pid claims,
+// which RequireCourierClaims has checked.
+func courierActor(c *gin.Context) services.Actor {
+    cid, _ := uuid.Parse(c.GetString("cid"))
+    pid, _ := uuid.Parse(c.GetString("pid"))
+    return services.CourierActor(cid, pid)
+}
+
 // Balance returns the courier's current available balance and aggregated
 // earnings/withdrawals. If the courier does not yet have a balance row it
 // will be created with zeros. The returned JSON includes totalEarned,
 // totalWithdrawn and available (earned minus withdrawn).
 func (h *CourierHandler) Balance(c *gin.Context) {
-    courierID := c.GetString("uid")
-    // ensure courier exists
+    courierID := c.GetString("cid")
     var bal domain.CourierBalance
-    // create row if missing
-    tx := h.DB.First(&bal, "courier_id = ?", courierID)
-    if tx.Error != nil {
-        // no existing balance, create with zero values
-        cid := uuid.MustParse(courierID)
-        bal = domain.CourierBalance{CourierID: cid, TotalEarnedKZT: 0, TotalWithdrawnKZT: 0}
-        if err := h.DB.Create(&bal).Error; err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
-        }
+    err := h.DB.First(&bal, "courier_id = ?", courierID).Error
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        // no existing balance, create with zero values; a settlement may
+        // have created it in the meantime
+        bal = domain.CourierBalance{CourierID: uuid.MustParse(courierID)}
+        err = h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&bal).Error
+        if err == nil { err = h.DB.First(&bal, "courier_id = ?", courierID).Error }
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
     }
     available := bal.TotalEarnedKZT - bal.TotalWithdrawnKZT
     c.JSON(http.StatusOK, gin.H{
@@ -216,7 +205,7 @@ func (h *CourierHandler) Balance(c *gin.Context) {
 // A payout request row is created with status REQUESTED. The balance is not
 // immediately decreased; funds are deducted when the payout is processed.
 func (h *CourierHandler) Withdraw(c *gin.Context) {
-    courierID := c.GetString("uid")
+    courierID := c.GetString("cid")
     var req struct{ Amount int `json:"amount"` }
     if err := c.BindJSON(&req); err != nil || req.Amount <= 0 {
         c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be > 0"})
@@ -1,62 +1,98 @@
 package handlers
 
 import (
+    "errors"
     "net/http"
-    "time"
     "strconv"
     
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
     "gorm.io/gorm"
     
-    "github.com/musorok/server/internal/domain"
     "github.com/musorok/server/internal/core/payments/paynetworks"
+    "github.com/musorok/server/internal/services"
 )
 
 type OrdersHandler struct{
 	DB *gorm.DB
 	Pay *paynetworks.Client
+	Orders *services.OrderService
+	Payments *services.PaymentService
 }
 
+// Quote prices an order without placing it. It takes the body of Create;
+// time_option and scheduled_at decide surcharges and slot discounts.
 func (h *OrdersHandler) Quote(c *gin.Context) {
-	var req struct{ AddressID string `json:"address_id"`; BagsCount int `json:"bags_count"` }
+	var req services.OrderRequest
 	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
-	if req.BagsCount <= 0 { c.JSON(http.StatusBadRequest, gin.H{"error":"bags_count must be > 0"}); return }
-	var addr domain.Address
-	if err := h.DB.First(&addr, "id = ?", req.AddressID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error":"address not found"}); return }
-	canServe := addr.PolygonID != nil
-	price := 249 * req.BagsCount
-	c.JSON(http.StatusOK, gin.H{"price_kzt": price, "can_serve": canServe, "polygon_name": addr.PolygonName})
+	q, err := h.Orders.Quote(c, c.GetString("uid"), req)
+	if err != nil { orderError(c, err); return }
+	c.JSON(http.StatusOK, q)
 }
 
 func (h *OrdersHandler) Create(c *gin.Context) {
-	uid := c.GetString("uid")
-	var req struct{
-		AddressID string `json:"address_id"`
-		BagsCount int `json:"bags_count"`
-		TimeOption domain.TimeOption `json:"time_option"`
-		ScheduledAt *time.Time `json:"scheduled_at"`
-		Comment string `json:"comment"`
-		Promocode string `json:"promocode"`
-	}
+	var req services.OrderRequest
 	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
-	if req.BagsCount <= 0 { c.JSON(http.StatusBadRequest, gin.H{"error":"bags_count must be > 0"}); return }
-	var addr domain.Address
-	if err := h.DB.First(&addr, "id = ?", req.AddressID).Error; err != nil { c.JSON(http.StatusNotFound, gin.H{"error":"address not found"}); return }
-	if addr.PolygonID == nil { c.JSON(http.StatusUnprocessableEntity, gin.H{"error":"этот район пока не обслуживается"}); return }
+	order, err := h.Orders.Create(c, c.GetString("uid"), req)
+	if err != nil { orderError(c, err); return }
+
+	intent, _ := h.Pay.CreatePaymentIntent(c, order.PriceKZT, map[string]string{"order_id": order.ID.String()})
+	if _, err := h.Payments.Record(c, order.UserID, &order.ID, nil, intent.ID, order.PriceKZT); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	c.JSON(http.StatusCreated, gin.H{"order": order, "payment": gin.H{"id": intent.ID, "paymentUrl": intent.PaymentURL}})
+}
 
-	price := 249 * req.BagsCount
-	uuidv, _ := uuid.Parse(uid)
-	order := domain.Order{
-		UserID: uuidv, AddressID: addr.ID, PolygonID: *addr.PolygonID,
-		Type: domain.OrderOneTime, BagsCount: req.BagsCount, PriceKZT: price,
-		Comment: req.Comment, TimeOption: req.TimeOption, ScheduledAt: req.ScheduledAt,
-		Status: domain.StatusNew,
+// Timeline returns the status changes of one of the caller's orders,
+// oldest first.
+func (h *OrdersHandler) Timeline(c *gin.Context) {
+	events, err := h.Orders.Timeline(c, c.GetString("uid"), c.Param("id"))
+	if err != nil { orderError(c, err); return }
+	items := make([]gin.H, 0, len(events))
+	for _, e := range events {
+		items = append(items, gin.H{
+			"from_status": e.FromStatus,
+			"to_status": e.ToStatus,
+			"actor": e.ActorRole,
+			"meta": rawJSON(e.Meta),
+			"at": e.At,
+		})
 	}
-	if err := h.DB.Create(&order).Error; err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	c.JSON(http.StatusOK, items)
+}
 
-	intent, _ := h.Pay.CreatePaymentIntent(c, price, map[string]string{"order_id": order.ID.String()})
-	c.JSON(http.StatusCreated, gin.H{"order": order, "payment": gin.H{"id": intent.ID, "paymentUrl": intent.PaymentURL}})
+// Cancel cancels one of the caller's orders: free until a courier accepts
+// it, for a fee after that, and not at all once it is being picked up. The
+// body with a reason is optional.
+func (h *OrdersHandler) Cancel(c *gin.Context) {
+	var req struct{ Reason string `json:"reason"` }
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
+	}
+	res, err := h.Orders.Cancel(c, c.GetString("uid"), c.Param("id"), req.Reason)
+	if err != nil { orderError(c, err); return }
+	c.JSON(http.StatusOK, res)
+}
+
+// orderError maps the errors of the order and subscription services and of
+// the order state machine.
+func orderError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidBags), errors.Is(err, services.ErrInvalidTimeOption),
+		errors.Is(err, services.ErrScheduleRequired), errors.Is(err, services.ErrScheduleInPast), errors.Is(err, services.ErrInvalidPlan),
+		errors.Is(err, services.ErrNoActiveSubscription), errors.Is(err, services.ErrNotEnoughBags):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderNotFound), errors.Is(err, services.ErrSubscriptionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNoTariff):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderTransition), errors.Is(err, services.ErrOrderTaken), errors.Is(err, services.ErrOrderSubscriptionUnknown):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrOrderOutsideZone):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		addressError(c, err)
+	}
 }
 
 // History returns a paginated list of the authenticated user's past orders.
@@ -74,13 +110,11 @@ func (h *OrdersHandler) History(c *gin.Context) {
     limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
     if limit <= 0 { limit = 20 }
     sort := c.DefaultQuery("sort", "desc")
-    orderStr := "created_at desc"
-    if sort == "asc" { orderStr = "created_at asc" }
-    offset := (page - 1) * limit
-    var orders []domain.Order
-    var total int64
-    h.DB.Model(&domain.Order{}).Where("user_id = ?", uID).Count(&total)
-    h.DB.Where("user_id = ?", uID).Order(orderStr).Offset(offset).Limit(limit).Find(&orders)
+    orders, total, err := h.Orders.History(c, uID, page, limit, sort == "asc")
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
     c.JSON(http.StatusOK, gin.H{
         "orders": orders,
         "total_count": total,
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/services"
+)
+
+// ChangePassword sets a new password for the authenticated user. The
+// current password is required unless the account never had one (OTP
+// signup). Other sessions are logged out.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+	err := h.Passwords.Change(c, c.GetString("uid"), req.CurrentPassword, req.NewPassword, c.GetString("sid"))
+	switch {
+	case errors.Is(err, services.ErrWeakPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+	case errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": true})
+}
+
+// ForgotPassword starts password recovery for a phone or e-mail. The
+// response is the same whether or not an account exists.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req struct{ Login string `json:"login"` }
+	if err := c.BindJSON(&req); err != nil || req.Login == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "login required"}); return }
+	if err := h.Passwords.Forgot(c, req.Login, c.ClientIP()); err != nil {
+		var throttled *services.ThrottledError
+		if errors.As(err, &throttled) { tooManyRequests(c, throttled.RetryAfter, throttled.Reason); return }
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to send recovery message"}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": true})
+}
+
+// VerifyResetOTP exchanges the recovery code sent to a phone for a
+// single-use reset token.
+func (h *AuthHandler) VerifyResetOTP(c *gin.Context) {
+	var req struct { Phone string `json:"phone"`; Code string `json:"code"` }
+	if err := c.BindJSON(&req); err != nil || req.Phone == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone and code required"}); return
+	}
+	if !normalizePhone(c, &req.Phone) { return }
+	attempt, ok := checkLogin(c, h.Guard, req.Phone)
+	if !ok { return }
+	token, err := h.Passwords.VerifyOTP(c, req.Phone, req.Code)
+	if !errors.Is(err, services.ErrOTPInvalid) && !errors.Is(err, services.ErrOTPTooManyAttempts) { loginReleased(c, attempt) }
+	switch {
+	case errors.Is(err, services.ErrOTPTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts, request a new code"}); return
+	case errors.Is(err, services.ErrOTPNotFound), errors.Is(err, services.ErrOTPInvalid), errors.Is(err, services.ErrInvalidResetToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"reset_token": token})
+}
+
+// ResetPassword redeems a reset token (from VerifyResetOTP or the e-mailed
+// link) and sets a new password. All sessions of the user are revoked.
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req struct {
+		ResetToken string `json:"reset_token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.ResetToken == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "reset_token required"}); return }
+	err := h.Passwords.Reset(c, req.ResetToken, req.NewPassword)
+	switch {
+	case errors.Is(err, services.ErrWeakPassword):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+	case errors.Is(err, services.ErrInvalidResetToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"reset": true})
+}
@@ -1,12 +1,50 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+
 	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/core/payments/paynetworks"
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/services"
 )
 
-type PaymentsHandler struct{}
+type PaymentsHandler struct{
+	Payments *services.PaymentService
+	WebhookSecret string
+}
 
+// Webhook applies a payment event of the provider, signed in the
+// X-Signature header with paynetworks.Sign:
+// {"intent_id": "...", "status": "SUCCEEDED", "amount": 748}. A
+// succeeded payment of an order moves the order to PAID. Replays are
+// answered 200 and change nothing.
 func (h *PaymentsHandler) Webhook(c *gin.Context) {
-	c.Status(http.StatusOK) // TODO: verify signature + update payments/orders
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad body"}); return }
+	if !paynetworks.VerifyWebhookSignature(h.WebhookSecret, body, c.GetHeader("X-Signature")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error":"bad signature"}); return
+	}
+	var ev struct{
+		IntentID string `json:"intent_id"`
+		Status domain.PaymentStatus `json:"status"`
+		Amount int `json:"amount"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil || ev.IntentID == "" { c.JSON(http.StatusBadRequest, gin.H{"error":"intent_id and status required"}); return }
+	if _, err := h.Payments.Apply(c, ev.IntentID, ev.Status, ev.Amount, body); err != nil {
+		switch {
+		case errors.Is(err, services.ErrPaymentNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrPaymentStatus), errors.Is(err, services.ErrPaymentAmount):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.Status(http.StatusOK)
 }
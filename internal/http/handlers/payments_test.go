@@ -0,0 +1,45 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/core/payments/paynetworks"
+	"github.com/musorok/server/internal/http/handlers"
+	"github.com/musorok/server/internal/services"
+)
+
+// TestWebhookSignature checks that only events signed with the webhook
+// secret reach the payment service. The signed event carries an unknown
+// status, so it is refused by the service without a database.
+func TestWebhookSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = "webhook-secret"
+	body := `{"intent_id":"intent_1","status":"PAID_FOR_FREE","amount":748}`
+	cases := []struct {
+		name, secret, signature string
+		want int
+	}{
+		{"missing signature", secret, "", http.StatusUnauthorized},
+		{"bad signature", secret, paynetworks.Sign("other-secret", []byte(body)), http.StatusUnauthorized},
+		{"not hex", secret, "zz", http.StatusUnauthorized},
+		{"no secret configured", "", paynetworks.Sign("", []byte(body)), http.StatusUnauthorized},
+		{"valid signature", secret, paynetworks.Sign(secret, []byte(body)), http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &handlers.PaymentsHandler{Payments: services.NewPaymentService(nil, nil), WebhookSecret: tc.secret}
+			r := gin.New()
+			r.POST("/v1/payments/webhook", h.Webhook)
+			req := httptest.NewRequest(http.MethodPost, "/v1/payments/webhook", strings.NewReader(body))
+			if tc.signature != "" { req.Header.Set("X-Signature", tc.signature) }
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tc.want { t.Fatalf("got %d, want %d: %s", w.Code, tc.want, w.Body) }
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+
+    "github.com/musorok/server/internal/core/geospatial"
+    "github.com/musorok/server/internal/domain"
+    "github.com/musorok/server/internal/services"
+)
+
+// polygonRequest is the body of CreatePolygon and UpdatePolygon. geojson
+// may be a Polygon, MultiPolygon, Feature or FeatureCollection; the
+// polygons of all features form one zone.
+type polygonRequest struct {
+    Name *string `json:"name"`
+    City *string `json:"city"`
+    Priority *int `json:"priority"`
+    IsActive *bool `json:"is_active"`
+    GeoJSON json.RawMessage `json:"geojson"`
+}
+
+// ListPolygons returns the service zones with their geometry. ?active=true
+// or ?active=false filters by status.
+func (h *AdminHandler) ListPolygons(c *gin.Context) {
+    var active *bool
+    if v := c.Query("active"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"}); return }
+        active = &b
+    }
+    polys, err := h.Polygons.List(c, active)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    items := make([]gin.H, 0, len(polys))
+    for i := range polys { items = append(items, polygonJSON(&polys[i])) }
+    c.JSON(http.StatusOK, items)
+}
+
+// GetPolygon returns one zone.
+func (h *AdminHandler) GetPolygon(c *gin.Context) {
+    p, err := h.Polygons.Get(c, c.Param("id"))
+    if err != nil { polygonError(c, err); return }
+    c.JSON(http.StatusOK, polygonJSON(p))
+}
+
+// CreatePolygon creates a zone. name and city default to the properties of
+// the first feature when the geojson is a Feature or FeatureCollection.
+// The response tells how many saved addresses entered coverage.
+func (h *AdminHandler) CreatePolygon(c *gin.Context) {
+    var req polygonRequest
+    if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+    mp, props, ok := zoneGeometry(c, req.GeoJSON)
+    if !ok { return }
+    if req.Name == nil { req.Name = stringProp(props, "name") }
+    if req.City == nil { req.City = stringProp(props, "city") }
+    p, change, err := h.Polygons.Create(c, actorID(c), services.PolygonInput{
+        Name: req.Name, City: req.City, Geometry: mp, Priority: req.Priority, IsActive: req.IsActive,
+    })
+    if err != nil { polygonError(c, err); return }
+    c.JSON(http.StatusCreated, gin.H{"polygon": polygonJSON(p), "coverage": change})
+}
+
+// UpdatePolygon changes a zone as a new version. Omitted fields are kept.
+// The response tells how many saved addresses entered or left coverage or
+// moved to another zone.
+func (h *AdminHandler) UpdatePolygon(c *gin.Context) {
+    var req polygonRequest
+    if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+    in := services.PolygonInput{Name: req.Name, City: req.City, Priority: req.Priority, IsActive: req.IsActive}
+    if len(req.GeoJSON) > 0 {
+        mp, _, ok := zoneGeometry(c, req.GeoJSON)
+        if !ok { return }
+        in.Geometry = mp
+    }
+    p, change, err := h.Polygons.Update(c, actorID(c), c.Param("id"), in)
+    if err != nil { polygonError(c, err); return }
+    c.JSON(http.StatusOK, gin.H{"polygon": polygonJSON(p), "coverage": change})
+}
+
+// ActivatePolygon puts a zone into service.
+func (h *AdminHandler) ActivatePolygon(c *gin.Context) { h.setPolygonActive(c, true) }
+
+// DeactivatePolygon takes a zone out of service. Its addresses move to an
+// overlapping zone or become unserved.
+func (h *AdminHandler) DeactivatePolygon(c *gin.Context) { h.setPolygonActive(c, false) }
+
+func (h *AdminHandler) setPolygonActive(c *gin.Context, active bool) {
+    p, change, err := h.Polygons.SetActive(c, actorID(c), c.Param("id"), active)
+    if err != nil { polygonError(c, err); return }
+    c.JSON(http.StatusOK, gin.H{"polygon": polygonJSON(p), "coverage": change})
+}
+
+// PolygonVersions returns the history of a zone, newest first.
+func (h *AdminHandler) PolygonVersions(c *gin.Context) {
+    versions, err := h.Polygons.Versions(c, c.Param("id"))
+    if err != nil { polygonError(c, err); return }
+    items := make([]gin.H, 0, len(versions))
+    for _, v := range versions {
+        items = append(items, gin.H{
+            "version": v.Version,
+            "name": v.Name,
+            "city": v.City,
+            "priority": v.Priority,
+            "is_active": v.IsActive,
+            "geojson": rawJSON(v.GeoJSON),
+            "changed_by": v.ChangedBy,
+            "created_at": v.CreatedAt,
+        })
+    }
+    c.JSON(http.StatusOK, items)
+}
+
+// ValidatePolygon checks zone GeoJSON without saving it, so a zone drawn in
+// an editor can be fixed before upload.
+func (h *AdminHandler) ValidatePolygon(c *gin.Context) {
+    raw, err := c.GetRawData()
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad body"}); return }
+    mp, _, ok := zoneGeometry(c, raw)
+    if !ok { return }
+    c.JSON(http.StatusOK, gin.H{"valid": true, "polygons": len(mp)})
+}
+
+// zoneGeometry parses raw GeoJSON into one validated MultiPolygon and the
+// properties of its first feature. It answers 400 when the input is not
+// areal GeoJSON and 422 with every problem geospatial.Validate found.
+func zoneGeometry(c *gin.Context, raw json.RawMessage) (geospatial.MultiPolygon, map[string]interface{}, bool) {
+    if len(raw) == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "geojson required"}); return nil, nil, false }
+    features, err := geospatial.ParseFeatures(string(raw))
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return nil, nil, false }
+    var mp geospatial.MultiPolygon
+    for _, f := range features { mp = append(mp, f.Geometry...) }
+    if err := geospatial.Validate(mp); err != nil {
+        var verr geospatial.ValidationError
+        errors.As(err, &verr)
+        c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid geometry", "problems": verr})
+        return nil, nil, false
+    }
+    return mp, features[0].Properties, true
+}
+
+func polygonError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, services.ErrPolygonNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+    case errors.Is(err, services.ErrPolygonName):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    }
+}
+
+func polygonJSON(p *domain.Polygon) gin.H {
+    return gin.H{
+        "id": p.ID,
+        "name": p.Name,
+        "city": p.City,
+        "priority": p.Priority,
+        "is_active": p.IsActive,
+        "version": p.Version,
+        "geojson": rawJSON(p.GeoJSON),
+        "created_at": p.CreatedAt,
+        "updated_at": p.UpdatedAt,
+    }
+}
+
+// rawJSON embeds a stored jsonb document as is instead of as a string.
+func rawJSON(s string) json.RawMessage {
+    if s == "" { return json.RawMessage("null") }
+    return json.RawMessage(s)
+}
+
+func stringProp(props map[string]interface{}, key string) *string {
+    if s, ok := props[key].(string); ok { return &s }
+    return nil
+}
+
+// actorID is the authenticated admin, or uuid.Nil.
+func actorID(c *gin.Context) uuid.UUID {
+    id, _ := uuid.Parse(c.GetString("uid"))
+    return id
+}
+
+// ImportPolygons creates and updates zones from a GeoJSON FeatureCollection
+// or a KML file sent as the request body. The format comes from ?format=
+// (geojson or kml), else from the Content-Type, else from the first byte.
+// Like the zones CLI it only returns the diff unless ?apply=true is given.
+// ?deactivate_missing=true switches off active zones that are not in the
+// file, and ?city= names the city of features without a city property.
+func (h *AdminHandler) ImportPolygons(c *gin.Context) {
+    apply, ok := boolQuery(c, "apply")
+    if !ok { return }
+    deactivate, ok := boolQuery(c, "deactivate_missing")
+    if !ok { return }
+    raw, err := c.GetRawData()
+    if err != nil || len(bytes.TrimSpace(raw)) == 0 { c.JSON(http.StatusBadRequest, gin.H{"error": "file required"}); return }
+    var features []geospatial.Feature
+    switch importFormat(c, raw) {
+    case "kml":
+        features, err = geospatial.ParseKML(bytes.NewReader(raw))
+    default:
+        features, err = geospatial.ParseFeatures(string(raw))
+    }
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return }
+    zones, err := services.ZonesFromFeatures(features, c.Query("city"))
+    if err != nil {
+        // problems is only set when a geometry failed validation
+        var verr geospatial.ValidationError
+        errors.As(err, &verr)
+        c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "problems": verr}); return
+    }
+    res, err := h.Polygons.Import(c, actorID(c), zones, services.ZoneImportOptions{DryRun: !apply, DeactivateMissing: deactivate})
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.JSON(http.StatusOK, res)
+}
+
+// boolQuery reads an optional boolean query parameter, false when absent,
+// or answers 400 and returns false as ok when it does not parse.
+func boolQuery(c *gin.Context, name string) (v, ok bool) {
+    q := c.Query(name)
+    if q == "" { return false, true }
+    v, err := strconv.ParseBool(q)
+    if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be true or false"}); return false, false }
+    return v, true
+}
+
+func importFormat(c *gin.Context, raw []byte) string {
+    if f := strings.ToLower(c.Query("format")); f != "" { return f }
+    if ct := c.ContentType(); strings.Contains(ct, "kml") || strings.Contains(ct, "xml") { return "kml" }
+    if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("<")) { return "kml" }
+    return "geojson"
+}
+
+// ExportPolygons downloads the zones as a GeoJSON FeatureCollection or,
+// with ?format=kml, as KML. ?active= filters like ListPolygons. The file
+// can be edited and sent back to ImportPolygons.
+func (h *AdminHandler) ExportPolygons(c *gin.Context) {
+    var active *bool
+    if v := c.Query("active"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "active must be true or false"}); return }
+        active = &b
+    }
+    features, err := h.Polygons.Export(c, active)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    if c.Query("format") == "kml" {
+        var buf bytes.Buffer
+        if err := geospatial.EncodeKML(&buf, "Musorok zones", features); err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+        c.Header("Content-Disposition", `attachment; filename="zones.kml"`)
+        c.Data(http.StatusOK, "application/vnd.google-earth.kml+xml", buf.Bytes())
+        return
+    }
+    b, err := geospatial.EncodeFeatureCollection(features)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    c.Header("Content-Disposition", `attachment; filename="zones.geojson"`)
+    c.Data(http.StatusOK, "application/geo+json", b)
+}
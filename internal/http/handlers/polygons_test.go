@@ -0,0 +1,28 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/musorok/server/internal/http/handlers"
+)
+
+// TestImportPolygonsFlags checks that flags which do not parse are refused
+// rather than read as false.
+func TestImportPolygonsFlags(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.AdminHandler{}
+	r := gin.New()
+	r.POST("/v1/admin/polygons/import", h.ImportPolygons)
+	for _, query := range []string{"apply=yes", "apply=1x", "deactivate_missing=maybe"} {
+		t.Run(query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/admin/polygons/import?"+query, strings.NewReader(`{"type":"FeatureCollection","features":[]}`)))
+			if w.Code != http.StatusBadRequest { t.Fatalf("got %d: %s", w.Code, w.Body) }
+		})
+	}
+}
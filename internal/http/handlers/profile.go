@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/services"
+)
+
+// Me returns the authenticated user's profile together with the flags the
+// apps use to choose the start screen.
+func (h *AuthHandler) Me(c *gin.Context) {
+	id, err := uuid.Parse(c.GetString("uid"))
+	if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"}); return }
+	p, err := h.Profiles.Get(c, id)
+	if errors.Is(err, services.ErrUserNotFound) { c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return }
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	c.JSON(http.StatusOK, p)
+}
+
+// UpdateMe edits name, e-mail, language and marketing consent. Omitted
+// fields are left alone. A new e-mail is only applied once the link mailed
+// to it is opened; until then it shows up as pending_email.
+func (h *AuthHandler) UpdateMe(c *gin.Context) {
+	id, err := uuid.Parse(c.GetString("uid"))
+	if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"}); return }
+	var req services.ProfileUpdate
+	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+	p, err := h.Profiles.Update(c, id, req)
+	var throttled *services.ThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		tooManyRequests(c, throttled.RetryAfter, throttled.Reason); return
+	case errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrInvalidEmail), errors.Is(err, services.ErrInvalidLanguage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return
+	case errors.Is(err, services.ErrEmailTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return
+	case errors.Is(err, services.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// VerifyEmail redeems the token from an e-mail verification link. It needs
+// no login since the link may be opened on another device.
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req struct{ Token string `json:"token"` }
+	if err := c.BindJSON(&req); err != nil || req.Token == "" { c.JSON(http.StatusBadRequest, gin.H{"error": "token required"}); return }
+	err := h.Profiles.VerifyEmail(c, req.Token)
+	switch {
+	case errors.Is(err, services.ErrInvalidEmailToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()}); return
+	case errors.Is(err, services.ErrEmailTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()}); return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return
+	}
+	c.JSON(http.StatusOK, gin.H{"verified": true})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+
+    "github.com/musorok/server/internal/domain"
+    "github.com/musorok/server/internal/services"
+)
+
+// ListRefunds returns the refunds given up after the provider failed every
+// attempt, most recent first, or those in ?status= (PENDING, SUCCEEDED,
+// FAILED).
+func (h *AdminHandler) ListRefunds(c *gin.Context) {
+    status := domain.RefundStatus(c.DefaultQuery("status", string(domain.RefundFailed)))
+    switch status {
+    case domain.RefundPending, domain.RefundSucceeded, domain.RefundFailed:
+    default:
+        c.JSON(http.StatusBadRequest, gin.H{"error": "status must be PENDING, SUCCEEDED or FAILED"})
+        return
+    }
+    refunds, err := h.Refunds.List(c, status, 100)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    items := make([]gin.H, 0, len(refunds))
+    for i := range refunds { items = append(items, refundJSON(&refunds[i])) }
+    c.JSON(http.StatusOK, items)
+}
+
+// RetryRefund queues a failed refund again and tries it at once; it is
+// retried with backoff from there, its attempts counted from zero.
+func (h *AdminHandler) RetryRefund(c *gin.Context) {
+    r, err := h.Refunds.Requeue(c, c.Param("id"))
+    switch {
+    case errors.Is(err, services.ErrRefundNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+    case errors.Is(err, services.ErrRefundNotFailed):
+        c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+    case err != nil:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusOK, refundJSON(r))
+    }
+}
+
+func refundJSON(r *domain.Refund) gin.H {
+    return gin.H{
+        "id": r.ID,
+        "payment_id": r.PaymentID,
+        "order_id": r.OrderID,
+        "amount_kzt": r.AmountKZT,
+        "status": r.Status,
+        "attempts": r.Attempts,
+        "last_error": r.LastError,
+        "next_attempt_at": r.NextAttemptAt,
+        "provider_refund_id": r.ProviderRefundID,
+        "created_at": r.CreatedAt,
+        "updated_at": r.UpdatedAt,
+    }
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/musorok/server/internal/core/phone"
+	"github.com/musorok/server/internal/services"
+)
+
+// tooManyRequests answers 429 with a Retry-After header rounded up to whole
+// seconds.
+func tooManyRequests(c *gin.Context, retryAfter time.Duration, msg string) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 { secs = 1 }
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": msg, "retry_after": secs})
+}
+
+// checkLogin reserves an attempt with the brute-force guard before
+// credentials are verified for identifier. The attempt counts as a failure
+// until loginSucceeded or loginReleased. It writes the 429 (or 503 when the
+// guard's store is down) and returns false when the attempt must not
+// proceed.
+func checkLogin(c *gin.Context, g *services.LoginGuard, identifier string) (*services.LoginAttempt, bool) {
+	if g == nil { return nil, true }
+	a, err := g.Begin(c, loginKey(identifier), c.ClientIP())
+	var throttled *services.ThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		tooManyRequests(c, throttled.RetryAfter, throttled.Reason)
+		return nil, false
+	case err != nil:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "login temporarily unavailable"})
+		return nil, false
+	}
+	return a, true
+}
+
+// loginReleased stops counting an attempt whose outcome says nothing about
+// the credentials.
+func loginReleased(c *gin.Context, a *services.LoginAttempt) {
+	if a == nil { return }
+	if err := a.Release(c); err != nil {
+		log.Error().Err(err).Msg("login guard: release attempt")
+	}
+}
+
+// loginSucceeded clears the failure log of the attempt's identifier.
+func loginSucceeded(c *gin.Context, a *services.LoginAttempt) {
+	if a == nil { return }
+	if err := a.Succeed(c); err != nil {
+		log.Error().Err(err).Msg("login guard: reset failures")
+	}
+}
+
+func loginKey(identifier string) string { return strings.ToLower(strings.TrimSpace(identifier)) }
+
+// normalizePhone rewrites *p to E.164, or answers 400 and returns false when
+// it is not a Kazakhstan mobile number.
+func normalizePhone(c *gin.Context, p *string) bool {
+	n, err := phone.Normalize(*p)
+	if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}); return false }
+	*p = n
+	return true
+}
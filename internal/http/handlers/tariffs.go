@@ -0,0 +1,82 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+
+    "github.com/musorok/server/internal/domain"
+    "github.com/musorok/server/internal/services"
+)
+
+// ListTariffs returns all tariff versions, or those of one zone with
+// ?polygon_id=.
+func (h *AdminHandler) ListTariffs(c *gin.Context) {
+    var pid *uuid.UUID
+    if v := c.Query("polygon_id"); v != "" {
+        id, err := uuid.Parse(v)
+        if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad polygon_id"}); return }
+        pid = &id
+    }
+    tariffs, err := h.Tariffs.List(c, pid)
+    if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+    items := make([]gin.H, 0, len(tariffs))
+    for i := range tariffs { items = append(items, tariffJSON(&tariffs[i])) }
+    c.JSON(http.StatusOK, items)
+}
+
+// CreateTariff adds a new version of a zone's tariff, or of the default one
+// without polygon_id. Orders placed from valid_from on are priced by it.
+func (h *AdminHandler) CreateTariff(c *gin.Context) {
+    var req services.TariffInput
+    if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+    t, err := h.Tariffs.Create(c, actorID(c), req)
+    if err != nil { tariffError(c, err); return }
+    c.JSON(http.StatusCreated, tariffJSON(t))
+}
+
+// CloseTariff ends a tariff at valid_to, or now without a body. Orders
+// already priced by it keep their price.
+func (h *AdminHandler) CloseTariff(c *gin.Context) {
+    var req struct{
+        ValidTo *time.Time `json:"valid_to"`
+    }
+    if c.Request.ContentLength > 0 {
+        if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "bad json"}); return }
+    }
+    t, err := h.Tariffs.Close(c, c.Param("id"), req.ValidTo)
+    if err != nil { tariffError(c, err); return }
+    c.JSON(http.StatusOK, tariffJSON(t))
+}
+
+func tariffError(c *gin.Context, err error) {
+    switch {
+    case errors.Is(err, services.ErrTariffNotFound), errors.Is(err, services.ErrPolygonNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+    case errors.Is(err, services.ErrInvalidTariff):
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+    default:
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+    }
+}
+
+func tariffJSON(t *domain.Tariff) gin.H {
+    return gin.H{
+        "id": t.ID,
+        "polygon_id": t.PolygonID,
+        "version": t.Version,
+        "base_kzt": t.BaseKZT,
+        "per_bag_kzt": t.PerBagKZT,
+        "bag_tiers": t.BagTiers,
+        "asap_surcharge_kzt": t.ASAPSurchargeKZT,
+        "slot_discounts": t.SlotDiscounts,
+        "courier_per_bag_kzt": t.CourierPerBagKZT,
+        "valid_from": t.ValidFrom,
+        "valid_to": t.ValidTo,
+        "created_by": t.CreatedBy,
+        "created_at": t.CreatedAt,
+    }
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/services"
+)
+
+// WaitlistHandler lets users wait for service where no zone covers them yet.
+type WaitlistHandler struct {
+	Waitlist *services.WaitlistService
+}
+
+// List returns the caller's waitlist entries; covered ones carry the zone.
+func (h *WaitlistHandler) List(c *gin.Context) {
+	uid, _ := uuid.Parse(c.GetString("uid"))
+	entries, err := h.Waitlist.List(c, uid)
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	items := make([]gin.H, 0, len(entries))
+	for i := range entries { items = append(items, waitlistJSON(&entries[i])) }
+	c.JSON(http.StatusOK, items)
+}
+
+// Join puts a place on the caller's waitlist without saving an address,
+// e.g. from the map before sign-up is finished.
+func (h *WaitlistHandler) Join(c *gin.Context) {
+	uid, _ := uuid.Parse(c.GetString("uid"))
+	var req services.WaitlistRequest
+	if err := c.BindJSON(&req); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error":"bad json"}); return }
+	e, err := h.Waitlist.Join(c, uid, req)
+	if err != nil { waitlistError(c, err); return }
+	c.JSON(http.StatusCreated, waitlistJSON(e))
+}
+
+// Delete removes an entry of the caller.
+func (h *WaitlistHandler) Delete(c *gin.Context) {
+	uid, _ := uuid.Parse(c.GetString("uid"))
+	if err := h.Waitlist.Delete(c, uid, c.Param("id")); err != nil { waitlistError(c, err); return }
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+// DemandClusters aggregates the open waitlist into grid cells to show where
+// to launch next. Query: cell (metres, default 1000), min_users, city,
+// since (RFC 3339) and limit.
+func (h *AdminHandler) DemandClusters(c *gin.Context) {
+	var q services.ClusterQuery
+	var err error
+	if v := c.Query("cell"); v != "" {
+		if q.CellMeters, err = strconv.ParseFloat(v, 64); err != nil || q.CellMeters < 50 { c.JSON(http.StatusBadRequest, gin.H{"error": "cell must be at least 50 metres"}); return }
+	}
+	if v := c.Query("min_users"); v != "" {
+		if q.MinUsers, err = strconv.Atoi(v); err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "min_users must be an integer"}); return }
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit > 500 { c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer up to 500"}); return }
+	}
+	if v := c.Query("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil { c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC 3339"}); return }
+		q.Since = &t
+	}
+	q.City = c.Query("city")
+	clusters, err := h.Waitlist.Clusters(c, q)
+	if err != nil { c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}); return }
+	if clusters == nil { clusters = []services.DemandCluster{} }
+	c.JSON(http.StatusOK, clusters)
+}
+
+func waitlistError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrWaitlistNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAreaServed):
+		c.JSON(http.StatusConflict, gin.H{"error":"этот район уже обслуживается"})
+	case errors.Is(err, services.ErrBadCoordinates):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func waitlistJSON(e *domain.WaitlistEntry) gin.H {
+	return gin.H{
+		"id": e.ID,
+		"lat": e.Lat,
+		"lng": e.Lng,
+		"city": e.City,
+		"street": e.Street,
+		"house": e.House,
+		"contact_consent": e.ContactConsent,
+		"covered": e.CoveredAt != nil,
+		"polygon_id": e.PolygonID,
+		"polygon_name": e.PolygonName,
+		"covered_at": e.CoveredAt,
+		"notified_at": e.NotifiedAt,
+		"created_at": e.CreatedAt,
+	}
+}
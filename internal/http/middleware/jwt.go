@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -8,17 +9,36 @@ import (
 	"github.com/musorok/server/internal/core/auth"
 )
 
-func JWT(secret string) gin.HandlerFunc {
+// SessionChecker reports whether the login session a token belongs to is
+// still live. It is implemented by services.SessionService.
+type SessionChecker interface {
+	IsActive(ctx context.Context, sessionID string) (bool, error)
+}
+
+// JWT authenticates the bearer access token and puts uid, role and sid (plus
+// cid and pid for couriers) into the context. When sessions is not nil, tokens whose session has been
+// revoked are rejected even if they have not expired yet. Every token this
+// service issues carries a sid, and auth.KeySet refuses legacy tokens
+// without one.
+func JWT(keys *auth.KeySet, sessions SessionChecker) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		h := c.GetHeader("Authorization")
 		if h == "" || !strings.HasPrefix(h, "Bearer ") {
 			c.AbortWithStatus(http.StatusUnauthorized); return
 		}
 		tok := strings.TrimPrefix(h, "Bearer ")
-		claims, err := auth.ParseClaims(secret, tok)
+		claims, err := keys.Parse(tok)
 		if err != nil { c.AbortWithStatus(http.StatusUnauthorized); return }
+		if sessions != nil && claims.SessionID != "" {
+			ok, err := sessions.IsActive(c, claims.SessionID)
+			if err != nil { c.AbortWithStatus(http.StatusServiceUnavailable); return }
+			if !ok { c.AbortWithStatus(http.StatusUnauthorized); return }
+		}
 		c.Set("uid", claims.UserID)
 		c.Set("role", claims.Role)
+		c.Set("sid", claims.SessionID)
+		c.Set("cid", claims.CourierID)
+		c.Set("pid", claims.PolygonID)
 		c.Next()
 	}
 }
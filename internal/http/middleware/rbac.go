@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+)
+
+// RequireRole lets the request through only if the role set by JWT is one of
+// roles. It must run after JWT.
+func RequireRole(roles ...domain.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := domain.Role(c.GetString("role"))
+		for _, r := range roles {
+			if r == role { c.Next(); return }
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+	}
+}
+
+// RequirePermission lets the request through only if the caller's role
+// grants every one of perms. It must run after JWT.
+func RequirePermission(perms ...auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, p := range perms {
+			if !auth.HasPermission(role, p) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "missing_permission": p})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireCourierClaims rejects courier tokens that do not carry the courier
+// and polygon ids, so courier handlers can rely on cid and pid being valid.
+// It must run after JWT.
+func RequireCourierClaims() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := uuid.Parse(c.GetString("cid")); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "courier token required"}); return
+		}
+		if _, err := uuid.Parse(c.GetString("pid")); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "courier token required"}); return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,65 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/http/middleware"
+)
+
+func serve(role string, guard gin.HandlerFunc) int {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { c.Set("role", role); c.Next() }, guard, func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Code
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		allowed []domain.Role
+		want int
+	}{
+		{"user on courier route", "USER", []domain.Role{domain.RoleCourier}, http.StatusForbidden},
+		{"courier on courier route", "COURIER", []domain.Role{domain.RoleCourier}, http.StatusOK},
+		{"admin on courier route", "ADMIN", []domain.Role{domain.RoleCourier}, http.StatusForbidden},
+		{"admin among several", "ADMIN", []domain.Role{domain.RoleCourier, domain.RoleAdmin}, http.StatusOK},
+		{"missing role", "", []domain.Role{domain.RoleUser}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(tt.role, middleware.RequireRole(tt.allowed...)); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name string
+		role string
+		perms []auth.Permission
+		want int
+	}{
+		{"admin writes polygons", "ADMIN", []auth.Permission{auth.PermPolygonsWrite}, http.StatusOK},
+		{"admin writes tariffs", "ADMIN", []auth.Permission{auth.PermTariffsWrite, auth.PermAdminAccess}, http.StatusOK},
+		{"user writes polygons", "USER", []auth.Permission{auth.PermPolygonsWrite}, http.StatusForbidden},
+		{"courier writes couriers", "COURIER", []auth.Permission{auth.PermCouriersWrite}, http.StatusForbidden},
+		{"unknown role", "ROOT", []auth.Permission{auth.PermAdminAccess}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(tt.role, middleware.RequirePermission(tt.perms...)); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,20 +1,29 @@
 package httpapi
 
 import (
+	"context"
 	"net/http"
-	"time"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
+	"github.com/musorok/server/config"
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
 	"github.com/musorok/server/internal/http/middleware"
 	"github.com/musorok/server/internal/http/handlers"
 	"github.com/musorok/server/internal/services"
+	pgrepo "github.com/musorok/server/internal/repo/postgres"
+	redisrepo "github.com/musorok/server/internal/repo/redis"
 	"github.com/musorok/server/internal/core/payments/paynetworks"
 )
 
 var upgrader = websocket.Upgrader{ CheckOrigin: func(r *http.Request) bool { return true } }
 
-func NewRouter(db *gorm.DB, secret, refresh string, accessTTLSeconds, refreshTTLSeconds int64, pay *paynetworks.Client) *gin.Engine {
+// NewRouter wires handlers and services. rdb may be nil when Redis is
+// disabled; state that would live there is then kept in process memory.
+// keys signs and verifies access tokens.
+func NewRouter(db *gorm.DB, rdb *redis.Client, cfg *config.Config, keys *auth.KeySet, pay *paynetworks.Client, otpSender services.OTPSender, mailer services.Mailer) *gin.Engine {
     r := gin.Default()
     // redirect root to the swagger documentation.  This makes it easy to open the API docs without
     // needing to remember the /docs path.
@@ -25,36 +34,104 @@ func NewRouter(db *gorm.DB, secret, refresh string, accessTTLSeconds, refreshTTL
     r.GET("/v1/health", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok"}) })
     // serve swagger documentation at /docs
     r.StaticFS("/docs", http.Dir("docs"))
+    // public keys for verifying access tokens, e.g. by partner services
+    r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+        c.Header("Cache-Control", "public, max-age=300")
+        c.JSON(http.StatusOK, keys.JWKS())
+    })
 
 	users := services.NewUserService(db)
-    authH := &handlers.AuthHandler{Users: users, JWTSecret: secret, JWTRefreshSecret: refresh, AccessTTL: time.Duration(accessTTLSeconds)*time.Second, RefreshTTL: time.Duration(refreshTTLSeconds)*time.Second, DB: db}
+    // refresh tokens are only read by this service and stay HS256, so
+    // rotating access keys never logs anyone out
+    refreshKeys := auth.NewHMACKeySet(cfg.JWTRefreshSecret, "", "")
+    if !cfg.JWTLegacyUntil.IsZero() { refreshKeys.AcceptLegacyHS256(cfg.JWTRefreshSecret, cfg.JWTLegacyUntil) }
+    sessions := services.NewSessionService(db, keys, refreshKeys, cfg.JWTAccessTTL, cfg.JWTRefreshTTL)
+    var otpStore services.OTPStore = services.NewMemoryOTPStore()
+    if rdb != nil { otpStore = redisrepo.NewOTPStore(rdb) }
+    otpSvc := services.NewOTPService(otpStore, otpSender, services.OTPConfig{
+        CodeLength: cfg.OTPLength,
+        TTL: cfg.OTPTTL,
+        MaxAttempts: cfg.OTPMaxAttempts,
+        ResendCooldown: cfg.OTPResendCooldown,
+        PhoneSendLimit: cfg.OTPPhoneLimit,
+        IPSendLimit: cfg.OTPIPLimit,
+        SendWindow: cfg.OTPLimitWindow,
+    })
+    var attempts services.AttemptStore = services.NewMemoryAttemptStore()
+    if rdb != nil { attempts = redisrepo.NewAttemptStore(rdb) }
+    guard := services.NewLoginGuard(attempts, services.LoginPolicy{
+        Window: cfg.LoginWindow,
+        FreeAttempts: cfg.LoginFreeAttempts,
+        BaseDelay: cfg.LoginBaseDelay,
+        MaxDelay: cfg.LoginMaxDelay,
+        LockoutThreshold: cfg.LoginLockoutThreshold,
+        IPThreshold: cfg.LoginIPThreshold,
+        LockoutDuration: cfg.LoginLockoutDuration,
+    })
+    passwords := services.NewPasswordService(db, otpSvc, mailer, sessions, cfg.PasswordResetURL, cfg.PasswordResetTTL)
+    authH := &handlers.AuthHandler{Users: users, Sessions: sessions, OTP: otpSvc, Passwords: passwords, Guard: guard, Accounts: services.NewAccountService(db),
+        Profiles: services.NewProfileService(db, otpSvc, mailer, cfg.EmailVerifyURL, cfg.EmailVerifyTTL), DB: db}
 
 	r.POST("/v1/auth/register", authH.Register)
 	r.POST("/v1/auth/login", authH.Login)
-    r.POST("/v1/auth/refresh", func(c *gin.Context){ c.JSON(http.StatusOK, gin.H{}) }) // TODO
+    r.POST("/v1/auth/refresh", authH.Refresh)
     // OTP endpoints for WhatsApp verification
     r.POST("/v1/auth/send_otp", authH.SendOTP)
     r.POST("/v1/auth/verify_otp", authH.VerifyOTP)
+    // password recovery: forgot -> (verify_otp for phones) -> reset
+    r.POST("/v1/auth/password/forgot", authH.ForgotPassword)
+    r.POST("/v1/auth/password/verify_otp", authH.VerifyResetOTP)
+    r.POST("/v1/auth/email/verify", authH.VerifyEmail)
+    r.POST("/v1/auth/password/reset", authH.ResetPassword)
 
-	api := r.Group("/v1", middleware.JWT(secret))
+	api := r.Group("/v1", middleware.JWT(keys, sessions))
 	api.GET("/me", authH.Me)
+    api.PATCH("/me", authH.UpdateMe)
+    api.POST("/auth/logout", authH.Logout)
+    api.POST("/auth/logout_all", authH.LogoutAll)
+    api.GET("/me/sessions", authH.ListSessions)
+    api.DELETE("/me/sessions/:id", authH.RevokeSession)
+    api.POST("/me/password", authH.ChangePassword)
     // delete account
     api.DELETE("/account", authH.DeleteAccount)
+    api.GET("/me/export", authH.ExportAccount)
 
-	addrH := &handlers.AddressHandler{DB: db, Addrs: services.NewAddressService(db)}
+	var zones services.SpatialRepo = services.NewZoneIndex(db, cfg.ZoneRefreshInterval)
+	if cfg.SpatialBackend == "postgis" { zones = pgrepo.NewSpatialRepo(db) }
+	addrs := services.NewAddressService(db, zones)
+	// users who logged in by phone have no verified e-mail, so the OTP
+	// channel reaches them instead
+	notifier := services.FallbackNotifier{services.MailNotifier{Mailer: mailer}}
+	if texts, ok := otpSender.(services.TextSender); ok { notifier = append(notifier, services.PhoneNotifier{Sender: texts}) }
+	waitlist := services.NewWaitlistService(db, zones, notifier)
+	if cfg.WaitlistRetryInterval > 0 { go waitlist.RetryNotifications(context.Background(), cfg.WaitlistRetryInterval) }
+	addrH := &handlers.AddressHandler{DB: db, Addrs: addrs, Waitlist: waitlist}
 	api.GET("/addresses", addrH.List)
 	api.POST("/addresses", addrH.Create)
+	api.PATCH("/addresses/:id", addrH.Update)
+	api.DELETE("/addresses/:id", addrH.Delete)
+	api.POST("/addresses/:id/default", addrH.SetDefault)
+	waitH := &handlers.WaitlistHandler{Waitlist: waitlist}
+	api.GET("/waitlist", waitH.List)
+	api.POST("/waitlist", waitH.Join)
+	api.DELETE("/waitlist/:id", waitH.Delete)
 
-    ordersH := &handlers.OrdersHandler{DB: db, Pay: pay}
+    tariffs := services.NewTariffService(db, cfg.Location)
+    refunds := services.NewRefundService(db, pay, services.RefundPolicy{MaxAttempts: cfg.RefundMaxAttempts, BaseDelay: cfg.RefundBaseDelay, MaxDelay: cfg.RefundMaxDelay})
+    if cfg.RefundRetryInterval > 0 { go refunds.RetryRefunds(context.Background(), cfg.RefundRetryInterval) }
+    payments := services.NewPaymentService(db, refunds)
+    ordersH := &handlers.OrdersHandler{DB: db, Pay: pay, Orders: services.NewOrderService(db, addrs, tariffs, refunds, services.CancelPolicy{FeeKZT: cfg.CancelFeeKZT, FeeBags: cfg.CancelFeeBags}), Payments: payments}
 	api.POST("/orders/quote", ordersH.Quote)
 	api.POST("/orders", ordersH.Create)
     api.GET("/orders/history", ordersH.History)
+    api.GET("/orders/:id/timeline", ordersH.Timeline)
+    api.POST("/orders/:id/cancel", ordersH.Cancel)
 
-	payH := &handlers.PaymentsHandler{}
+	payH := &handlers.PaymentsHandler{Payments: payments, WebhookSecret: cfg.PayWebhookSecret}
 	r.POST("/v1/payments/webhook", payH.Webhook)
 
     // subscriptions and promocodes routes
-    subH := &handlers.SubscriptionsHandler{DB: db, Pay: pay}
+    subH := &handlers.SubscriptionsHandler{DB: db, Pay: pay, Subs: services.NewSubscriptionService(db, addrs, tariffs), Payments: payments}
     promoH := &handlers.PromocodesHandler{DB: db}
     api.GET("/subscriptions/plans", subH.ListPlans)
     api.POST("/subscriptions", subH.Create)
@@ -65,28 +142,45 @@ func NewRouter(db *gorm.DB, secret, refresh string, accessTTLSeconds, refreshTTL
 
     // courier routes (login and protected actions)
     // pass DB to courier handler so it can query balances and settlements
-    courierH := &handlers.CourierHandler{DB: db}
+    couriers := services.NewCourierService(db)
+    courierH := &handlers.CourierHandler{DB: db, Users: users, Couriers: couriers, Orders: services.NewOrderStateMachine(db, refunds), Sessions: sessions, OTP: otpSvc, Guard: guard}
     // unauthenticated login
     r.POST("/v1/courier/auth/login", courierH.Login)
-    courierGroup := r.Group("/v1/courier", middleware.JWT(secret))
+    courierGroup := r.Group("/v1/courier", middleware.JWT(keys, sessions), middleware.RequireRole(domain.RoleCourier), middleware.RequireCourierClaims())
     courierGroup.GET("/me", courierH.Me)
     courierGroup.GET("/orders", courierH.ListOrders)
     courierGroup.POST("/orders/:id/accept", courierH.AcceptOrder)
     courierGroup.POST("/orders/:id/status", courierH.UpdateOrderStatus)
+    courierGroup.POST("/location", courierH.UpdateLocation)
     // courier balance and withdrawal
     courierGroup.GET("/balance", courierH.Balance)
     courierGroup.POST("/withdraw", courierH.Withdraw)
 
-    // admin routes, protected by admin role (checked in handlers or middleware)
-    adminH := &handlers.AdminHandler{DB: db}
-    adminGroup := r.Group("/v1/admin", middleware.JWT(secret))
-    adminGroup.GET("/polygons", adminH.ListPolygons)
-    adminGroup.POST("/polygons", adminH.CreatePolygon)
-    adminGroup.PUT("/polygons/:id", adminH.UpdatePolygon)
-    adminGroup.POST("/couriers", adminH.CreateCourier)
-    adminGroup.PUT("/couriers/:id", adminH.UpdateCourier)
-    adminGroup.GET("/metrics", adminH.Metrics)
-    adminGroup.POST("/promocodes", adminH.CreatePromocode)
+    // admin routes: the group requires admin access and every route declares
+    // the permission it needs on top of that
+    adminH := &handlers.AdminHandler{DB: db, Users: users, Couriers: couriers, Polygons: services.NewPolygonService(db, zones, waitlist), Waitlist: waitlist, Spatial: zones, Tariffs: tariffs, Refunds: refunds}
+    adminGroup := r.Group("/v1/admin", middleware.JWT(keys, sessions), middleware.RequirePermission(auth.PermAdminAccess))
+    adminGroup.GET("/polygons", middleware.RequirePermission(auth.PermPolygonsRead), adminH.ListPolygons)
+    adminGroup.POST("/polygons", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.CreatePolygon)
+    adminGroup.POST("/polygons/validate", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.ValidatePolygon)
+    adminGroup.POST("/polygons/import", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.ImportPolygons)
+    adminGroup.GET("/polygons/export", middleware.RequirePermission(auth.PermPolygonsRead), adminH.ExportPolygons)
+    adminGroup.GET("/polygons/:id", middleware.RequirePermission(auth.PermPolygonsRead), adminH.GetPolygon)
+    adminGroup.PUT("/polygons/:id", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.UpdatePolygon)
+    adminGroup.GET("/polygons/:id/versions", middleware.RequirePermission(auth.PermPolygonsRead), adminH.PolygonVersions)
+    adminGroup.POST("/polygons/:id/activate", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.ActivatePolygon)
+    adminGroup.POST("/polygons/:id/deactivate", middleware.RequirePermission(auth.PermPolygonsWrite), adminH.DeactivatePolygon)
+    adminGroup.GET("/waitlist/clusters", middleware.RequirePermission(auth.PermPolygonsRead), adminH.DemandClusters)
+    adminGroup.GET("/couriers/nearest", middleware.RequirePermission(auth.PermCouriersRead), adminH.NearestCouriers)
+    adminGroup.POST("/couriers", middleware.RequirePermission(auth.PermCouriersWrite), adminH.CreateCourier)
+    adminGroup.PUT("/couriers/:id", middleware.RequirePermission(auth.PermCouriersWrite), adminH.UpdateCourier)
+    adminGroup.GET("/tariffs", middleware.RequirePermission(auth.PermTariffsRead), adminH.ListTariffs)
+    adminGroup.POST("/tariffs", middleware.RequirePermission(auth.PermTariffsWrite), adminH.CreateTariff)
+    adminGroup.POST("/tariffs/:id/close", middleware.RequirePermission(auth.PermTariffsWrite), adminH.CloseTariff)
+    adminGroup.GET("/refunds", middleware.RequirePermission(auth.PermRefundsRead), adminH.ListRefunds)
+    adminGroup.POST("/refunds/:id/retry", middleware.RequirePermission(auth.PermRefundsWrite), adminH.RetryRefund)
+    adminGroup.GET("/metrics", middleware.RequirePermission(auth.PermMetricsRead), adminH.Metrics)
+    adminGroup.POST("/promocodes", middleware.RequirePermission(auth.PermPromocodesWrite), adminH.CreatePromocode)
 
 	return r
 }
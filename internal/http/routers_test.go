@@ -0,0 +1,42 @@
+package httpapi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/musorok/server/config"
+	"github.com/musorok/server/internal/core/auth"
+	httpapi "github.com/musorok/server/internal/http"
+)
+
+const testSecret = "test-secret"
+
+// TestProtectedGroupsRejectUsers walks every registered admin and courier
+// route and checks that a USER token is refused with 403.
+func TestProtectedGroupsRejectUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys := auth.NewHMACKeySet(testSecret, "musorok", "")
+	r := httpapi.NewRouter(nil, nil, &config.Config{JWTSecret: testSecret, JWTRefreshSecret: "refresh-secret"}, keys, nil, nil, nil)
+	tok, err := keys.Sign(auth.Claims{UserID: "00000000-0000-0000-0000-000000000001", Role: "USER"}, time.Minute)
+	if err != nil { t.Fatal(err) }
+
+	checked := 0
+	for _, rt := range r.Routes() {
+		if !strings.HasPrefix(rt.Path, "/v1/admin/") && !strings.HasPrefix(rt.Path, "/v1/courier/") { continue }
+		if strings.HasPrefix(rt.Path, "/v1/courier/auth/") { continue }
+		path := strings.ReplaceAll(rt.Path, ":id", "00000000-0000-0000-0000-0000000000aa")
+		t.Run(rt.Method+" "+rt.Path, func(t *testing.T) {
+			req := httptest.NewRequest(rt.Method, path, strings.NewReader("{}"))
+			req.Header.Set("Authorization", "Bearer "+tok)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden { t.Fatalf("got %d, want 403", w.Code) }
+		})
+		checked++
+	}
+	if checked == 0 { t.Fatal("no admin or courier routes registered") }
+}
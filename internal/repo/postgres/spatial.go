@@ -0,0 +1,93 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/services"
+)
+
+// SpatialRepo answers spatial queries with PostGIS, using polygons.geom and
+// couriers.location from migration 0012 and their GiST indexes. Triggers
+// keep those columns in step with geojson and last_lat/last_lng, so reads
+// always see committed changes and Reload has nothing to do. It implements
+// services.SpatialRepo.
+type SpatialRepo struct{ db *gorm.DB }
+
+func NewSpatialRepo(db *gorm.DB) *SpatialRepo { return &SpatialRepo{db: db} }
+
+var _ services.SpatialRepo = (*SpatialRepo)(nil)
+
+// CheckPostGIS fails unless PostGIS is installed and migration 0012 added
+// the spatial columns.
+func CheckPostGIS(db *gorm.DB) error {
+	var n int64
+	err := db.Raw(`SELECT count(*) FROM information_schema.columns
+		WHERE (table_name, column_name) IN (('polygons', 'geom'), ('couriers', 'location'))`).Scan(&n).Error
+	if err != nil { return err }
+	if n != 2 { return errors.New("postgis: polygons.geom or couriers.location missing; install PostGIS and rerun migration 0012") }
+	return nil
+}
+
+// polygonColumns leave out geojson and geom, like the in-memory index.
+const polygonColumns = "id, name, city, is_active, priority, version, created_at, updated_at"
+
+const point = "ST_SetSRID(ST_MakePoint(@lng, @lat), 4326)"
+
+// Resolve orders overlapping zones as geospatial.Index does: priority, then
+// planar area, then id. ST_Intersects counts the boundary as inside.
+func (r *SpatialRepo) Resolve(ctx context.Context, lat, lng float64) (*domain.Polygon, error) {
+	var out []domain.Polygon
+	err := r.db.WithContext(ctx).Raw(`SELECT `+polygonColumns+` FROM polygons
+		WHERE is_active AND ST_Intersects(geom, `+point+`)
+		ORDER BY priority DESC, ST_Area(geom), id::text
+		LIMIT 1`, map[string]interface{}{"lat": lat, "lng": lng}).Scan(&out).Error
+	if err != nil { return nil, err }
+	if len(out) == 0 { return nil, services.ErrNotServed }
+	return &out[0], nil
+}
+
+// Nearest takes the closest zones by the index-assisted planar distance and
+// picks among them by distance on the spheroid.
+func (r *SpatialRepo) Nearest(ctx context.Context, lat, lng float64) (*domain.Polygon, float64, error) {
+	var out []struct {
+		domain.Polygon
+		DistanceM float64
+	}
+	err := r.db.WithContext(ctx).Raw(`SELECT * FROM (
+			SELECT `+polygonColumns+`, ST_Area(geom) AS area, ST_Distance(geom::geography, `+point+`::geography) AS distance_m
+			FROM polygons WHERE is_active AND geom IS NOT NULL
+			ORDER BY geom <-> `+point+` LIMIT 8
+		) c ORDER BY distance_m, priority DESC, area, id::text LIMIT 1`, map[string]interface{}{"lat": lat, "lng": lng}).Scan(&out).Error
+	if err != nil { return nil, 0, err }
+	if len(out) == 0 { return nil, 0, nil }
+	return &out[0].Polygon, out[0].DistanceM, nil
+}
+
+// NearestCouriers walks the GiST index of couriers.location nearest first.
+func (r *SpatialRepo) NearestCouriers(ctx context.Context, lat, lng float64, q services.CourierQuery) ([]services.NearbyCourier, error) {
+	q = q.WithDefaults()
+	args := map[string]interface{}{"lat": lat, "lng": lng, "limit": q.Limit, "max_age": fmt.Sprintf("%d seconds", int(q.MaxAge.Seconds())), "radius": q.RadiusM}
+	where := "c.is_active AND c.location IS NOT NULL AND c.located_at > now() - CAST(@max_age AS interval)"
+	if q.PolygonID != nil { where += " AND c.polygon_id = @polygon"; args["polygon"] = *q.PolygonID }
+	if q.RadiusM > 0 { where += " AND ST_DWithin(c.location, " + point + "::geography, @radius)" }
+	var rows []struct {
+		domain.Courier
+		DistanceM float64
+	}
+	err := r.db.WithContext(ctx).Raw(`SELECT c.id, c.user_id, c.polygon_id, c.is_active, c.vehicle, c.work_start, c.work_end, c.capacity_bags,
+			c.last_lat, c.last_lng, c.located_at, c.created_at, c.updated_at,
+			ST_Distance(c.location, `+point+`::geography) AS distance_m
+		FROM couriers c WHERE `+where+`
+		ORDER BY c.location <-> `+point+`::geography LIMIT @limit`, args).Scan(&rows).Error
+	if err != nil { return nil, err }
+	out := make([]services.NearbyCourier, len(rows))
+	for i, row := range rows { out[i] = services.NearbyCourier{Courier: row.Courier, DistanceM: row.DistanceM} }
+	return out, nil
+}
+
+func (r *SpatialRepo) Reload(context.Context) error { return nil }
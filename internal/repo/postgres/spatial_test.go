@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/domain"
+	"github.com/musorok/server/internal/services"
+)
+
+// postgisDB is a rolled-back transaction on TEST_DB_DSN, skipping the test
+// when the database is not set or has no PostGIS.
+func postgisDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" { t.Skip("TEST_DB_DSN not set") }
+	db, err := Open(dsn)
+	if err != nil { t.Fatal(err) }
+	if err := CheckPostGIS(db); err != nil { t.Skip(err) }
+	tx := db.Begin()
+	if tx.Error != nil { t.Fatal(tx.Error) }
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+const (
+	bigZone   = `{"type":"Polygon","coordinates":[[[30,30],[30.2,30],[30.2,30.2],[30,30.2],[30,30]]]}`
+	smallZone = `{"type":"Polygon","coordinates":[[[30.05,30.05],[30.1,30.05],[30.1,30.1],[30.05,30.1],[30.05,30.05]]]}`
+	// the hole is served by nobody
+	holedZone = `{"type":"Polygon","coordinates":[[[30.3,30],[30.5,30],[30.5,30.2],[30.3,30.2],[30.3,30]],[[30.35,30.05],[30.35,30.15],[30.45,30.15],[30.45,30.05],[30.35,30.05]]]}`
+)
+
+// TestSpatialRepoMatchesZoneIndex checks that both SpatialRepo
+// implementations pick the same zone and about the same distance.
+func TestSpatialRepoMatchesZoneIndex(t *testing.T) {
+	db := postgisDB(t)
+	ctx := context.Background()
+	for _, p := range []domain.Polygon{
+		{Name: "big", City: "Тест", GeoJSON: bigZone, IsActive: true},
+		{Name: "small", City: "Тест", GeoJSON: smallZone, IsActive: true},
+		{Name: "holed", City: "Тест", GeoJSON: holedZone, IsActive: true, Priority: 1},
+	} {
+		if err := db.Create(&p).Error; err != nil { t.Fatal(err) }
+	}
+	pg := NewSpatialRepo(db)
+	mem := services.NewZoneIndex(db, time.Minute)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		lat, lng := 29.95+r.Float64()*0.3, 29.95+r.Float64()*0.6
+		want, werr := mem.Resolve(ctx, lat, lng)
+		got, gerr := pg.Resolve(ctx, lat, lng)
+		if (werr == nil) != (gerr == nil) || (werr == nil && want.ID != got.ID) {
+			t.Fatalf("Resolve(%v, %v): memory %v %v, postgis %v %v", lat, lng, want, werr, got, gerr)
+		}
+		wp, wd, err := mem.Nearest(ctx, lat, lng)
+		if err != nil { t.Fatal(err) }
+		gp, gd, err := pg.Nearest(ctx, lat, lng)
+		if err != nil { t.Fatal(err) }
+		// the spheroid and the sphere differ by up to about 0.5%
+		if math.Abs(wd-gd) > 1+wd*0.006 { t.Fatalf("Nearest(%v, %v) distance: memory %.1f, postgis %.1f", lat, lng, wd, gd) }
+		if wd > 1 && wp.ID != gp.ID { t.Fatalf("Nearest(%v, %v): memory %s, postgis %s", lat, lng, wp.Name, gp.Name) }
+	}
+}
+
+func TestSpatialRepoNearestCouriers(t *testing.T) {
+	db := postgisDB(t)
+	ctx := context.Background()
+	poly := domain.Polygon{Name: "big", City: "Тест", GeoJSON: bigZone, IsActive: true}
+	if err := db.Create(&poly).Error; err != nil { t.Fatal(err) }
+	users := services.NewUserService(db)
+	couriers := services.NewCourierService(db)
+	for i, pos := range [][2]float64{{30.1, 30.1}, {30.1, 30.12}, {30.1, 30.3}} {
+		u, err := users.Create(ctx, fmt.Sprintf("+7707999006%d", i), "", "", "", domain.RoleUser)
+		if err != nil { t.Fatal(err) }
+		c := domain.Courier{UserID: u.ID, PolygonID: poly.ID, IsActive: true}
+		if err := couriers.Create(ctx, &c); err != nil { t.Fatal(err) }
+		if err := couriers.UpdateLocation(ctx, c.ID, pos[0], pos[1]); err != nil { t.Fatal(err) }
+	}
+	for _, repo := range []services.SpatialRepo{NewSpatialRepo(db), services.NewZoneIndex(db, time.Minute)} {
+		got, err := repo.NearestCouriers(ctx, 30.1, 30.11, services.CourierQuery{PolygonID: &poly.ID, RadiusM: 5000})
+		if err != nil { t.Fatal(err) }
+		// the third courier is 20 km away
+		if len(got) != 2 || math.Abs(got[0].DistanceM-963) > 10 || math.Abs(got[1].DistanceM-963) > 10 {
+			t.Fatalf("%T: %+v", repo, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package redisrepo
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/musorok/server/internal/services"
+)
+
+// AttemptStore keeps login failure logs as sorted sets scored by time, which
+// gives an exact sliding window, and lockouts as keys expiring when the lock
+// ends. It implements services.AttemptStore.
+type AttemptStore struct{ r *redis.Client }
+
+func NewAttemptStore(r *redis.Client) *AttemptStore { return &AttemptStore{r: r} }
+
+// reserveScript checks the lock and progressive delay of every key pair
+// (KEYS: log, lock, ...; ARGV: now, id, then window, free attempts, base
+// delay, max delay, threshold and lockout per pair, all times in ms) and,
+// when nothing holds the attempt back, logs it under every log and locks
+// those reaching their threshold. It returns the wait and 1 when a lockout
+// caused it.
+var reserveScript = redis.NewScript(`
+local now, id = tonumber(ARGV[1]), ARGV[2]
+local wait, locked = 0, 0
+for i = 1, #KEYS / 2 do
+  local log, lock, a = KEYS[2*i-1], KEYS[2*i], 2 + (i-1)*6
+  local window, free, base, maxd = tonumber(ARGV[a+1]), tonumber(ARGV[a+2]), tonumber(ARGV[a+3]), tonumber(ARGV[a+4])
+  local lockedUntil = tonumber(redis.call("GET", lock) or 0)
+  if lockedUntil > now then wait, locked = math.max(wait, lockedUntil - now), 1 end
+  redis.call("ZREMRANGEBYSCORE", log, "-inf", now - window)
+  local extra = redis.call("ZCARD", log) - free
+  if extra > 0 and base > 0 then
+    local d = base
+    for j = 2, extra do
+      if d >= maxd then break end
+      d = d * 2
+    end
+    if maxd > 0 and d > maxd then d = maxd end
+    local last = tonumber(redis.call("ZRANGE", log, -1, -1, "WITHSCORES")[2])
+    if last + d > now then wait = math.max(wait, last + d - now) end
+  end
+end
+if wait > 0 then return {wait, locked} end
+for i = 1, #KEYS / 2 do
+  local log, lock, a = KEYS[2*i-1], KEYS[2*i], 2 + (i-1)*6
+  local window, threshold, lockout = tonumber(ARGV[a+1]), tonumber(ARGV[a+5]), tonumber(ARGV[a+6])
+  redis.call("ZADD", log, now, id)
+  redis.call("PEXPIRE", log, window)
+  if threshold > 0 and redis.call("ZCARD", log) >= threshold then
+    redis.call("SET", lock, now + lockout, "PX", lockout)
+    redis.call("DEL", log)
+  end
+end
+return {0, 0}
+`)
+
+func (s *AttemptStore) Reserve(ctx context.Context, id string, now time.Time, limits []services.AttemptLimit) (time.Duration, bool, error) {
+	keys := make([]string, 0, 2*len(limits))
+	args := []interface{}{now.UnixMilli(), id}
+	for _, l := range limits {
+		keys = append(keys, "login:fail:"+l.Key, "login:lock:"+l.Key)
+		args = append(args, l.Window.Milliseconds(), l.FreeAttempts, l.BaseDelay.Milliseconds(), l.MaxDelay.Milliseconds(), l.Threshold, l.LockoutDuration.Milliseconds())
+	}
+	res, err := reserveScript.Run(ctx, s.r, keys, args...).Int64Slice()
+	if err != nil { return 0, false, err }
+	return time.Duration(res[0]) * time.Millisecond, res[1] == 1, nil
+}
+
+func (s *AttemptStore) Release(ctx context.Context, id string, keys []string) error {
+	_, err := s.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, key := range keys { p.ZRem(ctx, "login:fail:"+key, id) }
+		return nil
+	})
+	return err
+}
+
+func (s *AttemptStore) Reset(ctx context.Context, key string) error {
+	return s.r.Del(ctx, "login:fail:"+key).Err()
+}
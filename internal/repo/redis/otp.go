@@ -0,0 +1,71 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/musorok/server/internal/services"
+)
+
+// OTPStore keeps one-time codes and their counters in Redis so they survive
+// restarts and are shared between replicas. It implements services.OTPStore.
+type OTPStore struct{ r *redis.Client }
+
+func NewOTPStore(r *redis.Client) *OTPStore { return &OTPStore{r: r} }
+
+func (s *OTPStore) SaveCode(ctx context.Context, phone, codeHash string, ttl time.Duration) error {
+	_, err := s.r.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, "otp:code:"+phone, codeHash, ttl)
+		p.Del(ctx, "otp:attempts:"+phone)
+		return nil
+	})
+	return err
+}
+
+func (s *OTPStore) CodeHash(ctx context.Context, phone string) (string, error) {
+	v, err := s.r.Get(ctx, "otp:code:"+phone).Result()
+	if errors.Is(err, redis.Nil) { return "", services.ErrOTPNotFound }
+	return v, err
+}
+
+func (s *OTPStore) DeleteCode(ctx context.Context, phone string) error {
+	return s.r.Del(ctx, "otp:code:"+phone, "otp:attempts:"+phone).Err()
+}
+
+func (s *OTPStore) IncrAttempts(ctx context.Context, phone string, ttl time.Duration) (int64, error) {
+	n, _, err := incrWithTTL(ctx, s.r, "otp:attempts:"+phone, ttl)
+	return n, err
+}
+
+func (s *OTPStore) Cooldown(ctx context.Context, phone string, ttl time.Duration) (bool, time.Duration, error) {
+	key := "otp:cooldown:" + phone
+	ok, err := s.r.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil || ok { return ok, 0, err }
+	left, err := s.r.PTTL(ctx, key).Result()
+	return false, left, err
+}
+
+func (s *OTPStore) ReleaseCooldown(ctx context.Context, phone string) error {
+	return s.r.Del(ctx, "otp:cooldown:"+phone).Err()
+}
+
+func (s *OTPStore) IncrWindow(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	return incrWithTTL(ctx, s.r, "otp:send:"+key, window)
+}
+
+// incrWithTTLScript increments a counter and starts its expiry on first use,
+// atomically, so a crash between INCR and PEXPIRE cannot leave an immortal key.
+var incrWithTTLScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return {n, redis.call("PTTL", KEYS[1])}
+`)
+
+func incrWithTTL(ctx context.Context, r *redis.Client, key string, ttl time.Duration) (int64, time.Duration, error) {
+	res, err := incrWithTTLScript.Run(ctx, r, []string{key}, ttl.Milliseconds()).Int64Slice()
+	if err != nil { return 0, 0, err }
+	return res[0], time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrActiveOrders = errors.New("account has orders in progress")
+)
+
+// AccountService handles account deletion and data export requests.
+type AccountService struct{ db *gorm.DB }
+
+func NewAccountService(db *gorm.DB) *AccountService { return &AccountService{db: db} }
+
+// Delete closes the account of userID in one transaction. The users row is
+// kept, since orders and payments reference it and must stay for accounting,
+// but its personal data is wiped and it is marked IsDeleted. Addresses used
+// by orders are reduced to city and polygon, the rest are removed. Waitlist
+// entries, sessions, device tokens and reset tokens are deleted, running
+// subscriptions canceled and unpaid orders canceled. Accounts with paid
+// orders still awaiting pickup cannot be deleted until those are done or
+// refunded.
+func (s *AccountService) Delete(ctx context.Context, userID uuid.UUID) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var u domain.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND is_deleted = false", userID).First(&u).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrUserNotFound }
+		if err != nil { return err }
+
+		var active int64
+		err = tx.Model(&domain.Order{}).
+			Where("user_id = ? AND status IN ?", userID, []domain.OrderStatus{domain.StatusPaid, domain.StatusAssigned, domain.StatusPickingUp}).
+			Count(&active).Error
+		if err != nil { return err }
+		if active > 0 { return ErrActiveOrders }
+
+		var unpaid []domain.Order
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ? AND status = ?", userID, domain.StatusNew).Find(&unpaid).Error
+		if err != nil { return err }
+		// unpaid, so nothing to refund, and the bags of subscription orders
+		// would go back to subscriptions canceled below
+		for i := range unpaid {
+			if err := moveOrder(tx, &unpaid[i], domain.StatusCanceled, SystemActor, map[string]interface{}{"reason": "account deleted"}); err != nil { return err }
+		}
+		if err := tx.Model(&domain.Order{}).Where("user_id = ?", userID).Update("comment", "").Error; err != nil { return err }
+		if err := tx.Model(&domain.Subscription{}).Where("user_id = ? AND status IN ?", userID, []domain.SubscriptionStatus{domain.SubActive, domain.SubPaused}).
+			Update("status", domain.SubCanceled).Error; err != nil { return err }
+
+		// addresses referenced by orders stay, minus anything below the city
+		used := tx.Model(&domain.Order{}).Select("address_id").Where("user_id = ?", userID)
+		if err := tx.Where("user_id = ? AND id NOT IN (?)", userID, used).Delete(&domain.Address{}).Error; err != nil { return err }
+		err = tx.Model(&domain.Address{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+			"label": nil, "street": "", "house": "", "entrance": "", "floor": "", "apartment": "", "intercom": nil,
+			"lat": gorm.Expr("round(lat::numeric, 2)"), "lng": gorm.Expr("round(lng::numeric, 2)"), "is_default": false,
+		}).Error
+		if err != nil { return err }
+
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.Session{}).Error; err != nil { return err }
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.PasswordReset{}).Error; err != nil { return err }
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.EmailVerification{}).Error; err != nil { return err }
+		if err := tx.Where("user_id = ?", userID).Delete(&domain.WaitlistEntry{}).Error; err != nil { return err }
+		if err := tx.Exec("DELETE FROM device_tokens WHERE user_id = ?", userID).Error; err != nil { return err }
+		if err := tx.Model(&domain.Courier{}).Where("user_id = ?", userID).Update("is_active", false).Error; err != nil { return err }
+
+		return tx.Model(&u).Updates(map[string]interface{}{
+			"phone": "deleted:" + userID.String(), "email": nil, "email_verified_at": nil, "name": "", "password_hash": nil,
+			"marketing_consent": false, "marketing_consent_at": nil,
+			"is_deleted": true, "updated_at": time.Now(),
+		}).Error
+	})
+}
+
+// AccountExport is everything stored about a user, as handed out on a data
+// access request. Secrets (password and token hashes) are left out.
+type AccountExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	Profile ExportProfile `json:"profile"`
+	Addresses []domain.Address `json:"addresses"`
+	Subscriptions []domain.Subscription `json:"subscriptions"`
+	Orders []domain.Order `json:"orders"`
+	Payments []ExportPayment `json:"payments"`
+	Sessions []ExportSession `json:"sessions"`
+	DeviceTokens []ExportDevice `json:"device_tokens"`
+	Promocodes []ExportPromocode `json:"promocodes"`
+	Waitlist []domain.WaitlistEntry `json:"waitlist"`
+}
+
+type ExportProfile struct {
+	ID uuid.UUID `json:"id"`
+	Phone string `json:"phone"`
+	Email *string `json:"email"`
+	Name string `json:"name"`
+	Role domain.Role `json:"role"`
+	Language string `json:"language"`
+	MarketingConsent bool `json:"marketing_consent"`
+	MarketingConsentAt *time.Time `json:"marketing_consent_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	HasPassword bool `json:"has_password"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ExportPayment struct {
+	ID uuid.UUID `json:"id"`
+	OrderID *uuid.UUID `json:"order_id"`
+	SubscriptionID *uuid.UUID `json:"subscription_id"`
+	AmountKZT int `json:"amount_kzt"`
+	Provider domain.PaymentProvider `json:"provider"`
+	Status domain.PaymentStatus `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportSession struct {
+	UserAgent string `json:"user_agent"`
+	IP string `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+type ExportDevice struct {
+	Platform string `json:"platform"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportPromocode struct {
+	Code string `json:"code"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+// Export collects the data of userID.
+func (s *AccountService) Export(ctx context.Context, userID uuid.UUID) (*AccountExport, error) {
+	db := s.db.WithContext(ctx)
+	var u domain.User
+	err := db.Where("id = ? AND is_deleted = false", userID).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrUserNotFound }
+	if err != nil { return nil, err }
+
+	out := &AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: ExportProfile{ID: u.ID, Phone: u.Phone, Email: u.Email, Name: u.Name, Role: u.Role,
+			Language: u.Language, MarketingConsent: u.MarketingConsent, MarketingConsentAt: u.MarketingConsentAt, EmailVerifiedAt: u.EmailVerifiedAt,
+			HasPassword: u.PasswordHash != nil, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt},
+		Addresses: []domain.Address{}, Subscriptions: []domain.Subscription{}, Orders: []domain.Order{},
+		Payments: []ExportPayment{}, Sessions: []ExportSession{}, DeviceTokens: []ExportDevice{}, Promocodes: []ExportPromocode{}, Waitlist: []domain.WaitlistEntry{},
+	}
+	queries := []*gorm.DB{
+		db.Where("user_id = ?", userID).Order("created_at").Find(&out.Addresses),
+		db.Where("user_id = ?", userID).Order("started_at").Find(&out.Subscriptions),
+		db.Where("user_id = ?", userID).Order("created_at").Find(&out.Orders),
+		db.Model(&domain.Payment{}).Where("user_id = ?", userID).Order("created_at").Find(&out.Payments),
+		db.Model(&domain.Session{}).Where("user_id = ?", userID).Order("created_at").Find(&out.Sessions),
+		db.Table("device_tokens").Where("user_id = ?", userID).Order("created_at").Find(&out.DeviceTokens),
+		db.Table("user_promocodes up").Select("p.code, up.used_at").Joins("JOIN promocodes p ON p.id = up.promocode_id").
+			Where("up.user_id = ?", userID).Order("up.used_at").Scan(&out.Promocodes),
+		db.Where("user_id = ?", userID).Order("created_at").Find(&out.Waitlist),
+	}
+	for _, q := range queries {
+		if q.Error != nil { return nil, q.Error }
+	}
+	return out, nil
+}
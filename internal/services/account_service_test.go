@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestAccountDeleteAnonymizesAndKeepsOrders(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990001", "del@example.com", "Delete Me", "secret123", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	poly := domain.Polygon{Name: "test", City: "Алматы", GeoJSON: "{}"}
+	if err := db.Create(&poly).Error; err != nil { t.Fatal(err) }
+	used := domain.Address{UserID: u.ID, City: "Алматы", Street: "Абая", House: "1", Apartment: "5", Lat: 43.23456, Lng: 76.91234}
+	spare := domain.Address{UserID: u.ID, City: "Алматы", Street: "Сатпаева", House: "2"}
+	if err := db.Create(&used).Error; err != nil { t.Fatal(err) }
+	if err := db.Create(&spare).Error; err != nil { t.Fatal(err) }
+	order := domain.Order{UserID: u.ID, AddressID: used.ID, PolygonID: poly.ID, Type: domain.OrderOneTime, BagsCount: 1, PriceKZT: 500,
+		TimeOption: domain.ASAP, Status: domain.StatusDone, Comment: "call Aigerim at +77079990001"}
+	if err := db.Create(&order).Error; err != nil { t.Fatal(err) }
+
+	svc := NewAccountService(db)
+	if err := svc.Delete(ctx, u.ID); err != nil { t.Fatal(err) }
+
+	var got domain.User
+	if err := db.First(&got, "id = ?", u.ID).Error; err != nil { t.Fatal(err) }
+	if !got.IsDeleted || got.Email != nil || got.Name != "" || got.PasswordHash != nil || got.Phone == "+77079990001" {
+		t.Fatalf("user not anonymized: %+v", got)
+	}
+	var o domain.Order
+	if err := db.First(&o, "id = ?", order.ID).Error; err != nil { t.Fatalf("order must be kept: %v", err) }
+	if o.Comment != "" { t.Fatalf("order comment kept: %q", o.Comment) }
+	var addrs []domain.Address
+	db.Where("user_id = ?", u.ID).Find(&addrs)
+	if len(addrs) != 1 || addrs[0].ID != used.ID || addrs[0].Street != "" || addrs[0].Lat != 43.23 {
+		t.Fatalf("addresses = %+v", addrs)
+	}
+	if _, err := NewUserService(db).Authenticate(ctx, "del@example.com", "secret123"); err == nil {
+		t.Fatal("deleted user can still log in")
+	}
+	if err := svc.Delete(ctx, u.ID); !errors.Is(err, ErrUserNotFound) { t.Fatalf("second delete: %v", err) }
+}
+
+func TestAccountDeleteRefusedWithActiveOrders(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990002", "", "Busy", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	poly := domain.Polygon{Name: "test", City: "Алматы", GeoJSON: "{}"}
+	if err := db.Create(&poly).Error; err != nil { t.Fatal(err) }
+	addr := domain.Address{UserID: u.ID, City: "Алматы"}
+	if err := db.Create(&addr).Error; err != nil { t.Fatal(err) }
+	order := domain.Order{UserID: u.ID, AddressID: addr.ID, PolygonID: poly.ID, Type: domain.OrderOneTime, BagsCount: 1, TimeOption: domain.ASAP, Status: domain.StatusPaid}
+	if err := db.Create(&order).Error; err != nil { t.Fatal(err) }
+	if err := NewAccountService(db).Delete(ctx, u.ID); !errors.Is(err, ErrActiveOrders) { t.Fatalf("err = %v", err) }
+}
+
+func TestAccountExport(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990003", "", "Export", "secret123", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	if err := db.Create(&domain.Address{UserID: u.ID, City: "Алматы"}).Error; err != nil { t.Fatal(err) }
+	out, err := NewAccountService(db).Export(ctx, u.ID)
+	if err != nil { t.Fatal(err) }
+	if out.Profile.Phone != "+77079990003" || !out.Profile.HasPassword || len(out.Addresses) != 1 {
+		t.Fatalf("export = %+v", out)
+	}
+}
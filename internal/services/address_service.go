@@ -2,22 +2,175 @@ package services
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
 	"github.com/musorok/server/internal/domain"
 )
 
-type AddressService struct{ db *gorm.DB }
+var (
+	ErrAddressNotFound = errors.New("address not found")
+	ErrNotServed = errors.New("area is not served yet")
+)
 
-func NewAddressService(db *gorm.DB) *AddressService { return &AddressService{db: db} }
+// AddressService manages a user's saved addresses. Every method is scoped to
+// the owner, and a user with addresses always has exactly one default.
+type AddressService struct{
+	db *gorm.DB
+	zones SpatialRepo
+}
+
+func NewAddressService(db *gorm.DB, zones SpatialRepo) *AddressService { return &AddressService{db: db, zones: zones} }
+
+// AddressUpdate lists the fields PATCH may change; nil means keep.
+type AddressUpdate struct {
+	Label *string `json:"label"`
+	Lat *float64 `json:"lat"`
+	Lng *float64 `json:"lng"`
+	City *string `json:"city"`
+	Street *string `json:"street"`
+	House *string `json:"house"`
+	Entrance *string `json:"entrance"`
+	Floor *string `json:"floor"`
+	Apartment *string `json:"apartment"`
+	Intercom *string `json:"intercom"`
+}
 
+// ResolvePolygon returns the active polygon serving the point, or
+// ErrNotServed.
+func (s *AddressService) ResolvePolygon(ctx context.Context, lat, lng float64) (*domain.Polygon, error) {
+	return s.zones.Resolve(ctx, lat, lng)
+}
+
+// NearestPolygon returns the active polygon closest to the point and its
+// distance in metres, or a nil polygon when no zone is active.
+func (s *AddressService) NearestPolygon(ctx context.Context, lat, lng float64) (*domain.Polygon, float64, error) {
+	return s.zones.Nearest(ctx, lat, lng)
+}
+
+// Create saves a new address of a.UserID. When polygon is nil it is resolved
+// from the coordinates. The first address becomes the default, as does any
+// address created with IsDefault.
 func (s *AddressService) Create(ctx context.Context, a *domain.Address, polygon *domain.Polygon) error {
-	if polygon != nil {
-		a.PolygonID = &polygon.ID
-		a.PolygonName = &polygon.Name
+	if polygon == nil {
+		p, err := s.ResolvePolygon(ctx, a.Lat, a.Lng)
+		if err != nil { return err }
+		polygon = p
 	}
-	return s.db.WithContext(ctx).Create(a).Error
+	a.ID = uuid.Nil
+	a.PolygonID = &polygon.ID
+	a.PolygonName = &polygon.Name
+	a.DeletedAt = nil
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := lockUser(tx, a.UserID); err != nil { return err }
+		var defaults int64
+		if err := liveAddresses(tx, a.UserID).Where("is_default").Count(&defaults).Error; err != nil { return err }
+		if a.IsDefault && defaults > 0 {
+			if err := liveAddresses(tx, a.UserID).Where("is_default").Update("is_default", false).Error; err != nil { return err }
+		}
+		a.IsDefault = a.IsDefault || defaults == 0
+		return tx.Create(a).Error
+	})
 }
 
+// List returns the live addresses of userID, default first.
 func (s *AddressService) List(ctx context.Context, userID string, out *[]domain.Address) error {
-	return s.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Find(out).Error
+	return liveAddresses(s.db.WithContext(ctx), userID).Order("is_default DESC, created_at DESC").Find(out).Error
+}
+
+// Get returns a live address of userID or ErrAddressNotFound.
+func (s *AddressService) Get(ctx context.Context, userID, id string) (*domain.Address, error) {
+	if _, err := uuid.Parse(id); err != nil { return nil, ErrAddressNotFound }
+	var a domain.Address
+	err := liveAddresses(s.db.WithContext(ctx), userID).Where("id = ?", id).First(&a).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrAddressNotFound }
+	if err != nil { return nil, err }
+	return &a, nil
+}
+
+// Update changes an address of userID. Moving the pin re-resolves the
+// polygon; a point outside every active polygon is rejected with
+// ErrNotServed.
+func (s *AddressService) Update(ctx context.Context, userID, id string, upd AddressUpdate) (*domain.Address, error) {
+	a, err := s.Get(ctx, userID, id)
+	if err != nil { return nil, err }
+	changes := map[string]interface{}{"updated_at": time.Now()}
+	set := func(col string, v *string) { if v != nil { changes[col] = *v } }
+	set("city", upd.City); set("street", upd.Street); set("house", upd.House); set("entrance", upd.Entrance)
+	set("floor", upd.Floor); set("apartment", upd.Apartment)
+	if upd.Label != nil { changes["label"] = upd.Label }
+	if upd.Intercom != nil { changes["intercom"] = upd.Intercom }
+	if (upd.Lat != nil && *upd.Lat != a.Lat) || (upd.Lng != nil && *upd.Lng != a.Lng) {
+		lat, lng := a.Lat, a.Lng
+		if upd.Lat != nil { lat = *upd.Lat }
+		if upd.Lng != nil { lng = *upd.Lng }
+		p, err := s.ResolvePolygon(ctx, lat, lng)
+		if err != nil { return nil, err }
+		changes["lat"], changes["lng"] = lat, lng
+		changes["polygon_id"], changes["polygon_name"] = p.ID, p.Name
+	}
+	if err := s.db.WithContext(ctx).Model(a).Updates(changes).Error; err != nil { return nil, err }
+	return s.Get(ctx, userID, id)
+}
+
+// Delete removes an address of userID. Addresses referenced by orders are
+// only marked deleted so the order history keeps them. If the default goes,
+// the newest remaining address becomes the default.
+func (s *AddressService) Delete(ctx context.Context, userID, id string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		uid, err := uuid.Parse(userID)
+		if err != nil { return ErrAddressNotFound }
+		if err := lockUser(tx, uid); err != nil { return err }
+		var a domain.Address
+		err = liveAddresses(tx, userID).Where("id = ?", id).First(&a).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrAddressNotFound }
+		if err != nil { return err }
+
+		var used int64
+		if err := tx.Model(&domain.Order{}).Where("address_id = ?", a.ID).Count(&used).Error; err != nil { return err }
+		if used > 0 {
+			err = tx.Model(&a).Updates(map[string]interface{}{"deleted_at": time.Now(), "is_default": false}).Error
+		} else {
+			err = tx.Delete(&a).Error
+		}
+		if err != nil || !a.IsDefault { return err }
+
+		var next domain.Address
+		q := liveAddresses(tx, userID).Order("created_at DESC").Limit(1).Find(&next)
+		if q.Error != nil || q.RowsAffected == 0 { return q.Error }
+		return tx.Model(&next).Update("is_default", true).Error
+	})
+}
+
+// SetDefault makes an address of userID the default and clears the flag on
+// all others.
+func (s *AddressService) SetDefault(ctx context.Context, userID, id string) (*domain.Address, error) {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		uid, err := uuid.Parse(userID)
+		if err != nil { return ErrAddressNotFound }
+		if err := lockUser(tx, uid); err != nil { return err }
+		var n int64
+		if err := liveAddresses(tx, userID).Where("id = ?", id).Count(&n).Error; err != nil { return err }
+		if n == 0 { return ErrAddressNotFound }
+		if err := liveAddresses(tx, userID).Where("is_default AND id <> ?", id).Update("is_default", false).Error; err != nil { return err }
+		return liveAddresses(tx, userID).Where("id = ?", id).Update("is_default", true).Error
+	})
+	if err != nil { return nil, err }
+	return s.Get(ctx, userID, id)
+}
+
+func liveAddresses(db *gorm.DB, userID interface{}) *gorm.DB {
+	return db.Model(&domain.Address{}).Where("user_id = ? AND deleted_at IS NULL", userID)
+}
+
+// lockUser serializes changes to the default address of one user.
+func lockUser(tx *gorm.DB, userID uuid.UUID) error {
+	var u domain.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", userID).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return ErrUserNotFound }
+	return err
 }
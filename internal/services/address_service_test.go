@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+// testPolygon is a small active square around 43.22N 76.914E.
+const testPolygonGeoJSON = `{"type":"Polygon","coordinates":[[[76.910,43.2185],[76.918,43.2185],[76.918,43.223],[76.910,43.223],[76.910,43.2185]]]}`
+
+func addressFixture(t *testing.T) (context.Context, *AddressService, *domain.User) {
+	t.Helper()
+	db := testDB(t)
+	ctx := context.Background()
+	if err := db.Create(&domain.Polygon{Name: "test", City: "Алматы", GeoJSON: testPolygonGeoJSON, IsActive: true}).Error; err != nil { t.Fatal(err) }
+	u, err := NewUserService(db).Create(ctx, "+77079990020", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	return ctx, NewAddressService(db, NewZoneIndex(db, time.Minute)), u
+}
+
+func defaults(t *testing.T, ctx context.Context, svc *AddressService, userID string) []domain.Address {
+	t.Helper()
+	var all, out []domain.Address
+	if err := svc.List(ctx, userID, &all); err != nil { t.Fatal(err) }
+	for _, a := range all { if a.IsDefault { out = append(out, a) } }
+	return out
+}
+
+func TestAddressExactlyOneDefault(t *testing.T) {
+	ctx, svc, u := addressFixture(t)
+	first := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := svc.Create(ctx, &first, nil); err != nil { t.Fatal(err) }
+	if !first.IsDefault || first.PolygonID == nil { t.Fatalf("first address: %+v", first) }
+	second := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.221, Lng: 76.915, IsDefault: true}
+	if err := svc.Create(ctx, &second, nil); err != nil { t.Fatal(err) }
+	third := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.222, Lng: 76.916}
+	if err := svc.Create(ctx, &third, nil); err != nil { t.Fatal(err) }
+	if d := defaults(t, ctx, svc, u.ID.String()); len(d) != 1 || d[0].ID != second.ID { t.Fatalf("defaults = %+v", d) }
+
+	if _, err := svc.SetDefault(ctx, u.ID.String(), third.ID.String()); err != nil { t.Fatal(err) }
+	if d := defaults(t, ctx, svc, u.ID.String()); len(d) != 1 || d[0].ID != third.ID { t.Fatalf("defaults = %+v", d) }
+
+	if err := svc.Delete(ctx, u.ID.String(), third.ID.String()); err != nil { t.Fatal(err) }
+	if d := defaults(t, ctx, svc, u.ID.String()); len(d) != 1 || d[0].ID != second.ID { t.Fatalf("default not promoted: %+v", d) }
+}
+
+func TestAddressUpdateResolvesPolygon(t *testing.T) {
+	ctx, svc, u := addressFixture(t)
+	a := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := svc.Create(ctx, &a, nil); err != nil { t.Fatal(err) }
+	far := 44.0
+	if _, err := svc.Update(ctx, u.ID.String(), a.ID.String(), AddressUpdate{Lat: &far}); !errors.Is(err, ErrNotServed) {
+		t.Fatalf("moving outside the zone: %v", err)
+	}
+	street := "Абая"
+	got, err := svc.Update(ctx, u.ID.String(), a.ID.String(), AddressUpdate{Street: &street})
+	if err != nil { t.Fatal(err) }
+	if got.Street != "Абая" || got.Lat != 43.22 { t.Fatalf("updated = %+v", got) }
+}
+
+func TestAddressDeleteIsSoftWhenOrdered(t *testing.T) {
+	ctx, svc, u := addressFixture(t)
+	a := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := svc.Create(ctx, &a, nil); err != nil { t.Fatal(err) }
+	order := domain.Order{UserID: u.ID, AddressID: a.ID, PolygonID: *a.PolygonID, Type: domain.OrderOneTime, BagsCount: 1, TimeOption: domain.ASAP, Status: domain.StatusDone}
+	if err := svc.db.Create(&order).Error; err != nil { t.Fatal(err) }
+	if err := svc.Delete(ctx, u.ID.String(), a.ID.String()); err != nil { t.Fatal(err) }
+	if _, err := svc.Get(ctx, u.ID.String(), a.ID.String()); !errors.Is(err, ErrAddressNotFound) { t.Fatalf("deleted address visible: %v", err) }
+	var kept domain.Address
+	if err := svc.db.First(&kept, "id = ?", a.ID).Error; err != nil || kept.DeletedAt == nil { t.Fatalf("row should be kept and marked: %v %+v", err, kept) }
+}
+
+func TestAddressOwnership(t *testing.T) {
+	ctx, svc, u := addressFixture(t)
+	other, err := NewUserService(svc.db).Create(ctx, "+77079990021", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	a := domain.Address{UserID: u.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := svc.Create(ctx, &a, nil); err != nil { t.Fatal(err) }
+	street := "hijacked"
+	if _, err := svc.Update(ctx, other.ID.String(), a.ID.String(), AddressUpdate{Street: &street}); !errors.Is(err, ErrAddressNotFound) { t.Fatalf("update: %v", err) }
+	if _, err := svc.SetDefault(ctx, other.ID.String(), a.ID.String()); !errors.Is(err, ErrAddressNotFound) { t.Fatalf("set default: %v", err) }
+	if err := svc.Delete(ctx, other.ID.String(), a.ID.String()); !errors.Is(err, ErrAddressNotFound) { t.Fatalf("delete: %v", err) }
+}
+
+func TestAddressNearestPolygon(t *testing.T) {
+	ctx, svc, _ := addressFixture(t)
+	// 0.01° east of the test square, about 810 m; other zones may be closer
+	p, dist, err := svc.NearestPolygon(ctx, 43.22, 76.928)
+	if err != nil { t.Fatal(err) }
+	if p == nil || dist <= 0 || dist > 815 { t.Fatalf("nearest = %+v, %.0f m", p, dist) }
+	if _, dist, _ := svc.NearestPolygon(ctx, 43.22, 76.914); dist != 0 { t.Fatalf("inside: %.0f m", dist) }
+}
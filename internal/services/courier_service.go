@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrNotCourier = errors.New("user is not a courier")
+	ErrCourierInactive = errors.New("courier is inactive")
+	ErrInvalidWorkHours = errors.New("work hours must be HH:MM")
+	ErrInvalidVehicle = errors.New("vehicle must be FOOT, BICYCLE, SCOOTER or CAR")
+	ErrInvalidCapacity = errors.New("capacity_bags must be positive")
+	ErrCourierExists = errors.New("user is already a courier")
+)
+
+var workHoursRe = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+type CourierService struct{ db *gorm.DB }
+
+func NewCourierService(db *gorm.DB) *CourierService { return &CourierService{db: db} }
+
+// ActiveByUserID returns the courier linked to the user. ErrNotCourier is
+// returned when there is no couriers row and ErrCourierInactive when the
+// courier has been deactivated.
+func (s *CourierService) ActiveByUserID(ctx context.Context, userID uuid.UUID) (*domain.Courier, error) {
+	return activeCourier(s.db.WithContext(ctx), userID)
+}
+
+// Create registers an existing user as a courier and switches the user's
+// role to COURIER in the same transaction. A zero Vehicle or CapacityBags
+// takes the column default. ErrUserNotFound and ErrPolygonNotFound are
+// returned when the user or polygon does not exist, ErrCourierExists when
+// the user is a courier already.
+func (s *CourierService) Create(ctx context.Context, c *domain.Courier) error {
+	if c.Vehicle == "" { c.Vehicle = domain.VehicleFoot }
+	if c.CapacityBags == 0 { c.CapacityBags = 10 }
+	if err := validateCourier(c); err != nil { return err }
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var users int64
+		if err := tx.Model(&domain.User{}).Where("id = ? AND is_deleted = false", c.UserID).Count(&users).Error; err != nil { return err }
+		if users == 0 { return ErrUserNotFound }
+		if err := polygonExists(tx, c.PolygonID); err != nil { return err }
+		// couriers.user_id is unique; a concurrent assignment loses here too
+		res := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "user_id"}}, DoNothing: true}).Create(c)
+		if res.Error != nil { return res.Error }
+		if res.RowsAffected == 0 { return ErrCourierExists }
+		return tx.Model(&domain.User{}).Where("id = ?", c.UserID).Update("role", domain.RoleCourier).Error
+	})
+}
+
+// Update saves changed courier fields. Deactivating the courier or moving
+// it to another zone ends its sessions in the same transaction, since its
+// tokens carry the zone and stand for an active courier: it has to log in
+// again, which a deactivated courier cannot. The position is left alone so
+// an edit never overwrites a newer report.
+func (s *CourierService) Update(ctx context.Context, c *domain.Courier) error {
+	if err := validateCourier(c); err != nil { return err }
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := polygonExists(tx, c.PolygonID); err != nil { return err }
+		var old domain.Courier
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", c.ID).First(&old).Error; err != nil { return err }
+		err := tx.Model(c).Select("polygon_id", "is_active", "vehicle", "work_start", "work_end", "capacity_bags", "updated_at").Updates(c).Error
+		if err != nil || (old.IsActive == c.IsActive && old.PolygonID == c.PolygonID) { return err }
+		return (&SessionService{db: tx}).RevokeAll(ctx, old.UserID.String())
+	})
+}
+
+// UpdateLocation records where the courier is now.
+func (s *CourierService) UpdateLocation(ctx context.Context, courierID uuid.UUID, lat, lng float64) error {
+	if math.Abs(lat) > 90 || math.Abs(lng) > 180 { return ErrBadCoordinates }
+	return s.db.WithContext(ctx).Model(&domain.Courier{}).Where("id = ?", courierID).
+		UpdateColumns(map[string]interface{}{"last_lat": lat, "last_lng": lng, "located_at": time.Now()}).Error
+}
+
+func (s *CourierService) Get(ctx context.Context, id string) (*domain.Courier, error) {
+	var c domain.Courier
+	if err := s.db.WithContext(ctx).First(&c, "id = ?", id).Error; err != nil { return nil, err }
+	return &c, nil
+}
+
+func validateCourier(c *domain.Courier) error {
+	if c.WorkStart != "" && !workHoursRe.MatchString(c.WorkStart) { return ErrInvalidWorkHours }
+	if c.WorkEnd != "" && !workHoursRe.MatchString(c.WorkEnd) { return ErrInvalidWorkHours }
+	if !c.Vehicle.Valid() { return ErrInvalidVehicle }
+	if c.CapacityBags <= 0 { return ErrInvalidCapacity }
+	return nil
+}
+
+func polygonExists(db *gorm.DB, id uuid.UUID) error {
+	var n int64
+	if err := db.Model(&domain.Polygon{}).Where("id = ?", id).Count(&n).Error; err != nil { return err }
+	if n == 0 { return ErrPolygonNotFound }
+	return nil
+}
+
+func activeCourier(db *gorm.DB, userID uuid.UUID) (*domain.Courier, error) {
+	var c domain.Courier
+	err := db.Where("user_id = ?", userID).First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrNotCourier }
+	if err != nil { return nil, err }
+	if !c.IsActive { return nil, ErrCourierInactive }
+	return &c, nil
+}
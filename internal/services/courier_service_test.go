@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestValidateCourier(t *testing.T) {
+	cases := []struct {
+		name string
+		c domain.Courier
+		want error
+	}{
+		{"valid", domain.Courier{Vehicle: domain.VehicleCar, CapacityBags: 20, WorkStart: "08:00", WorkEnd: "20:00"}, nil},
+		{"bad hours", domain.Courier{Vehicle: domain.VehicleFoot, CapacityBags: 10, WorkStart: "8"}, ErrInvalidWorkHours},
+		{"unknown vehicle", domain.Courier{Vehicle: "TRUCK", CapacityBags: 10}, ErrInvalidVehicle},
+		{"no vehicle", domain.Courier{CapacityBags: 10}, ErrInvalidVehicle},
+		{"zero capacity", domain.Courier{Vehicle: domain.VehicleFoot}, ErrInvalidCapacity},
+		{"negative capacity", domain.Courier{Vehicle: domain.VehicleFoot, CapacityBags: -1}, ErrInvalidCapacity},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validateCourier(&tc.c); !errors.Is(err, tc.want) { t.Fatalf("got %v, want %v", err, tc.want) }
+		})
+	}
+}
+
+func TestCreateCourierNotFound(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	couriers := NewCourierService(addrs.db)
+	c := domain.Courier{UserID: uuid.New(), PolygonID: *addr.PolygonID, Vehicle: domain.VehicleFoot, CapacityBags: 10}
+	if err := couriers.Create(ctx, &c); !errors.Is(err, ErrUserNotFound) { t.Fatalf("unknown user: %v", err) }
+	c = domain.Courier{UserID: owner.ID, PolygonID: uuid.New(), Vehicle: domain.VehicleFoot, CapacityBags: 10}
+	if err := couriers.Create(context.Background(), &c); !errors.Is(err, ErrPolygonNotFound) { t.Fatalf("unknown polygon: %v", err) }
+}
+
+// TestCreateCourierExists refuses to make a courier of a user who is one
+// already.
+func TestCreateCourierExists(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	couriers := NewCourierService(addrs.db)
+	c := domain.Courier{UserID: owner.ID, PolygonID: *addr.PolygonID, IsActive: true}
+	if err := couriers.Create(ctx, &c); err != nil { t.Fatal(err) }
+	again := domain.Courier{UserID: owner.ID, PolygonID: *addr.PolygonID, IsActive: true}
+	if err := couriers.Create(ctx, &again); !errors.Is(err, ErrCourierExists) { t.Fatalf("second assignment: %v", err) }
+}
+
+// TestUpdateCourierSessions ends the courier's sessions when it is
+// deactivated or moved to another zone, and only then.
+func TestUpdateCourierSessions(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	u, err := NewUserService(db).Create(ctx, "+77079990101", "", "", "", domain.RoleCourier)
+	if err != nil { t.Fatal(err) }
+	couriers := NewCourierService(db)
+	c := domain.Courier{UserID: u.ID, PolygonID: *addr.PolygonID, IsActive: true}
+	if err := couriers.Create(ctx, &c); err != nil { t.Fatal(err) }
+	other := domain.Polygon{Name: "other zone", City: "Алматы", GeoJSON: "{}"}
+	if err := db.Create(&other).Error; err != nil { t.Fatal(err) }
+	login := func() *domain.Session {
+		t.Helper()
+		s := domain.Session{ID: uuid.New(), UserID: u.ID, FamilyID: uuid.New(), RefreshTokenHash: uuid.NewString(), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := db.Create(&s).Error; err != nil { t.Fatal(err) }
+		return &s
+	}
+	revoked := func(s *domain.Session) bool {
+		t.Helper()
+		if err := db.First(s, "id = ?", s.ID).Error; err != nil { t.Fatal(err) }
+		return s.RevokedAt != nil
+	}
+
+	s := login()
+	c.CapacityBags = 20
+	if err := couriers.Update(ctx, &c); err != nil { t.Fatal(err) }
+	if revoked(s) { t.Fatal("capacity change ended the session") }
+	c.PolygonID = other.ID
+	if err := couriers.Update(ctx, &c); err != nil { t.Fatal(err) }
+	if !revoked(s) { t.Fatal("zone change left the session") }
+	s = login()
+	c.IsActive = false
+	if err := couriers.Update(ctx, &c); err != nil { t.Fatal(err) }
+	if !revoked(s) { t.Fatal("deactivation left the session") }
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ThrottledError is returned when a caller has to back off, e.g. by
+// OTPService.Send or LoginGuard.Begin. RetryAfter tells the client when to
+// try again and becomes the Retry-After header of the 429 response.
+type ThrottledError struct {
+	Reason string
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("throttled: %s, retry after %s", e.Reason, e.RetryAfter)
+}
+
+// LoginPolicy configures LoginGuard. Failures are counted in a sliding
+// Window per login identifier and per client IP. After FreeAttempts failures
+// of an identifier every further attempt has to wait BaseDelay, doubling per
+// failure up to MaxDelay, since the last failure. LockoutThreshold failures
+// of an identifier, or IPThreshold failures from an IP, lock it out for
+// LockoutDuration.
+type LoginPolicy struct {
+	Window time.Duration
+	FreeAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	LockoutThreshold int
+	IPThreshold int
+	LockoutDuration time.Duration
+}
+
+// AttemptLimit is how attempts on one key are held back: by a progressive
+// delay after FreeAttempts failures within Window, and by a lockout for
+// LockoutDuration once Threshold failures are reached.
+type AttemptLimit struct {
+	Key string
+	Window time.Duration
+	FreeAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	Threshold int
+	LockoutDuration time.Duration
+}
+
+// delay is the wait required after n failures.
+func (l AttemptLimit) delay(n int) time.Duration {
+	extra := n - l.FreeAttempts
+	if extra <= 0 || l.BaseDelay <= 0 { return 0 }
+	d := l.BaseDelay
+	for i := 1; i < extra && d < l.MaxDelay; i++ { d *= 2 }
+	if l.MaxDelay > 0 && d > l.MaxDelay { d = l.MaxDelay }
+	return d
+}
+
+// AttemptStore keeps sliding-window failure logs and lockouts. The Redis
+// implementation is redisrepo.AttemptStore; MemoryAttemptStore serves
+// single-process development and tests.
+type AttemptStore interface {
+	// Reserve checks the limits and logs the attempt id as a failure under
+	// every key in one atomic step, locking the keys that reach their
+	// threshold. When a limit holds the attempt back nothing is logged and
+	// it returns the wait, and whether a lockout rather than a delay is the
+	// cause.
+	Reserve(ctx context.Context, id string, now time.Time, limits []AttemptLimit) (time.Duration, bool, error)
+	// Release takes the attempt id back out of the logs of keys.
+	Release(ctx context.Context, id string, keys []string) error
+	Reset(ctx context.Context, key string) error
+}
+
+// LoginGuard throttles password and OTP logins against brute force. Every
+// attempt is counted as a failure before the credentials are checked, so
+// parallel guesses cannot all slip in before the first one is recorded.
+type LoginGuard struct {
+	store AttemptStore
+	policy LoginPolicy
+	now func() time.Time
+}
+
+func NewLoginGuard(store AttemptStore, policy LoginPolicy) *LoginGuard {
+	return &LoginGuard{store: store, policy: policy, now: time.Now}
+}
+
+// LoginAttempt is an attempt reserved by LoginGuard.Begin. It stays counted
+// as a failure unless it succeeds or is released.
+type LoginAttempt struct {
+	g *LoginGuard
+	id string
+	keys []string
+}
+
+// Begin reserves an attempt for identifier from ip, or returns a
+// *ThrottledError when either is locked out or has to wait out a
+// progressive delay. Call it before verifying credentials.
+func (g *LoginGuard) Begin(ctx context.Context, identifier, ip string) (*LoginAttempt, error) {
+	limits := []AttemptLimit{{
+		Key: "id:" + identifier, Window: g.policy.Window, FreeAttempts: g.policy.FreeAttempts,
+		BaseDelay: g.policy.BaseDelay, MaxDelay: g.policy.MaxDelay,
+		Threshold: g.policy.LockoutThreshold, LockoutDuration: g.policy.LockoutDuration,
+	}}
+	if ip != "" {
+		limits = append(limits, AttemptLimit{Key: "ip:" + ip, Window: g.policy.Window, Threshold: g.policy.IPThreshold, LockoutDuration: g.policy.LockoutDuration})
+	}
+	a := &LoginAttempt{g: g, id: uuid.NewString()}
+	for _, l := range limits { a.keys = append(a.keys, l.Key) }
+	wait, locked, err := g.store.Reserve(ctx, a.id, g.now(), limits)
+	if err != nil { return nil, err }
+	switch {
+	case locked:
+		return nil, &ThrottledError{Reason: "too many failed attempts, temporarily locked", RetryAfter: wait}
+	case wait > 0:
+		return nil, &ThrottledError{Reason: "too many failed attempts, slow down", RetryAfter: wait}
+	}
+	return a, nil
+}
+
+// Succeed clears the failure log of the identifier after a successful
+// login and takes the attempt back out of the IP log, so many users behind
+// one NAT address do not lock it by logging in. Earlier failures from the
+// IP stay, so one address cannot reset them with its own account.
+func (a *LoginAttempt) Succeed(ctx context.Context) error {
+	if err := a.g.store.Reset(ctx, a.keys[0]); err != nil { return err }
+	if len(a.keys) == 1 { return nil }
+	return a.g.store.Release(ctx, a.id, a.keys[1:])
+}
+
+// Release stops counting the attempt, for outcomes that say nothing about
+// the credentials, such as a code that was never sent.
+func (a *LoginAttempt) Release(ctx context.Context) error {
+	return a.g.store.Release(ctx, a.id, a.keys)
+}
+
+// MemoryAttemptStore is an in-process AttemptStore used when Redis is
+// disabled and in tests.
+type MemoryAttemptStore struct {
+	mu sync.Mutex
+	failures map[string][]failure
+	locks map[string]time.Time
+}
+
+type failure struct {
+	at time.Time
+	id string
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{failures: map[string][]failure{}, locks: map[string]time.Time{}}
+}
+
+// prune drops failures older than the window. Callers hold mu.
+func (m *MemoryAttemptStore) prune(key string, now time.Time, window time.Duration) []failure {
+	from := now.Add(-window)
+	log := m.failures[key]
+	i := sort.Search(len(log), func(i int) bool { return log[i].at.After(from) })
+	log = log[i:]
+	m.failures[key] = log
+	return log
+}
+
+func (m *MemoryAttemptStore) Reserve(_ context.Context, id string, now time.Time, limits []AttemptLimit) (time.Duration, bool, error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	var wait time.Duration
+	locked := false
+	for _, l := range limits {
+		if until := m.locks[l.Key]; until.After(now) {
+			wait, locked = max(wait, until.Sub(now)), true
+		}
+		log := m.prune(l.Key, now, l.Window)
+		if d := l.delay(len(log)); d > 0 && log[len(log)-1].at.Add(d).After(now) {
+			wait = max(wait, log[len(log)-1].at.Add(d).Sub(now))
+		}
+	}
+	if wait > 0 { return wait, locked, nil }
+	for _, l := range limits {
+		log := append(m.failures[l.Key], failure{at: now, id: id})
+		m.failures[l.Key] = log
+		if l.Threshold > 0 && len(log) >= l.Threshold {
+			m.locks[l.Key] = now.Add(l.LockoutDuration)
+			delete(m.failures, l.Key)
+		}
+	}
+	return 0, false, nil
+}
+
+func (m *MemoryAttemptStore) Release(_ context.Context, id string, keys []string) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	for _, key := range keys {
+		log := m.failures[key]
+		for i := range log {
+			if log[i].id == id { m.failures[key] = append(log[:i:i], log[i+1:]...); break }
+		}
+	}
+	return nil
+}
+
+func (m *MemoryAttemptStore) Reset(_ context.Context, key string) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
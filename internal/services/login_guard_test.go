@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testLoginPolicy = LoginPolicy{
+	Window: 15 * time.Minute, FreeAttempts: 3, BaseDelay: 2 * time.Second, MaxDelay: 10 * time.Second,
+	LockoutThreshold: 8, IPThreshold: 12, LockoutDuration: 15 * time.Minute,
+}
+
+func newTestGuard() (*LoginGuard, *time.Time) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := NewLoginGuard(NewMemoryAttemptStore(), testLoginPolicy)
+	g.now = func() time.Time { return clock }
+	return g, &clock
+}
+
+func retryAfter(t *testing.T, err error) time.Duration {
+	t.Helper()
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) { t.Fatalf("expected ThrottledError, got %v", err) }
+	return throttled.RetryAfter
+}
+
+// attempt reserves an attempt that is expected to be let through.
+func attempt(t *testing.T, g *LoginGuard, identifier, ip string) *LoginAttempt {
+	t.Helper()
+	a, err := g.Begin(context.Background(), identifier, ip)
+	if err != nil { t.Fatalf("attempt of %s from %q: %v", identifier, ip, err) }
+	return a
+}
+
+func throttled(t *testing.T, g *LoginGuard, identifier, ip string) time.Duration {
+	t.Helper()
+	_, err := g.Begin(context.Background(), identifier, ip)
+	return retryAfter(t, err)
+}
+
+func TestLoginGuardProgressiveDelay(t *testing.T) {
+	g, clock := newTestGuard()
+	for i := 0; i <= testLoginPolicy.FreeAttempts; i++ { attempt(t, g, "+77070000001", "10.0.0.1") }
+	// 4th failure: 2s, 5th: 4s, 6th: 8s, 7th: capped at 10s
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if got := throttled(t, g, "+77070000001", "10.0.0.1"); got != want { t.Fatalf("delay %s, want %s", got, want) }
+		*clock = clock.Add(want)
+		attempt(t, g, "+77070000001", "10.0.0.1")
+	}
+	attempt(t, g, "+77070000002", "10.0.0.1")
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	g, clock := newTestGuard()
+	for i := 0; i < testLoginPolicy.LockoutThreshold; i++ {
+		attempt(t, g, "user@example.com", "10.0.0.1")
+		*clock = clock.Add(testLoginPolicy.MaxDelay)
+	}
+	if got := throttled(t, g, "user@example.com", "10.0.0.2"); got != testLoginPolicy.LockoutDuration-testLoginPolicy.MaxDelay {
+		t.Fatalf("lockout %s, want %s", got, testLoginPolicy.LockoutDuration-testLoginPolicy.MaxDelay)
+	}
+	*clock = clock.Add(testLoginPolicy.LockoutDuration)
+	attempt(t, g, "user@example.com", "10.0.0.2")
+}
+
+func TestLoginGuardIPLockout(t *testing.T) {
+	g, _ := newTestGuard()
+	// spread over many identifiers so none of them hits its own limits
+	for i := 0; i < testLoginPolicy.IPThreshold; i++ { attempt(t, g, string(rune('a'+i)), "10.0.0.1") }
+	throttled(t, g, "fresh", "10.0.0.1")
+	attempt(t, g, "fresh", "10.0.0.2")
+}
+
+// TestLoginGuardIPSuccess logs many users in from one NAT address: their
+// successful logins must not lock it, while failures still count.
+func TestLoginGuardIPSuccess(t *testing.T) {
+	ctx := context.Background()
+	g, _ := newTestGuard()
+	for i := 0; i < testLoginPolicy.IPThreshold; i++ {
+		if err := attempt(t, g, string(rune('a'+i)), "10.0.0.1").Succeed(ctx); err != nil { t.Fatal(err) }
+	}
+	attempt(t, g, "fresh", "10.0.0.1")
+	for i := 1; i < testLoginPolicy.IPThreshold; i++ { attempt(t, g, string(rune('A'+i)), "10.0.0.1") }
+	throttled(t, g, "fresh", "10.0.0.1")
+}
+
+func TestLoginGuardWindowAndSuccess(t *testing.T) {
+	ctx := context.Background()
+	g, clock := newTestGuard()
+	for i := 0; i < testLoginPolicy.FreeAttempts+1; i++ { attempt(t, g, "u", "") }
+	throttled(t, g, "u", "")
+	*clock = clock.Add(testLoginPolicy.Window + time.Second)
+	for i := 0; i < testLoginPolicy.FreeAttempts; i++ { attempt(t, g, "u", "") }
+	if err := attempt(t, g, "u", "").Succeed(ctx); err != nil { t.Fatal(err) }
+	for i := 0; i <= testLoginPolicy.FreeAttempts; i++ { attempt(t, g, "u", "") }
+
+	// a released attempt does not count
+	*clock = clock.Add(testLoginPolicy.Window + time.Second)
+	for i := 0; i < testLoginPolicy.FreeAttempts+1; i++ {
+		if err := attempt(t, g, "v", "").Release(ctx); err != nil { t.Fatal(err) }
+	}
+	attempt(t, g, "v", "")
+}
+
+// TestLoginGuardParallel checks that parallel guesses are counted as they
+// start, so no more than the free attempts get through before the delay.
+func TestLoginGuardParallel(t *testing.T) {
+	g, _ := newTestGuard()
+	var passed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := g.Begin(context.Background(), "+77070000003", "10.0.0.3"); err == nil { passed.Add(1) }
+		}()
+	}
+	wg.Wait()
+	if n := int(passed.Load()); n != testLoginPolicy.FreeAttempts+1 { t.Fatalf("%d parallel attempts passed, want %d", n, testLoginPolicy.FreeAttempts+1) }
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrRefundFailed = errors.New("refund failed")
+	ErrOrderSubscriptionUnknown = errors.New("order does not name the subscription its bags came from")
+)
+
+// Refunder returns money of a succeeded payment through the payment
+// provider and gives the provider's refund id. The provider makes one
+// refund per key: a repeated call with the same key returns the first
+// refund instead of paying out again. paynetworks.Client is one.
+type Refunder interface {
+	Refund(ctx context.Context, intentID string, amount int, key string) (string, error)
+}
+
+// CancelPolicy is what a customer pays to cancel an order. Canceling is
+// free until a courier accepts the order; after that FeeKZT is kept from
+// the refund of a one-time order and FeeBags from the bags a subscription
+// order returns. Once the courier is picking the order up the customer can
+// no longer cancel it.
+type CancelPolicy struct {
+	FeeKZT int
+	FeeBags int
+}
+
+// Cancellation is what canceling an order cost and returned. RefundPending
+// is set while the refund waits for the provider; the order moves on to
+// REFUNDED once it is made.
+type Cancellation struct {
+	Order *domain.Order `json:"order"`
+	FeeKZT int `json:"fee_kzt"`
+	RefundKZT int `json:"refund_kzt"`
+	RefundPending bool `json:"refund_pending"`
+	FeeBags int `json:"fee_bags"`
+	ReturnedBags int `json:"returned_bags"`
+}
+
+// Terms works out the fee and what is returned for canceling o in its
+// current status. Nothing is returned for a one-time order that is not paid
+// yet, and fees never exceed what was paid. Subscription orders always drew
+// their bags when placed, even those left NEW from before they became PAID
+// right away.
+func (p CancelPolicy) Terms(o *domain.Order) Cancellation {
+	c := Cancellation{Order: o}
+	if o.Status == domain.StatusNew && o.Type != domain.OrderSubscription { return c }
+	assigned := o.Status == domain.StatusAssigned
+	if o.Type == domain.OrderSubscription {
+		if assigned { c.FeeBags = min(p.FeeBags, o.BagsCount) }
+		c.ReturnedBags = o.BagsCount - c.FeeBags
+		return c
+	}
+	if assigned { c.FeeKZT = min(p.FeeKZT, o.PriceKZT) }
+	c.RefundKZT = o.PriceKZT - c.FeeKZT
+	return c
+}
+
+// Cancel cancels an order of userID by the CancelPolicy. A subscription
+// order returns its bags less the fee to the subscription. A paid one-time
+// order is refunded less the fee: the refund is queued with the
+// cancellation and made with the provider once it commits, moving the order
+// on to REFUNDED. When the provider fails the order stays CANCELED with the
+// refund pending, and RefundService retries it.
+func (s *OrderService) Cancel(ctx context.Context, userID, id, reason string) (*Cancellation, error) {
+	oid, err := uuid.Parse(id)
+	if err != nil { return nil, ErrOrderNotFound }
+	uid, err := uuid.Parse(userID)
+	if err != nil { return nil, ErrOrderNotFound }
+	var c Cancellation
+	var refund *domain.Refund
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var o domain.Order
+		if err := lockOrder(tx, oid, &o); err != nil { return err }
+		meta := map[string]interface{}{}
+		if reason != "" { meta["reason"] = reason }
+		c, refund, err = cancelOrder(tx, &o, s.cancel, CustomerActor(uid), meta)
+		return err
+	})
+	if err != nil { return nil, err }
+	if refund != nil { c.RefundPending = !s.refunds.make(ctx, refund, c.Order) }
+	return &c, nil
+}
+
+// cancelOrder moves the locked order o to CANCELED as actor on the terms of
+// policy, and gives back what they return: bags to the subscription, or a
+// refund that it queues and returns for the caller to make once tx
+// commits. Every cancellation goes through it, except those of account
+// deletion, which only cancels unpaid orders along with the subscriptions.
+func cancelOrder(tx *gorm.DB, o *domain.Order, policy CancelPolicy, actor Actor, meta map[string]interface{}) (Cancellation, *domain.Refund, error) {
+	c := policy.Terms(o)
+	if meta == nil { meta = map[string]interface{}{} }
+	if o.Type == domain.OrderSubscription {
+		meta["fee_bags"] = c.FeeBags
+	} else {
+		meta["fee_kzt"] = c.FeeKZT
+	}
+	if err := moveOrder(tx, o, domain.StatusCanceled, actor, meta); err != nil { return c, nil, err }
+	switch {
+	case c.ReturnedBags > 0:
+		return c, nil, returnBags(tx, o, c.ReturnedBags)
+	case c.RefundKZT > 0:
+		refund, err := queueOrderRefund(tx, o, &c)
+		return c, refund, err
+	}
+	return c, nil, nil
+}
+
+// returnBags gives n bags of the canceled subscription order o back to its
+// subscription.
+func returnBags(tx *gorm.DB, o *domain.Order, n int) error {
+	if o.SubscriptionID == nil { return ErrOrderSubscriptionUnknown }
+	res := tx.Model(&domain.Subscription{}).Where("id = ?", *o.SubscriptionID).Update("remaining_bags", gorm.Expr("remaining_bags + ?", n))
+	if res.Error != nil { return res.Error }
+	if res.RowsAffected != 1 { return ErrSubscriptionNotFound }
+	return nil
+}
+
+// queueOrderRefund queues the refund of c.RefundKZT of the payment of the
+// canceled order o, never more than is left of it, keyed by the order. It
+// returns nil when nothing is left to refund.
+func queueOrderRefund(tx *gorm.DB, o *domain.Order, c *Cancellation) (*domain.Refund, error) {
+	var p domain.Payment
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_id = ? AND status = ?", o.ID, domain.PaySucceeded).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, fmt.Errorf("%w: order %s has no succeeded payment", ErrPaymentNotFound, o.ID) }
+	if err != nil { return nil, err }
+	left, err := refundable(tx, &p)
+	if err != nil { return nil, err }
+	c.RefundKZT = min(c.RefundKZT, left)
+	if c.RefundKZT == 0 { return nil, nil }
+	return queueRefund(tx, &p, o, c.RefundKZT, o.ID.String())
+}
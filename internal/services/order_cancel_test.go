@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestCancelTerms(t *testing.T) {
+	policy := CancelPolicy{FeeKZT: 300, FeeBags: 1}
+	cases := []struct {
+		name string
+		o domain.Order
+		want Cancellation
+	}{
+		{"unpaid", domain.Order{Type: domain.OrderOneTime, Status: domain.StatusNew, PriceKZT: 748, BagsCount: 2}, Cancellation{}},
+		{"paid", domain.Order{Type: domain.OrderOneTime, Status: domain.StatusPaid, PriceKZT: 748, BagsCount: 2}, Cancellation{RefundKZT: 748}},
+		{"assigned", domain.Order{Type: domain.OrderOneTime, Status: domain.StatusAssigned, PriceKZT: 748, BagsCount: 2}, Cancellation{FeeKZT: 300, RefundKZT: 448}},
+		{"fee above the price", domain.Order{Type: domain.OrderOneTime, Status: domain.StatusAssigned, PriceKZT: 249, BagsCount: 1}, Cancellation{FeeKZT: 249}},
+		{"subscription", domain.Order{Type: domain.OrderSubscription, Status: domain.StatusPaid, BagsCount: 3}, Cancellation{ReturnedBags: 3}},
+		{"subscription left new", domain.Order{Type: domain.OrderSubscription, Status: domain.StatusNew, BagsCount: 3}, Cancellation{ReturnedBags: 3}},
+		{"assigned subscription", domain.Order{Type: domain.OrderSubscription, Status: domain.StatusAssigned, BagsCount: 3}, Cancellation{FeeBags: 1, ReturnedBags: 2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := policy.Terms(&tc.o)
+			got.Order = nil
+			if got != tc.want { t.Fatalf("got %+v, want %+v", got, tc.want) }
+		})
+	}
+}
+
+// fakeRefunder pays out once per key like the provider.
+type fakeRefunder struct {
+	amounts []int
+	keys map[string]bool
+	err error
+}
+
+func (f *fakeRefunder) Refund(ctx context.Context, intentID string, amount int, key string) (string, error) {
+	if f.err != nil { return "", f.err }
+	if f.keys == nil { f.keys = map[string]bool{} }
+	if !f.keys[key] { f.amounts = append(f.amounts, amount) }
+	f.keys[key] = true
+	return "refund_" + key, nil
+}
+
+// TestCancelOrder cancels one-time and subscription orders before and after
+// a courier accepts them.
+func TestCancelOrder(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	tariffs := NewTariffService(db, almaty)
+	provider := &fakeRefunder{}
+	// no delay between tries, so a retry right after a failure is due
+	refunds := NewRefundService(db, provider, RefundPolicy{MaxAttempts: 5})
+	orders := NewOrderService(db, addrs, tariffs, refunds, CancelPolicy{FeeKZT: 300, FeeBags: 1})
+	payments := NewPaymentService(db, refunds)
+	subs := NewSubscriptionService(db, addrs, tariffs)
+	machine := NewOrderStateMachine(db, refunds)
+	u, err := NewUserService(db).Create(ctx, "+77079990100", "", "", "", domain.RoleCourier)
+	if err != nil { t.Fatal(err) }
+	courier := domain.Courier{UserID: u.ID, PolygonID: *addr.PolygonID, IsActive: true}
+	if err := NewCourierService(db).Create(ctx, &courier); err != nil { t.Fatal(err) }
+	req := OrderRequest{AddressID: addr.ID.String(), BagsCount: 2, TimeOption: domain.ASAP}
+	paid := func(intent string) *domain.Order {
+		o, err := orders.Create(ctx, owner.ID.String(), req)
+		if err != nil { t.Fatal(err) }
+		if _, err := payments.Record(ctx, owner.ID, &o.ID, nil, intent, o.PriceKZT); err != nil { t.Fatal(err) }
+		if _, err := payments.Apply(ctx, intent, domain.PaySucceeded, o.PriceKZT, nil); err != nil { t.Fatal(err) }
+		return o
+	}
+
+	// unpaid: nothing to refund
+	o, err := orders.Create(ctx, owner.ID.String(), req)
+	if err != nil { t.Fatal(err) }
+	if c, err := orders.Cancel(ctx, owner.ID.String(), o.ID.String(), "changed my mind"); err != nil || c.Order.Status != domain.StatusCanceled || c.RefundKZT != 0 { t.Fatalf("unpaid: %+v %v", c, err) }
+
+	// paid: refunded in full
+	o = paid("intent_cancel_1")
+	c, err := orders.Cancel(ctx, owner.ID.String(), o.ID.String(), "")
+	if err != nil { t.Fatal(err) }
+	if c.Order.Status != domain.StatusRefunded || c.FeeKZT != 0 || c.RefundKZT != o.PriceKZT { t.Fatalf("paid: %+v", c) }
+	var p domain.Payment
+	if err := db.Where("provider_intent_id = ?", "intent_cancel_1").First(&p).Error; err != nil { t.Fatal(err) }
+	if p.RefundedKZT != o.PriceKZT || p.ProviderRefundID == nil { t.Fatalf("payment: %+v", p) }
+
+	// assigned: refunded less the fee; a failing provider leaves the order
+	// canceled with the refund pending until a retry makes it
+	o = paid("intent_cancel_2")
+	if _, err := machine.Transition(ctx, o.ID.String(), domain.StatusAssigned, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if _, err := orders.Cancel(ctx, u.ID.String(), o.ID.String(), ""); !errors.Is(err, ErrOrderNotFound) { t.Fatalf("foreign order: %v", err) }
+	provider.err = errors.New("provider down")
+	c, err = orders.Cancel(ctx, owner.ID.String(), o.ID.String(), "")
+	if err != nil { t.Fatalf("provider down: %v", err) }
+	if c.Order.Status != domain.StatusCanceled || !c.RefundPending || c.FeeKZT != 300 || c.RefundKZT != o.PriceKZT-300 { t.Fatalf("provider down: %+v", c) }
+	var pending domain.Refund
+	if err := db.Where("order_id = ?", o.ID).First(&pending).Error; err != nil { t.Fatal(err) }
+	if pending.Status != domain.RefundPending || pending.Attempts != 1 || pending.LastError == nil { t.Fatalf("pending refund: %+v", pending) }
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 0 { t.Fatalf("retry while down: %d %v", n, err) }
+	provider.err = nil
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 1 { t.Fatalf("retry: %d %v", n, err) }
+	// a second run finds nothing left and pays out nothing
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 0 { t.Fatalf("second retry: %d %v", n, err) }
+	if err := refunds.Process(ctx, pending.ID); err != nil { t.Fatal(err) }
+	if got, _ := orders.Get(ctx, owner.ID.String(), o.ID.String()); got.Status != domain.StatusRefunded { t.Fatalf("after retry: %s", got.Status) }
+	if len(provider.amounts) != 2 || provider.amounts[1] != o.PriceKZT-300 { t.Fatalf("refunds %v", provider.amounts) }
+	var retried domain.Payment
+	if err := db.Where("order_id = ?", o.ID).First(&retried).Error; err != nil || retried.RefundedKZT != o.PriceKZT-300 { t.Fatalf("payment after retry: %+v %v", retried, err) }
+
+	// picking up: too late
+	o = paid("intent_cancel_3")
+	if _, err := machine.Transition(ctx, o.ID.String(), domain.StatusAssigned, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, o.ID.String(), domain.StatusPickingUp, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if _, err := orders.Cancel(ctx, owner.ID.String(), o.ID.String(), ""); !errors.Is(err, ErrOrderTransition) { t.Fatalf("picking up: %v", err) }
+	// the courier still can, and the customer gets everything back
+	canceled, err := machine.Transition(ctx, o.ID.String(), domain.StatusCanceled, CourierActor(courier.ID, courier.PolygonID), map[string]interface{}{"reason": "nobody home"})
+	if err != nil { t.Fatal(err) }
+	if canceled.Status != domain.StatusRefunded || provider.amounts[len(provider.amounts)-1] != o.PriceKZT { t.Fatalf("courier cancel: %s, refunds %v", canceled.Status, provider.amounts) }
+
+	// subscription orders return their bags, less the fee once assigned
+	sub, err := subs.Create(ctx, owner.ID, domain.PlanP7)
+	if err != nil { t.Fatal(err) }
+	so, err := subs.CreateOrder(ctx, owner.ID, req)
+	if err != nil { t.Fatal(err) }
+	if c, err := orders.Cancel(ctx, owner.ID.String(), so.ID.String(), ""); err != nil || c.ReturnedBags != 2 { t.Fatalf("subscription: %+v %v", c, err) }
+	so, err = subs.CreateOrder(ctx, owner.ID, req)
+	if err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, so.ID.String(), domain.StatusAssigned, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if c, err := orders.Cancel(ctx, owner.ID.String(), so.ID.String(), ""); err != nil || c.FeeBags != 1 || c.ReturnedBags != 1 || c.Order.Status != domain.StatusCanceled { t.Fatalf("assigned subscription: %+v %v", c, err) }
+	if err := db.First(sub, "id = ?", sub.ID).Error; err != nil { t.Fatal(err) }
+	if sub.RemainingBags != sub.TotalBags-1 { t.Fatalf("remaining bags %d of %d", sub.RemainingBags, sub.TotalBags) }
+	// canceled by the courier, all bags go back
+	so, err = subs.CreateOrder(ctx, owner.ID, req)
+	if err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, so.ID.String(), domain.StatusAssigned, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, so.ID.String(), domain.StatusCanceled, CourierActor(courier.ID, courier.PolygonID), nil); err != nil { t.Fatal(err) }
+	if err := db.First(sub, "id = ?", sub.ID).Error; err != nil { t.Fatal(err) }
+	if sub.RemainingBags != sub.TotalBags-1 { t.Fatalf("remaining bags after courier cancel %d of %d", sub.RemainingBags, sub.TotalBags) }
+
+	// a subscription order left NEW from before orders named their
+	// subscription is refused rather than losing its bags
+	legacy := domain.Order{UserID: owner.ID, AddressID: addr.ID, PolygonID: *addr.PolygonID, Type: domain.OrderSubscription, BagsCount: 1, TimeOption: domain.ASAP, Status: domain.StatusNew}
+	if err := db.Create(&legacy).Error; err != nil { t.Fatal(err) }
+	if _, err := orders.Cancel(ctx, owner.ID.String(), legacy.ID.String(), ""); !errors.Is(err, ErrOrderSubscriptionUnknown) { t.Fatalf("legacy subscription order: %v", err) }
+	if err := db.Model(&legacy).Update("subscription_id", sub.ID).Error; err != nil { t.Fatal(err) }
+	if c, err := orders.Cancel(ctx, owner.ID.String(), legacy.ID.String(), ""); err != nil || c.ReturnedBags != 1 { t.Fatalf("backfilled legacy order: %+v %v", c, err) }
+
+	// a payment that succeeds after its order was canceled is refunded in full
+	o, err = orders.Create(ctx, owner.ID.String(), req)
+	if err != nil { t.Fatal(err) }
+	if _, err := payments.Record(ctx, owner.ID, &o.ID, nil, "intent_cancel_late", o.PriceKZT); err != nil { t.Fatal(err) }
+	if _, err := orders.Cancel(ctx, owner.ID.String(), o.ID.String(), ""); err != nil { t.Fatal(err) }
+	provider.err = errors.New("provider down")
+	late, err := payments.Apply(ctx, "intent_cancel_late", domain.PaySucceeded, o.PriceKZT, nil)
+	if err != nil { t.Fatalf("late payment, provider down: %v", err) }
+	if late.Status != domain.PaySucceeded || late.RefundedKZT != 0 { t.Fatalf("late payment, provider down: %+v", late) }
+	if got, _ := orders.Get(ctx, owner.ID.String(), o.ID.String()); got.Status != domain.StatusCanceled { t.Fatalf("order after late payment, provider down: %s", got.Status) }
+	provider.err = nil
+	// the provider's retry of the event changes nothing
+	if _, err := payments.Apply(ctx, "intent_cancel_late", domain.PaySucceeded, o.PriceKZT, nil); err != nil { t.Fatal(err) }
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 1 { t.Fatalf("retry late refund: %d %v", n, err) }
+	if err := db.Where("id = ?", late.ID).First(late).Error; err != nil { t.Fatal(err) }
+	if late.RefundedKZT != o.PriceKZT { t.Fatalf("late payment: %+v", late) }
+	if got, _ := orders.Get(ctx, owner.ID.String(), o.ID.String()); got.Status != domain.StatusRefunded { t.Fatalf("order after late payment: %s", got.Status) }
+	if n := len(provider.amounts); n != 4 || provider.amounts[n-1] != o.PriceKZT { t.Fatalf("refunds %v", provider.amounts) }
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrInvalidBags = errors.New("bags_count must be > 0")
+	ErrInvalidTimeOption = errors.New("time_option must be ASAP or SCHEDULED")
+	ErrScheduleRequired = errors.New("scheduled_at required for a SCHEDULED order")
+	ErrScheduleInPast = errors.New("scheduled_at must be in the future")
+	ErrOrderNotFound = errors.New("order not found")
+)
+
+// OrderRequest is what a customer submits to place an order.
+type OrderRequest struct {
+	AddressID string `json:"address_id"`
+	BagsCount int `json:"bags_count"`
+	TimeOption domain.TimeOption `json:"time_option"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+	Comment string `json:"comment"`
+	Promocode string `json:"promocode"`
+}
+
+// check refuses a request that could not be priced or served as asked: no
+// bags, an unknown time option, or a SCHEDULED one without a time after
+// now.
+func (r OrderRequest) check(now time.Time) error {
+	if r.BagsCount <= 0 { return ErrInvalidBags }
+	if !r.TimeOption.Valid() { return ErrInvalidTimeOption }
+	if r.TimeOption != domain.SCHEDULED { return nil }
+	if r.ScheduledAt == nil { return ErrScheduleRequired }
+	if !r.ScheduledAt.After(now) { return ErrScheduleInPast }
+	return nil
+}
+
+// Quote is the price of a prospective order. Addresses outside every zone
+// are quoted by the default tariff.
+type Quote struct {
+	PriceKZT int `json:"price_kzt"`
+	CanServe bool `json:"can_serve"`
+	PolygonName *string `json:"polygon_name"`
+	Breakdown Price `json:"breakdown"`
+}
+
+// OrderService is the customer side of orders. Every method takes the
+// caller's user id and only ever sees that user's orders and addresses.
+type OrderService struct {
+	db *gorm.DB
+	addrs *AddressService
+	tariffs *TariffService
+	refunds *RefundService
+	cancel CancelPolicy
+}
+
+func NewOrderService(db *gorm.DB, addrs *AddressService, tariffs *TariffService, refunds *RefundService, cancel CancelPolicy) *OrderService {
+	return &OrderService{db: db, addrs: addrs, tariffs: tariffs, refunds: refunds, cancel: cancel}
+}
+
+// Quote prices req by the tariff of its address valid now, as Create would.
+func (s *OrderService) Quote(ctx context.Context, userID string, req OrderRequest) (*Quote, error) {
+	if err := req.check(time.Now()); err != nil { return nil, err }
+	addr, err := s.addrs.Get(ctx, userID, req.AddressID)
+	if err != nil { return nil, err }
+	t, err := s.tariffs.Current(ctx, addr.PolygonID, time.Now())
+	if err != nil { return nil, err }
+	p := PriceOrder(t, req.BagsCount, req.TimeOption, req.ScheduledAt, s.tariffs.loc)
+	return &Quote{PriceKZT: p.TotalKZT, CanServe: addr.PolygonID != nil, PolygonName: addr.PolygonName, Breakdown: p}, nil
+}
+
+// Create places a one-time order of userID, priced by the zone's tariff
+// valid now. The order starts as NEW and moves to PAID once the payment the
+// caller starts for it succeeds.
+func (s *OrderService) Create(ctx context.Context, userID string, req OrderRequest) (*domain.Order, error) {
+	if err := req.check(time.Now()); err != nil { return nil, err }
+	addr, err := s.addrs.Get(ctx, userID, req.AddressID)
+	if err != nil { return nil, err }
+	if addr.PolygonID == nil { return nil, ErrNotServed }
+	t, err := s.tariffs.Current(ctx, addr.PolygonID, time.Now())
+	if err != nil { return nil, err }
+	p := PriceOrder(t, req.BagsCount, req.TimeOption, req.ScheduledAt, s.tariffs.loc)
+	order := domain.Order{
+		UserID: addr.UserID, AddressID: addr.ID, PolygonID: *addr.PolygonID,
+		Type: domain.OrderOneTime, BagsCount: req.BagsCount, PriceKZT: p.TotalKZT,
+		Comment: req.Comment, TimeOption: req.TimeOption, ScheduledAt: req.ScheduledAt,
+		Status: domain.StatusNew, TariffID: &t.ID, TariffVersion: &t.Version,
+	}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil { return err }
+		return writeOrderEvent(tx, &order, nil, CustomerActor(addr.UserID), nil)
+	})
+	if err != nil { return nil, err }
+	return &order, nil
+}
+
+// Timeline returns the status changes of an order of userID, oldest first.
+func (s *OrderService) Timeline(ctx context.Context, userID, id string) ([]domain.OrderEvent, error) {
+	o, err := s.Get(ctx, userID, id)
+	if err != nil { return nil, err }
+	return NewOrderStateMachine(s.db, s.refunds).Timeline(ctx, o.ID)
+}
+
+// Get returns an order of userID or ErrOrderNotFound.
+func (s *OrderService) Get(ctx context.Context, userID, id string) (*domain.Order, error) {
+	if _, err := uuid.Parse(id); err != nil { return nil, ErrOrderNotFound }
+	var o domain.Order
+	err := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userID).First(&o).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrOrderNotFound }
+	if err != nil { return nil, err }
+	return &o, nil
+}
+
+// History pages through the orders of userID by creation time.
+func (s *OrderService) History(ctx context.Context, userID uuid.UUID, page, limit int, asc bool) ([]domain.Order, int64, error) {
+	db := s.db.WithContext(ctx)
+	order := "created_at desc"
+	if asc { order = "created_at asc" }
+	var total int64
+	if err := db.Model(&domain.Order{}).Where("user_id = ?", userID).Count(&total).Error; err != nil { return nil, 0, err }
+	orders := []domain.Order{}
+	err := db.Where("user_id = ?", userID).Order(order).Offset((page - 1) * limit).Limit(limit).Find(&orders).Error
+	return orders, total, err
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestOrderRequestCheck(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	later, earlier := now.Add(time.Hour), now.Add(-time.Minute)
+	cases := []struct {
+		name string
+		req OrderRequest
+		want error
+	}{
+		{"asap", OrderRequest{BagsCount: 1, TimeOption: domain.ASAP}, nil},
+		{"scheduled", OrderRequest{BagsCount: 1, TimeOption: domain.SCHEDULED, ScheduledAt: &later}, nil},
+		{"no bags", OrderRequest{TimeOption: domain.ASAP}, ErrInvalidBags},
+		{"no time option", OrderRequest{BagsCount: 1}, ErrInvalidTimeOption},
+		{"unknown time option", OrderRequest{BagsCount: 1, TimeOption: "TOMORROW"}, ErrInvalidTimeOption},
+		{"scheduled without a time", OrderRequest{BagsCount: 1, TimeOption: domain.SCHEDULED}, ErrScheduleRequired},
+		{"scheduled in the past", OrderRequest{BagsCount: 1, TimeOption: domain.SCHEDULED, ScheduledAt: &earlier}, ErrScheduleInPast},
+		{"scheduled for now", OrderRequest{BagsCount: 1, TimeOption: domain.SCHEDULED, ScheduledAt: &now}, ErrScheduleInPast},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.req.check(now); !errors.Is(err, tc.want) { t.Fatalf("got %v, want %v", err, tc.want) }
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrOrderTransition = errors.New("order cannot move to this status")
+	ErrOrderForbidden = errors.New("order is not assigned to this courier")
+	ErrOrderOutsideZone = errors.New("order outside of courier polygon")
+	ErrOrderTaken = errors.New("order already accepted by another courier")
+)
+
+// Actor is who changes an order. ID is the user id of a customer or admin
+// and couriers.id of a courier; the system has none. PolygonID is the zone
+// a courier works in, from the cid/pid claims of their token, so accepting
+// an order needs no lookup of the courier.
+type Actor struct {
+	Role domain.ActorRole
+	ID uuid.UUID
+	PolygonID uuid.UUID
+}
+
+func CustomerActor(userID uuid.UUID) Actor { return Actor{Role: domain.ActorCustomer, ID: userID} }
+func CourierActor(courierID, polygonID uuid.UUID) Actor {
+	return Actor{Role: domain.ActorCourier, ID: courierID, PolygonID: polygonID}
+}
+func AdminActor(userID uuid.UUID) Actor { return Actor{Role: domain.ActorAdmin, ID: userID} }
+
+// SystemActor changes orders on behalf of payments, refunds and account
+// deletion.
+var SystemActor = Actor{Role: domain.ActorSystem}
+
+// orderTransitions lists, for every status, the statuses an order may move
+// to and who may move it there. Customers only ever touch their own orders
+// and couriers only the orders assigned to them, except for accepting one.
+var orderTransitions = map[domain.OrderStatus]map[domain.OrderStatus][]domain.ActorRole{
+	domain.StatusNew: {
+		domain.StatusPaid: {domain.ActorSystem},
+		domain.StatusCanceled: {domain.ActorCustomer, domain.ActorAdmin, domain.ActorSystem},
+	},
+	domain.StatusPaid: {
+		domain.StatusAssigned: {domain.ActorCourier},
+		domain.StatusCanceled: {domain.ActorCustomer, domain.ActorAdmin, domain.ActorSystem},
+	},
+	domain.StatusAssigned: {
+		domain.StatusPickingUp: {domain.ActorCourier},
+		domain.StatusCanceled: {domain.ActorCustomer, domain.ActorCourier, domain.ActorAdmin},
+	},
+	domain.StatusPickingUp: {
+		domain.StatusDone: {domain.ActorCourier},
+		domain.StatusCanceled: {domain.ActorCourier, domain.ActorAdmin},
+	},
+	domain.StatusDone: {
+		domain.StatusRefunded: {domain.ActorAdmin},
+	},
+	domain.StatusCanceled: {
+		domain.StatusRefunded: {domain.ActorAdmin, domain.ActorSystem},
+	},
+}
+
+// CanTransition reports whether role may move an order from one status to
+// another, ownership aside.
+func CanTransition(from, to domain.OrderStatus, role domain.ActorRole) bool {
+	for _, r := range orderTransitions[from][to] {
+		if r == role { return true }
+	}
+	return false
+}
+
+// OrderStateMachine is the only way order statuses change. Each change is
+// checked against orderTransitions and the actor's ownership of the order,
+// and saved together with its domain.OrderEvent and side effects in one
+// transaction: accepting assigns the courier, completing settles the
+// courier's pay by the order's tariff, and canceling returns the bags or
+// refunds the payment like a customer's cancellation, without a fee.
+type OrderStateMachine struct {
+	db *gorm.DB
+	refunds *RefundService
+}
+
+func NewOrderStateMachine(db *gorm.DB, refunds *RefundService) *OrderStateMachine {
+	return &OrderStateMachine{db: db, refunds: refunds}
+}
+
+// Transition moves the order id to `to` as actor. meta is stored with the
+// event and may be nil. Orders of other customers are ErrOrderNotFound.
+// The refund of a canceled order is made after the change commits; when
+// the provider fails the order stays CANCELED and RefundService retries it.
+func (m *OrderStateMachine) Transition(ctx context.Context, id string, to domain.OrderStatus, actor Actor, meta map[string]interface{}) (*domain.Order, error) {
+	oid, err := uuid.Parse(id)
+	if err != nil { return nil, ErrOrderNotFound }
+	var o domain.Order
+	var refund *domain.Refund
+	err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := lockOrder(tx, oid, &o); err != nil { return err }
+		if to != domain.StatusCanceled { return moveOrder(tx, &o, to, actor, meta) }
+		_, refund, err = cancelOrder(tx, &o, CancelPolicy{}, actor, meta)
+		return err
+	})
+	if err != nil { return nil, err }
+	if refund != nil { m.refunds.make(ctx, refund, &o) }
+	return &o, nil
+}
+
+// Timeline returns the events of an order, oldest first.
+func (m *OrderStateMachine) Timeline(ctx context.Context, orderID uuid.UUID) ([]domain.OrderEvent, error) {
+	var out []domain.OrderEvent
+	return out, m.db.WithContext(ctx).Where("order_id = ?", orderID).Order("at, id").Find(&out).Error
+}
+
+func lockOrder(tx *gorm.DB, id uuid.UUID, o *domain.Order) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(o).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return ErrOrderNotFound }
+	return err
+}
+
+// moveOrder changes the locked order o inside tx. See OrderStateMachine.
+// The update is also conditional on the status o was read with, so a
+// caller that forgot the lock cannot overwrite a concurrent change.
+func moveOrder(tx *gorm.DB, o *domain.Order, to domain.OrderStatus, actor Actor, meta map[string]interface{}) error {
+	switch actor.Role {
+	case domain.ActorCustomer:
+		if o.UserID != actor.ID { return ErrOrderNotFound }
+	case domain.ActorCourier:
+		if to == domain.StatusAssigned && o.CourierID != nil {
+			// a repeated tap on accept by the winner is not an error
+			if *o.CourierID == actor.ID && o.Status == domain.StatusAssigned { return nil }
+			return ErrOrderTaken
+		}
+		if to != domain.StatusAssigned && (o.CourierID == nil || *o.CourierID != actor.ID) { return ErrOrderForbidden }
+	}
+	if !CanTransition(o.Status, to, actor.Role) {
+		return fmt.Errorf("%w: %s to %s", ErrOrderTransition, o.Status, to)
+	}
+	from := o.Status
+	o.Status, o.UpdatedAt = to, time.Now()
+	updates := map[string]interface{}{"status": o.Status, "updated_at": o.UpdatedAt}
+	switch to {
+	case domain.StatusAssigned:
+		if actor.PolygonID != o.PolygonID { return ErrOrderOutsideZone }
+		o.CourierID = &actor.ID
+		updates["courier_id"] = actor.ID
+	case domain.StatusDone:
+		if err := settleOrder(tx, o); err != nil { return err }
+	}
+	res := tx.Model(&domain.Order{}).Where("id = ? AND status = ?", o.ID, from).Updates(updates)
+	if res.Error != nil { return res.Error }
+	if res.RowsAffected != 1 { return fmt.Errorf("%w: the order changed concurrently", ErrOrderTransition) }
+	return writeOrderEvent(tx, o, &from, actor, meta)
+}
+
+// writeOrderEvent records that o reached its current status, or was
+// created when from is nil.
+func writeOrderEvent(tx *gorm.DB, o *domain.Order, from *domain.OrderStatus, actor Actor, meta map[string]interface{}) error {
+	if meta == nil { meta = map[string]interface{}{} }
+	raw, err := json.Marshal(meta)
+	if err != nil { return fmt.Errorf("order event meta: %w", err) }
+	e := domain.OrderEvent{OrderID: o.ID, FromStatus: from, ToStatus: o.Status, ActorRole: actor.Role, Meta: string(raw), At: time.Now()}
+	if actor.ID != uuid.Nil { e.ActorID = &actor.ID }
+	return tx.Create(&e).Error
+}
+
+// settleOrder records what the courier of o earns for it and adds it to
+// their balance, creating the balance row on the first settlement.
+func settleOrder(tx *gorm.DB, o *domain.Order) error {
+	amount, err := (&TariffService{db: tx}).Payout(tx.Statement.Context, o)
+	if err != nil { return err }
+	settlement := domain.OrderSettlement{OrderID: o.ID, CourierID: *o.CourierID, BagsCount: o.BagsCount, AmountKZT: amount}
+	if err := tx.Create(&settlement).Error; err != nil { return err }
+	return tx.Exec(`INSERT INTO courier_balances (courier_id, total_earned_kzt, updated_at) VALUES (?, ?, now())
+		ON CONFLICT (courier_id) DO UPDATE SET total_earned_kzt = courier_balances.total_earned_kzt + EXCLUDED.total_earned_kzt, updated_at = now()`,
+		o.CourierID, amount).Error
+}
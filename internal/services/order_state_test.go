@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestCanTransition(t *testing.T) {
+	cases := []struct {
+		from, to domain.OrderStatus
+		role domain.ActorRole
+		want bool
+	}{
+		{domain.StatusNew, domain.StatusPaid, domain.ActorSystem, true},
+		{domain.StatusNew, domain.StatusPaid, domain.ActorCustomer, false},
+		{domain.StatusNew, domain.StatusAssigned, domain.ActorCourier, false},
+		{domain.StatusPaid, domain.StatusAssigned, domain.ActorCourier, true},
+		{domain.StatusPaid, domain.StatusAssigned, domain.ActorAdmin, false},
+		{domain.StatusAssigned, domain.StatusDone, domain.ActorCourier, false},
+		{domain.StatusAssigned, domain.StatusCanceled, domain.ActorCustomer, true},
+		{domain.StatusPickingUp, domain.StatusDone, domain.ActorCourier, true},
+		{domain.StatusPickingUp, domain.StatusCanceled, domain.ActorCustomer, false},
+		{domain.StatusDone, domain.StatusRefunded, domain.ActorAdmin, true},
+		{domain.StatusDone, domain.StatusRefunded, domain.ActorSystem, false},
+		{domain.StatusRefunded, domain.StatusNew, domain.ActorAdmin, false},
+	}
+	for _, tc := range cases {
+		if got := CanTransition(tc.from, tc.to, tc.role); got != tc.want {
+			t.Errorf("%s -> %s by %s = %v, want %v", tc.from, tc.to, tc.role, got, tc.want)
+		}
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	tariffs := NewTariffService(db, almaty)
+	orders := NewOrderService(db, addrs, tariffs, nil, CancelPolicy{})
+	payments := NewPaymentService(db, nil)
+	machine := NewOrderStateMachine(db, nil)
+	couriers := NewCourierService(db)
+	var crew []domain.Courier
+	for _, phone := range []string{"+77079990070", "+77079990071"} {
+		u, err := NewUserService(db).Create(ctx, phone, "", "", "", domain.RoleCourier)
+		if err != nil { t.Fatal(err) }
+		c := domain.Courier{UserID: u.ID, PolygonID: *addr.PolygonID, IsActive: true}
+		if err := couriers.Create(ctx, &c); err != nil { t.Fatal(err) }
+		crew = append(crew, c)
+	}
+	first, second := CourierActor(crew[0].ID, crew[0].PolygonID), CourierActor(crew[1].ID, crew[1].PolygonID)
+
+	o, err := orders.Create(ctx, owner.ID.String(), OrderRequest{AddressID: addr.ID.String(), BagsCount: 2, TimeOption: domain.ASAP})
+	if err != nil { t.Fatal(err) }
+	id := o.ID.String()
+	if _, err := machine.Transition(ctx, id, domain.StatusAssigned, first, nil); !errors.Is(err, ErrOrderTransition) { t.Fatalf("accepting an unpaid order: %v", err) }
+	if _, err := payments.Record(ctx, owner.ID, &o.ID, nil, "intent_test_1", o.PriceKZT); err != nil { t.Fatal(err) }
+	if _, err := payments.Apply(ctx, "intent_test_1", domain.PaySucceeded, o.PriceKZT-1, nil); !errors.Is(err, ErrPaymentAmount) { t.Fatalf("short payment: %v", err) }
+	for i := 0; i < 2; i++ { // the replay changes nothing
+		if _, err := payments.Apply(ctx, "intent_test_1", domain.PaySucceeded, o.PriceKZT, nil); err != nil { t.Fatal(err) }
+	}
+	if o, err = orders.Get(ctx, owner.ID.String(), id); err != nil || o.Status != domain.StatusPaid { t.Fatalf("after payment: %v %v", o, err) }
+
+	if _, err := machine.Transition(ctx, id, domain.StatusAssigned, CourierActor(crew[1].ID, uuid.New()), nil); !errors.Is(err, ErrOrderOutsideZone) { t.Fatalf("accept outside the token's zone: %v", err) }
+	if _, err := machine.Transition(ctx, id, domain.StatusAssigned, first, nil); err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, id, domain.StatusAssigned, second, nil); !errors.Is(err, ErrOrderTaken) { t.Fatalf("second accept: %v", err) }
+	if o, err := machine.Transition(ctx, id, domain.StatusAssigned, first, nil); err != nil || *o.CourierID != crew[0].ID { t.Fatalf("repeated accept: %v", err) }
+	if _, err := machine.Transition(ctx, id, domain.StatusPickingUp, second, nil); !errors.Is(err, ErrOrderForbidden) { t.Fatalf("other courier: %v", err) }
+	if _, err := machine.Transition(ctx, id, domain.StatusPickingUp, first, nil); err != nil { t.Fatal(err) }
+	if _, err := machine.Transition(ctx, id, domain.StatusCanceled, CustomerActor(owner.ID), nil); !errors.Is(err, ErrOrderTransition) { t.Fatalf("customer cancel of an order being picked up: %v", err) }
+	done, err := machine.Transition(ctx, id, domain.StatusDone, first, map[string]interface{}{"photo": "bags.jpg"})
+	if err != nil { t.Fatal(err) }
+	if done.Status != domain.StatusDone { t.Fatalf("status %s", done.Status) }
+
+	var settlement domain.OrderSettlement
+	if err := db.Where("order_id = ?", o.ID).First(&settlement).Error; err != nil { t.Fatal(err) }
+	want, _ := tariffs.Payout(ctx, o)
+	if settlement.AmountKZT != want || settlement.CourierID != crew[0].ID { t.Fatalf("settlement: %+v, want %d", settlement, want) }
+
+	events, err := orders.Timeline(ctx, owner.ID.String(), id)
+	if err != nil { t.Fatal(err) }
+	steps := []domain.OrderStatus{domain.StatusNew, domain.StatusPaid, domain.StatusAssigned, domain.StatusPickingUp, domain.StatusDone}
+	actors := []domain.ActorRole{domain.ActorCustomer, domain.ActorSystem, domain.ActorCourier, domain.ActorCourier, domain.ActorCourier}
+	if len(events) != len(steps) { t.Fatalf("%d events", len(events)) }
+	for i, e := range events {
+		if e.ToStatus != steps[i] || e.ActorRole != actors[i] || (i == 0) != (e.FromStatus == nil) { t.Errorf("event %d: %+v", i, e) }
+	}
+	if _, err := orders.Timeline(ctx, crew[0].UserID.String(), id); !errors.Is(err, ErrOrderNotFound) { t.Fatalf("foreign timeline: %v", err) }
+}
+
+// TestConcurrentAccept races couriers accepting the same order on separate
+// connections: exactly one wins and the rest get ErrOrderTaken.
+func TestConcurrentAccept(t *testing.T) {
+	db := testConn(t)
+	ctx := context.Background()
+	const n = 8
+	poly := domain.Polygon{Name: "race", City: "Тест", GeoJSON: testPolygonGeoJSON, IsActive: true}
+	if err := db.Create(&poly).Error; err != nil { t.Fatal(err) }
+	owner := domain.User{Phone: "+77079990080", Role: domain.RoleUser}
+	if err := db.Create(&owner).Error; err != nil { t.Fatal(err) }
+	addr := domain.Address{UserID: owner.ID, City: "Тест", PolygonID: &poly.ID}
+	if err := db.Create(&addr).Error; err != nil { t.Fatal(err) }
+	o := domain.Order{UserID: owner.ID, AddressID: addr.ID, PolygonID: poly.ID, Type: domain.OrderOneTime, BagsCount: 1, TimeOption: domain.ASAP, Status: domain.StatusPaid}
+	if err := db.Create(&o).Error; err != nil { t.Fatal(err) }
+	var crew []domain.Courier
+	t.Cleanup(func() {
+		db.Where("order_id = ?", o.ID).Delete(&domain.OrderEvent{})
+		db.Delete(&o)
+		for _, c := range crew { db.Delete(&c); db.Delete(&domain.User{}, "id = ?", c.UserID) }
+		db.Delete(&addr)
+		db.Delete(&owner)
+		db.Delete(&poly)
+	})
+	for i := 0; i < n; i++ {
+		u := domain.User{Phone: fmt.Sprintf("+7707999009%d", i), Role: domain.RoleCourier}
+		if err := db.Create(&u).Error; err != nil { t.Fatal(err) }
+		c := domain.Courier{UserID: u.ID, PolygonID: poly.ID, IsActive: true}
+		if err := db.Create(&c).Error; err != nil { t.Fatal(err) }
+		crew = append(crew, c)
+	}
+
+	machine := NewOrderStateMachine(db, nil)
+	start := make(chan struct{})
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range crew {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = machine.Transition(ctx, o.ID.String(), domain.StatusAssigned, CourierActor(crew[i].ID, crew[i].PolygonID), nil)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if winner >= 0 { t.Fatalf("couriers %d and %d both accepted", winner, i) }
+			winner = i
+		case !errors.Is(err, ErrOrderTaken):
+			t.Fatalf("courier %d: %v", i, err)
+		}
+	}
+	if winner < 0 { t.Fatal("nobody accepted") }
+	var got domain.Order
+	if err := db.First(&got, "id = ?", o.ID).Error; err != nil { t.Fatal(err) }
+	if got.Status != domain.StatusAssigned || *got.CourierID != crew[winner].ID { t.Fatalf("order: %s %v", got.Status, got.CourierID) }
+	var events int64
+	if err := db.Model(&domain.OrderEvent{}).Where("order_id = ? AND to_status = ?", o.ID, domain.StatusAssigned).Count(&events).Error; err != nil { t.Fatal(err) }
+	if events != 1 { t.Fatalf("%d ASSIGNED events", events) }
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/musorok/server/internal/core/auth"
+)
+
+var (
+	ErrOTPNotFound = errors.New("otp not sent or expired")
+	ErrOTPInvalid = errors.New("invalid otp code")
+	ErrOTPTooManyAttempts = errors.New("too many otp attempts")
+)
+
+// OTPSender delivers a one-time code to a phone number. Implementations live
+// in internal/core/otp (WhatsApp via 360Dialog, SMS, log-only).
+type OTPSender interface {
+	SendOTP(ctx context.Context, phone, code string) error
+}
+
+// OTPStore keeps codes, attempt counters and send limits. The Redis
+// implementation is redisrepo.OTPStore; MemoryOTPStore serves single-process
+// development and tests.
+type OTPStore interface {
+	// SaveCode stores the code hash for phone and resets its attempt counter.
+	SaveCode(ctx context.Context, phone, codeHash string, ttl time.Duration) error
+	// CodeHash returns the stored hash or ErrOTPNotFound.
+	CodeHash(ctx context.Context, phone string) (string, error)
+	// DeleteCode removes the code and its attempt counter.
+	DeleteCode(ctx context.Context, phone string) error
+	// IncrAttempts counts a verification attempt against the current code.
+	IncrAttempts(ctx context.Context, phone string, ttl time.Duration) (int64, error)
+	// Cooldown sets a resend cooldown for phone unless one is running, in
+	// which case it reports false and the time left.
+	Cooldown(ctx context.Context, phone string, ttl time.Duration) (bool, time.Duration, error)
+	// ReleaseCooldown ends the cooldown of phone, e.g. when the send failed.
+	ReleaseCooldown(ctx context.Context, phone string) error
+	// IncrWindow counts a hit on key within a fixed window and returns the
+	// count so far and the time until the window resets.
+	IncrWindow(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error)
+}
+
+// OTPConfig tunes code generation and abuse limits.
+type OTPConfig struct {
+	CodeLength int
+	TTL time.Duration
+	MaxAttempts int
+	ResendCooldown time.Duration
+	PhoneSendLimit int
+	IPSendLimit int
+	SendWindow time.Duration
+}
+
+// OTPService generates, delivers and verifies one-time codes.
+type OTPService struct {
+	store OTPStore
+	sender OTPSender
+	cfg OTPConfig
+}
+
+func NewOTPService(store OTPStore, sender OTPSender, cfg OTPConfig) *OTPService {
+	return &OTPService{store: store, sender: sender, cfg: cfg}
+}
+
+// Send generates a fresh code for phone and delivers it, within the limits
+// of Throttle. When delivery fails the cooldown is released so the user can
+// ask again right away.
+func (s *OTPService) Send(ctx context.Context, phone, ip string) error {
+	if err := s.Throttle(ctx, phone, ip); err != nil { return err }
+	code, err := randomDigits(s.cfg.CodeLength)
+	if err == nil { err = s.store.SaveCode(ctx, phone, hashOTP(phone, code), s.cfg.TTL) }
+	if err == nil { err = s.sender.SendOTP(ctx, phone, code) }
+	if err != nil {
+		_ = s.store.ReleaseCooldown(ctx, phone)
+		return err
+	}
+	return nil
+}
+
+// Throttle counts a message to login, a phone or an e-mail address,
+// requested from ip. Messages are limited by a per-login cooldown and
+// per-login/per-IP counters within SendWindow; hitting either returns a
+// *ThrottledError. Send applies it to codes; other messages, such as
+// password reset e-mails, call it themselves.
+func (s *OTPService) Throttle(ctx context.Context, login, ip string) error {
+	n, reset, err := s.store.IncrWindow(ctx, "login:"+login, s.cfg.SendWindow)
+	if err != nil { return err }
+	if s.cfg.PhoneSendLimit > 0 && n > int64(s.cfg.PhoneSendLimit) {
+		return &ThrottledError{Reason: "too many messages requested for this login", RetryAfter: reset}
+	}
+	if ip != "" {
+		n, reset, err := s.store.IncrWindow(ctx, "ip:"+ip, s.cfg.SendWindow)
+		if err != nil { return err }
+		if s.cfg.IPSendLimit > 0 && n > int64(s.cfg.IPSendLimit) {
+			return &ThrottledError{Reason: "too many messages requested from this address", RetryAfter: reset}
+		}
+	}
+	ok, left, err := s.store.Cooldown(ctx, login, s.cfg.ResendCooldown)
+	if err != nil { return err }
+	if !ok { return &ThrottledError{Reason: "message was sent recently", RetryAfter: left} }
+	return nil
+}
+
+// Verify checks code against the one sent to phone. A correct code is
+// consumed; after MaxAttempts wrong guesses the code is discarded and a new
+// one has to be requested.
+func (s *OTPService) Verify(ctx context.Context, phone, code string) error {
+	stored, err := s.store.CodeHash(ctx, phone)
+	if err != nil { return err }
+	n, err := s.store.IncrAttempts(ctx, phone, s.cfg.TTL)
+	if err != nil { return err }
+	if s.cfg.MaxAttempts > 0 && n > int64(s.cfg.MaxAttempts) {
+		_ = s.store.DeleteCode(ctx, phone)
+		return ErrOTPTooManyAttempts
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(hashOTP(phone, code))) != 1 {
+		return ErrOTPInvalid
+	}
+	return s.store.DeleteCode(ctx, phone)
+}
+
+func hashOTP(phone, code string) string { return auth.HashToken(phone + ":" + code) }
+
+func randomDigits(n int) (string, error) {
+	if n <= 0 { n = 4 }
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil { return "", err }
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+// MemoryOTPStore is an in-process OTPStore used when Redis is disabled and in
+// tests. It does not survive restarts and is not shared between replicas.
+type MemoryOTPStore struct {
+	mu sync.Mutex
+	now func() time.Time
+	entries map[string]memoryOTPEntry
+}
+
+type memoryOTPEntry struct {
+	value string
+	n int64
+	expires time.Time
+}
+
+func NewMemoryOTPStore() *MemoryOTPStore {
+	return &MemoryOTPStore{now: time.Now, entries: map[string]memoryOTPEntry{}}
+}
+
+// get returns the live entry for key, dropping it if expired. Callers hold mu.
+func (m *MemoryOTPStore) get(key string) (memoryOTPEntry, bool) {
+	e, ok := m.entries[key]
+	if ok && !m.now().Before(e.expires) {
+		delete(m.entries, key)
+		return memoryOTPEntry{}, false
+	}
+	return e, ok
+}
+
+func (m *MemoryOTPStore) SaveCode(_ context.Context, phone, codeHash string, ttl time.Duration) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	m.entries["code:"+phone] = memoryOTPEntry{value: codeHash, expires: m.now().Add(ttl)}
+	delete(m.entries, "attempts:"+phone)
+	return nil
+}
+
+func (m *MemoryOTPStore) CodeHash(_ context.Context, phone string) (string, error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	e, ok := m.get("code:" + phone)
+	if !ok { return "", ErrOTPNotFound }
+	return e.value, nil
+}
+
+func (m *MemoryOTPStore) DeleteCode(_ context.Context, phone string) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	delete(m.entries, "code:"+phone)
+	delete(m.entries, "attempts:"+phone)
+	return nil
+}
+
+func (m *MemoryOTPStore) IncrAttempts(_ context.Context, phone string, ttl time.Duration) (int64, error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	return m.incr("attempts:"+phone, ttl), nil
+}
+
+func (m *MemoryOTPStore) Cooldown(_ context.Context, phone string, ttl time.Duration) (bool, time.Duration, error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	if e, ok := m.get("cooldown:" + phone); ok { return false, e.expires.Sub(m.now()), nil }
+	m.entries["cooldown:"+phone] = memoryOTPEntry{expires: m.now().Add(ttl)}
+	return true, 0, nil
+}
+
+func (m *MemoryOTPStore) ReleaseCooldown(_ context.Context, phone string) error {
+	m.mu.Lock(); defer m.mu.Unlock()
+	delete(m.entries, "cooldown:"+phone)
+	return nil
+}
+
+func (m *MemoryOTPStore) IncrWindow(_ context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	m.mu.Lock(); defer m.mu.Unlock()
+	n := m.incr("window:"+key, window)
+	return n, m.entries["window:"+key].expires.Sub(m.now()), nil
+}
+
+// incr bumps a counter, starting a new one that expires after ttl if none is
+// live. Callers hold mu.
+func (m *MemoryOTPStore) incr(key string, ttl time.Duration) int64 {
+	e, ok := m.get(key)
+	if !ok { e = memoryOTPEntry{expires: m.now().Add(ttl)} }
+	e.n++
+	m.entries[key] = e
+	return e.n
+}
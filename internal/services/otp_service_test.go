@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/core/otp"
+)
+
+// fakeSender records the last code per phone instead of delivering it, or
+// fails with err.
+type fakeSender struct {
+	codes map[string]string
+	err error
+}
+
+func (f *fakeSender) SendOTP(_ context.Context, phone, code string) error {
+	if f.err != nil { return f.err }
+	f.codes[phone] = code
+	return nil
+}
+
+var testOTPConfig = OTPConfig{
+	CodeLength: 6, TTL: 5 * time.Minute, MaxAttempts: 3,
+	ResendCooldown: time.Minute, PhoneSendLimit: 3, IPSendLimit: 5, SendWindow: time.Hour,
+}
+
+func newTestOTP() (*OTPService, *fakeSender, *MemoryOTPStore, *time.Time) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryOTPStore()
+	store.now = func() time.Time { return clock }
+	sender := &fakeSender{codes: map[string]string{}}
+	return NewOTPService(store, sender, testOTPConfig), sender, store, &clock
+}
+
+func TestOTPSendAndVerify(t *testing.T) {
+	ctx := context.Background()
+	svc, sender, _, _ := newTestOTP()
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); err != nil { t.Fatal(err) }
+	code := sender.codes["+77070000001"]
+	if len(code) != 6 { t.Fatalf("code %q has wrong length", code) }
+	if err := svc.Verify(ctx, "+77070000001", code); err != nil { t.Fatalf("verify: %v", err) }
+	if err := svc.Verify(ctx, "+77070000001", code); !errors.Is(err, ErrOTPNotFound) {
+		t.Fatalf("second verify: got %v, want ErrOTPNotFound", err)
+	}
+}
+
+func TestOTPExpires(t *testing.T) {
+	ctx := context.Background()
+	svc, sender, _, clock := newTestOTP()
+	_ = svc.Send(ctx, "+77070000001", "")
+	*clock = clock.Add(testOTPConfig.TTL + time.Second)
+	if err := svc.Verify(ctx, "+77070000001", sender.codes["+77070000001"]); !errors.Is(err, ErrOTPNotFound) {
+		t.Fatalf("got %v, want ErrOTPNotFound", err)
+	}
+}
+
+func TestOTPMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	svc, sender, _, _ := newTestOTP()
+	_ = svc.Send(ctx, "+77070000001", "")
+	for i := 0; i < testOTPConfig.MaxAttempts; i++ {
+		if err := svc.Verify(ctx, "+77070000001", "wrong"); !errors.Is(err, ErrOTPInvalid) {
+			t.Fatalf("attempt %d: got %v, want ErrOTPInvalid", i, err)
+		}
+	}
+	// the right code no longer helps once attempts are exhausted
+	if err := svc.Verify(ctx, "+77070000001", sender.codes["+77070000001"]); !errors.Is(err, ErrOTPTooManyAttempts) {
+		t.Fatalf("got %v, want ErrOTPTooManyAttempts", err)
+	}
+}
+
+func TestOTPResendCooldownAndLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, _, _, clock := newTestOTP()
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); err != nil { t.Fatal(err) }
+
+	var throttled *ThrottledError
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); !errors.As(err, &throttled) {
+		t.Fatalf("resend inside cooldown: got %v", err)
+	}
+	if throttled.RetryAfter <= 0 || throttled.RetryAfter > testOTPConfig.ResendCooldown {
+		t.Fatalf("unexpected retry after %s", throttled.RetryAfter)
+	}
+
+	// per-phone limit: the cooldown passes, the hourly counter does not
+	*clock = clock.Add(2 * time.Minute)
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); err != nil { t.Fatalf("third send: %v", err) }
+	*clock = clock.Add(2 * time.Minute)
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); !errors.As(err, &throttled) {
+		t.Fatalf("fourth send: got %v, want throttled by phone limit", err)
+	}
+
+	// per-IP limit across different phones; three sends from this IP so far
+	for _, p := range []string{"+77070000002", "+77070000003"} {
+		if err := svc.Send(ctx, p, "10.0.0.1"); err != nil { t.Fatalf("send to %s: %v", p, err) }
+	}
+	if err := svc.Send(ctx, "+77070000004", "10.0.0.1"); !errors.As(err, &throttled) {
+		t.Fatalf("got %v, want throttled by ip limit", err)
+	}
+}
+
+// TestOTPFailedSendReleasesCooldown checks that a code that never left does
+// not hold the user back.
+func TestOTPFailedSendReleasesCooldown(t *testing.T) {
+	ctx := context.Background()
+	svc, sender, _, _ := newTestOTP()
+	sender.err = errors.New("sms gateway down")
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); err == nil { t.Fatal("send succeeded with the gateway down") }
+	sender.err = nil
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); err != nil { t.Fatalf("retry after a failed send: %v", err) }
+	var throttled *ThrottledError
+	if err := svc.Send(ctx, "+77070000001", "10.0.0.1"); !errors.As(err, &throttled) { t.Fatalf("resend after a delivered code: %v", err) }
+}
+
+func TestOTPLogSender(t *testing.T) {
+	svc := NewOTPService(NewMemoryOTPStore(), otp.LogSender{}, testOTPConfig)
+	if err := svc.Send(context.Background(), "+77070000001", ""); err != nil { t.Fatal(err) }
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+// TestCrossUserAccess checks that one customer can neither use nor change
+// another customer's addresses, orders and subscriptions.
+func TestCrossUserAccess(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	intruder, err := NewUserService(db).Create(ctx, "+77079990030", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	tariffs := NewTariffService(db, almaty)
+	orders := NewOrderService(db, addrs, tariffs, nil, CancelPolicy{})
+	subs := NewSubscriptionService(db, addrs, tariffs)
+
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	ownerSub, err := subs.Create(ctx, owner.ID, domain.PlanP7)
+	if err != nil { t.Fatal(err) }
+	if _, err := subs.Create(ctx, intruder.ID, domain.PlanP7); err != nil { t.Fatal(err) }
+	ownerOrder, err := orders.Create(ctx, owner.ID.String(), OrderRequest{AddressID: addr.ID.String(), BagsCount: 1, TimeOption: domain.ASAP})
+	if err != nil { t.Fatal(err) }
+
+	req := OrderRequest{AddressID: addr.ID.String(), BagsCount: 1, TimeOption: domain.ASAP}
+	if _, err := orders.Quote(ctx, intruder.ID.String(), req); !errors.Is(err, ErrAddressNotFound) {
+		t.Errorf("quote on foreign address: %v", err)
+	}
+	if _, err := orders.Create(ctx, intruder.ID.String(), req); !errors.Is(err, ErrAddressNotFound) {
+		t.Errorf("order to foreign address: %v", err)
+	}
+	if _, err := subs.CreateOrder(ctx, intruder.ID, req); !errors.Is(err, ErrAddressNotFound) {
+		t.Errorf("subscription order to foreign address: %v", err)
+	}
+	if err := subs.Cancel(ctx, intruder.ID, ownerSub.ID.String()); !errors.Is(err, ErrSubscriptionNotFound) {
+		t.Errorf("cancel foreign subscription: %v", err)
+	}
+	if _, err := orders.Get(ctx, intruder.ID.String(), ownerOrder.ID.String()); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("read foreign order: %v", err)
+	}
+	if list, total, err := orders.History(ctx, intruder.ID, 1, 20, false); err != nil || total != 0 || len(list) != 0 {
+		t.Errorf("foreign orders in history: %d %v", total, err)
+	}
+
+	var sub domain.Subscription
+	if err := db.First(&sub, "id = ?", ownerSub.ID).Error; err != nil { t.Fatal(err) }
+	if sub.Status != domain.SubActive { t.Fatalf("owner's subscription was changed: %s", sub.Status) }
+	if err := subs.Cancel(ctx, owner.ID, ownerSub.ID.String()); err != nil { t.Fatalf("owner cancel: %v", err) }
+}
+
+func TestSubscriptionOrderDrawsBags(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	subs := NewSubscriptionService(addrs.db, addrs, NewTariffService(addrs.db, almaty))
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	if _, err := subs.Create(ctx, owner.ID, domain.PlanP7); err != nil { t.Fatal(err) }
+	req := OrderRequest{AddressID: addr.ID.String(), BagsCount: 5, TimeOption: domain.ASAP}
+	if _, err := subs.CreateOrder(ctx, owner.ID, req); err != nil { t.Fatal(err) }
+	if _, err := subs.CreateOrder(ctx, owner.ID, req); !errors.Is(err, ErrNotEnoughBags) { t.Fatalf("overdraw: %v", err) }
+	cur, err := subs.Current(ctx, owner.ID)
+	if err != nil { t.Fatal(err) }
+	if cur.RemainingBags != 2 { t.Fatalf("remaining = %d", cur.RemainingBags) }
+}
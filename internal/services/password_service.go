@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+)
+
+const MinPasswordLength = 8
+
+var (
+	ErrWeakPassword = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrWrongPassword = errors.New("current password is wrong")
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+)
+
+// Mailer sends a plain-text e-mail. Implementations live in
+// internal/core/mail.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// PasswordService changes and recovers passwords. Recovery proves access to
+// the phone (OTP) or the e-mail address and yields a single-use reset token;
+// redeeming it revokes every session of the user. Only the newest token of a
+// user is ever valid, and none survives a password change.
+type PasswordService struct {
+	db *gorm.DB
+	otp *OTPService
+	mailer Mailer
+	sessions *SessionService
+	resetURL string
+	ttl time.Duration
+}
+
+// NewPasswordService builds the service. resetURL is the link mailed to the
+// user with a single %s for the token, e.g. https://musorok.kz/reset?token=%s.
+func NewPasswordService(db *gorm.DB, otp *OTPService, mailer Mailer, sessions *SessionService, resetURL string, ttl time.Duration) *PasswordService {
+	return &PasswordService{db: db, otp: otp, mailer: mailer, sessions: sessions, resetURL: resetURL, ttl: ttl}
+}
+
+// Change sets a new password for an authenticated user. Users who signed up
+// by OTP have no password yet and may set one without current. All other
+// sessions of the user are ended; keepSession stays logged in.
+func (s *PasswordService) Change(ctx context.Context, userID, current, next, keepSession string) error {
+	if len(next) < MinPasswordLength { return ErrWeakPassword }
+	var u domain.User
+	if err := s.db.WithContext(ctx).Where("id = ? AND is_deleted = false", userID).First(&u).Error; err != nil { return err }
+	if u.PasswordHash != nil && bcrypt.CompareHashAndPassword([]byte(*u.PasswordHash), []byte(current)) != nil {
+		return ErrWrongPassword
+	}
+	hash, err := hashPassword(next)
+	if err != nil { return err }
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&u).Update("password_hash", hash).Error; err != nil { return err }
+		return expireResetTokens(tx, u.ID)
+	})
+	if err != nil { return err }
+	return s.sessions.RevokeOthers(ctx, userID, keepSession)
+}
+
+// Forgot starts recovery for login, which is a phone or an e-mail address.
+// Phones get an OTP to redeem with VerifyOTP, e-mail addresses get a reset
+// link. Unknown logins are silently ignored so the endpoint cannot be used
+// to probe for accounts. E-mails are throttled like codes, per address and
+// per IP, whether or not the account exists; phones are by OTPService.Send.
+func (s *PasswordService) Forgot(ctx context.Context, login, ip string) error {
+	login = NormalizeLogin(login)
+	email := strings.Contains(login, "@")
+	if email {
+		if err := s.otp.Throttle(ctx, login, ip); err != nil { return err }
+	}
+	var u domain.User
+	err := s.db.WithContext(ctx).Where("(phone = ? OR email = ?) AND is_deleted = false", login, login).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil }
+	if err != nil { return err }
+	if email {
+		token, err := s.newToken(ctx, u.ID, "email")
+		if err != nil { return err }
+		body := fmt.Sprintf("Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\nСсылка действует %d мин. Если вы не запрашивали сброс пароля, просто проигнорируйте это письмо.",
+			fmt.Sprintf(s.resetURL, token), int(s.ttl.Minutes()))
+		return s.mailer.Send(ctx, login, "MusorOK: сброс пароля", body)
+	}
+	return s.otp.Send(ctx, u.Phone, ip)
+}
+
+// VerifyOTP exchanges the code sent by Forgot for a reset token.
+func (s *PasswordService) VerifyOTP(ctx context.Context, phone, code string) (string, error) {
+	if err := s.otp.Verify(ctx, phone, code); err != nil { return "", err }
+	var u domain.User
+	if err := s.db.WithContext(ctx).Where("phone = ? AND is_deleted = false", phone).First(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) { return "", ErrInvalidResetToken }
+		return "", err
+	}
+	return s.newToken(ctx, u.ID, "otp")
+}
+
+// Reset redeems a reset token, sets the new password and logs the user out
+// everywhere.
+func (s *PasswordService) Reset(ctx context.Context, token, next string) error {
+	if len(next) < MinPasswordLength { return ErrWeakPassword }
+	hash, err := hashPassword(next)
+	if err != nil { return err }
+	var userID string
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var pr domain.PasswordReset
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > now()", auth.HashToken(token)).
+			First(&pr).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrInvalidResetToken }
+		if err != nil { return err }
+		if err := expireResetTokens(tx, pr.UserID); err != nil { return err }
+		userID = pr.UserID.String()
+		return tx.Model(&domain.User{}).Where("id = ?", pr.UserID).Update("password_hash", hash).Error
+	})
+	if err != nil { return err }
+	return s.sessions.RevokeAll(ctx, userID)
+}
+
+// newToken issues a reset token for userID, ending the ones issued before.
+func (s *PasswordService) newToken(ctx context.Context, userID uuid.UUID, channel string) (string, error) {
+	token, err := randomToken()
+	if err != nil { return "", err }
+	pr := domain.PasswordReset{UserID: userID, TokenHash: auth.HashToken(token), Channel: channel, ExpiresAt: time.Now().Add(s.ttl)}
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := expireResetTokens(tx, userID); err != nil { return err }
+		return tx.Create(&pr).Error
+	})
+	if err != nil { return "", err }
+	return token, nil
+}
+
+// expireResetTokens marks every open reset token of userID as used.
+func expireResetTokens(tx *gorm.DB, userID uuid.UUID) error {
+	return tx.Model(&domain.PasswordReset{}).Where("user_id = ? AND used_at IS NULL", userID).Update("used_at", time.Now()).Error
+}
+
+// randomToken returns 256 random bits, URL-safe, for single-use links.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil { return "", err }
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
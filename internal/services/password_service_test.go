@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+)
+
+func passwordFixture(t *testing.T) (context.Context, *PasswordService, *SessionService, *fakeMailer, *domain.User) {
+	t.Helper()
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990110", "reset@example.com", "", "old-password", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	keys := auth.NewHMACKeySet("access-secret", "musorok", "")
+	sessions := NewSessionService(db, keys, auth.NewHMACKeySet("refresh-secret", "", ""), time.Minute, time.Hour)
+	otpSvc, _, _, _ := newTestOTP()
+	mailer := &fakeMailer{sent: map[string]string{}}
+	return ctx, NewPasswordService(db, otpSvc, mailer, sessions, "https://musorok.kz/reset?token=%s", time.Hour), sessions, mailer, u
+}
+
+// mailedToken pulls the reset token out of the last link mailed to to.
+func mailedToken(t *testing.T, mailer *fakeMailer, to string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(mailer.sent[to], "token=")
+	if !ok { t.Fatalf("no reset link mailed to %s", to) }
+	return strings.Fields(rest)[0]
+}
+
+func TestResetTokenSingleUse(t *testing.T) {
+	ctx, passwords, sessions, mailer, u := passwordFixture(t)
+	var live []string
+	for i := 0; i < 2; i++ {
+		pair, err := sessions.Start(ctx, u, "test", "10.0.0.1")
+		if err != nil { t.Fatal(err) }
+		claims, err := sessions.access.Parse(pair.Access)
+		if err != nil { t.Fatal(err) }
+		live = append(live, claims.SessionID)
+	}
+	if err := passwords.Forgot(ctx, "reset@example.com", "10.0.0.1"); err != nil { t.Fatal(err) }
+	token := mailedToken(t, mailer, "reset@example.com")
+
+	if err := passwords.Reset(ctx, token, "new-password"); err != nil { t.Fatal(err) }
+	if err := passwords.Reset(ctx, token, "other-password"); !errors.Is(err, ErrInvalidResetToken) { t.Fatalf("second use: %v", err) }
+	for _, sid := range live {
+		if ok, err := sessions.IsActive(ctx, sid); err != nil || ok { t.Fatalf("session %s survived the reset: %v", sid, err) }
+	}
+}
+
+func TestResetTokenExpires(t *testing.T) {
+	ctx, passwords, _, _, u := passwordFixture(t)
+	token, err := passwords.newToken(ctx, u.ID, "email")
+	if err != nil { t.Fatal(err) }
+	err = passwords.db.Model(&domain.PasswordReset{}).Where("token_hash = ?", auth.HashToken(token)).Update("expires_at", time.Now().Add(-time.Second)).Error
+	if err != nil { t.Fatal(err) }
+	if err := passwords.Reset(ctx, token, "new-password"); !errors.Is(err, ErrInvalidResetToken) { t.Fatalf("expired token: %v", err) }
+}
+
+// TestResetTokenInvalidation checks that a new token ends the previous one
+// and that changing the password ends them all.
+func TestResetTokenInvalidation(t *testing.T) {
+	ctx, passwords, _, _, u := passwordFixture(t)
+	first, err := passwords.newToken(ctx, u.ID, "email")
+	if err != nil { t.Fatal(err) }
+	second, err := passwords.newToken(ctx, u.ID, "otp")
+	if err != nil { t.Fatal(err) }
+	if err := passwords.Reset(ctx, first, "new-password"); !errors.Is(err, ErrInvalidResetToken) { t.Fatalf("superseded token: %v", err) }
+
+	if err := passwords.Change(ctx, u.ID.String(), "old-password", "changed-password", ""); err != nil { t.Fatal(err) }
+	if err := passwords.Reset(ctx, second, "new-password"); !errors.Is(err, ErrInvalidResetToken) { t.Fatalf("token after a password change: %v", err) }
+}
+
+// TestForgotEmailThrottled checks that reset e-mails are limited like codes,
+// for unknown addresses too so the limit does not reveal accounts.
+func TestForgotEmailThrottled(t *testing.T) {
+	ctx, passwords, _, mailer, _ := passwordFixture(t)
+	for _, login := range []string{"reset@example.com", "nobody@example.com"} {
+		if err := passwords.Forgot(ctx, login, "10.0.0.2"); err != nil { t.Fatal(err) }
+		var throttled *ThrottledError
+		if err := passwords.Forgot(ctx, login, "10.0.0.2"); !errors.As(err, &throttled) { t.Fatalf("%s: second request: %v", login, err) }
+	}
+	if len(mailer.sent) != 1 { t.Fatalf("mailed %d addresses", len(mailer.sent)) }
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrPaymentStatus = errors.New("unknown payment status")
+	ErrPaymentAmount = errors.New("payment amount does not match")
+)
+
+// PaymentService records the payments started with the provider and
+// applies the provider's webhook events to them.
+type PaymentService struct {
+	db *gorm.DB
+	refunds *RefundService
+}
+
+func NewPaymentService(db *gorm.DB, refunds *RefundService) *PaymentService { return &PaymentService{db: db, refunds: refunds} }
+
+// Record saves a payment just started with the provider for an order or a
+// subscription of userID.
+func (s *PaymentService) Record(ctx context.Context, userID uuid.UUID, orderID, subscriptionID *uuid.UUID, intentID string, amount int) (*domain.Payment, error) {
+	p := domain.Payment{
+		UserID: userID, OrderID: orderID, SubscriptionID: subscriptionID, AmountKZT: amount,
+		Provider: domain.ProviderPaynetworks, Status: domain.PayInit, ProviderIntentID: intentID, ProviderPayload: "{}",
+	}
+	if err := s.db.WithContext(ctx).Create(&p).Error; err != nil { return nil, err }
+	return &p, nil
+}
+
+// Apply sets the payment of intentID to status, keeping the event payload.
+// The event must carry the amount the payment was started with. A
+// succeeded payment is final: later events are ignored, so replayed
+// webhooks are harmless. When it succeeds the order it pays for moves from
+// NEW to PAID in the same transaction. An order canceled while the customer
+// was paying gets the money back in full: the refund is queued with the
+// payment and made once it commits, and when the provider fails it stays
+// pending for RefundService to retry, so the event is still accepted. Any
+// other order that is no longer NEW is left as it is and logged.
+func (s *PaymentService) Apply(ctx context.Context, intentID string, status domain.PaymentStatus, amount int, payload json.RawMessage) (*domain.Payment, error) {
+	switch status {
+	case domain.PayRequiresAction, domain.PaySucceeded, domain.PayFailed, domain.PayCanceled:
+	default:
+		return nil, ErrPaymentStatus
+	}
+	if len(payload) == 0 { payload = json.RawMessage("{}") }
+	var p domain.Payment
+	var refund *domain.Refund
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("provider_intent_id = ?", intentID).First(&p).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrPaymentNotFound }
+		if err != nil { return err }
+		if amount != p.AmountKZT { return ErrPaymentAmount }
+		if p.Status == domain.PaySucceeded || p.Status == status { return nil }
+		p.Status, p.ProviderPayload, p.UpdatedAt = status, string(payload), time.Now()
+		err = tx.Model(&p).Updates(map[string]interface{}{"status": p.Status, "provider_payload": p.ProviderPayload, "updated_at": p.UpdatedAt}).Error
+		if err != nil || status != domain.PaySucceeded || p.OrderID == nil { return err }
+		var o domain.Order
+		if err := lockOrder(tx, *p.OrderID, &o); err != nil { return err }
+		if o.Status == domain.StatusCanceled {
+			// keyed by the payment, as a refund on cancel is keyed by the
+			// order and this one must not be taken for it
+			left, err := refundable(tx, &p)
+			if err != nil || left == 0 { return err }
+			refund, err = queueRefund(tx, &p, &o, left, p.ID.String())
+			return err
+		}
+		if o.Status != domain.StatusNew {
+			log.Warn().Str("order", o.ID.String()).Str("status", string(o.Status)).Msg("payment succeeded for an order that is no longer new")
+			return nil
+		}
+		return moveOrder(tx, &o, domain.StatusPaid, SystemActor, map[string]interface{}{"payment_id": p.ID})
+	})
+	if err != nil { return nil, err }
+	if refund == nil { return &p, nil }
+	if err := s.refunds.Process(ctx, refund.ID); err != nil {
+		log.Warn().Err(err).Str("payment", p.ID.String()).Msg("payment for a canceled order: refund left pending")
+		return &p, nil
+	}
+	if err := s.db.WithContext(ctx).Where("id = ?", p.ID).First(&p).Error; err != nil { return nil, err }
+	return &p, nil
+}
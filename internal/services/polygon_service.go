@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrPolygonNotFound = errors.New("polygon not found")
+	ErrPolygonName = errors.New("polygon name and city are required")
+)
+
+// PolygonService manages service zones. Every change bumps the polygon's
+// version and writes an immutable domain.PolygonVersion, reassigns the
+// addresses the change affects, marks the waitlist entries it covers and
+// reloads the zones. Coverage is always computed in Go, inside the
+// transaction, whichever SpatialRepo serves requests.
+type PolygonService struct {
+	db *gorm.DB
+	zones SpatialRepo
+	waitlist *WaitlistService
+}
+
+// NewPolygonService builds the service. zones and waitlist may be nil; with
+// a waitlist, users whose entries a change covers are notified after it
+// commits.
+func NewPolygonService(db *gorm.DB, zones SpatialRepo, waitlist *WaitlistService) *PolygonService {
+	return &PolygonService{db: db, zones: zones, waitlist: waitlist}
+}
+
+// PolygonInput is a zone change; nil fields are kept as they are. Geometry
+// must already be validated.
+type PolygonInput struct {
+	Name *string
+	City *string
+	Geometry geospatial.MultiPolygon
+	Priority *int
+	IsActive *bool
+}
+
+// CoverageChange tells how a zone change moved saved addresses.
+type CoverageChange struct {
+	// Entered counts addresses that were not served and now are.
+	Entered int `json:"entered"`
+	// Left counts addresses that were served and no longer are.
+	Left int `json:"left"`
+	// Reassigned counts addresses that moved from one zone to another.
+	Reassigned int `json:"reassigned"`
+	// Waitlisted counts waitlist entries the change covered.
+	Waitlisted int `json:"waitlisted"`
+}
+
+// List returns the zones ordered by city and name, optionally only the
+// active or inactive ones.
+func (s *PolygonService) List(ctx context.Context, active *bool) ([]domain.Polygon, error) {
+	q := s.db.WithContext(ctx).Order("city, name")
+	if active != nil { q = q.Where("is_active = ?", *active) }
+	var out []domain.Polygon
+	return out, q.Find(&out).Error
+}
+
+// Get returns a zone or ErrPolygonNotFound.
+func (s *PolygonService) Get(ctx context.Context, id string) (*domain.Polygon, error) {
+	pid, err := uuid.Parse(id)
+	if err != nil { return nil, ErrPolygonNotFound }
+	var p domain.Polygon
+	err = s.db.WithContext(ctx).Where("id = ?", pid).First(&p).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrPolygonNotFound }
+	if err != nil { return nil, err }
+	return &p, nil
+}
+
+// Versions returns the history of a zone, newest first.
+func (s *PolygonService) Versions(ctx context.Context, id string) ([]domain.PolygonVersion, error) {
+	p, err := s.Get(ctx, id)
+	if err != nil { return nil, err }
+	var out []domain.PolygonVersion
+	return out, s.db.WithContext(ctx).Where("polygon_id = ?", p.ID).Order("version DESC").Find(&out).Error
+}
+
+// Create adds a zone at version 1. Name, city and geometry are required;
+// a zone is active unless in.IsActive says otherwise.
+func (s *PolygonService) Create(ctx context.Context, by uuid.UUID, in PolygonInput) (*domain.Polygon, CoverageChange, error) {
+	var p domain.Polygon
+	var change CoverageChange
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := createZone(tx, by, &p, in); err != nil { return err }
+		var err error
+		change, err = recomputeCoverage(tx, []uuid.UUID{p.ID}, in.Geometry)
+		return err
+	})
+	if err != nil { return nil, CoverageChange{}, err }
+	s.reloadZones(ctx)
+	s.notifyWaitlist(ctx, change)
+	return &p, change, nil
+}
+
+// Update applies in to a zone as a new version. A change that alters
+// nothing does not create a version.
+func (s *PolygonService) Update(ctx context.Context, by uuid.UUID, id string, in PolygonInput) (*domain.Polygon, CoverageChange, error) {
+	pid, err := uuid.Parse(id)
+	if err != nil { return nil, CoverageChange{}, ErrPolygonNotFound }
+	var p domain.Polygon
+	var change CoverageChange
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", pid).First(&p).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrPolygonNotFound }
+		if err != nil { return err }
+		changed, geometry, err := updateZone(tx, by, &p, in)
+		if err != nil || len(changed) == 0 { return err }
+		change, err = recomputeCoverage(tx, []uuid.UUID{p.ID}, geometry)
+		return err
+	})
+	if err != nil { return nil, CoverageChange{}, err }
+	s.reloadZones(ctx)
+	s.notifyWaitlist(ctx, change)
+	return &p, change, nil
+}
+
+// SetActive switches a zone on or off as a new version.
+func (s *PolygonService) SetActive(ctx context.Context, by uuid.UUID, id string, active bool) (*domain.Polygon, CoverageChange, error) {
+	return s.Update(ctx, by, id, PolygonInput{IsActive: &active})
+}
+
+// notifyWaitlist notifies in the background, so a zone launch covering many
+// entries does not hold up the admin's request.
+func (s *PolygonService) notifyWaitlist(ctx context.Context, change CoverageChange) {
+	if s.waitlist == nil || change.Waitlisted == 0 { return }
+	go func() {
+		n, err := s.waitlist.NotifyCovered(context.WithoutCancel(ctx))
+		if err != nil { log.Error().Err(err).Msg("waitlist: notify after polygon change"); return }
+		log.Info().Int("sent", n).Int("covered", change.Waitlisted).Msg("waitlist: notified covered users")
+	}()
+}
+
+func (s *PolygonService) reloadZones(ctx context.Context) {
+	if s.zones == nil { return }
+	// the periodic refresh retries, so a failure here only delays the change
+	if err := s.zones.Reload(ctx); err != nil { log.Error().Err(err).Msg("zone index: reload after polygon change") }
+}
+
+// createZone inserts p from in as version 1.
+func createZone(tx *gorm.DB, by uuid.UUID, p *domain.Polygon, in PolygonInput) error {
+	if in.Name == nil || in.City == nil || strings.TrimSpace(*in.Name) == "" || strings.TrimSpace(*in.City) == "" { return ErrPolygonName }
+	if in.Geometry == nil { return fmt.Errorf("polygon geometry is required") }
+	*p = domain.Polygon{Name: strings.TrimSpace(*in.Name), City: strings.TrimSpace(*in.City), GeoJSON: in.Geometry.GeoJSON(), IsActive: true, Version: 1}
+	if in.Priority != nil { p.Priority = *in.Priority }
+	if err := tx.Create(p).Error; err != nil { return err }
+	// is_active has a column default, so false is not inserted by Create
+	if in.IsActive != nil && !*in.IsActive {
+		if err := tx.Model(p).Update("is_active", false).Error; err != nil { return err }
+		p.IsActive = false
+	}
+	return writeVersion(tx, p, by)
+}
+
+// updateZone applies in to the locked p and saves a new version when
+// something changed. It returns the names of the changed fields and the
+// zone's geometry after the change.
+func updateZone(tx *gorm.DB, by uuid.UUID, p *domain.Polygon, in PolygonInput) ([]string, geospatial.MultiPolygon, error) {
+	geometry, err := geospatial.ParseGeometry(p.GeoJSON)
+	if err != nil { return nil, nil, fmt.Errorf("stored geometry of %s: %w", p.ID, err) }
+	var changed []string
+	if in.Name != nil && strings.TrimSpace(*in.Name) != p.Name { p.Name = strings.TrimSpace(*in.Name); changed = append(changed, "name") }
+	if in.City != nil && strings.TrimSpace(*in.City) != p.City { p.City = strings.TrimSpace(*in.City); changed = append(changed, "city") }
+	if p.Name == "" || p.City == "" { return nil, nil, ErrPolygonName }
+	if in.Geometry != nil && !reflect.DeepEqual(in.Geometry, geometry) {
+		geometry = in.Geometry
+		p.GeoJSON = geometry.GeoJSON()
+		changed = append(changed, "geometry")
+	}
+	if in.Priority != nil && *in.Priority != p.Priority { p.Priority = *in.Priority; changed = append(changed, "priority") }
+	if in.IsActive != nil && *in.IsActive != p.IsActive { p.IsActive = *in.IsActive; changed = append(changed, "is_active") }
+	if len(changed) == 0 { return nil, geometry, nil }
+	p.Version++
+	p.UpdatedAt = time.Now()
+	if err := tx.Model(p).Select("name", "city", "geojson", "priority", "is_active", "version", "updated_at").Updates(p).Error; err != nil { return nil, nil, err }
+	return changed, geometry, writeVersion(tx, p, by)
+}
+
+func writeVersion(tx *gorm.DB, p *domain.Polygon, by uuid.UUID) error {
+	v := domain.PolygonVersion{
+		PolygonID: p.ID, Version: p.Version, Name: p.Name, City: p.City,
+		GeoJSON: p.GeoJSON, IsActive: p.IsActive, Priority: p.Priority,
+	}
+	if by != uuid.Nil { v.ChangedBy = &by }
+	return tx.Create(&v).Error
+}
+
+// recomputeCoverage re-resolves the addresses that changes of the polygons
+// pids can affect: those assigned to one of them and those inside the
+// bounding box of one of the (new) geometries. Open waitlist entries in
+// those boxes that are now served are marked covered. The zones are read
+// through tx, so they include the uncommitted changes.
+func recomputeCoverage(tx *gorm.DB, pids []uuid.UUID, geometries ...geospatial.MultiPolygon) (CoverageChange, error) {
+	var change CoverageChange
+	snap, err := loadZones(tx)
+	if err != nil { return change, err }
+	where := []string{"polygon_id IN ?"}
+	args := []interface{}{pids}
+	boxes := make([]geospatial.BBox, 0, len(geometries))
+	for _, g := range geometries {
+		b := g.Bounds()
+		boxes = append(boxes, b)
+		where = append(where, "(lng BETWEEN ? AND ? AND lat BETWEEN ? AND ?)")
+		args = append(args, b.MinLng, b.MaxLng, b.MinLat, b.MaxLat)
+	}
+	var addrs []domain.Address
+	err = tx.Select("id", "lat", "lng", "polygon_id", "polygon_name").
+		Where("deleted_at IS NULL").
+		Where("("+strings.Join(where, " OR ")+")", args...).
+		Find(&addrs).Error
+	if err != nil { return change, err }
+	for _, a := range addrs {
+		var newID *uuid.UUID
+		var newName *string
+		if z, ok := snap.idx.Resolve(a.Lng, a.Lat); ok {
+			p := snap.polygons[z.ID]
+			newID, newName = &p.ID, &p.Name
+		}
+		switch {
+		case a.PolygonID == nil && newID == nil:
+			continue
+		case a.PolygonID == nil:
+			change.Entered++
+		case newID == nil:
+			change.Left++
+		case *a.PolygonID != *newID:
+			change.Reassigned++
+		case a.PolygonName != nil && *a.PolygonName == *newName:
+			continue
+		}
+		// UpdateColumns: a zone change is not an edit of the address
+		if err := tx.Model(&domain.Address{}).Where("id = ?", a.ID).UpdateColumns(map[string]interface{}{"polygon_id": newID, "polygon_name": newName}).Error; err != nil {
+			return change, err
+		}
+	}
+	change.Waitlisted, err = coverWaitlist(tx, snap, boxes)
+	return change, err
+}
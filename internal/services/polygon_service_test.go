@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+// testSquare is a zone far from any real one, so the rest of the database
+// does not interfere.
+func testSquare(lng, lat, size float64) geospatial.MultiPolygon {
+	return geospatial.MultiPolygon{{{{lng, lat}, {lng + size, lat}, {lng + size, lat + size}, {lng, lat + size}, {lng, lat}}}}
+}
+
+func TestPolygonLifecycle(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	zones := NewZoneIndex(db, time.Minute)
+	svc := NewPolygonService(db, zones, nil)
+	u, err := NewUserService(db).Create(ctx, "+77079990040", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	// saved while the area was not served
+	addr := domain.Address{UserID: u.ID, City: "Тест", Lat: 10.05, Lng: 10.05}
+	if err := db.Create(&addr).Error; err != nil { t.Fatal(err) }
+
+	if _, _, err := svc.Create(ctx, uuid.Nil, PolygonInput{Name: strp(" "), City: strp("Тест"), Geometry: testSquare(10, 10, 0.1)}); !errors.Is(err, ErrPolygonName) {
+		t.Fatalf("blank name: got %v", err)
+	}
+	p, change, err := svc.Create(ctx, uuid.Nil, PolygonInput{Name: strp("Тест"), City: strp("Тест"), Geometry: testSquare(10, 10, 0.1)})
+	if err != nil { t.Fatal(err) }
+	if change.Entered != 1 || p.Version != 1 || !p.IsActive { t.Fatalf("create: %+v %+v", p, change) }
+	if z, err := zones.Resolve(ctx, 10.05, 10.05); err != nil || z.ID != p.ID { t.Fatalf("index not reloaded: %v %v", z, err) }
+
+	// shrinking the zone drops the address
+	p, change, err = svc.Update(ctx, uuid.Nil, p.ID.String(), PolygonInput{Geometry: testSquare(10, 10, 0.01)})
+	if err != nil { t.Fatal(err) }
+	if change.Left != 1 || p.Version != 2 { t.Fatalf("shrink: %+v %+v", p, change) }
+	var got domain.Address
+	db.First(&got, "id = ?", addr.ID)
+	if got.PolygonID != nil { t.Fatalf("address still assigned: %+v", got) }
+
+	// a no-op update writes no version
+	if p, _, err = svc.Update(ctx, uuid.Nil, p.ID.String(), PolygonInput{Name: strp("Тест")}); err != nil || p.Version != 2 {
+		t.Fatalf("no-op update: %+v %v", p, err)
+	}
+
+	// a bigger zone takes the address, the regrown smaller one wins it back,
+	// and deactivating that hands it over again
+	other, change, err := svc.Create(ctx, uuid.Nil, PolygonInput{Name: strp("Соседний"), City: strp("Тест"), Geometry: testSquare(10, 10, 0.2)})
+	if err != nil || change.Entered != 1 { t.Fatalf("second zone: %+v %v", change, err) }
+	if _, change, err = svc.Update(ctx, uuid.Nil, p.ID.String(), PolygonInput{Geometry: testSquare(10, 10, 0.1)}); err != nil || change.Reassigned != 1 {
+		t.Fatalf("regrow: %+v %v", change, err)
+	}
+	if _, change, err = svc.SetActive(ctx, uuid.Nil, p.ID.String(), false); err != nil || change.Reassigned != 1 {
+		t.Fatalf("deactivate: %+v %v", change, err)
+	}
+	db.First(&got, "id = ?", addr.ID)
+	if got.PolygonID == nil || *got.PolygonID != other.ID { t.Fatalf("address not handed over: %+v", got) }
+
+	versions, err := svc.Versions(ctx, p.ID.String())
+	if err != nil { t.Fatal(err) }
+	if len(versions) != 4 || versions[0].Version != 4 || versions[0].IsActive { t.Fatalf("versions: %+v", versions) }
+	if err := db.Model(&versions[0]).Update("name", "x").Error; err == nil { t.Fatal("versions must be immutable") }
+}
+
+func TestPolygonNotFound(t *testing.T) {
+	svc := NewPolygonService(testDB(t), nil, nil)
+	for _, id := range []string{"nope", uuid.NewString()} {
+		if _, _, err := svc.Update(context.Background(), uuid.Nil, id, PolygonInput{}); !errors.Is(err, ErrPolygonNotFound) { t.Fatalf("%s: got %v", id, err) }
+	}
+}
@@ -0,0 +1,216 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+)
+
+const MaxNameLength = 100
+
+// Languages the apps and notifications are translated to.
+var Languages = []string{"ru", "kk", "en"}
+
+var (
+	ErrInvalidName = fmt.Errorf("name must be 1 to %d characters", MaxNameLength)
+	ErrInvalidEmail = errors.New("invalid e-mail address")
+	ErrInvalidLanguage = fmt.Errorf("language must be one of %s", strings.Join(Languages, ", "))
+	ErrEmailTaken = errors.New("e-mail address is already in use")
+	ErrInvalidEmailToken = errors.New("invalid or expired verification link")
+)
+
+// Profile is what GET /v1/me returns.
+type Profile struct {
+	User ProfileUser `json:"user"`
+	HasActiveSubscription bool `json:"hasActiveSubscription"`
+	RemainingBags int `json:"remainingBags"`
+	HasSavedAddresses bool `json:"hasSavedAddresses"`
+}
+
+type ProfileUser struct {
+	ID uuid.UUID `json:"id"`
+	Phone string `json:"phone"`
+	Email *string `json:"email"`
+	EmailVerified bool `json:"email_verified"`
+	// PendingEmail is an address waiting for its verification link to be
+	// opened.
+	PendingEmail *string `json:"pending_email"`
+	Name string `json:"name"`
+	Role domain.Role `json:"role"`
+	Language string `json:"language"`
+	MarketingConsent bool `json:"marketing_consent"`
+	HasPassword bool `json:"has_password"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ProfileUpdate lists the fields PATCH /v1/me may change; nil means keep.
+type ProfileUpdate struct {
+	Name *string `json:"name"`
+	Email *string `json:"email"`
+	Language *string `json:"language"`
+	MarketingConsent *bool `json:"marketing_consent"`
+}
+
+// ProfileService reads and edits the user's own profile. A new e-mail
+// address takes effect only after the link mailed to it is opened.
+// Verification e-mails are throttled by the OTP limits, per address and per
+// user.
+type ProfileService struct {
+	db *gorm.DB
+	otp *OTPService
+	mailer Mailer
+	verifyURL string
+	ttl time.Duration
+}
+
+// NewProfileService builds the service. verifyURL is the link mailed to a
+// new address with a single %s for the token.
+func NewProfileService(db *gorm.DB, otp *OTPService, mailer Mailer, verifyURL string, ttl time.Duration) *ProfileService {
+	return &ProfileService{db: db, otp: otp, mailer: mailer, verifyURL: verifyURL, ttl: ttl}
+}
+
+// Get returns the profile of userID with the subscription and address flags
+// the apps use to pick their start screen.
+func (s *ProfileService) Get(ctx context.Context, userID uuid.UUID) (*Profile, error) {
+	db := s.db.WithContext(ctx)
+	var u domain.User
+	err := db.Where("id = ? AND is_deleted = false", userID).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrUserNotFound }
+	if err != nil { return nil, err }
+
+	var subs struct{ N int; Bags int }
+	err = db.Model(&domain.Subscription{}).Select("count(*) AS n, coalesce(sum(remaining_bags), 0) AS bags").
+		Where("user_id = ? AND status = ? AND (expires_at IS NULL OR expires_at > now())", userID, domain.SubActive).
+		Scan(&subs).Error
+	if err != nil { return nil, err }
+	var addrs int64
+	if err := liveAddresses(db, userID).Count(&addrs).Error; err != nil { return nil, err }
+	var pending domain.EmailVerification
+	q := db.Where("user_id = ? AND used_at IS NULL AND expires_at > now()", userID).Order("created_at DESC").Limit(1).Find(&pending)
+	if q.Error != nil { return nil, q.Error }
+
+	p := &Profile{
+		User: ProfileUser{
+			ID: u.ID, Phone: u.Phone, Email: u.Email, EmailVerified: u.Email != nil && u.EmailVerifiedAt != nil,
+			Name: u.Name, Role: u.Role, Language: u.Language, MarketingConsent: u.MarketingConsent,
+			HasPassword: u.PasswordHash != nil, CreatedAt: u.CreatedAt, UpdatedAt: u.UpdatedAt,
+		},
+		HasActiveSubscription: subs.N > 0,
+		RemainingBags: subs.Bags,
+		HasSavedAddresses: addrs > 0,
+	}
+	if q.RowsAffected > 0 { p.User.PendingEmail = &pending.Email }
+	return p, nil
+}
+
+// Update applies upd to the profile of userID. Name, language and marketing
+// consent change immediately; a new e-mail address gets a verification link
+// and is reported by the returned profile as pending. When verification
+// e-mails are throttled nothing changes and a *ThrottledError is returned.
+func (s *ProfileService) Update(ctx context.Context, userID uuid.UUID, upd ProfileUpdate) (*Profile, error) {
+	if err := upd.normalize(); err != nil { return nil, err }
+	db := s.db.WithContext(ctx)
+	var u domain.User
+	err := db.Where("id = ? AND is_deleted = false", userID).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrUserNotFound }
+	if err != nil { return nil, err }
+	newEmail := upd.Email != nil && (u.Email == nil || !strings.EqualFold(*u.Email, *upd.Email))
+	if newEmail {
+		// the address may be anyone's, so it is limited on its own as well
+		// as for the user asking
+		if err := s.otp.Throttle(ctx, *upd.Email, ""); err != nil { return nil, err }
+		if err := s.otp.Throttle(ctx, "user:"+u.ID.String(), ""); err != nil { return nil, err }
+	}
+
+	changes := map[string]interface{}{}
+	if upd.Name != nil { changes["name"] = *upd.Name }
+	if upd.Language != nil { changes["language"] = *upd.Language }
+	if upd.MarketingConsent != nil && *upd.MarketingConsent != u.MarketingConsent {
+		// the time of consent is kept as evidence, and cleared on withdrawal
+		changes["marketing_consent"] = *upd.MarketingConsent
+		changes["marketing_consent_at"] = nil
+		if *upd.MarketingConsent { changes["marketing_consent_at"] = time.Now() }
+	}
+	if len(changes) > 0 {
+		if err := db.Model(&u).Updates(changes).Error; err != nil { return nil, err }
+	}
+	if newEmail {
+		if err := s.requestEmailChange(ctx, u.ID, *upd.Email); err != nil { return nil, err }
+	}
+	return s.Get(ctx, userID)
+}
+
+func (s *ProfileService) requestEmailChange(ctx context.Context, userID uuid.UUID, email string) error {
+	var taken int64
+	err := s.db.WithContext(ctx).Model(&domain.User{}).Where("lower(email) = lower(?) AND id <> ?", email, userID).Count(&taken).Error
+	if err != nil { return err }
+	if taken > 0 { return ErrEmailTaken }
+	token, err := randomToken()
+	if err != nil { return err }
+	v := domain.EmailVerification{UserID: userID, Email: email, TokenHash: auth.HashToken(token), ExpiresAt: time.Now().Add(s.ttl)}
+	if err := s.db.WithContext(ctx).Create(&v).Error; err != nil { return err }
+	body := fmt.Sprintf("Чтобы подтвердить адрес %s для аккаунта MusorOK, перейдите по ссылке:\n%s\n\nСсылка действует %d ч. Если вы не меняли почту, просто проигнорируйте это письмо.",
+		email, fmt.Sprintf(s.verifyURL, token), int(s.ttl.Hours()))
+	return s.mailer.Send(ctx, email, "MusorOK: подтверждение почты", body)
+}
+
+// VerifyEmail redeems a verification link and makes its address the user's
+// e-mail. Older pending links of the user are invalidated.
+func (s *ProfileService) VerifyEmail(ctx context.Context, token string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var v domain.EmailVerification
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > now()", auth.HashToken(token)).
+			First(&v).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrInvalidEmailToken }
+		if err != nil { return err }
+		var taken int64
+		if err := tx.Model(&domain.User{}).Where("lower(email) = lower(?) AND id <> ?", v.Email, v.UserID).Count(&taken).Error; err != nil { return err }
+		if taken > 0 { return ErrEmailTaken }
+		now := time.Now()
+		if err := tx.Model(&domain.EmailVerification{}).Where("user_id = ? AND used_at IS NULL", v.UserID).Update("used_at", now).Error; err != nil { return err }
+		res := tx.Model(&domain.User{}).Where("id = ? AND is_deleted = false", v.UserID).
+			Updates(map[string]interface{}{"email": v.Email, "email_verified_at": now})
+		if res.Error != nil { return res.Error }
+		if res.RowsAffected == 0 { return ErrInvalidEmailToken }
+		return nil
+	})
+}
+
+// normalize trims the update and validates it.
+func (u *ProfileUpdate) normalize() error {
+	if u.Name != nil {
+		n := strings.TrimSpace(*u.Name)
+		if n == "" || utf8.RuneCountInString(n) > MaxNameLength { return ErrInvalidName }
+		u.Name = &n
+	}
+	if u.Email != nil {
+		e := strings.TrimSpace(*u.Email)
+		addr, err := mail.ParseAddress(e)
+		if err != nil || addr.Address != e { return ErrInvalidEmail }
+		// stored in lower case, which the unique index on lower(email)
+		// relies on too
+		e = strings.ToLower(e)
+		u.Email = &e
+	}
+	if u.Language != nil {
+		l := strings.ToLower(strings.TrimSpace(*u.Language))
+		ok := false
+		for _, known := range Languages { ok = ok || l == known }
+		if !ok { return ErrInvalidLanguage }
+		u.Language = &l
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+// fakeMailer keeps the last message per recipient.
+type fakeMailer struct{ sent map[string]string }
+
+func (f *fakeMailer) Send(_ context.Context, to, _, body string) error {
+	f.sent[to] = body
+	return nil
+}
+
+func strp(s string) *string { return &s }
+
+func TestProfileUpdateValidation(t *testing.T) {
+	cases := []struct {
+		upd ProfileUpdate
+		err error
+	}{
+		{ProfileUpdate{Name: strp("  Айгерим ")}, nil},
+		{ProfileUpdate{Name: strp("   ")}, ErrInvalidName},
+		{ProfileUpdate{Name: strp(strings.Repeat("я", MaxNameLength+1))}, ErrInvalidName},
+		{ProfileUpdate{Email: strp("user@example.com")}, nil},
+		{ProfileUpdate{Email: strp("User <user@example.com>")}, ErrInvalidEmail},
+		{ProfileUpdate{Email: strp("not-an-email")}, ErrInvalidEmail},
+		{ProfileUpdate{Language: strp("KK")}, nil},
+		{ProfileUpdate{Language: strp("de")}, ErrInvalidLanguage},
+	}
+	for _, tc := range cases {
+		if err := tc.upd.normalize(); !errors.Is(err, tc.err) { t.Errorf("%+v: err = %v, want %v", tc.upd, err, tc.err) }
+	}
+	u := ProfileUpdate{Name: strp("  Айгерим "), Email: strp(" User@Example.COM "), Language: strp("KK")}
+	_ = u.normalize()
+	if *u.Name != "Айгерим" || *u.Email != "user@example.com" || *u.Language != "kk" { t.Fatalf("not normalized: %q %q %q", *u.Name, *u.Email, *u.Language) }
+}
+
+func TestProfileEmailChangeNeedsVerification(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990010", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	mailer := &fakeMailer{sent: map[string]string{}}
+	otpSvc, _, _, _ := newTestOTP()
+	svc := NewProfileService(db, otpSvc, mailer, "https://musorok.kz/verify-email?token=%s", time.Hour)
+
+	yes := true
+	p, err := svc.Update(ctx, u.ID, ProfileUpdate{Name: strp("Айгерим"), Email: strp("new@example.com"), MarketingConsent: &yes})
+	if err != nil { t.Fatal(err) }
+	if p.User.Name != "Айгерим" || !p.User.MarketingConsent { t.Fatalf("profile = %+v", p.User) }
+	if p.User.Email != nil || p.User.PendingEmail == nil || *p.User.PendingEmail != "new@example.com" {
+		t.Fatalf("e-mail must stay pending until verified: %+v", p.User)
+	}
+	token := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`).FindStringSubmatch(mailer.sent["new@example.com"])
+	if token == nil { t.Fatalf("no link mailed: %q", mailer.sent["new@example.com"]) }
+	if err := svc.VerifyEmail(ctx, token[1]); err != nil { t.Fatal(err) }
+	if err := svc.VerifyEmail(ctx, token[1]); !errors.Is(err, ErrInvalidEmailToken) { t.Fatalf("link reused: %v", err) }
+
+	p, err = svc.Get(ctx, u.ID)
+	if err != nil { t.Fatal(err) }
+	if p.User.Email == nil || *p.User.Email != "new@example.com" || !p.User.EmailVerified || p.User.PendingEmail != nil {
+		t.Fatalf("after verification: %+v", p.User)
+	}
+}
+
+// TestProfileEmailChangeThrottled checks that verification e-mails are
+// limited per user and per target address.
+func TestProfileEmailChangeThrottled(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	users := NewUserService(db)
+	u, err := users.Create(ctx, "+77079990012", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	other, err := users.Create(ctx, "+77079990013", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	mailer := &fakeMailer{sent: map[string]string{}}
+	otpSvc, _, _, clock := newTestOTP()
+	svc := NewProfileService(db, otpSvc, mailer, "%s", time.Hour)
+	var throttled *ThrottledError
+
+	if _, err := svc.Update(ctx, u.ID, ProfileUpdate{Email: strp("victim@example.com")}); err != nil { t.Fatal(err) }
+	if _, err := svc.Update(ctx, u.ID, ProfileUpdate{Email: strp("another@example.com")}); !errors.As(err, &throttled) { t.Fatalf("second change by the same user: %v", err) }
+	if _, err := svc.Update(ctx, other.ID, ProfileUpdate{Email: strp("victim@example.com")}); !errors.As(err, &throttled) { t.Fatalf("same address by another user: %v", err) }
+	if _, ok := mailer.sent["another@example.com"]; ok { t.Fatal("throttled change was mailed") }
+
+	// past the cooldown the address may be mailed again, until its limit
+	// for the window is used up; throttled requests count too
+	*clock = clock.Add(testOTPConfig.ResendCooldown)
+	if _, err := svc.Update(ctx, other.ID, ProfileUpdate{Email: strp("victim@example.com")}); err != nil { t.Fatal(err) }
+	*clock = clock.Add(testOTPConfig.ResendCooldown)
+	if _, err := svc.Update(ctx, other.ID, ProfileUpdate{Email: strp("victim@example.com")}); !errors.As(err, &throttled) { t.Fatalf("past the address limit: %v", err) }
+}
+
+func TestProfileFlags(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	u, err := NewUserService(db).Create(ctx, "+77079990011", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	otpSvc, _, _, _ := newTestOTP()
+	svc := NewProfileService(db, otpSvc, &fakeMailer{sent: map[string]string{}}, "%s", time.Hour)
+	p, err := svc.Get(ctx, u.ID)
+	if err != nil { t.Fatal(err) }
+	if p.HasActiveSubscription || p.HasSavedAddresses || p.RemainingBags != 0 { t.Fatalf("fresh user flags: %+v", p) }
+
+	if err := db.Create(&domain.Subscription{UserID: u.ID, Plan: domain.PlanP7, TotalBags: 7, RemainingBags: 5, Status: domain.SubActive}).Error; err != nil { t.Fatal(err) }
+	if err := db.Create(&domain.Address{UserID: u.ID, City: "Алматы"}).Error; err != nil { t.Fatal(err) }
+	p, err = svc.Get(ctx, u.ID)
+	if err != nil { t.Fatal(err) }
+	if !p.HasActiveSubscription || !p.HasSavedAddresses || p.RemainingBags != 5 { t.Fatalf("flags: %+v", p) }
+}
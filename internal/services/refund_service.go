@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+// RefundService returns the money of canceled orders through the payment
+// provider. A refund is queued in the transaction that cancels the order
+// and made with the provider only after it commits, so no order is locked
+// while the provider answers and an outage of the provider never undoes a
+// cancellation or a payment. Refunds the provider failed stay pending and
+// RetryPending makes them later, within RefundPolicy.
+type RefundService struct {
+	db *gorm.DB
+	provider Refunder
+	policy RefundPolicy
+	now func() time.Time
+}
+
+// RefundPolicy bounds the tries of a refund the provider fails. The next
+// try waits BaseDelay after the first failure, doubling per failure up to
+// MaxDelay. After MaxAttempts failures the refund is given up as FAILED and
+// waits for an operator instead; zero MaxAttempts never gives up.
+type RefundPolicy struct {
+	MaxAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+}
+
+var (
+	ErrRefundNotFound = errors.New("refund not found")
+	ErrRefundNotFailed = errors.New("only a failed refund can be queued again")
+)
+
+func NewRefundService(db *gorm.DB, provider Refunder, policy RefundPolicy) *RefundService {
+	return &RefundService{db: db, provider: provider, policy: policy, now: time.Now}
+}
+
+// delay is the wait before the next try of a refund failed n times.
+func (p RefundPolicy) delay(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && d > 0 && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ { d *= 2 }
+	if p.MaxDelay > 0 && d > p.MaxDelay { d = p.MaxDelay }
+	return d
+}
+
+// queueRefund records inside tx that amount of the succeeded payment p is
+// owed back for the canceled order o, to be made under key. A key queued
+// before keeps its refund, which is returned instead.
+func queueRefund(tx *gorm.DB, p *domain.Payment, o *domain.Order, amount int, key string) (*domain.Refund, error) {
+	r := domain.Refund{PaymentID: p.ID, OrderID: o.ID, AmountKZT: amount, IdempotencyKey: key, Status: domain.RefundPending}
+	res := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "idempotency_key"}}, DoNothing: true}).Create(&r)
+	if res.Error != nil { return nil, res.Error }
+	if res.RowsAffected == 0 {
+		if err := tx.Where("idempotency_key = ?", key).First(&r).Error; err != nil { return nil, err }
+	}
+	return &r, nil
+}
+
+// refundable is what is left of the locked payment p once the refunds
+// queued or made for it are taken off.
+func refundable(tx *gorm.DB, p *domain.Payment) (int, error) {
+	var owed int
+	err := tx.Model(&domain.Refund{}).Where("payment_id = ?", p.ID).Select("coalesce(sum(amount_kzt), 0)").Scan(&owed).Error
+	return max(p.AmountKZT-owed, 0), err
+}
+
+// Process makes the pending refund id with the provider and records it: the
+// payment counts it as refunded and its order, if still CANCELED, moves on
+// to REFUNDED. A refund already made or given up is left alone. When the
+// provider fails, the attempt is counted and the refund waits out the
+// policy's delay, or is given up as FAILED on the last attempt; the error
+// wraps ErrRefundFailed.
+func (s *RefundService) Process(ctx context.Context, id uuid.UUID) error {
+	var r domain.Refund
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&r).Error; err != nil { return err }
+	if r.Status != domain.RefundPending { return nil }
+	var p domain.Payment
+	if err := s.db.WithContext(ctx).Where("id = ?", r.PaymentID).First(&p).Error; err != nil { return err }
+	refundID, err := s.refund(ctx, &p, &r)
+	if err != nil {
+		if uerr := s.fail(ctx, &r, err); uerr != nil { return uerr }
+		return fmt.Errorf("%w: %v", ErrRefundFailed, err)
+	}
+	// locked in the order Cancel takes them: order, payment, refund
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var o domain.Order
+		if err := lockOrder(tx, r.OrderID, &o); err != nil { return err }
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", p.ID).First(&p).Error; err != nil { return err }
+		res := tx.Model(&domain.Refund{}).Where("id = ? AND status = ?", r.ID, domain.RefundPending).
+			Updates(map[string]interface{}{"status": domain.RefundSucceeded, "provider_refund_id": refundID, "last_error": nil, "updated_at": time.Now()})
+		if res.Error != nil { return res.Error }
+		// made by a concurrent run already
+		if res.RowsAffected == 0 { return nil }
+		p.RefundedKZT, p.ProviderRefundID, p.UpdatedAt = p.RefundedKZT+r.AmountKZT, &refundID, time.Now()
+		err := tx.Model(&p).Updates(map[string]interface{}{"refunded_kzt": p.RefundedKZT, "provider_refund_id": refundID, "updated_at": p.UpdatedAt}).Error
+		if err != nil || o.Status != domain.StatusCanceled { return err }
+		return moveOrder(tx, &o, domain.StatusRefunded, SystemActor, map[string]interface{}{"payment_id": p.ID, "refund_id": refundID, "amount_kzt": r.AmountKZT})
+	})
+}
+
+// make processes the refund r just queued for the order o and reloads o
+// when it was made. A failure is logged and leaves the refund to
+// RetryPending; make reports whether the refund went through.
+func (s *RefundService) make(ctx context.Context, r *domain.Refund, o *domain.Order) bool {
+	if err := s.Process(ctx, r.ID); err != nil {
+		log.Warn().Err(err).Str("order", o.ID.String()).Msg("refunds: left pending")
+		return false
+	}
+	if err := s.db.WithContext(ctx).Where("id = ?", o.ID).First(o).Error; err != nil {
+		log.Error().Err(err).Str("order", o.ID.String()).Msg("refunds: reload order")
+	}
+	return true
+}
+
+// fail counts the failed attempt of the pending refund r and schedules the
+// next one, or gives r up when it was the last. A concurrent run that
+// counted the attempt first wins.
+func (s *RefundService) fail(ctx context.Context, r *domain.Refund, cause error) error {
+	now := s.now()
+	n := r.Attempts + 1
+	status := domain.RefundPending
+	if s.policy.MaxAttempts > 0 && n >= s.policy.MaxAttempts { status = domain.RefundFailed }
+	err := s.db.WithContext(ctx).Model(&domain.Refund{}).Where("id = ? AND status = ? AND attempts = ?", r.ID, domain.RefundPending, r.Attempts).
+		Updates(map[string]interface{}{"status": status, "attempts": n, "last_error": cause.Error(), "next_attempt_at": now.Add(s.policy.delay(n)), "updated_at": now}).Error
+	if err != nil { return err }
+	if status == domain.RefundFailed {
+		log.Error().Err(cause).Str("refund", r.ID.String()).Str("order", r.OrderID.String()).Int("attempts", n).Msg("refunds: given up, needs an operator")
+	}
+	return nil
+}
+
+func (s *RefundService) refund(ctx context.Context, p *domain.Payment, r *domain.Refund) (string, error) {
+	if s.provider == nil { return "", errors.New("no payment provider") }
+	return s.provider.Refund(ctx, p.ProviderIntentID, r.AmountKZT, r.IdempotencyKey)
+}
+
+// refundBatch bounds the refunds RetryPending takes at once.
+const refundBatch = 100
+
+// RetryPending tries the pending refunds that are due again, longest
+// waiting first, and returns how many were made. Failures are logged and
+// wait out their delay.
+func (s *RefundService) RetryPending(ctx context.Context) (int, error) {
+	var ids []uuid.UUID
+	err := s.db.WithContext(ctx).Model(&domain.Refund{}).Where("status = ? AND next_attempt_at <= ?", domain.RefundPending, s.now()).
+		Order("next_attempt_at").Limit(refundBatch).Pluck("id", &ids).Error
+	if err != nil { return 0, err }
+	made := 0
+	for _, id := range ids {
+		if err := s.Process(ctx, id); err != nil {
+			log.Warn().Err(err).Str("refund", id.String()).Msg("refunds: retry")
+			continue
+		}
+		made++
+	}
+	return made, nil
+}
+
+// List returns the refunds in status, most recently changed first, at most
+// limit of them.
+func (s *RefundService) List(ctx context.Context, status domain.RefundStatus, limit int) ([]domain.Refund, error) {
+	items := []domain.Refund{}
+	err := s.db.WithContext(ctx).Where("status = ?", status).Order("updated_at DESC").Limit(limit).Find(&items).Error
+	return items, err
+}
+
+// Requeue sends the given-up refund id back to the queue with its attempts
+// counted from zero, and tries it at once. It returns the refund as that
+// try left it.
+func (s *RefundService) Requeue(ctx context.Context, id string) (*domain.Refund, error) {
+	rid, err := uuid.Parse(id)
+	if err != nil { return nil, ErrRefundNotFound }
+	var r domain.Refund
+	if err := s.db.WithContext(ctx).Where("id = ?", rid).First(&r).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrRefundNotFound }
+		return nil, err
+	}
+	res := s.db.WithContext(ctx).Model(&domain.Refund{}).Where("id = ? AND status = ?", rid, domain.RefundFailed).
+		Updates(map[string]interface{}{"status": domain.RefundPending, "attempts": 0, "next_attempt_at": s.now(), "updated_at": s.now()})
+	if res.Error != nil { return nil, res.Error }
+	if res.RowsAffected == 0 { return nil, ErrRefundNotFailed }
+	if err := s.Process(ctx, rid); err != nil && !errors.Is(err, ErrRefundFailed) { return nil, err }
+	if err := s.db.WithContext(ctx).Where("id = ?", rid).First(&r).Error; err != nil { return nil, err }
+	return &r, nil
+}
+
+// RetryRefunds runs RetryPending every interval until ctx ends.
+func (s *RefundService) RetryRefunds(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := s.RetryPending(ctx)
+		if err != nil { log.Error().Err(err).Msg("refunds: retry pending"); continue }
+		if n > 0 { log.Info().Int("made", n).Msg("refunds: made pending refunds") }
+	}
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+func TestRefundDelay(t *testing.T) {
+	p := RefundPolicy{BaseDelay: 5 * time.Minute, MaxDelay: time.Hour}
+	want := []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w { t.Fatalf("after %d failures: %s, want %s", i+1, got, w) }
+	}
+	if got := (RefundPolicy{}).delay(3); got != 0 { t.Fatalf("no delay: %s", got) }
+}
+
+// TestRefundRetries backs off a refund the provider keeps failing, gives it
+// up after the last attempt and makes it once an operator queues it again.
+func TestRefundRetries(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	provider := &fakeRefunder{err: errors.New("provider down")}
+	refunds := NewRefundService(db, provider, RefundPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour})
+	now := time.Now()
+	refunds.now = func() time.Time { return now }
+	orders := NewOrderService(db, addrs, NewTariffService(db, almaty), refunds, CancelPolicy{})
+	payments := NewPaymentService(db, refunds)
+	o, err := orders.Create(ctx, owner.ID.String(), OrderRequest{AddressID: addr.ID.String(), BagsCount: 1, TimeOption: domain.ASAP})
+	if err != nil { t.Fatal(err) }
+	if _, err := payments.Record(ctx, owner.ID, &o.ID, nil, "intent_refund_retries", o.PriceKZT); err != nil { t.Fatal(err) }
+	if _, err := payments.Apply(ctx, "intent_refund_retries", domain.PaySucceeded, o.PriceKZT, nil); err != nil { t.Fatal(err) }
+	if c, err := orders.Cancel(ctx, owner.ID.String(), o.ID.String(), ""); err != nil || !c.RefundPending { t.Fatalf("cancel: %+v %v", c, err) }
+	var r domain.Refund
+	load := func() {
+		t.Helper()
+		if err := db.Where("order_id = ?", o.ID).First(&r).Error; err != nil { t.Fatal(err) }
+	}
+	load()
+	if r.Attempts != 1 || !r.NextAttemptAt.Equal(now.Add(time.Minute).Truncate(time.Microsecond)) { t.Fatalf("first failure: %+v", r) }
+
+	// not due before its delay is over
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 0 { t.Fatalf("early retry: %d %v", n, err) }
+	load()
+	if r.Attempts != 1 { t.Fatalf("tried before due: %+v", r) }
+	// the second failure waits twice as long
+	now = now.Add(time.Minute)
+	if _, err := refunds.RetryPending(ctx); err != nil { t.Fatal(err) }
+	load()
+	if r.Attempts != 2 || !r.NextAttemptAt.Equal(now.Add(2*time.Minute).Truncate(time.Microsecond)) { t.Fatalf("second failure: %+v", r) }
+	// the third is the last
+	now = now.Add(2 * time.Minute)
+	if _, err := refunds.RetryPending(ctx); err != nil { t.Fatal(err) }
+	load()
+	if r.Status != domain.RefundFailed || r.Attempts != 3 || r.LastError == nil { t.Fatalf("given up: %+v", r) }
+	now = now.Add(24 * time.Hour)
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 0 { t.Fatalf("retry of a failed refund: %d %v", n, err) }
+	failed, err := refunds.List(ctx, domain.RefundFailed, 50)
+	if err != nil || len(failed) != 1 || failed[0].ID != r.ID { t.Fatalf("failed refunds: %+v %v", failed, err) }
+
+	// queued again by an operator: tried at once and, the provider still
+	// down, counted from zero
+	again, err := refunds.Requeue(ctx, r.ID.String())
+	if err != nil || again.Status != domain.RefundPending || again.Attempts != 1 { t.Fatalf("requeued while down: %+v %v", again, err) }
+	if _, err := refunds.Requeue(ctx, r.ID.String()); !errors.Is(err, ErrRefundNotFailed) { t.Fatalf("requeue of a pending refund: %v", err) }
+	if _, err := refunds.Requeue(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, ErrRefundNotFound) { t.Fatalf("requeue of no refund: %v", err) }
+	provider.err = nil
+	now = now.Add(time.Minute)
+	if n, err := refunds.RetryPending(ctx); err != nil || n != 1 { t.Fatalf("retry: %d %v", n, err) }
+	load()
+	if r.Status != domain.RefundSucceeded || len(provider.amounts) != 1 { t.Fatalf("made: %+v, refunds %v", r, provider.amounts) }
+	if got, _ := orders.Get(ctx, owner.ID.String(), o.ID.String()); got.Status != domain.StatusRefunded { t.Fatalf("order: %s", got.Status) }
+}
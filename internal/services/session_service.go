@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/core/auth"
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// TokenPair is the access/refresh pair returned by every login flow.
+type TokenPair struct {
+	Access string `json:"access"`
+	Refresh string `json:"refresh"`
+}
+
+// SessionService issues and rotates refresh tokens backed by the sessions
+// table. Refresh tokens are never stored, only auth.HashToken of them.
+type SessionService struct {
+	db *gorm.DB
+	access *auth.KeySet
+	refresh *auth.KeySet
+	accessTTL time.Duration
+	refreshTTL time.Duration
+}
+
+// NewSessionService signs access tokens with access, which other services
+// may verify through JWKS, and refresh tokens with refresh, which only this
+// service ever reads.
+func NewSessionService(db *gorm.DB, access, refresh *auth.KeySet, accessTTL, refreshTTL time.Duration) *SessionService {
+	return &SessionService{db: db, access: access, refresh: refresh, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+// Start opens a new session family for u and returns its first token pair.
+func (s *SessionService) Start(ctx context.Context, u *domain.User, userAgent, ip string) (*TokenPair, error) {
+	var pair *TokenPair
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		id := uuid.New()
+		p, err := s.issue(ctx, tx, u, id, id, userAgent, ip)
+		pair = p
+		return err
+	})
+	return pair, err
+}
+
+// Refresh exchanges a refresh token for a new pair and revokes the presented
+// one. A token that was already rotated signals theft: the whole family is
+// revoked and ErrRefreshTokenReused is returned.
+func (s *SessionService) Refresh(ctx context.Context, refresh, userAgent, ip string) (*TokenPair, error) {
+	if _, err := s.refresh.Parse(refresh); err != nil { return nil, ErrInvalidRefreshToken }
+	var pair *TokenPair
+	reused := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var cur domain.Session
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("refresh_token_hash = ?", auth.HashToken(refresh)).First(&cur).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrInvalidRefreshToken }
+		if err != nil { return err }
+		if cur.RevokedAt != nil {
+			if cur.ReplacedBy == nil { return ErrInvalidRefreshToken }
+			reused = true
+			return nil
+		}
+		if time.Now().After(cur.ExpiresAt) { return ErrInvalidRefreshToken }
+		var u domain.User
+		if err := tx.Where("id = ? AND is_deleted = false", cur.UserID).First(&u).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) { return ErrInvalidRefreshToken }
+			return err
+		}
+		next := uuid.New()
+		p, err := s.issue(ctx, tx, &u, next, cur.FamilyID, userAgent, ip)
+		if errors.Is(err, ErrNotCourier) || errors.Is(err, ErrCourierInactive) { return ErrInvalidRefreshToken }
+		if err != nil { return err }
+		if err := tx.Model(&domain.Session{}).Where("id = ?", cur.ID).
+			Updates(map[string]interface{}{"revoked_at": time.Now(), "replaced_by": next}).Error; err != nil {
+			return err
+		}
+		pair = p
+		return nil
+	})
+	if err != nil { return nil, err }
+	if reused {
+		// revoke outside the lookup transaction so the family stays revoked
+		// regardless of what the caller does with the error
+		if err := s.revokeFamilyOf(ctx, refresh); err != nil { return nil, err }
+		return nil, ErrRefreshTokenReused
+	}
+	return pair, nil
+}
+
+func (s *SessionService) revokeFamilyOf(ctx context.Context, refresh string) error {
+	return s.db.WithContext(ctx).Exec(
+		`UPDATE sessions SET revoked_at = now()
+		 WHERE revoked_at IS NULL
+		   AND family_id = (SELECT family_id FROM sessions WHERE refresh_token_hash = ?)`,
+		auth.HashToken(refresh),
+	).Error
+}
+
+// issue mints a token pair for u and stores the refresh token as session id
+// within family.
+func (s *SessionService) issue(ctx context.Context, tx *gorm.DB, u *domain.User, id, family uuid.UUID, userAgent, ip string) (*TokenPair, error) {
+	claims, err := claimsFor(tx, u)
+	if err != nil { return nil, err }
+	claims.SessionID = family.String()
+	acc, err := s.access.Sign(claims, s.accessTTL)
+	if err != nil { return nil, err }
+	ref, err := s.refresh.Sign(claims, s.refreshTTL)
+	if err != nil { return nil, err }
+	row := domain.Session{
+		ID: id, UserID: u.ID, FamilyID: family,
+		RefreshTokenHash: auth.HashToken(ref),
+		UserAgent: userAgent, IP: ip,
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}
+	if err := tx.WithContext(ctx).Create(&row).Error; err != nil { return nil, err }
+	return &TokenPair{Access: acc, Refresh: ref}, nil
+}
+
+// IsActive reports whether the session family is neither revoked nor expired.
+// It backs the revocation check in middleware.JWT.
+func (s *SessionService) IsActive(ctx context.Context, sessionID string) (bool, error) {
+	var n int64
+	err := s.db.WithContext(ctx).Model(&domain.Session{}).
+		Where("family_id = ? AND revoked_at IS NULL AND expires_at > now()", sessionID).
+		Count(&n).Error
+	return n > 0, err
+}
+
+// List returns the live sessions of a user, one row per logged-in device.
+func (s *SessionService) List(ctx context.Context, userID string) ([]domain.Session, error) {
+	var out []domain.Session
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > now()", userID).
+		Order("created_at DESC").Find(&out).Error
+	return out, err
+}
+
+// Revoke ends one session family of the user. ErrSessionNotFound is returned
+// when the family does not belong to the user or is already revoked.
+func (s *SessionService) Revoke(ctx context.Context, userID, sessionID string) error {
+	res := s.db.WithContext(ctx).Model(&domain.Session{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", userID, sessionID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil { return res.Error }
+	if res.RowsAffected == 0 { return ErrSessionNotFound }
+	return nil
+}
+
+// RevokeAll ends every session of the user, logging them out everywhere.
+func (s *SessionService) RevokeAll(ctx context.Context, userID string) error {
+	return s.db.WithContext(ctx).Model(&domain.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// claimsFor builds the token claims for u. Couriers additionally get their
+// courier and polygon ids; a courier that was deactivated or unlinked can no
+// longer obtain tokens.
+func claimsFor(db *gorm.DB, u *domain.User) (auth.Claims, error) {
+	claims := auth.Claims{UserID: u.ID.String(), Role: string(u.Role)}
+	if u.Role != domain.RoleCourier { return claims, nil }
+	courier, err := activeCourier(db, u.ID)
+	if err != nil { return claims, err }
+	claims.CourierID = courier.ID.String()
+	claims.PolygonID = courier.PolygonID.String()
+	return claims, nil
+}
+
+// RevokeOthers ends every session of the user except keepSession, e.g. after
+// a password change made from that session.
+func (s *SessionService) RevokeOthers(ctx context.Context, userID, keepSession string) error {
+	q := s.db.WithContext(ctx).Model(&domain.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if keepSession != "" { q = q.Where("family_id <> ?", keepSession) }
+	return q.Update("revoked_at", time.Now()).Error
+}
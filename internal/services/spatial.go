@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+// SpatialRepo answers the spatial queries about zones and couriers.
+// ZoneIndex answers them in Go from an in-memory index and is the default;
+// postgres.SpatialRepo answers them with PostGIS (SPATIAL_BACKEND=postgis).
+// Both must agree on which zone serves a point.
+type SpatialRepo interface {
+	// Resolve returns the active polygon serving the point, without its
+	// GeoJSON, or ErrNotServed. Overlaps go to the highest priority, then
+	// the smallest zone, then the lowest id.
+	Resolve(ctx context.Context, lat, lng float64) (*domain.Polygon, error)
+	// Nearest returns the active polygon closest to the point, without its
+	// GeoJSON, and its distance in metres (0 when it serves the point). The
+	// polygon is nil when no zone is active.
+	Nearest(ctx context.Context, lat, lng float64) (*domain.Polygon, float64, error)
+	// NearestCouriers returns active couriers with a recent position,
+	// closest first.
+	NearestCouriers(ctx context.Context, lat, lng float64, q CourierQuery) ([]NearbyCourier, error)
+	// Reload makes zone changes committed by this process visible at once.
+	Reload(ctx context.Context) error
+}
+
+// CourierQuery narrows NearestCouriers.
+type CourierQuery struct {
+	// PolygonID keeps only the couriers of one zone.
+	PolygonID *uuid.UUID
+	// MaxAge drops positions older than it, default 15 minutes.
+	MaxAge time.Duration
+	// RadiusM drops couriers farther than it in metres; 0 means no limit.
+	RadiusM float64
+	// Limit caps the result, default 10.
+	Limit int
+}
+
+// WithDefaults fills in the zero fields that have a default.
+func (q CourierQuery) WithDefaults() CourierQuery {
+	if q.MaxAge <= 0 { q.MaxAge = 15 * time.Minute }
+	if q.Limit <= 0 { q.Limit = 10 }
+	return q
+}
+
+// NearbyCourier is a courier and their distance from the query point.
+type NearbyCourier struct {
+	Courier domain.Courier
+	DistanceM float64
+}
+
+var _ SpatialRepo = (*ZoneIndex)(nil)
+
+// NearestCouriers reads the candidates from the database, within the
+// bounding box of q.RadiusM when set, and sorts them by Haversine distance.
+func (z *ZoneIndex) NearestCouriers(ctx context.Context, lat, lng float64, q CourierQuery) ([]NearbyCourier, error) {
+	q = q.WithDefaults()
+	db := z.db.WithContext(ctx).
+		Where("is_active AND last_lat IS NOT NULL AND last_lng IS NOT NULL AND located_at > ?", time.Now().Add(-q.MaxAge))
+	if q.PolygonID != nil { db = db.Where("polygon_id = ?", *q.PolygonID) }
+	if q.RadiusM > 0 {
+		dLat := q.RadiusM / metersPerDegree
+		dLng := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+		db = db.Where("last_lat BETWEEN ? AND ? AND last_lng BETWEEN ? AND ?", lat-dLat, lat+dLat, lng-dLng, lng+dLng)
+	}
+	var couriers []domain.Courier
+	if err := db.Find(&couriers).Error; err != nil { return nil, err }
+	pt := geospatial.Position{lng, lat}
+	out := make([]NearbyCourier, 0, len(couriers))
+	for _, c := range couriers {
+		d := geospatial.Haversine(pt, geospatial.Position{*c.LastLng, *c.LastLat})
+		if q.RadiusM > 0 && d > q.RadiusM { continue }
+		out = append(out, NearbyCourier{Courier: c, DistanceM: d})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].DistanceM < out[j].DistanceM })
+	if len(out) > q.Limit { out = out[:q.Limit] }
+	return out, nil
+}
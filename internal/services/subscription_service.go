@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrInvalidPlan = errors.New("invalid plan")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrNoActiveSubscription = errors.New("no active subscription")
+	ErrNotEnoughBags = errors.New("not enough remaining bags")
+)
+
+// Plan is a subscription plan on sale.
+type Plan struct {
+	Plan domain.SubscriptionPlan `json:"plan"`
+	Price int `json:"price"`
+	TotalBags int `json:"total_bags"`
+}
+
+// Plans lists the plans in display order.
+var Plans = []Plan{
+	{Plan: domain.PlanP7, Price: 1569, TotalBags: 7},
+	{Plan: domain.PlanP15, Price: 3175, TotalBags: 15},
+	{Plan: domain.PlanP30, Price: 5976, TotalBags: 30},
+}
+
+// SubscriptionService is the customer side of subscriptions, scoped to the
+// caller like OrderService.
+type SubscriptionService struct {
+	db *gorm.DB
+	addrs *AddressService
+	tariffs *TariffService
+}
+
+func NewSubscriptionService(db *gorm.DB, addrs *AddressService, tariffs *TariffService) *SubscriptionService {
+	return &SubscriptionService{db: db, addrs: addrs, tariffs: tariffs}
+}
+
+// Create starts a subscription of userID on plan.
+func (s *SubscriptionService) Create(ctx context.Context, userID uuid.UUID, plan domain.SubscriptionPlan) (*domain.Subscription, error) {
+	for _, p := range Plans {
+		if p.Plan != plan { continue }
+		sub := domain.Subscription{
+			UserID: userID, Plan: p.Plan, TotalBags: p.TotalBags, RemainingBags: p.TotalBags,
+			PriceKZT: p.Price, Status: domain.SubActive, StartedAt: time.Now(),
+		}
+		if err := s.db.WithContext(ctx).Create(&sub).Error; err != nil { return nil, err }
+		return &sub, nil
+	}
+	return nil, ErrInvalidPlan
+}
+
+// Current returns the newest active subscription of userID or
+// ErrNoActiveSubscription.
+func (s *SubscriptionService) Current(ctx context.Context, userID uuid.UUID) (*domain.Subscription, error) {
+	var sub domain.Subscription
+	err := s.db.WithContext(ctx).Where("user_id = ? AND status = ?", userID, domain.SubActive).Order("started_at desc").First(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrNoActiveSubscription }
+	if err != nil { return nil, err }
+	return &sub, nil
+}
+
+// Cancel cancels a subscription of userID.
+func (s *SubscriptionService) Cancel(ctx context.Context, userID uuid.UUID, id string) error {
+	if _, err := uuid.Parse(id); err != nil { return ErrSubscriptionNotFound }
+	res := s.db.WithContext(ctx).Model(&domain.Subscription{}).Where("id = ? AND user_id = ?", id, userID).Update("status", domain.SubCanceled)
+	if res.Error != nil { return res.Error }
+	if res.RowsAffected == 0 { return ErrSubscriptionNotFound }
+	return nil
+}
+
+// CreateOrder places an order of userID paid with bags of their active
+// subscription. The bags are taken under a row lock so two concurrent
+// orders cannot overdraw the subscription. The order costs nothing, so it
+// is PAID right away, and records the zone's tariff, which the courier is
+// paid by.
+func (s *SubscriptionService) CreateOrder(ctx context.Context, userID uuid.UUID, req OrderRequest) (*domain.Order, error) {
+	if err := req.check(time.Now()); err != nil { return nil, err }
+	addr, err := s.addrs.Get(ctx, userID.String(), req.AddressID)
+	if err != nil { return nil, err }
+	if addr.PolygonID == nil { return nil, ErrNotServed }
+	t, err := s.tariffs.Current(ctx, addr.PolygonID, time.Now())
+	if err != nil { return nil, err }
+	var order domain.Order
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var sub domain.Subscription
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND status = ?", userID, domain.SubActive).Order("started_at desc").First(&sub).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) { return ErrNoActiveSubscription }
+		if err != nil { return err }
+		if sub.RemainingBags < req.BagsCount { return ErrNotEnoughBags }
+		order = domain.Order{
+			UserID: userID, AddressID: addr.ID, PolygonID: *addr.PolygonID,
+			Type: domain.OrderSubscription, BagsCount: req.BagsCount, PriceKZT: 0,
+			Comment: req.Comment, TimeOption: req.TimeOption, ScheduledAt: req.ScheduledAt,
+			Status: domain.StatusNew, TariffID: &t.ID, TariffVersion: &t.Version, SubscriptionID: &sub.ID,
+		}
+		if err := tx.Create(&order).Error; err != nil { return err }
+		if err := writeOrderEvent(tx, &order, nil, CustomerActor(userID), nil); err != nil { return err }
+		if err := moveOrder(tx, &order, domain.StatusPaid, SystemActor, map[string]interface{}{"subscription_id": sub.ID}); err != nil { return err }
+		return tx.Model(&sub).Update("remaining_bags", gorm.Expr("remaining_bags - ?", req.BagsCount)).Error
+	})
+	if err != nil { return nil, err }
+	return &order, nil
+}
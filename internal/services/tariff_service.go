@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrTariffNotFound = errors.New("tariff not found")
+	ErrNoTariff = errors.New("no tariff applies to this zone")
+	ErrInvalidTariff = errors.New("invalid tariff")
+)
+
+// TariffService keeps the tariffs and prices orders and courier payouts by
+// them. Tariffs are never changed: a new price is a new version, and an old
+// version can only be closed. Slot discounts are local times of loc.
+type TariffService struct {
+	db *gorm.DB
+	loc *time.Location
+}
+
+func NewTariffService(db *gorm.DB, loc *time.Location) *TariffService { return &TariffService{db: db, loc: loc} }
+
+// TariffInput is a new tariff version. Without PolygonID it is a new
+// version of the default tariff. ValidFrom defaults to now.
+type TariffInput struct {
+	PolygonID *uuid.UUID `json:"polygon_id"`
+	BaseKZT int `json:"base_kzt"`
+	PerBagKZT int `json:"per_bag_kzt"`
+	BagTiers []domain.BagTier `json:"bag_tiers"`
+	ASAPSurchargeKZT int `json:"asap_surcharge_kzt"`
+	SlotDiscounts []domain.SlotDiscount `json:"slot_discounts"`
+	CourierPerBagKZT int `json:"courier_per_bag_kzt"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ValidTo *time.Time `json:"valid_to"`
+}
+
+// Price is what an order costs under a tariff:
+// TotalKZT = BaseKZT + BagsKZT + SurchargeKZT - DiscountKZT.
+type Price struct {
+	TariffID uuid.UUID `json:"tariff_id"`
+	TariffVersion int `json:"tariff_version"`
+	BaseKZT int `json:"base_kzt"`
+	// PerBagKZT is the per-bag price after bag tiers.
+	PerBagKZT int `json:"per_bag_kzt"`
+	BagsKZT int `json:"bags_kzt"`
+	SurchargeKZT int `json:"surcharge_kzt"`
+	DiscountKZT int `json:"discount_kzt"`
+	TotalKZT int `json:"total_kzt"`
+}
+
+// PriceOrder prices bags under t. ASAP orders pay the surcharge; scheduled
+// ones get the largest discount among the slots containing the time of
+// scheduledAt in loc. Requests are checked before they are priced, so a
+// scheduled order without a time never reaches it from the API.
+func PriceOrder(t *domain.Tariff, bags int, opt domain.TimeOption, scheduledAt *time.Time, loc *time.Location) Price {
+	p := Price{TariffID: t.ID, TariffVersion: t.Version, BaseKZT: t.BaseKZT, PerBagKZT: t.PerBagKZT}
+	for _, tier := range t.BagTiers {
+		if bags >= tier.MinBags { p.PerBagKZT = tier.PerBagKZT }
+	}
+	p.BagsKZT = p.PerBagKZT * bags
+	subtotal := p.BaseKZT + p.BagsKZT
+	switch {
+	case opt == domain.ASAP:
+		p.SurchargeKZT = t.ASAPSurchargeKZT
+	case opt == domain.SCHEDULED && scheduledAt != nil:
+		clock := scheduledAt.In(loc).Format("15:04")
+		percent := 0
+		for _, d := range t.SlotDiscounts {
+			if clock >= d.From && clock < d.To && d.Percent > percent { percent = d.Percent }
+		}
+		p.DiscountKZT = subtotal * percent / 100
+	}
+	p.TotalKZT = subtotal + p.SurchargeKZT - p.DiscountKZT
+	return p
+}
+
+// Current returns the tariff of a zone valid at: the zone's newest valid
+// version, else the newest valid default one. A nil polygonID asks for the
+// default tariff.
+func (s *TariffService) Current(ctx context.Context, polygonID *uuid.UUID, at time.Time) (*domain.Tariff, error) {
+	q := s.db.WithContext(ctx).Where("valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)", at, at)
+	if polygonID != nil {
+		q = q.Where("polygon_id = ? OR polygon_id IS NULL", *polygonID)
+	} else {
+		q = q.Where("polygon_id IS NULL")
+	}
+	var t domain.Tariff
+	err := q.Order("polygon_id IS NULL, version DESC").First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrNoTariff }
+	if err != nil { return nil, err }
+	return &t, nil
+}
+
+// Get returns a tariff or ErrTariffNotFound.
+func (s *TariffService) Get(ctx context.Context, id string) (*domain.Tariff, error) {
+	tid, err := uuid.Parse(id)
+	if err != nil { return nil, ErrTariffNotFound }
+	var t domain.Tariff
+	err = s.db.WithContext(ctx).Where("id = ?", tid).First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return nil, ErrTariffNotFound }
+	if err != nil { return nil, err }
+	return &t, nil
+}
+
+// List returns the tariffs of one zone, or all of them when polygonID is
+// nil, the default ones first and newest versions first.
+func (s *TariffService) List(ctx context.Context, polygonID *uuid.UUID) ([]domain.Tariff, error) {
+	q := s.db.WithContext(ctx).Order("polygon_id NULLS FIRST, version DESC")
+	if polygonID != nil { q = q.Where("polygon_id = ?", *polygonID) }
+	var out []domain.Tariff
+	return out, q.Find(&out).Error
+}
+
+// Create adds the next version of a zone's tariff, or of the default one.
+func (s *TariffService) Create(ctx context.Context, by uuid.UUID, in TariffInput) (*domain.Tariff, error) {
+	if err := validateTariff(&in); err != nil { return nil, err }
+	t := domain.Tariff{
+		PolygonID: in.PolygonID, BaseKZT: in.BaseKZT, PerBagKZT: in.PerBagKZT, BagTiers: in.BagTiers,
+		ASAPSurchargeKZT: in.ASAPSurchargeKZT, SlotDiscounts: in.SlotDiscounts, CourierPerBagKZT: in.CourierPerBagKZT,
+		ValidFrom: time.Now(), ValidTo: in.ValidTo,
+	}
+	if in.ValidFrom != nil { t.ValidFrom = *in.ValidFrom }
+	if t.ValidTo != nil && !t.ValidTo.After(t.ValidFrom) { return nil, fmt.Errorf("%w: valid_to must be after valid_from", ErrInvalidTariff) }
+	if t.BagTiers == nil { t.BagTiers = []domain.BagTier{} }
+	if t.SlotDiscounts == nil { t.SlotDiscounts = []domain.SlotDiscount{} }
+	if by != uuid.Nil { t.CreatedBy = &by }
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// versions are numbered per zone; creating tariffs is rare enough
+		// to serialize all of them
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('tariffs'))").Error; err != nil { return err }
+		q := tx.Model(&domain.Tariff{})
+		if in.PolygonID != nil {
+			var n int64
+			if err := tx.Model(&domain.Polygon{}).Where("id = ?", *in.PolygonID).Count(&n).Error; err != nil { return err }
+			if n == 0 { return ErrPolygonNotFound }
+			q = q.Where("polygon_id = ?", *in.PolygonID)
+		} else {
+			q = q.Where("polygon_id IS NULL")
+		}
+		if err := q.Select("coalesce(max(version), 0) + 1").Scan(&t.Version).Error; err != nil { return err }
+		return tx.Create(&t).Error
+	})
+	if err != nil { return nil, err }
+	return &t, nil
+}
+
+// Close ends a tariff at at, or now when at is nil. A default tariff can
+// only be closed once a newer open-ended default version exists, so every
+// zone always has a price.
+func (s *TariffService) Close(ctx context.Context, id string, at *time.Time) (*domain.Tariff, error) {
+	t, err := s.Get(ctx, id)
+	if err != nil { return nil, err }
+	end := time.Now()
+	if at != nil { end = *at }
+	if !end.After(t.ValidFrom) { return nil, fmt.Errorf("%w: valid_to must be after valid_from", ErrInvalidTariff) }
+	if t.ValidTo != nil && !end.Before(*t.ValidTo) { return nil, fmt.Errorf("%w: the tariff already ends by then", ErrInvalidTariff) }
+	if t.PolygonID == nil {
+		var n int64
+		err := s.db.WithContext(ctx).Model(&domain.Tariff{}).
+			Where("polygon_id IS NULL AND version > ? AND valid_to IS NULL AND valid_from <= ?", t.Version, end).Count(&n).Error
+		if err != nil { return nil, err }
+		if n == 0 { return nil, fmt.Errorf("%w: add a newer default tariff before closing this one", ErrInvalidTariff) }
+	}
+	if err := s.db.WithContext(ctx).Model(t).Update("valid_to", end).Error; err != nil { return nil, err }
+	t.ValidTo = &end
+	return t, nil
+}
+
+// Payout is what the courier earns for o: the courier rate of the tariff
+// the order was priced with times its bags. Orders without a tariff are
+// paid by the one valid when they were created.
+func (s *TariffService) Payout(ctx context.Context, o *domain.Order) (int, error) {
+	var t *domain.Tariff
+	var err error
+	if o.TariffID != nil {
+		t, err = s.Get(ctx, o.TariffID.String())
+	} else {
+		t, err = s.Current(ctx, &o.PolygonID, o.CreatedAt)
+	}
+	if err != nil { return 0, err }
+	return t.CourierPerBagKZT * o.BagsCount, nil
+}
+
+// validateTariff checks amounts, that bag tiers ascend and that discount
+// slots are well-formed.
+func validateTariff(in *TariffInput) error {
+	if in.BaseKZT < 0 || in.PerBagKZT < 0 || in.ASAPSurchargeKZT < 0 { return fmt.Errorf("%w: prices must not be negative", ErrInvalidTariff) }
+	if in.PerBagKZT == 0 && in.BaseKZT == 0 { return fmt.Errorf("%w: per_bag_kzt or base_kzt is required", ErrInvalidTariff) }
+	if in.CourierPerBagKZT <= 0 { return fmt.Errorf("%w: courier_per_bag_kzt must be > 0", ErrInvalidTariff) }
+	prev := 1
+	for _, tier := range in.BagTiers {
+		if tier.MinBags <= prev { return fmt.Errorf("%w: bag tiers must start above 1 bag and ascend by min_bags", ErrInvalidTariff) }
+		if tier.PerBagKZT < 0 { return fmt.Errorf("%w: prices must not be negative", ErrInvalidTariff) }
+		prev = tier.MinBags
+	}
+	for _, d := range in.SlotDiscounts {
+		if !workHoursRe.MatchString(d.From) || !workHoursRe.MatchString(d.To) || d.From >= d.To {
+			return fmt.Errorf("%w: discount slots need from < to as HH:MM", ErrInvalidTariff)
+		}
+		if d.Percent < 1 || d.Percent > 100 { return fmt.Errorf("%w: discount percent must be 1-100", ErrInvalidTariff) }
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+// almaty is the zone slot discounts are read in by the tests, fixed so
+// they do not depend on the host's TZ or time zone database.
+var almaty = time.FixedZone("Asia/Almaty", 5*60*60)
+
+func TestPriceOrder(t *testing.T) {
+	tariff := &domain.Tariff{
+		Version: 3, BaseKZT: 100, PerBagKZT: 249,
+		BagTiers: []domain.BagTier{{MinBags: 5, PerBagKZT: 229}, {MinBags: 10, PerBagKZT: 199}},
+		ASAPSurchargeKZT: 150,
+		SlotDiscounts: []domain.SlotDiscount{{From: "06:00", To: "09:00", Percent: 10}, {From: "07:00", To: "08:00", Percent: 20}},
+	}
+	at := func(clock string) *time.Time {
+		// as the apps send it, in UTC: 06:00 in Almaty is 01:00Z
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", "2030-05-01 "+clock, almaty)
+		tm = tm.UTC()
+		return &tm
+	}
+	cases := []struct {
+		name string
+		bags int
+		opt domain.TimeOption
+		when *time.Time
+		want Price
+	}{
+		{"asap", 2, domain.ASAP, nil, Price{PerBagKZT: 249, BagsKZT: 498, SurchargeKZT: 150, TotalKZT: 748}},
+		{"first tier", 5, domain.SCHEDULED, at("12:00"), Price{PerBagKZT: 229, BagsKZT: 1145, TotalKZT: 1245}},
+		{"second tier", 12, domain.SCHEDULED, at("12:00"), Price{PerBagKZT: 199, BagsKZT: 2388, TotalKZT: 2488}},
+		{"slot", 2, domain.SCHEDULED, at("06:00"), Price{PerBagKZT: 249, BagsKZT: 498, DiscountKZT: 59, TotalKZT: 539}},
+		{"best of overlapping slots", 2, domain.SCHEDULED, at("07:30"), Price{PerBagKZT: 249, BagsKZT: 498, DiscountKZT: 119, TotalKZT: 479}},
+		{"slot end is exclusive", 2, domain.SCHEDULED, at("09:00"), Price{PerBagKZT: 249, BagsKZT: 498, TotalKZT: 598}},
+		{"scheduled without a time", 2, domain.SCHEDULED, nil, Price{PerBagKZT: 249, BagsKZT: 498, TotalKZT: 598}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.want.TariffVersion, tc.want.BaseKZT = 3, 100
+			if got := PriceOrder(tariff, tc.bags, tc.opt, tc.when, almaty); got != tc.want { t.Fatalf("got %+v, want %+v", got, tc.want) }
+		})
+	}
+	// the same instant read in UTC is 01:00, outside every slot
+	if got := PriceOrder(tariff, 2, domain.SCHEDULED, at("06:00"), time.UTC); got.DiscountKZT != 0 { t.Fatalf("slot read in UTC: %+v", got) }
+}
+
+func TestValidateTariff(t *testing.T) {
+	ok := TariffInput{PerBagKZT: 249, CourierPerBagKZT: 200}
+	if err := validateTariff(&ok); err != nil { t.Fatal(err) }
+	for name, in := range map[string]TariffInput{
+		"no price": {CourierPerBagKZT: 200},
+		"no courier rate": {PerBagKZT: 249},
+		"negative": {PerBagKZT: 249, CourierPerBagKZT: 200, ASAPSurchargeKZT: -1},
+		"tier of one bag": {PerBagKZT: 249, CourierPerBagKZT: 200, BagTiers: []domain.BagTier{{MinBags: 1, PerBagKZT: 200}}},
+		"descending tiers": {PerBagKZT: 249, CourierPerBagKZT: 200, BagTiers: []domain.BagTier{{MinBags: 10, PerBagKZT: 199}, {MinBags: 5, PerBagKZT: 229}}},
+		"bad slot": {PerBagKZT: 249, CourierPerBagKZT: 200, SlotDiscounts: []domain.SlotDiscount{{From: "9:00", To: "12:00", Percent: 10}}},
+		"empty slot": {PerBagKZT: 249, CourierPerBagKZT: 200, SlotDiscounts: []domain.SlotDiscount{{From: "12:00", To: "12:00", Percent: 10}}},
+		"bad percent": {PerBagKZT: 249, CourierPerBagKZT: 200, SlotDiscounts: []domain.SlotDiscount{{From: "06:00", To: "09:00", Percent: 101}}},
+	} {
+		if err := validateTariff(&in); !errors.Is(err, ErrInvalidTariff) { t.Errorf("%s: %v", name, err) }
+	}
+}
+
+// TestTariffVersions checks that a zone tariff overrides the default one
+// while valid, that orders keep the tariff they were priced with and that
+// the courier is paid by it.
+func TestTariffVersions(t *testing.T) {
+	ctx, addrs, owner := addressFixture(t)
+	db := addrs.db
+	tariffs := NewTariffService(db, almaty)
+	orders := NewOrderService(db, addrs, tariffs, nil, CancelPolicy{})
+	addr := domain.Address{UserID: owner.ID, City: "Алматы", Lat: 43.22, Lng: 76.914}
+	if err := addrs.Create(ctx, &addr, nil); err != nil { t.Fatal(err) }
+	req := OrderRequest{AddressID: addr.ID.String(), BagsCount: 2, TimeOption: domain.ASAP}
+
+	before, err := orders.Create(ctx, owner.ID.String(), req)
+	if err != nil { t.Fatal(err) }
+	def, err := tariffs.Current(ctx, nil, time.Now())
+	if err != nil { t.Fatal(err) }
+	if *before.TariffID != def.ID { t.Fatalf("order priced by %v, default is %v", *before.TariffID, def.ID) }
+
+	zone, err := tariffs.Create(ctx, uuid.Nil, TariffInput{PolygonID: addr.PolygonID, PerBagKZT: 300, CourierPerBagKZT: 250, ValidFrom: ptrTime(time.Now().Add(-time.Minute))})
+	if err != nil { t.Fatal(err) }
+	next, err := tariffs.Create(ctx, uuid.Nil, TariffInput{PolygonID: addr.PolygonID, PerBagKZT: 350, CourierPerBagKZT: 260, ValidFrom: ptrTime(time.Now().Add(time.Hour))})
+	if err != nil { t.Fatal(err) }
+	if zone.Version != 1 || next.Version != 2 { t.Fatalf("versions %d, %d", zone.Version, next.Version) }
+
+	q, err := orders.Quote(ctx, owner.ID.String(), req)
+	if err != nil { t.Fatal(err) }
+	if q.Breakdown.TariffID != zone.ID || q.PriceKZT != 600 { t.Fatalf("quote: %+v", q) }
+	after, err := orders.Create(ctx, owner.ID.String(), req)
+	if err != nil { t.Fatal(err) }
+	if *after.TariffID != zone.ID || *after.TariffVersion != 1 || after.PriceKZT != 600 { t.Fatalf("order: %+v", after) }
+
+	// closing the zone tariff falls back to the default; priced orders
+	// keep their tariff
+	if _, err := tariffs.Close(ctx, zone.ID.String(), nil); err != nil { t.Fatal(err) }
+	if cur, err := tariffs.Current(ctx, addr.PolygonID, time.Now()); err != nil || cur.ID != def.ID { t.Fatalf("after close: %v %v", cur, err) }
+	if pay, err := tariffs.Payout(ctx, after); err != nil || pay != 500 { t.Fatalf("payout: %d %v", pay, err) }
+	if pay, err := tariffs.Payout(ctx, before); err != nil || pay != def.CourierPerBagKZT*2 { t.Fatalf("payout by default: %d %v", pay, err) }
+
+	if _, err := tariffs.Close(ctx, def.ID.String(), nil); !errors.Is(err, ErrInvalidTariff) { t.Fatalf("closing the only default tariff: %v", err) }
+	if err := db.Model(zone).Update("per_bag_kzt", 1).Error; err == nil { t.Fatal("tariff was changed in place") }
+}
+
+func ptrTime(t time.Time) *time.Time { return &t }
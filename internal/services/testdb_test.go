@@ -0,0 +1,38 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// testDB connects to the migrated database named by TEST_DB_DSN and skips
+// the test when it is not set. Every test runs inside a transaction that is
+// rolled back, so the database can be shared. It opens the driver itself
+// because repo/postgres imports this package.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" { t.Skip("TEST_DB_DSN not set") }
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil { t.Fatal(err) }
+	tx := db.Begin()
+	if tx.Error != nil { t.Fatal(tx.Error) }
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+// testConn connects to TEST_DB_DSN like testDB but without a transaction,
+// for tests that need several connections at once. Such tests must delete
+// what they create.
+func testConn(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" { t.Skip("TEST_DB_DSN not set") }
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { if sqlDB, err := db.DB(); err == nil { sqlDB.Close() } })
+	return db
+}
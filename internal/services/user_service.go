@@ -5,6 +5,7 @@ import (
 	"strings"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"github.com/musorok/server/internal/core/phone"
 	"github.com/musorok/server/internal/domain"
 )
 
@@ -12,24 +13,48 @@ type UserService struct{ db *gorm.DB }
 
 func NewUserService(db *gorm.DB) *UserService { return &UserService{db: db} }
 
-func (s *UserService) Create(ctx context.Context, phone, email, name, password string, role domain.Role) (*domain.User, error) {
+// Create stores a new user. A non-empty phone must be a Kazakhstan mobile
+// number and is stored in E.164 form.
+func (s *UserService) Create(ctx context.Context, rawPhone, email, name, password string, role domain.Role) (*domain.User, error) {
+	var ph string
+	if strings.TrimSpace(rawPhone) != "" {
+		n, err := phone.Normalize(rawPhone)
+		if err != nil { return nil, err }
+		ph = n
+	}
 	var hash *string
 	if password != "" {
-		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hs, err := hashPassword(password)
 		if err != nil { return nil, err }
-		hs := string(h); hash = &hs
+		hash = &hs
 	}
-	u := &domain.User{Phone: strings.TrimSpace(phone), Name: name, Role: role, PasswordHash: hash}
-	if email != "" { u.Email = &email }
+	u := &domain.User{Phone: ph, Name: name, Role: role, PasswordHash: hash}
+	if email = NormalizeLogin(email); email != "" { u.Email = &email }
 	if err := s.db.WithContext(ctx).Create(u).Error; err != nil { return nil, err }
 	return u, nil
 }
 
 func (s *UserService) Authenticate(ctx context.Context, login, password string) (*domain.User, error) {
 	var u domain.User
-	q := s.db.WithContext(ctx).Where("phone = ? OR email = ?", login, login).First(&u)
+	login = NormalizeLogin(login)
+	q := s.db.WithContext(ctx).Where("(phone = ? OR email = ?) AND is_deleted = false", login, login).First(&u)
 	if q.Error != nil { return nil, q.Error }
 	if u.PasswordHash == nil { return nil, gorm.ErrRecordNotFound }
 	if bcrypt.CompareHashAndPassword([]byte(*u.PasswordHash), []byte(password)) != nil { return nil, gorm.ErrRecordNotFound }
 	return &u, nil
 }
+
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// NormalizeLogin brings a login (phone or e-mail) to the form it is stored
+// in: phone numbers become E.164, e-mail addresses lower case, anything else
+// is only trimmed.
+func NormalizeLogin(login string) string {
+	login = strings.TrimSpace(login)
+	if strings.Contains(login, "@") { return strings.ToLower(login) }
+	if n, err := phone.Normalize(login); err == nil { return n }
+	return login
+}
@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+var (
+	ErrWaitlistNotFound = errors.New("waitlist entry not found")
+	ErrAreaServed = errors.New("area is already served")
+	ErrBadCoordinates = errors.New("lat must be within ±90 and lng within ±180")
+	// ErrNoChannel is returned by a Notifier that cannot reach the user.
+	ErrNoChannel = errors.New("user has no notification channel")
+)
+
+// Notifier tells a user something outside of a request. Implementations
+// pick the channel and return ErrNoChannel when the user has none.
+type Notifier interface {
+	Notify(ctx context.Context, u *domain.User, subject, body string) error
+}
+
+// MailNotifier notifies users with a verified e-mail address.
+type MailNotifier struct{ Mailer Mailer }
+
+func (n MailNotifier) Notify(ctx context.Context, u *domain.User, subject, body string) error {
+	if u.Email == nil || u.EmailVerifiedAt == nil { return ErrNoChannel }
+	return n.Mailer.Send(ctx, *u.Email, subject, body)
+}
+
+// TextSender delivers a message to a phone. The OTP senders of package otp
+// are TextSenders too.
+type TextSender interface {
+	SendText(ctx context.Context, phone, text string) error
+}
+
+// PhoneNotifier notifies users by their phone number, which the OTP login
+// has verified. The message is the body alone.
+type PhoneNotifier struct{ Sender TextSender }
+
+func (n PhoneNotifier) Notify(ctx context.Context, u *domain.User, _, body string) error {
+	if u.Phone == "" { return ErrNoChannel }
+	return n.Sender.SendText(ctx, u.Phone, body)
+}
+
+// FallbackNotifier notifies through the first of its notifiers that has a
+// channel to the user.
+type FallbackNotifier []Notifier
+
+func (n FallbackNotifier) Notify(ctx context.Context, u *domain.User, subject, body string) error {
+	for _, next := range n {
+		if err := next.Notify(ctx, u, subject, body); !errors.Is(err, ErrNoChannel) { return err }
+	}
+	return ErrNoChannel
+}
+
+// WaitlistService keeps the places users asked for service in before a zone
+// covered them. Zone changes mark the entries they cover (see
+// recomputeCoverage) and NotifyCovered tells the users who agreed to it.
+type WaitlistService struct {
+	db *gorm.DB
+	zones SpatialRepo
+	notifier Notifier
+}
+
+// NewWaitlistService builds the service. zones may be nil, then Join does
+// not check whether the point is served; notifier may be nil, then nobody
+// is notified.
+func NewWaitlistService(db *gorm.DB, zones SpatialRepo, notifier Notifier) *WaitlistService {
+	return &WaitlistService{db: db, zones: zones, notifier: notifier}
+}
+
+// WaitlistRequest is a place to wait for.
+type WaitlistRequest struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+	City string `json:"city"`
+	Street string `json:"street"`
+	House string `json:"house"`
+	ContactConsent bool `json:"contact_consent"`
+}
+
+// Join puts the place on the waitlist of userID, or ErrAreaServed if a zone
+// already covers it. Asking again for the same spot (about 10 m) updates the
+// open entry instead of adding one, including the consent.
+func (s *WaitlistService) Join(ctx context.Context, userID uuid.UUID, req WaitlistRequest) (*domain.WaitlistEntry, error) {
+	if math.Abs(req.Lat) > 90 || math.Abs(req.Lng) > 180 { return nil, ErrBadCoordinates }
+	if s.zones != nil {
+		_, err := s.zones.Resolve(ctx, req.Lat, req.Lng)
+		if err == nil { return nil, ErrAreaServed }
+		if !errors.Is(err, ErrNotServed) { return nil, err }
+	}
+	var e domain.WaitlistEntry
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := lockUser(tx, userID); err != nil { return err }
+		err := tx.Where("user_id = ? AND covered_at IS NULL", userID).
+			Where("round(lat::numeric, 4) = round(?::numeric, 4) AND round(lng::numeric, 4) = round(?::numeric, 4)", req.Lat, req.Lng).
+			First(&e).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) { return err }
+		now := time.Now()
+		fresh := e.ID == uuid.Nil
+		if fresh || e.ContactConsent != req.ContactConsent {
+			e.ConsentAt = nil
+			if req.ContactConsent { e.ConsentAt = &now }
+		}
+		e.UserID, e.Lat, e.Lng, e.ContactConsent = userID, req.Lat, req.Lng, req.ContactConsent
+		e.City, e.Street, e.House = strings.TrimSpace(req.City), strings.TrimSpace(req.Street), strings.TrimSpace(req.House)
+		if fresh { return tx.Create(&e).Error }
+		e.UpdatedAt = now
+		return tx.Model(&e).Select("lat", "lng", "city", "street", "house", "contact_consent", "consent_at", "updated_at").Updates(&e).Error
+	})
+	if err != nil { return nil, err }
+	return &e, nil
+}
+
+// List returns the waitlist entries of userID, newest first, including the
+// ones a zone covers by now.
+func (s *WaitlistService) List(ctx context.Context, userID uuid.UUID) ([]domain.WaitlistEntry, error) {
+	var out []domain.WaitlistEntry
+	return out, s.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at DESC").Find(&out).Error
+}
+
+// Delete removes an entry of userID.
+func (s *WaitlistService) Delete(ctx context.Context, userID uuid.UUID, id string) error {
+	eid, err := uuid.Parse(id)
+	if err != nil { return ErrWaitlistNotFound }
+	res := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", eid, userID).Delete(&domain.WaitlistEntry{})
+	if res.Error != nil { return res.Error }
+	if res.RowsAffected == 0 { return ErrWaitlistNotFound }
+	return nil
+}
+
+// DemandCluster is the open waitlist entries of one grid cell.
+type DemandCluster struct {
+	// City is the most common city of the entries.
+	City string `json:"city"`
+	// Lat and Lng are the centroid of the entries.
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+	MinLat float64 `json:"min_lat"`
+	MinLng float64 `json:"min_lng"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLng float64 `json:"max_lng"`
+	Entries int `json:"entries"`
+	// Users counts distinct users; clusters are ranked by it so that one
+	// user asking many times does not make demand.
+	Users int `json:"users"`
+	// Contactable counts entries whose user agreed to be notified.
+	Contactable int `json:"contactable"`
+	FirstAt time.Time `json:"first_at"`
+	LastAt time.Time `json:"last_at"`
+}
+
+// ClusterQuery filters and sizes Clusters.
+type ClusterQuery struct {
+	// CellMeters is the side of a grid cell, default 1000.
+	CellMeters float64
+	// MinUsers drops cells with fewer distinct users, default 1.
+	MinUsers int
+	City string
+	// Since limits the entries to those created after it.
+	Since *time.Time
+	// Limit caps the number of clusters, default 50.
+	Limit int
+}
+
+// metersPerDegree is the length of a degree of latitude, and of longitude
+// at the equator.
+const metersPerDegree = 111320.0
+
+// Clusters groups the open waitlist entries into square grid cells of about
+// q.CellMeters and returns the cells with the most distinct users first.
+// Longitude is scaled by the cosine of the latitude so cells stay square
+// away from the equator.
+func (s *WaitlistService) Clusters(ctx context.Context, q ClusterQuery) ([]DemandCluster, error) {
+	if q.CellMeters <= 0 { q.CellMeters = 1000 }
+	if q.MinUsers <= 0 { q.MinUsers = 1 }
+	if q.Limit <= 0 { q.Limit = 50 }
+	cell := q.CellMeters / metersPerDegree
+	db := s.db.WithContext(ctx).Table("waitlist_entries").
+		Select(`mode() WITHIN GROUP (ORDER BY city) AS city,
+			avg(lat) AS lat, avg(lng) AS lng,
+			min(lat) AS min_lat, min(lng) AS min_lng, max(lat) AS max_lat, max(lng) AS max_lng,
+			count(*) AS entries, count(DISTINCT user_id) AS users,
+			count(*) FILTER (WHERE contact_consent) AS contactable,
+			min(created_at) AS first_at, max(created_at) AS last_at`).
+		Where("covered_at IS NULL")
+	if q.City != "" { db = db.Where("lower(city) = lower(?)", q.City) }
+	if q.Since != nil { db = db.Where("created_at >= ?", *q.Since) }
+	var out []DemandCluster
+	err := db.Group(fmt.Sprintf("floor(lat / %[1]g), floor(lng * cos(radians(lat)) / %[1]g)", cell)).
+		Having("count(DISTINCT user_id) >= ?", q.MinUsers).
+		Order("users DESC, entries DESC, last_at DESC").
+		Limit(q.Limit).
+		Scan(&out).Error
+	return out, err
+}
+
+// notifyBatch bounds the entries NotifyCovered claims at once.
+const notifyBatch = 200
+
+// NotifyCovered tells the users of covered, not yet notified entries with
+// contact consent that their area is served, one message per user and
+// zone, and returns how many messages went out. Entries are claimed before
+// sending so concurrent runs do not notify twice; a failed send releases
+// its entries for the next run. Users without a channel see the covered
+// entry in the app and are not retried.
+func (s *WaitlistService) NotifyCovered(ctx context.Context) (int, error) {
+	if s.notifier == nil { return 0, nil }
+	sent := 0
+	for {
+		var due []domain.WaitlistEntry
+		err := s.db.WithContext(ctx).Raw(`UPDATE waitlist_entries SET notified_at = now() WHERE id IN (
+			SELECT id FROM waitlist_entries
+			WHERE covered_at IS NOT NULL AND notified_at IS NULL AND contact_consent
+			ORDER BY covered_at LIMIT ? FOR UPDATE SKIP LOCKED
+		) RETURNING *`, notifyBatch).Scan(&due).Error
+		if err != nil { return sent, err }
+		failed := false
+		for _, group := range groupWaitlist(due) {
+			n, err := s.notify(ctx, group)
+			sent += n
+			if err == nil { continue }
+			failed = true
+			log.Error().Err(err).Str("user_id", group[0].UserID.String()).Msg("waitlist: notify")
+			ids := make([]uuid.UUID, len(group))
+			for i, e := range group { ids[i] = e.ID }
+			if err := s.db.WithContext(ctx).Model(&domain.WaitlistEntry{}).Where("id IN ?", ids).Update("notified_at", nil).Error; err != nil { return sent, err }
+		}
+		// released entries wait for the next run rather than being retried
+		// here
+		if failed || len(due) < notifyBatch { return sent, nil }
+	}
+}
+
+// RetryNotifications runs NotifyCovered every interval until ctx ends, so
+// that sends which failed are retried without waiting for the next zone
+// change.
+func (s *WaitlistService) RetryNotifications(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := s.NotifyCovered(ctx)
+		if err != nil { log.Error().Err(err).Msg("waitlist: retry notifications"); continue }
+		if n > 0 { log.Info().Int("sent", n).Msg("waitlist: notified covered users") }
+	}
+}
+
+func (s *WaitlistService) notify(ctx context.Context, group []domain.WaitlistEntry) (int, error) {
+	var u domain.User
+	err := s.db.WithContext(ctx).Where("id = ? AND is_deleted = false", group[0].UserID).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) { return 0, nil }
+	if err != nil { return 0, err }
+	subject, body := coveredMessage(u.Language, group)
+	err = s.notifier.Notify(ctx, &u, subject, body)
+	if errors.Is(err, ErrNoChannel) { return 0, nil }
+	if err != nil { return 0, err }
+	return 1, nil
+}
+
+// groupWaitlist splits entries by user and covering zone, keeping order.
+func groupWaitlist(entries []domain.WaitlistEntry) [][]domain.WaitlistEntry {
+	var out [][]domain.WaitlistEntry
+	at := map[string]int{}
+	for _, e := range entries {
+		key := e.UserID.String()
+		if e.PolygonID != nil { key += e.PolygonID.String() }
+		i, ok := at[key]
+		if !ok { i = len(out); at[key] = i; out = append(out, nil) }
+		out[i] = append(out[i], e)
+	}
+	return out
+}
+
+var coveredTexts = map[string][2]string{
+	"ru": {"MusorOK теперь работает у вас", "Хорошие новости: MusorOK начал вывозить мусор в зоне «%s». Откройте приложение, чтобы оформить вывоз по адресу: %s."},
+	"kk": {"MusorOK енді сіздің ауданыңызда", "Жақсы жаңалық: MusorOK «%s» аймағында қоқыс шығаруды бастады. Мекенжай бойынша тапсырыс беру үшін қосымшаны ашыңыз: %s."},
+	"en": {"MusorOK now serves your area", "Good news: MusorOK now collects trash in the %s zone. Open the app to book a pickup at %s."},
+}
+
+// coveredMessage is the subject and body telling a user that the entries,
+// all covered by one zone, are served now. Unknown languages get Russian.
+func coveredMessage(lang string, entries []domain.WaitlistEntry) (string, string) {
+	t, ok := coveredTexts[lang]
+	if !ok { t = coveredTexts["ru"] }
+	zone := ""
+	if entries[0].PolygonName != nil { zone = *entries[0].PolygonName }
+	places := make([]string, 0, len(entries))
+	for _, e := range entries { places = append(places, waitlistPlace(e)) }
+	return t[0], fmt.Sprintf(t[1], zone, strings.Join(places, "; "))
+}
+
+// waitlistPlace is the address of e as the user typed it, or its
+// coordinates.
+func waitlistPlace(e domain.WaitlistEntry) string {
+	var parts []string
+	for _, s := range []string{e.City, e.Street, e.House} { if s != "" { parts = append(parts, s) } }
+	if len(parts) == 0 { return fmt.Sprintf("%.5f, %.5f", e.Lat, e.Lng) }
+	return strings.Join(parts, ", ")
+}
+
+// coverWaitlist marks the open waitlist entries inside the bounding boxes
+// that snap now serves and returns how many it marked.
+func coverWaitlist(tx *gorm.DB, snap *zoneSnapshot, boxes []geospatial.BBox) (int, error) {
+	if len(boxes) == 0 { return 0, nil }
+	where := make([]string, len(boxes))
+	var args []interface{}
+	for i, b := range boxes {
+		where[i] = "(lng BETWEEN ? AND ? AND lat BETWEEN ? AND ?)"
+		args = append(args, b.MinLng, b.MaxLng, b.MinLat, b.MaxLat)
+	}
+	var open []domain.WaitlistEntry
+	err := tx.Select("id", "lat", "lng").Where("covered_at IS NULL").Where("("+strings.Join(where, " OR ")+")", args...).Find(&open).Error
+	if err != nil { return 0, err }
+	covered := 0
+	now := time.Now()
+	for _, e := range open {
+		z, ok := snap.idx.Resolve(e.Lng, e.Lat)
+		if !ok { continue }
+		p := snap.polygons[z.ID]
+		err := tx.Model(&domain.WaitlistEntry{}).Where("id = ?", e.ID).
+			UpdateColumns(map[string]interface{}{"polygon_id": p.ID, "polygon_name": p.Name, "covered_at": now}).Error
+		if err != nil { return covered, err }
+		covered++
+	}
+	return covered, nil
+}
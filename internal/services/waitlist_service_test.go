@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/domain"
+)
+
+type recordingNotifier struct {
+	sent []string
+	err error
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, u *domain.User, subject, body string) error {
+	if n.err != nil { return n.err }
+	n.sent = append(n.sent, u.Phone+": "+body)
+	return nil
+}
+
+func TestWaitlistCoverAndNotify(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	notifier := &recordingNotifier{}
+	wl := NewWaitlistService(db, nil, notifier)
+	users := NewUserService(db)
+	u, err := users.Create(ctx, "+77079990050", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	other, err := users.Create(ctx, "+77079990051", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+
+	e, err := wl.Join(ctx, u.ID, WaitlistRequest{Lat: 20.05, Lng: 20.05, City: "Тестоград", Street: "Абая", House: "1"})
+	if err != nil { t.Fatal(err) }
+	// the same spot again updates the entry and records consent
+	again, err := wl.Join(ctx, u.ID, WaitlistRequest{Lat: 20.05001, Lng: 20.05001, City: "Тестоград", Street: "Абая", House: "1", ContactConsent: true})
+	if err != nil { t.Fatal(err) }
+	if again.ID != e.ID || again.ConsentAt == nil { t.Fatalf("rejoin: %+v", again) }
+	if _, err := wl.Join(ctx, other.ID, WaitlistRequest{Lat: 20.051, Lng: 20.052, City: "Тестоград"}); err != nil { t.Fatal(err) }
+	if _, err := wl.Join(ctx, u.ID, WaitlistRequest{Lat: 95, Lng: 20}); !errors.Is(err, ErrBadCoordinates) { t.Fatalf("bad coordinates: %v", err) }
+
+	clusters, err := wl.Clusters(ctx, ClusterQuery{City: "Тестоград", MinUsers: 2})
+	if err != nil { t.Fatal(err) }
+	if len(clusters) != 1 || clusters[0].Users != 2 || clusters[0].Entries != 2 || clusters[0].Contactable != 1 {
+		t.Fatalf("clusters: %+v", clusters)
+	}
+
+	_, change, err := NewPolygonService(db, nil, nil).Create(ctx, uuid.Nil, PolygonInput{Name: strp("Тест"), City: strp("Тестоград"), Geometry: testSquare(20, 20, 0.1)})
+	if err != nil { t.Fatal(err) }
+	if change.Waitlisted != 2 { t.Fatalf("waitlisted: %+v", change) }
+	if clusters, _ := wl.Clusters(ctx, ClusterQuery{City: "Тестоград"}); len(clusters) != 0 { t.Fatalf("covered entries still clustered: %+v", clusters) }
+
+	// only the user who consented hears about it, and only once
+	n, err := wl.NotifyCovered(ctx)
+	if err != nil || n != 1 { t.Fatalf("notify: %d %v", n, err) }
+	if !strings.Contains(notifier.sent[0], "Тестоград, Абая, 1") { t.Fatalf("message: %q", notifier.sent[0]) }
+	if n, err := wl.NotifyCovered(ctx); err != nil || n != 0 { t.Fatalf("second notify: %d %v", n, err) }
+	list, err := wl.List(ctx, u.ID)
+	if err != nil || len(list) != 1 || list[0].CoveredAt == nil || list[0].NotifiedAt == nil { t.Fatalf("list: %+v %v", list, err) }
+
+	if err := wl.Delete(ctx, other.ID, e.ID.String()); !errors.Is(err, ErrWaitlistNotFound) { t.Fatalf("foreign delete: %v", err) }
+	if err := wl.Delete(ctx, u.ID, e.ID.String()); err != nil { t.Fatal(err) }
+}
+
+func TestWaitlistFailedNotifyIsRetried(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	notifier := &recordingNotifier{err: errors.New("smtp down")}
+	wl := NewWaitlistService(db, nil, notifier)
+	u, err := NewUserService(db).Create(ctx, "+77079990052", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	if _, err := wl.Join(ctx, u.ID, WaitlistRequest{Lat: 21.05, Lng: 21.05, ContactConsent: true}); err != nil { t.Fatal(err) }
+	if _, _, err := NewPolygonService(db, nil, nil).Create(ctx, uuid.Nil, PolygonInput{Name: strp("Тест"), City: strp("Тестоград"), Geometry: testSquare(21, 21, 0.1)}); err != nil { t.Fatal(err) }
+	if n, err := wl.NotifyCovered(ctx); err != nil || n != 0 { t.Fatalf("failing notify: %d %v", n, err) }
+	notifier.err = nil
+	if n, err := wl.NotifyCovered(ctx); err != nil || n != 1 { t.Fatalf("retry: %d %v", n, err) }
+}
+
+// fakeTexts keeps the last message per phone.
+type fakeTexts struct{ sent map[string]string }
+
+func (f *fakeTexts) SendText(_ context.Context, phone, text string) error {
+	f.sent[phone] = text
+	return nil
+}
+
+// TestFallbackNotifier checks that users without a verified e-mail, as
+// after a phone OTP login, are reached on their phone.
+func TestFallbackNotifier(t *testing.T) {
+	ctx := context.Background()
+	mailer, texts := &fakeMailer{sent: map[string]string{}}, &fakeTexts{sent: map[string]string{}}
+	n := FallbackNotifier{MailNotifier{Mailer: mailer}, PhoneNotifier{Sender: texts}}
+	now := time.Now()
+	verified := &domain.User{Phone: "+77070000001", Email: strp("a@example.com"), EmailVerifiedAt: &now}
+	unverified := &domain.User{Phone: "+77070000002", Email: strp("b@example.com")}
+	for _, u := range []*domain.User{verified, unverified} {
+		if err := n.Notify(ctx, u, "subject", "body"); err != nil { t.Fatal(err) }
+	}
+	if len(mailer.sent) != 1 || mailer.sent["a@example.com"] != "body" { t.Fatalf("mailed %v", mailer.sent) }
+	if len(texts.sent) != 1 || texts.sent["+77070000002"] != "body" { t.Fatalf("texted %v", texts.sent) }
+	if err := n.Notify(ctx, &domain.User{}, "subject", "body"); !errors.Is(err, ErrNoChannel) { t.Fatalf("no channel: %v", err) }
+}
+
+func TestCoveredMessage(t *testing.T) {
+	zone := "Бостандык"
+	pid := uuid.New()
+	u := uuid.New()
+	entries := []domain.WaitlistEntry{
+		{UserID: u, PolygonID: &pid, PolygonName: &zone, City: "Алматы", Street: "Абая", House: "1"},
+		{UserID: u, PolygonID: &pid, PolygonName: &zone, Lat: 43.2, Lng: 76.9},
+		{UserID: uuid.New(), PolygonID: &pid, PolygonName: &zone},
+	}
+	groups := groupWaitlist(entries)
+	if len(groups) != 2 || len(groups[0]) != 2 { t.Fatalf("groups: %+v", groups) }
+	subject, body := coveredMessage("kk", groups[0])
+	if subject != coveredTexts["kk"][0] || !strings.Contains(body, "«Бостандык»") || !strings.Contains(body, "Алматы, Абая, 1; 43.20000, 76.90000") {
+		t.Fatalf("kk: %q %q", subject, body)
+	}
+	if subject, _ := coveredMessage("de", groups[0]); subject != coveredTexts["ru"][0] { t.Fatalf("fallback: %q", subject) }
+}
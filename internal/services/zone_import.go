@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+// ImportZone is one zone read from an import file.
+type ImportZone struct {
+	// ID matches an existing polygon when the file came from Export.
+	ID uuid.UUID
+	Name string
+	City string
+	Priority int
+	IsActive bool
+	Geometry geospatial.MultiPolygon
+}
+
+// ZonesFromFeatures turns imported features into zones. Properties used:
+// name (required), city (defaults to defaultCity), priority, is_active
+// (default true) and id; numbers and booleans may be strings, as KML
+// stores them. Rings are rewound to RFC 7946 order and then validated.
+func ZonesFromFeatures(features []geospatial.Feature, defaultCity string) ([]ImportZone, error) {
+	out := make([]ImportZone, 0, len(features))
+	seen := map[string]int{}
+	for i, f := range features {
+		z := ImportZone{Name: propString(f.Properties, "name"), City: propString(f.Properties, "city"), IsActive: true, Geometry: geospatial.Rewind(f.Geometry)}
+		if z.City == "" { z.City = defaultCity }
+		fail := func(err error) error { return fmt.Errorf("feature %d (%q): %w", i, z.Name, err) }
+		if z.Name == "" || z.City == "" { return nil, fail(ErrPolygonName) }
+		if v, ok := f.Properties["priority"]; ok && v != nil {
+			n, err := strconv.Atoi(strings.TrimSpace(fmt.Sprint(v)))
+			if err != nil { return nil, fail(fmt.Errorf("priority %v is not an integer", v)) }
+			z.Priority = n
+		}
+		if v, ok := f.Properties["is_active"]; ok && v != nil {
+			b, err := strconv.ParseBool(strings.TrimSpace(fmt.Sprint(v)))
+			if err != nil { return nil, fail(fmt.Errorf("is_active %v is not a boolean", v)) }
+			z.IsActive = b
+		}
+		id := propString(f.Properties, "id")
+		if id == "" { id = f.ID }
+		if pid, err := uuid.Parse(id); err == nil { z.ID = pid }
+		if err := geospatial.Validate(z.Geometry); err != nil { return nil, fail(err) }
+		key := zoneKey(z.Name, z.City)
+		if j, dup := seen[key]; dup { return nil, fail(fmt.Errorf("same name and city as feature %d", j)) }
+		seen[key] = i
+		out = append(out, z)
+	}
+	return out, nil
+}
+
+func propString(props map[string]interface{}, key string) string {
+	if v, ok := props[key]; ok && v != nil { return strings.TrimSpace(fmt.Sprint(v)) }
+	return ""
+}
+
+func zoneKey(name, city string) string { return strings.ToLower(city) + "\x00" + strings.ToLower(name) }
+
+// ZoneImportOptions controls Import.
+type ZoneImportOptions struct {
+	// DryRun computes the diff and coverage change and writes nothing.
+	DryRun bool
+	// DeactivateMissing switches off active zones that are not in the file.
+	DeactivateMissing bool
+}
+
+// ZoneDiff is the planned or applied change of one zone.
+type ZoneDiff struct {
+	// Action is create, update, unchanged, deactivate or missing (an active
+	// zone not in the file that is left alone).
+	Action string `json:"action"`
+	ID *uuid.UUID `json:"id,omitempty"`
+	Name string `json:"name"`
+	City string `json:"city"`
+	// Changes lists the changed fields of an update.
+	Changes []string `json:"changes,omitempty"`
+}
+
+// ZoneImportResult is the outcome of Import.
+type ZoneImportResult struct {
+	DryRun bool `json:"dry_run"`
+	Zones []ZoneDiff `json:"zones"`
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Deactivated int `json:"deactivated"`
+	Coverage CoverageChange `json:"coverage"`
+}
+
+var errDryRun = errors.New("dry run")
+
+// Import creates and updates zones from an import file in one transaction.
+// A zone matches an existing polygon by ID, then by name and city
+// (ignoring case). Every change writes a version as an edit through the
+// admin API would, and addresses are re-resolved once at the end. A dry run
+// does all of it and rolls back, so its diff and coverage are exact.
+func (s *PolygonService) Import(ctx context.Context, by uuid.UUID, zones []ImportZone, opts ZoneImportOptions) (*ZoneImportResult, error) {
+	res := &ZoneImportResult{DryRun: opts.DryRun}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing []domain.Polygon
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("city, name").Find(&existing).Error; err != nil { return err }
+		byID := map[uuid.UUID]*domain.Polygon{}
+		byKey := map[string]*domain.Polygon{}
+		for i := range existing {
+			byID[existing[i].ID] = &existing[i]
+			byKey[zoneKey(existing[i].Name, existing[i].City)] = &existing[i]
+		}
+		touched := map[uuid.UUID]bool{}
+		var pids []uuid.UUID
+		var geometries []geospatial.MultiPolygon
+		for _, z := range zones {
+			in := PolygonInput{Name: &z.Name, City: &z.City, Geometry: z.Geometry, Priority: &z.Priority, IsActive: &z.IsActive}
+			p := byID[z.ID]
+			if p == nil { p = byKey[zoneKey(z.Name, z.City)] }
+			if p != nil && touched[p.ID] { return fmt.Errorf("zone %q matches polygon %s twice", z.Name, p.ID) }
+			if p == nil {
+				var created domain.Polygon
+				if err := createZone(tx, by, &created, in); err != nil { return fmt.Errorf("create %q: %w", z.Name, err) }
+				res.Created++
+				res.Zones = append(res.Zones, ZoneDiff{Action: "create", ID: &created.ID, Name: created.Name, City: created.City})
+				touched[created.ID] = true
+				pids, geometries = append(pids, created.ID), append(geometries, z.Geometry)
+				continue
+			}
+			touched[p.ID] = true
+			changed, _, err := updateZone(tx, by, p, in)
+			if err != nil { return fmt.Errorf("update %q: %w", z.Name, err) }
+			id := p.ID
+			if len(changed) == 0 {
+				res.Unchanged++
+				res.Zones = append(res.Zones, ZoneDiff{Action: "unchanged", ID: &id, Name: p.Name, City: p.City})
+				continue
+			}
+			res.Updated++
+			res.Zones = append(res.Zones, ZoneDiff{Action: "update", ID: &id, Name: p.Name, City: p.City, Changes: changed})
+			pids, geometries = append(pids, p.ID), append(geometries, z.Geometry)
+		}
+		for i := range existing {
+			p := &existing[i]
+			if touched[p.ID] || !p.IsActive { continue }
+			id := p.ID
+			if !opts.DeactivateMissing {
+				res.Zones = append(res.Zones, ZoneDiff{Action: "missing", ID: &id, Name: p.Name, City: p.City})
+				continue
+			}
+			off := false
+			if _, _, err := updateZone(tx, by, p, PolygonInput{IsActive: &off}); err != nil { return fmt.Errorf("deactivate %q: %w", p.Name, err) }
+			res.Deactivated++
+			res.Zones = append(res.Zones, ZoneDiff{Action: "deactivate", ID: &id, Name: p.Name, City: p.City})
+			pids = append(pids, p.ID)
+		}
+		if len(pids) > 0 {
+			var err error
+			if res.Coverage, err = recomputeCoverage(tx, pids, geometries...); err != nil { return err }
+		}
+		if opts.DryRun { return errDryRun }
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) { return nil, err }
+	if opts.DryRun {
+		// the ids of planned zones were rolled back with everything else
+		for i := range res.Zones { if res.Zones[i].Action == "create" { res.Zones[i].ID = nil } }
+		return res, nil
+	}
+	s.reloadZones(ctx)
+	s.notifyWaitlist(ctx, res.Coverage)
+	return res, nil
+}
+
+// Export returns the zones as features whose properties Import reads back:
+// id, name, city, priority and is_active, plus version for reference.
+func (s *PolygonService) Export(ctx context.Context, active *bool) ([]geospatial.Feature, error) {
+	polys, err := s.List(ctx, active)
+	if err != nil { return nil, err }
+	out := make([]geospatial.Feature, 0, len(polys))
+	for _, p := range polys {
+		g, err := geospatial.ParseGeometry(p.GeoJSON)
+		if err != nil { return nil, fmt.Errorf("polygon %s: %w", p.ID, err) }
+		out = append(out, geospatial.Feature{
+			ID: p.ID.String(),
+			Properties: map[string]interface{}{"id": p.ID.String(), "name": p.Name, "city": p.City, "priority": p.Priority, "is_active": p.IsActive, "version": p.Version},
+			Geometry: g,
+		})
+	}
+	return out, nil
+}
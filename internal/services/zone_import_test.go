@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+func feature(props map[string]interface{}, g geospatial.MultiPolygon) geospatial.Feature {
+	return geospatial.Feature{Properties: props, Geometry: g}
+}
+
+func TestZonesFromFeatures(t *testing.T) {
+	cw := geospatial.MultiPolygon{{{{10, 10}, {10, 10.1}, {10.1, 10.1}, {10.1, 10}, {10, 10}}}}
+	zones, err := ZonesFromFeatures([]geospatial.Feature{
+		feature(map[string]interface{}{"name": "А", "priority": "2", "is_active": "false"}, cw),
+		feature(map[string]interface{}{"name": "Б", "city": "Астана", "priority": 1.0}, testSquare(11, 11, 0.1)),
+	}, "Алматы")
+	if err != nil { t.Fatal(err) }
+	if z := zones[0]; z.City != "Алматы" || z.Priority != 2 || z.IsActive || geospatial.Validate(z.Geometry) != nil { t.Fatalf("first zone: %+v", z) }
+	if z := zones[1]; z.City != "Астана" || z.Priority != 1 || !z.IsActive { t.Fatalf("second zone: %+v", z) }
+
+	bowTie := geospatial.MultiPolygon{{{{0, 0}, {1, 1}, {1, 0}, {0, 1}, {0, 0}}}}
+	for _, tc := range []struct {
+		fs []geospatial.Feature
+		want string
+	}{
+		{[]geospatial.Feature{feature(map[string]interface{}{"city": "Алматы"}, cw)}, ErrPolygonName.Error()},
+		{[]geospatial.Feature{feature(map[string]interface{}{"name": "А", "priority": "high"}, cw)}, "priority"},
+		{[]geospatial.Feature{feature(map[string]interface{}{"name": "А"}, bowTie)}, "crosses itself"},
+		{[]geospatial.Feature{feature(map[string]interface{}{"name": "А"}, cw), feature(map[string]interface{}{"name": "а"}, cw)}, "same name and city as feature 0"},
+	} {
+		if _, err := ZonesFromFeatures(tc.fs, "Алматы"); err == nil || !strings.Contains(err.Error(), tc.want) { t.Errorf("got %v, want %q", err, tc.want) }
+	}
+}
+
+func TestZoneImport(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	svc := NewPolygonService(db, nil, nil)
+	existing, _, err := svc.Create(ctx, uuid.Nil, PolygonInput{Name: strp("Старая"), City: strp("Тест"), Geometry: testSquare(10, 10, 0.1)})
+	if err != nil { t.Fatal(err) }
+	kept, _, err := svc.Create(ctx, uuid.Nil, PolygonInput{Name: strp("Без изменений"), City: strp("Тест"), Geometry: testSquare(12, 12, 0.1)})
+	if err != nil { t.Fatal(err) }
+	u, err := NewUserService(db).Create(ctx, "+77079990041", "", "", "", domain.RoleUser)
+	if err != nil { t.Fatal(err) }
+	if err := db.Create(&domain.Address{UserID: u.ID, City: "Тест", Lat: 11.05, Lng: 11.05}).Error; err != nil { t.Fatal(err) }
+
+	zones := []ImportZone{
+		{Name: "старая", City: "тест", IsActive: true, Geometry: testSquare(10, 10, 0.2)},
+		{Name: "Без изменений", City: "Тест", IsActive: true, Geometry: testSquare(12, 12, 0.1)},
+		{Name: "Новая", City: "Тест", IsActive: true, Geometry: testSquare(11, 11, 0.1)},
+	}
+	plan, err := svc.Import(ctx, uuid.Nil, zones, ZoneImportOptions{DryRun: true})
+	if err != nil { t.Fatal(err) }
+	if plan.Created != 1 || plan.Updated != 1 || plan.Unchanged != 1 || plan.Coverage.Entered != 1 { t.Fatalf("plan: %+v", plan) }
+	var n int64
+	db.Model(&domain.Polygon{}).Where("name = ?", "Новая").Count(&n)
+	if n != 0 { t.Fatal("dry run wrote a zone") }
+
+	res, err := svc.Import(ctx, uuid.Nil, zones[:1], ZoneImportOptions{DeactivateMissing: true})
+	if err != nil { t.Fatal(err) }
+	if res.Updated != 1 || res.Deactivated < 1 { t.Fatalf("apply: %+v", res) }
+	p, err := svc.Get(ctx, existing.ID.String())
+	if err != nil || p.Version != 2 || p.Name != "старая" { t.Fatalf("updated zone: %+v %v", p, err) }
+	if p, _ = svc.Get(ctx, kept.ID.String()); p.IsActive { t.Fatal("missing zone should be deactivated") }
+
+	// an export imports back without changes
+	active := true
+	features, err := svc.Export(ctx, &active)
+	if err != nil { t.Fatal(err) }
+	back, err := ZonesFromFeatures(features, "")
+	if err != nil { t.Fatal(err) }
+	res, err = svc.Import(ctx, uuid.Nil, back, ZoneImportOptions{DryRun: true})
+	if err != nil || res.Created != 0 || res.Updated != 0 { t.Fatalf("round trip: %+v %v", res, err) }
+	if _, err := svc.Import(ctx, uuid.Nil, []ImportZone{zones[0], {ID: existing.ID, Name: "x", City: "Тест", Geometry: testSquare(10, 10, 0.1)}}, ZoneImportOptions{DryRun: true}); err == nil || errors.Is(err, errDryRun) {
+		t.Fatalf("a polygon matched twice: got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+// ZoneIndex is the in-memory SpatialRepo: it resolves coordinates to the
+// active polygon serving them from a geospatial.Index. The index is rebuilt by Reload, which admin
+// polygon changes call, and in the background once it is older than the
+// refresh interval so that changes made through another replica show up
+// too. Lookups never wait for a rebuild, except the very first one.
+type ZoneIndex struct {
+	db *gorm.DB
+	refresh time.Duration
+	snap atomic.Pointer[zoneSnapshot]
+	mu sync.Mutex // serializes reloads
+	load func(ctx context.Context) (*zoneSnapshot, error)
+}
+
+type zoneSnapshot struct {
+	idx *geospatial.Index
+	polygons map[string]domain.Polygon
+	loadedAt time.Time
+}
+
+func NewZoneIndex(db *gorm.DB, refresh time.Duration) *ZoneIndex {
+	z := &ZoneIndex{db: db, refresh: refresh}
+	z.load = func(ctx context.Context) (*zoneSnapshot, error) { return loadZones(z.db.WithContext(ctx)) }
+	return z
+}
+
+// Reload rebuilds the index from the active polygons. Polygons whose GeoJSON
+// cannot be parsed are logged and left out.
+func (z *ZoneIndex) Reload(ctx context.Context) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.reload(ctx)
+}
+
+// reload swaps in a new snapshot. Callers hold mu, so reloads cannot store
+// their snapshots out of order; lookups only read snap and do not wait.
+func (z *ZoneIndex) reload(ctx context.Context) error {
+	snap, err := z.load(ctx)
+	if err != nil { return err }
+	z.snap.Store(snap)
+	return nil
+}
+
+// loadZones builds a snapshot of the active polygons visible to db, which
+// may be a transaction that has not committed yet.
+func loadZones(db *gorm.DB) (*zoneSnapshot, error) {
+	var polys []domain.Polygon
+	if err := db.Where("is_active = true").Find(&polys).Error; err != nil { return nil, err }
+	snap := &zoneSnapshot{polygons: make(map[string]domain.Polygon, len(polys)), loadedAt: time.Now()}
+	zones := make([]geospatial.Zone, 0, len(polys))
+	for _, p := range polys {
+		g, err := geospatial.ParseGeometry(p.GeoJSON)
+		if err != nil {
+			log.Error().Err(err).Str("polygon_id", p.ID.String()).Msg("zone index: skip polygon with bad geometry")
+			continue
+		}
+		// zones saved before validation existed stay in service; the
+		// warning tells ops to redraw them
+		if err := geospatial.Validate(g); err != nil {
+			log.Warn().Err(err).Str("polygon_id", p.ID.String()).Msg("zone index: polygon fails validation")
+		}
+		zones = append(zones, geospatial.Zone{ID: p.ID.String(), Name: p.Name, Priority: p.Priority, Geometry: g})
+		p.GeoJSON = "" // the parsed geometry lives in the index
+		snap.polygons[p.ID.String()] = p
+	}
+	snap.idx = geospatial.NewIndex(zones)
+	return snap, nil
+}
+
+// current returns the latest snapshot. Once it is older than the refresh
+// interval one caller starts a reload in the background and everyone keeps
+// serving the stale snapshot until it lands; a failed reload is retried by
+// the next lookup. Only when there is no snapshot yet do callers wait.
+func (z *ZoneIndex) current(ctx context.Context) (*zoneSnapshot, error) {
+	if s := z.snap.Load(); s != nil {
+		if time.Since(s.loadedAt) >= z.refresh && z.mu.TryLock() {
+			go func() {
+				defer z.mu.Unlock()
+				// another reload may have landed since the check
+				if s := z.snap.Load(); time.Since(s.loadedAt) < z.refresh { return }
+				if err := z.reload(context.WithoutCancel(ctx)); err != nil {
+					log.Error().Err(err).Msg("zone index: reload failed, serving stale zones")
+				}
+			}()
+		}
+		return s, nil
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if s := z.snap.Load(); s != nil { return s, nil }
+	if err := z.reload(ctx); err != nil { return nil, err }
+	return z.snap.Load(), nil
+}
+
+// Resolve returns the active polygon serving the point, without its GeoJSON,
+// or ErrNotServed.
+func (z *ZoneIndex) Resolve(ctx context.Context, lat, lng float64) (*domain.Polygon, error) {
+	s, err := z.current(ctx)
+	if err != nil { return nil, err }
+	zone, ok := s.idx.Resolve(lng, lat)
+	if !ok { return nil, ErrNotServed }
+	p := s.polygons[zone.ID]
+	return &p, nil
+}
+
+// Nearest returns the active polygon closest to the point, without its
+// GeoJSON, and its distance in metres (0 when it serves the point). The
+// polygon is nil when there are no active zones.
+func (z *ZoneIndex) Nearest(ctx context.Context, lat, lng float64) (*domain.Polygon, float64, error) {
+	s, err := z.current(ctx)
+	if err != nil { return nil, 0, err }
+	zone, dist, ok := s.idx.Nearest(lng, lat)
+	if !ok { return nil, 0, nil }
+	p := s.polygons[zone.ID]
+	return &p, dist, nil
+}
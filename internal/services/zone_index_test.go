@@ -0,0 +1,40 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/musorok/server/internal/core/geospatial"
+	"github.com/musorok/server/internal/domain"
+)
+
+// TestZoneIndexStaleReload checks that lookups keep answering from a stale
+// snapshot while the reload runs, and see the new one once it lands.
+func TestZoneIndexStaleReload(t *testing.T) {
+	ctx := context.Background()
+	z := NewZoneIndex(nil, time.Minute)
+	stale := &zoneSnapshot{idx: geospatial.NewIndex(nil), polygons: map[string]domain.Polygon{}, loadedAt: time.Now().Add(-time.Hour)}
+	z.snap.Store(stale)
+	started, release := make(chan struct{}), make(chan struct{})
+	loads := 0
+	fresh := &zoneSnapshot{idx: geospatial.NewIndex(nil), polygons: map[string]domain.Polygon{}, loadedAt: time.Now()}
+	z.load = func(context.Context) (*zoneSnapshot, error) {
+		loads++
+		close(started)
+		<-release
+		return fresh, nil
+	}
+
+	if s, err := z.current(ctx); err != nil || s != stale { t.Fatalf("first lookup: %v", err) }
+	<-started
+	// the reload is blocked: lookups must not wait for it or start another
+	for i := 0; i < 3; i++ {
+		if s, err := z.current(ctx); err != nil || s != stale { t.Fatalf("lookup during reload: %v", err) }
+	}
+	close(release)
+	z.mu.Lock() // held by the reload until it has swapped the snapshot
+	z.mu.Unlock()
+	if s, err := z.current(ctx); err != nil || s != fresh { t.Fatalf("after reload: %v", err) }
+	if loads != 1 { t.Fatalf("%d reloads", loads) }
+}
@@ -1,5 +1,5 @@
--- Add tables for courier settlements, balances and payout requests
--- Defines the payout_status_enum and tables: order_settlements, courier_balances and payout_requests.
+-- Add tables for couriers, courier settlements, balances and payout requests
+-- Defines the vehicle_enum, payout_status_enum and tables: couriers, order_settlements, courier_balances and payout_requests.
 
 -- payout status enum defines the lifecycle of payout requests
 DO $$ BEGIN
@@ -8,6 +8,30 @@ EXCEPTION
     WHEN duplicate_object THEN NULL;
 END $$;
 
+-- vehicle enum for couriers
+DO $$ BEGIN
+    CREATE TYPE vehicle_enum AS ENUM ('FOOT','BICYCLE','SCOOTER','CAR');
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+
+-- couriers links a COURIER user to the polygon they serve. The tables below
+-- reference couriers(id), so it has to exist before them; on databases where
+-- it was created by hand this is a no-op.
+CREATE TABLE IF NOT EXISTS couriers (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL UNIQUE REFERENCES users(id),
+    polygon_id uuid NOT NULL REFERENCES polygons(id),
+    is_active boolean NOT NULL DEFAULT true,
+    vehicle vehicle_enum NOT NULL DEFAULT 'FOOT',
+    work_start text NOT NULL DEFAULT '09:00' CHECK (work_start ~ '^([01][0-9]|2[0-3]):[0-5][0-9]$'),
+    work_end text NOT NULL DEFAULT '21:00' CHECK (work_end ~ '^([01][0-9]|2[0-3]):[0-5][0-9]$'),
+    capacity_bags int NOT NULL DEFAULT 10 CHECK (capacity_bags > 0),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_couriers_polygon ON couriers(polygon_id);
+
 -- order_settlements table records compensation owed to couriers after
 -- each completed order. There is a unique constraint on order_id to
 -- prevent duplicate settlements per order.
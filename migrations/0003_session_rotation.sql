@@ -0,0 +1,17 @@
+-- Refresh-token rotation on top of the sessions table.
+-- Every login starts a session family; each refresh inserts a new row in the
+-- same family and revokes the previous one, pointing replaced_by at its
+-- successor. Presenting a refresh token whose row was already replaced means
+-- the token leaked, and the whole family is revoked.
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS family_id uuid;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS replaced_by uuid REFERENCES sessions(id);
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+
+UPDATE sessions SET family_id = id WHERE family_id IS NULL;
+ALTER TABLE sessions ALTER COLUMN family_id SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_refresh_token_hash ON sessions(refresh_token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_family ON sessions(family_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
@@ -0,0 +1,42 @@
+-- 0002 creates couriers on new databases. Older ones ran 0002 against a
+-- couriers table made by hand; bring it to the same shape.
+
+DO $$ BEGIN
+    CREATE TYPE vehicle_enum AS ENUM ('FOOT','BICYCLE','SCOOTER','CAR');
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+
+ALTER TABLE couriers
+    ADD COLUMN IF NOT EXISTS is_active boolean NOT NULL DEFAULT true,
+    ADD COLUMN IF NOT EXISTS vehicle vehicle_enum NOT NULL DEFAULT 'FOOT',
+    ADD COLUMN IF NOT EXISTS work_start text NOT NULL DEFAULT '09:00',
+    ADD COLUMN IF NOT EXISTS work_end text NOT NULL DEFAULT '21:00',
+    ADD COLUMN IF NOT EXISTS capacity_bags int NOT NULL DEFAULT 10,
+    ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+DO $$ BEGIN
+    ALTER TABLE couriers ADD CONSTRAINT couriers_capacity_bags_check CHECK (capacity_bags > 0);
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+CREATE INDEX IF NOT EXISTS idx_couriers_polygon ON couriers(polygon_id);
+
+-- orders.courier_id used to be filled with the courier's user id while
+-- settlements, balances and payouts reference couriers(id). Point existing
+-- orders at the couriers row and enforce the reference from now on.
+
+UPDATE orders o SET courier_id = c.id
+FROM couriers c
+WHERE o.courier_id = c.user_id;
+
+-- anything left does not match a courier at all
+UPDATE orders SET courier_id = NULL
+WHERE courier_id IS NOT NULL AND courier_id NOT IN (SELECT id FROM couriers);
+
+DO $$ BEGIN
+    ALTER TABLE orders ADD CONSTRAINT fk_orders_courier FOREIGN KEY (courier_id) REFERENCES couriers(id);
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+CREATE INDEX IF NOT EXISTS idx_orders_courier ON orders(courier_id);
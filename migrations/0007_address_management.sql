@@ -0,0 +1,13 @@
+-- Addresses used by past orders are soft-deleted through deleted_at so the
+-- order history keeps its address. A user has at most one live default.
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+
+-- keep only the newest default per user before the index goes in
+UPDATE addresses a SET is_default = false
+WHERE a.is_default AND EXISTS (
+  SELECT 1 FROM addresses b
+  WHERE b.user_id = a.user_id AND b.is_default AND b.deleted_at IS NULL
+    AND (b.created_at, b.id) > (a.created_at, a.id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uq_addresses_default ON addresses(user_id) WHERE is_default AND deleted_at IS NULL;
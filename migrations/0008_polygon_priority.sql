@@ -0,0 +1,2 @@
+-- Overlapping zones resolve by priority (higher wins), then by smaller area.
+ALTER TABLE polygons ADD COLUMN IF NOT EXISTS priority int NOT NULL DEFAULT 0;
@@ -0,0 +1,33 @@
+-- Every change of a zone is recorded as an immutable row in polygon_versions;
+-- polygons holds the current state and its version number.
+ALTER TABLE polygons ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 1;
+ALTER TABLE polygons ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS polygon_versions (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  polygon_id uuid NOT NULL REFERENCES polygons(id),
+  version int NOT NULL,
+  name text NOT NULL,
+  city text NOT NULL,
+  geojson jsonb NOT NULL,
+  is_active boolean NOT NULL,
+  priority int NOT NULL,
+  changed_by uuid REFERENCES users(id),
+  created_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (polygon_id, version)
+);
+
+CREATE OR REPLACE FUNCTION polygon_versions_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'polygon_versions rows cannot be changed or deleted';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS polygon_versions_immutable ON polygon_versions;
+CREATE TRIGGER polygon_versions_immutable BEFORE UPDATE OR DELETE ON polygon_versions
+  FOR EACH ROW EXECUTE FUNCTION polygon_versions_immutable();
+
+-- existing zones start their history at version 1
+INSERT INTO polygon_versions (polygon_id, version, name, city, geojson, is_active, priority, created_at)
+SELECT p.id, p.version, p.name, p.city, p.geojson, p.is_active, p.priority, p.created_at FROM polygons p
+WHERE NOT EXISTS (SELECT 1 FROM polygon_versions v WHERE v.polygon_id = p.id);
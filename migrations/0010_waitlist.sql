@@ -0,0 +1,25 @@
+-- Addresses outside every zone are kept as waitlist entries: they show
+-- admins where demand is, and users who agreed to be contacted are told when
+-- a zone starts covering them. covered_at is set by the zone change that
+-- covers an entry, notified_at once the user was told (or has no channel).
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id uuid NOT NULL REFERENCES users(id),
+  lat double precision NOT NULL,
+  lng double precision NOT NULL,
+  city text NOT NULL DEFAULT '',
+  street text NOT NULL DEFAULT '',
+  house text NOT NULL DEFAULT '',
+  contact_consent boolean NOT NULL DEFAULT false,
+  consent_at timestamptz,
+  polygon_id uuid REFERENCES polygons(id),
+  polygon_name text,
+  covered_at timestamptz,
+  notified_at timestamptz,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_waitlist_user ON waitlist_entries(user_id);
+-- zone changes look up open entries by bounding box
+CREATE INDEX IF NOT EXISTS idx_waitlist_open ON waitlist_entries(lng, lat) WHERE covered_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_waitlist_due ON waitlist_entries(covered_at) WHERE covered_at IS NOT NULL AND notified_at IS NULL;
@@ -0,0 +1,4 @@
+-- Couriers report where they are so dispatch can pick the nearest one.
+ALTER TABLE couriers ADD COLUMN IF NOT EXISTS last_lat double precision;
+ALTER TABLE couriers ADD COLUMN IF NOT EXISTS last_lng double precision;
+ALTER TABLE couriers ADD COLUMN IF NOT EXISTS located_at timestamptz;
@@ -0,0 +1,54 @@
+-- Optional PostGIS columns for SPATIAL_BACKEND=postgis. When the server has
+-- no PostGIS this migration only leaves a notice and the in-memory backend
+-- keeps working. polygons.geojson and couriers.last_lat/last_lng stay the
+-- source of truth; triggers keep the geometry columns in step with them.
+DO $migration$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis') THEN
+    RAISE NOTICE 'postgis is not available, skipping spatial columns';
+    RETURN;
+  END IF;
+  CREATE EXTENSION IF NOT EXISTS postgis;
+
+  EXECUTE 'ALTER TABLE polygons ADD COLUMN IF NOT EXISTS geom geometry(MultiPolygon, 4326)';
+  EXECUTE 'CREATE INDEX IF NOT EXISTS idx_polygons_geom ON polygons USING gist (geom)';
+  EXECUTE 'ALTER TABLE couriers ADD COLUMN IF NOT EXISTS location geography(Point, 4326)';
+  EXECUTE 'CREATE INDEX IF NOT EXISTS idx_couriers_location ON couriers USING gist (location)';
+
+  -- geometry that PostGIS cannot read is left NULL with a warning, like
+  -- the in-memory index skips it
+  EXECUTE $fn$
+    CREATE OR REPLACE FUNCTION polygons_sync_geom() RETURNS trigger AS $body$
+    BEGIN
+      BEGIN
+        NEW.geom := ST_Multi(ST_SetSRID(ST_GeomFromGeoJSON(NEW.geojson::text), 4326));
+      EXCEPTION WHEN others THEN
+        RAISE WARNING 'polygon %: unreadable geojson: %', NEW.id, SQLERRM;
+        NEW.geom := NULL;
+      END;
+      RETURN NEW;
+    END;
+    $body$ LANGUAGE plpgsql
+  $fn$;
+  DROP TRIGGER IF EXISTS polygons_sync_geom ON polygons;
+  CREATE TRIGGER polygons_sync_geom BEFORE INSERT OR UPDATE OF geojson ON polygons
+    FOR EACH ROW EXECUTE FUNCTION polygons_sync_geom();
+
+  EXECUTE $fn$
+    CREATE OR REPLACE FUNCTION couriers_sync_location() RETURNS trigger AS $body$
+    BEGIN
+      NEW.location := CASE WHEN NEW.last_lat IS NULL OR NEW.last_lng IS NULL THEN NULL
+        ELSE ST_SetSRID(ST_MakePoint(NEW.last_lng, NEW.last_lat), 4326)::geography END;
+      RETURN NEW;
+    END;
+    $body$ LANGUAGE plpgsql
+  $fn$;
+  DROP TRIGGER IF EXISTS couriers_sync_location ON couriers;
+  CREATE TRIGGER couriers_sync_location BEFORE INSERT OR UPDATE OF last_lat, last_lng ON couriers
+    FOR EACH ROW EXECUTE FUNCTION couriers_sync_location();
+
+  -- backfill through the triggers
+  UPDATE polygons SET geojson = geojson WHERE geom IS NULL;
+  UPDATE couriers SET last_lat = last_lat WHERE last_lat IS NOT NULL AND location IS NULL;
+END
+$migration$;
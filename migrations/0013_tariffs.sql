@@ -0,0 +1,52 @@
+-- Prices come from tariffs. A tariff belongs to a zone, or is the default
+-- for zones without one when polygon_id is NULL. Tariffs are immutable
+-- versions: a price change is a new row, and the only change allowed is
+-- closing a tariff by setting valid_to. For a zone at a given time the
+-- newest version valid then wins, so a short promotional tariff falls back
+-- to the previous one when it ends.
+CREATE TABLE IF NOT EXISTS tariffs (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  polygon_id uuid REFERENCES polygons(id),
+  version int NOT NULL,
+  base_kzt int NOT NULL DEFAULT 0 CHECK (base_kzt >= 0),
+  per_bag_kzt int NOT NULL CHECK (per_bag_kzt >= 0),
+  -- [{"min_bags": 5, "per_bag_kzt": 229}, ...] by ascending min_bags
+  bag_tiers jsonb NOT NULL DEFAULT '[]'::jsonb,
+  asap_surcharge_kzt int NOT NULL DEFAULT 0 CHECK (asap_surcharge_kzt >= 0),
+  -- [{"from": "06:00", "to": "09:00", "percent": 10}, ...] in local time
+  slot_discounts jsonb NOT NULL DEFAULT '[]'::jsonb,
+  courier_per_bag_kzt int NOT NULL CHECK (courier_per_bag_kzt >= 0),
+  valid_from timestamptz NOT NULL DEFAULT now(),
+  valid_to timestamptz,
+  created_by uuid REFERENCES users(id),
+  created_at timestamptz NOT NULL DEFAULT now(),
+  CHECK (valid_to IS NULL OR valid_to > valid_from)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tariffs_version
+  ON tariffs ((coalesce(polygon_id, '00000000-0000-0000-0000-000000000000'::uuid)), version);
+CREATE INDEX IF NOT EXISTS idx_tariffs_valid ON tariffs(polygon_id, valid_from);
+
+CREATE OR REPLACE FUNCTION tariffs_immutable() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'UPDATE' AND to_jsonb(NEW) - 'valid_to' = to_jsonb(OLD) - 'valid_to' THEN
+    RETURN NEW;
+  END IF;
+  RAISE EXCEPTION 'tariffs can only be closed, not changed or deleted';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tariffs_immutable ON tariffs;
+CREATE TRIGGER tariffs_immutable BEFORE UPDATE OR DELETE ON tariffs
+  FOR EACH ROW EXECUTE FUNCTION tariffs_immutable();
+
+-- the default tariff keeps the prices that used to be hardcoded
+INSERT INTO tariffs (polygon_id, version, base_kzt, per_bag_kzt, courier_per_bag_kzt, valid_from)
+SELECT NULL, 1, 0, 249, 200, '2000-01-01T00:00:00Z'
+WHERE NOT EXISTS (SELECT 1 FROM tariffs WHERE polygon_id IS NULL);
+
+-- every order records the tariff it was priced with; settlement pays the
+-- courier by the same tariff
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tariff_id uuid REFERENCES tariffs(id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tariff_version int;
+UPDATE orders SET tariff_id = t.id, tariff_version = t.version
+FROM tariffs t WHERE orders.tariff_id IS NULL AND t.polygon_id IS NULL AND t.version = 1;
@@ -0,0 +1,12 @@
+-- order_events is the audit trail of order statuses. Every change is written
+-- by services.OrderStateMachine in the transaction that makes it, with who
+-- made it: the customer, the courier (couriers.id), an admin or the system
+-- (payments, account deletion). from_status is NULL for the creation.
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS actor_role text NOT NULL DEFAULT 'SYSTEM';
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS actor_id uuid;
+CREATE INDEX IF NOT EXISTS idx_order_events_order ON order_events(order_id, at);
+
+-- orders from before the trail start it with their current status
+INSERT INTO order_events (order_id, from_status, to_status, at, meta)
+SELECT o.id, NULL, o.status, o.updated_at, '{"backfilled": true}'::jsonb FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_events e WHERE e.order_id = o.id);
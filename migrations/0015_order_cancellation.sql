@@ -0,0 +1,22 @@
+-- Customers cancel their own orders (services.OrderService.Cancel). Bags of a
+-- canceled subscription order go back to the subscription it was taken
+-- from, so orders remember it; refunds of one-time orders are kept on the
+-- payment they return money from.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS subscription_id uuid REFERENCES subscriptions(id);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS refunded_kzt int NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider_refund_id text;
+
+-- subscription orders placed before this migration name their subscription
+-- in the event that paid them
+UPDATE orders o SET subscription_id = (e.meta->>'subscription_id')::uuid
+FROM order_events e
+WHERE e.order_id = o.id AND o.type = 'SUBSCRIPTION' AND o.subscription_id IS NULL AND e.meta ? 'subscription_id';
+
+-- older ones, still NEW from before order events, took their bags from the
+-- newest subscription of the user running when they were placed
+UPDATE orders o SET subscription_id = (
+  SELECT s.id FROM subscriptions s
+  WHERE s.user_id = o.user_id AND s.started_at <= o.created_at AND (s.expires_at IS NULL OR s.expires_at > o.created_at)
+  ORDER BY s.started_at DESC LIMIT 1
+)
+WHERE o.type = 'SUBSCRIPTION' AND o.subscription_id IS NULL;
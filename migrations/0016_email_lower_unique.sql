@@ -0,0 +1,20 @@
+-- E-mail addresses are compared case-insensitively and stored in lower case
+-- from now on. Bring existing addresses to lower case and make the
+-- uniqueness case-insensitive too, so two accounts cannot hold the same
+-- address in different spellings. Addresses that already collide have to be
+-- resolved by hand first; the migration stops and names them.
+
+DO $$
+DECLARE dups text;
+BEGIN
+    SELECT string_agg(email, ', ') INTO dups FROM (
+        SELECT lower(email) AS email FROM users WHERE email IS NOT NULL GROUP BY lower(email) HAVING count(*) > 1
+    ) d;
+    IF dups IS NOT NULL THEN
+        RAISE EXCEPTION 'users share e-mail addresses that differ only in case: %', dups;
+    END IF;
+END $$;
+
+UPDATE users SET email = lower(email) WHERE email <> lower(email);
+UPDATE email_verifications SET email = lower(email) WHERE email <> lower(email);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email));
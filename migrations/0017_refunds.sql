@@ -0,0 +1,21 @@
+-- Refunds are queued here in the transaction that cancels an order, or
+-- applies a payment for an order already canceled, and made with the
+-- provider after it commits (services.RefundService). A refund the provider
+-- fails stays PENDING and is retried; idempotency_key is sent to the
+-- provider, so a retry never pays out twice. payments.refunded_kzt counts
+-- the SUCCEEDED ones.
+CREATE TABLE IF NOT EXISTS refunds (
+  id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+  payment_id uuid NOT NULL REFERENCES payments(id),
+  order_id uuid NOT NULL REFERENCES orders(id),
+  amount_kzt int NOT NULL CHECK (amount_kzt > 0),
+  idempotency_key text NOT NULL UNIQUE,
+  status text NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SUCCEEDED')),
+  attempts int NOT NULL DEFAULT 0,
+  last_error text,
+  provider_refund_id text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  updated_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_payment ON refunds(payment_id);
+CREATE INDEX IF NOT EXISTS idx_refunds_pending ON refunds(created_at) WHERE status = 'PENDING';
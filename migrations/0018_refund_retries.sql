@@ -0,0 +1,10 @@
+-- A refund the provider keeps failing is tried again after a growing delay
+-- (next_attempt_at) and given up as FAILED after REFUND_MAX_ATTEMPTS tries,
+-- so it stops being retried and shows up for an operator in
+-- GET /v1/admin/refunds, who can queue it again.
+ALTER TABLE refunds ADD COLUMN IF NOT EXISTS next_attempt_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE refunds DROP CONSTRAINT IF EXISTS refunds_status_check;
+ALTER TABLE refunds ADD CONSTRAINT refunds_status_check CHECK (status IN ('PENDING', 'SUCCEEDED', 'FAILED'));
+DROP INDEX IF EXISTS idx_refunds_pending;
+CREATE INDEX IF NOT EXISTS idx_refunds_due ON refunds(next_attempt_at) WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS idx_refunds_failed ON refunds(updated_at) WHERE status = 'FAILED';